@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+type adminReceiver struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	ConnectedForMs int64     `json:"connected_for_ms"`
+}
+
+type adminUpload struct {
+	ID            string          `json:"id"`
+	Meta          Metadata        `json:"metadata"`
+	ReceiverCount int             `json:"receiver_count"`
+	Notes         string          `json:"notes,omitempty"`
+	Labels        []string        `json:"labels,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	AgeMs         int64           `json:"age_ms"`
+	Receivers     []adminReceiver `json:"receivers,omitempty"`
+	Transfers     transferSummary `json:"transfers"`
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// requireAdmin accepts the -admin-token only. API keys are credentials of
+// tenants, see requireAPIKey, and don't reach the operator's endpoints.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, "")
+			return
+		}
+		if !isAdminToken(token) {
+			writeProblem(w, http.StatusForbidden, problemForbidden, "")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminScopeKey{}, true)))
+	})
+}
+
+// requireAPIKey accepts the -admin-token or any API key from the store. A
+// request with an API key carries the key's ID as its tenant.
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, "")
+			return
+		}
+
+		if isAdminToken(token) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminScopeKey{}, true)))
+			return
+		}
+
+		if key, err := store.LookupAPIKey(r.Context(), hashAPIToken(token)); err == nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, key)))
+			return
+		}
+
+		writeProblem(w, http.StatusForbidden, problemForbidden, "")
+	})
+}
+
+func isAdminToken(token string) bool {
+	return cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+type adminScopeKey struct{}
+
+// hasAdminScope reports whether the request was authenticated with the
+// -admin-token.
+func hasAdminScope(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminScopeKey{}).(bool)
+	return admin
+}
+
+// ownsUpload reports whether the request may see and close upload: the
+// admin token may touch any session, an API key the ones it published.
+func ownsUpload(r *http.Request, upload *Upload) bool {
+	if hasAdminScope(r) {
+		return true
+	}
+	tenant, ok := tenantFrom(r)
+	return ok && upload.tenant == tenant
+}
+
+func summarizeUpload(upload *Upload, withReceivers bool) adminUpload {
+	now := time.Now()
+
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+
+	summary := adminUpload{
+		ID:            upload.ID,
+		Meta:          upload.Meta,
+		ReceiverCount: len(upload.Receivers),
+		Notes:         upload.notes,
+		Labels:        upload.labels,
+		CreatedAt:     upload.CreatedAt,
+		AgeMs:         now.Sub(upload.CreatedAt).Milliseconds(),
+		Transfers:     summarizeTransfers(upload),
+	}
+	if withReceivers {
+		summary.Receivers = make([]adminReceiver, len(upload.Receivers))
+		for i, r := range upload.Receivers {
+			summary.Receivers[i] = adminReceiver{
+				ID:             r.ID,
+				Name:           r.Name,
+				ConnectedAt:    r.ConnectedAt,
+				ConnectedForMs: now.Sub(r.ConnectedAt).Milliseconds(),
+			}
+		}
+	}
+	return summary
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleAdminListUploads(w http.ResponseWriter, r *http.Request) {
+	uploadsMutex.RLock()
+	list := make([]*Upload, 0, len(uploads))
+	for _, upload := range uploads {
+		if ownsUpload(r, upload) {
+			list = append(list, upload)
+		}
+	}
+	uploadsMutex.RUnlock()
+
+	summaries := make([]adminUpload, len(list))
+	for i, upload := range list {
+		summaries[i] = summarizeUpload(upload, false)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].CreatedAt.Before(summaries[j].CreatedAt) })
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func lookupUpload(id string) (*Upload, bool) {
+	uploadsMutex.RLock()
+	defer uploadsMutex.RUnlock()
+	upload, ok := uploads[id]
+	return upload, ok
+}
+
+func handleAdminGetUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok || !ownsUpload(r, upload) {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, summarizeUpload(upload, true))
+}
+
+// handleAdminDeleteUpload force-closes a session. Closing the host socket
+// makes handleHostConnection tear the upload down as if the host had left.
+func handleAdminDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok || !ownsUpload(r, upload) {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+
+	log.Info("Force-closing upload", "id", upload.ID)
+
+	upload.mutex.RLock()
+	for _, receiver := range upload.Receivers {
+		receiver.close()
+	}
+	upload.mutex.RUnlock()
+	upload.hostConn().Close()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type createAPIKeyRequest struct {
+	Name           string `json:"name"`
+	SessionsPerDay int64  `json:"sessions_per_day"`
+	BytesPerDay    int64  `json:"bytes_per_day"`
+}
+
+type createAPIKeyResponse struct {
+	APIKey
+	Token string `json:"token"` // only returned once
+}
+
+func handleAdminCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must be JSON with a name")
+		return
+	}
+	token := "smz_" + generateReceiverID() + generateReceiverID()
+	key := APIKey{
+		ID:             generateReceiverID(),
+		Name:           req.Name,
+		Hash:           hashAPIToken(token),
+		CreatedAt:      time.Now(),
+		SessionsPerDay: req.SessionsPerDay,
+		BytesPerDay:    req.BytesPerDay,
+	}
+	if err := store.PutAPIKey(r.Context(), key); err != nil {
+		log.Error("Could not store API key", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store API key")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, createAPIKeyResponse{APIKey: key, Token: token})
+}
+
+func handleAdminListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := store.ListAPIKeys(r.Context())
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not list API keys")
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func handleAdminDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := store.DeleteAPIKey(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not delete API key")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func registerAdminRoutes(api *mux.Router) {
+	// API keys see and close the sessions they published; everything else
+	// is the operator's
+	api.Handle("/admin/uploads", requireAPIKey(http.HandlerFunc(handleAdminListUploads))).Methods("GET")
+	api.Handle("/admin/uploads/{id}", requireAPIKey(http.HandlerFunc(handleAdminGetUpload))).Methods("GET")
+	api.Handle("/admin/uploads/{id}", requireAPIKey(http.HandlerFunc(handleAdminDeleteUpload))).Methods("DELETE")
+
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/keys", handleAdminCreateAPIKey).Methods("POST")
+	admin.HandleFunc("/keys", handleAdminListAPIKeys).Methods("GET")
+	admin.HandleFunc("/keys/{id}", handleAdminDeleteAPIKey).Methods("DELETE")
+	admin.HandleFunc("/stats", handleAdminStats).Methods("GET")
+	admin.HandleFunc("/bans", handleAdminListBans).Methods("GET")
+	admin.HandleFunc("/bans", handleAdminAddBan).Methods("POST")
+	admin.HandleFunc("/bans/{subject}", handleAdminRemoveBan).Methods("DELETE")
+	admin.HandleFunc("/secrets/refresh", handleAdminRefreshSecrets).Methods("POST")
+	admin.HandleFunc("/spool/rekey", handleAdminRekeySpool).Methods("POST")
+	admin.HandleFunc("/webhooks/dead-letters", handleAdminListDeadLetters).Methods("GET")
+	admin.HandleFunc("/webhooks/dead-letters/{id}", handleAdminDeleteDeadLetter).Methods("DELETE")
+	admin.HandleFunc("/webhooks/dead-letters/{id}/redeliver", handleAdminRedeliver).Methods("POST")
+}
+
+type addBanRequest struct {
+	Subject  string `json:"subject"` // an IP
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration,omitempty"` // e.g. "24h", empty is permanent
+}
+
+func handleAdminListBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := store.ListBans(r.Context())
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not list bans")
+		return
+	}
+	if bans == nil {
+		bans = []Ban{}
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
+
+// handleAdminAddBan bans an IP from the whole server and disconnects the
+// receivers it has in live sessions. Hosts keep their sessions.
+func handleAdminAddBan(w http.ResponseWriter, r *http.Request) {
+	var req addBanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Subject == "" {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must be JSON with a subject")
+		return
+	}
+	if _, err := netip.ParseAddr(req.Subject); err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "subject must be an IP address")
+		return
+	}
+	ban := Ban{Subject: req.Subject, Reason: req.Reason, CreatedAt: time.Now()}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "duration must be a positive Go duration")
+			return
+		}
+		ban.ExpiresAt = ban.CreatedAt.Add(d)
+	}
+	if err := store.AddBan(r.Context(), ban); err != nil {
+		log.Error("Could not store ban", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store ban")
+		return
+	}
+
+	uploadsMutex.RLock()
+	var kicked []*Receiver
+	for _, upload := range uploads {
+		upload.mutex.RLock()
+		for _, receiver := range slices.Concat(upload.Receivers, upload.pending, upload.queue) {
+			if receiver.ip == ban.Subject {
+				kicked = append(kicked, receiver)
+			}
+		}
+		upload.mutex.RUnlock()
+	}
+	uploadsMutex.RUnlock()
+	for _, receiver := range kicked {
+		kickReceiver(receiver, "banned")
+	}
+
+	log.Info("Banned from the server", "subject", ban.Subject, "until", ban.ExpiresAt, "disconnected", len(kicked))
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func handleAdminRemoveBan(w http.ResponseWriter, r *http.Request) {
+	if err := store.RemoveBan(r.Context(), mux.Vars(r)["subject"]); err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not remove ban")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantScope(t *testing.T) {
+	upload := &Upload{ID: "upload", tenant: "key"}
+	plain := httptest.NewRequest("GET", "/api/events", nil)
+	admin := plain.WithContext(context.WithValue(plain.Context(), adminScopeKey{}, true))
+	owner := plain.WithContext(context.WithValue(plain.Context(), tenantKey{}, APIKey{ID: "key"}))
+	other := plain.WithContext(context.WithValue(plain.Context(), tenantKey{}, APIKey{ID: "other"}))
+
+	for _, tt := range []struct {
+		name   string
+		r      *http.Request
+		tenant string
+		ok     bool
+		owns   bool
+	}{
+		{"unauthenticated", plain, "", false, false},
+		{"admin", admin, allTenants, true, true},
+		{"owner", owner, "key", true, true},
+		{"other key", other, "other", true, false},
+	} {
+		if tenant, ok := listingTenant(tt.r); tenant != tt.tenant || ok != tt.ok {
+			t.Errorf("%s: lists %q, %v, want %q, %v", tt.name, tenant, ok, tt.tenant, tt.ok)
+		}
+		if got := ownsUpload(tt.r, upload); got != tt.owns {
+			t.Errorf("%s: owns %v, want %v", tt.name, got, tt.owns)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// `sendmyzip admin` manages a running server through its admin API. `admin
+// login` stores the server URL and token in the user's config directory
+// (readable only by them) and every other subcommand uses them, unless
+// -server or -token say otherwise.
+
+const adminUsage = `usage: sendmyzip admin <command> [flags] [args]
+
+commands:
+  login -server URL [-token TOKEN]   store the server and token (token defaults to $SENDMYZIP_ADMIN_TOKEN)
+  list-sessions                      show live sessions
+  kill-session ID                    close a session and disconnect its receivers
+  ban-ip [-for 24h] [-reason R] IP   ban an IP from the server, disconnecting its receivers
+  unban-ip IP                        lift a ban
+  rotate-keys                        make the server re-read its secrets after a rotation
+  rekey-spool                        re-seal spooled data under the current spool key
+  stats                              print server statistics as JSON`
+
+type adminCredentials struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func adminCredentialsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sendmyzip", "admin.json"), nil
+}
+
+func loadAdminCredentials() adminCredentials {
+	var creds adminCredentials
+	path, err := adminCredentialsPath()
+	if err != nil {
+		return creds
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &creds)
+	}
+	return creds
+}
+
+func saveAdminCredentials(creds adminCredentials) (string, error) {
+	path, err := adminCredentialsPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	data, _ := json.MarshalIndent(creds, "", "  ")
+	return path, os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+type adminClient struct {
+	adminCredentials
+	http *http.Client
+}
+
+// do calls the admin API and decodes a successful reply into out, if any.
+// Error replies come back as their problem detail.
+func (c adminClient) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+"/api/admin"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var problem Problem
+		if json.NewDecoder(resp.Body).Decode(&problem) != nil || problem.Title == "" {
+			return fmt.Errorf("server replied %s", resp.Status)
+		}
+		if problem.Detail != "" {
+			return fmt.Errorf("%s: %s", problem.Title, problem.Detail)
+		}
+		return errors.New(problem.Title)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// adminFlags parses the flags of a subcommand, adding -server and -token.
+func adminFlags(name string, args []string, define func(*flag.FlagSet)) (adminClient, *flag.FlagSet) {
+	stored := loadAdminCredentials()
+	fs := flag.NewFlagSet("admin "+name, flag.ExitOnError)
+	server := fs.String("server", stored.Server, "base URL of the sendmyzip server (defaults to the stored one)")
+	token := fs.String("token", stored.Token, "admin token, or an API key for the sessions it published (defaults to the stored one)")
+	if define != nil {
+		define(fs)
+	}
+	fs.Parse(args)
+
+	client := adminClient{
+		adminCredentials: adminCredentials{Server: strings.TrimRight(*server, "/"), Token: *token},
+		http:             &http.Client{},
+	}
+	if name != "login" && (client.Server == "" || client.Token == "") {
+		adminFatalf("no server or token: run sendmyzip admin login first")
+	}
+	return client, fs
+}
+
+func adminFatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "sendmyzip admin: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func runAdmin(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+	var err error
+	switch command {
+	case "login":
+		err = adminLogin(args)
+	case "list-sessions":
+		err = adminListSessions(args)
+	case "kill-session":
+		err = adminKillSession(args)
+	case "ban-ip":
+		err = adminBanIP(args)
+	case "unban-ip":
+		err = adminUnbanIP(args)
+	case "rotate-keys":
+		err = adminRotateKeys(args)
+	case "rekey-spool":
+		err = adminRekeySpool(args)
+	case "stats":
+		err = adminPrintStats(args)
+	default:
+		fmt.Fprintln(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		adminFatalf("%v", err)
+	}
+}
+
+// adminArg returns the single argument a subcommand takes.
+func adminArg(fs *flag.FlagSet, what string) string {
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: sendmyzip admin %s [flags] %s\n", strings.TrimPrefix(fs.Name(), "admin "), what)
+		os.Exit(2)
+	}
+	return fs.Arg(0)
+}
+
+func adminLogin(args []string) error {
+	client, _ := adminFlags("login", args, nil)
+	if client.Token == "" {
+		client.Token = os.Getenv("SENDMYZIP_ADMIN_TOKEN")
+	}
+	if client.Server == "" || client.Token == "" {
+		return errors.New("login needs -server and -token (or $SENDMYZIP_ADMIN_TOKEN)")
+	}
+	// Check the token before keeping it
+	if err := client.do(http.MethodGet, "/stats", nil, nil); err != nil {
+		return err
+	}
+	path, err := saveAdminCredentials(client.adminCredentials)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Logged in to %s, credentials stored in %s\n", client.Server, path)
+	return nil
+}
+
+func adminListSessions(args []string) error {
+	client, _ := adminFlags("list-sessions", args, nil)
+	var sessions []adminUpload
+	if err := client.do(http.MethodGet, "/uploads", nil, &sessions); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFILE\tSIZE\tRECEIVERS\tCOMPLETED\tAGE\tLABELS")
+	for _, s := range sessions {
+		name := s.Meta.FileName
+		if len(s.Meta.Files) > 0 {
+			name = fmt.Sprintf("%d files", len(s.Meta.Files))
+		}
+		size := s.Meta.FileSize
+		if s.Meta.TotalSize > 0 {
+			size = s.Meta.TotalSize
+		}
+		age := (time.Duration(s.AgeMs) * time.Millisecond).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", s.ID, name, formatFileSize(size),
+			s.ReceiverCount, s.Transfers.CompletedCount, age, strings.Join(s.Labels, ","))
+	}
+	return w.Flush()
+}
+
+func adminKillSession(args []string) error {
+	client, fs := adminFlags("kill-session", args, nil)
+	id := adminArg(fs, "ID")
+	if err := client.do(http.MethodDelete, "/uploads/"+url.PathEscape(id), nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Closed session %s\n", id)
+	return nil
+}
+
+func adminBanIP(args []string) error {
+	var duration time.Duration
+	var reason string
+	client, fs := adminFlags("ban-ip", args, func(fs *flag.FlagSet) {
+		fs.DurationVar(&duration, "for", 0, "how long the ban lasts (0 is permanent)")
+		fs.StringVar(&reason, "reason", "", "note kept with the ban")
+	})
+	req := addBanRequest{Subject: adminArg(fs, "IP"), Reason: reason}
+	if duration > 0 {
+		req.Duration = duration.String()
+	}
+	var ban Ban
+	if err := client.do(http.MethodPost, "/bans", req, &ban); err != nil {
+		return err
+	}
+	if ban.ExpiresAt.IsZero() {
+		fmt.Printf("Banned %s permanently\n", ban.Subject)
+	} else {
+		fmt.Printf("Banned %s until %s\n", ban.Subject, ban.ExpiresAt.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+func adminUnbanIP(args []string) error {
+	client, fs := adminFlags("unban-ip", args, nil)
+	ip := adminArg(fs, "IP")
+	if err := client.do(http.MethodDelete, "/bans/"+url.PathEscape(ip), nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Lifted the ban on %s\n", ip)
+	return nil
+}
+
+func adminRotateKeys(args []string) error {
+	client, _ := adminFlags("rotate-keys", args, nil)
+	var statuses []secretStatus
+	if err := client.do(http.MethodPost, "/secrets/refresh", nil, &statuses); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SECRET\tVERSIONS")
+	for _, s := range statuses {
+		versions := strings.Join(s.Versions, ", ")
+		switch {
+		case s.Error != "":
+			versions = "error: " + s.Error
+		case versions == "":
+			versions = "not configured"
+		}
+		if s.Rekeyed > 0 {
+			versions += fmt.Sprintf(" (re-sealed %d spool entries)", s.Rekeyed)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", s.Name, versions)
+	}
+	return w.Flush()
+}
+
+func adminRekeySpool(args []string) error {
+	client, _ := adminFlags("rekey-spool", args, nil)
+	var result struct {
+		Rekeyed int `json:"rekeyed"`
+	}
+	if err := client.do(http.MethodPost, "/spool/rekey", nil, &result); err != nil {
+		return err
+	}
+	fmt.Printf("Re-sealed %d spool entries\n", result.Rekeyed)
+	return nil
+}
+
+func adminPrintStats(args []string) error {
+	client, _ := adminFlags("stats", args, nil)
+	var stats json.RawMessage
+	if err := client.do(http.MethodGet, "/stats", nil, &stats); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	json.Indent(&out, stats, "", "  ")
+	out.WriteByte('\n')
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+// Sessions created with require_approval hold every joining receiver in a
+// pending list until the host approves or rejects it. Pending receivers get
+// no metadata and can't be sent offers, since they aren't in Receivers yet.
+
+type receiverDecision struct {
+	ReceiverID string `json:"receiver_id"`
+}
+
+// admitReceiver adds receiver to the session and hands it the metadata.
+func admitReceiver(upload *Upload, receiver *Receiver) {
+	upload.mutex.Lock()
+	upload.Receivers = append(upload.Receivers, receiver)
+	meta := upload.Meta // the host may replace it, see metadata.go
+	upload.mutex.Unlock()
+	recordEvent(upload, "receiver_joined", map[string]any{"receiver_id": receiver.ID, "name": receiver.Name})
+	startWaitClock(upload, receiver)
+
+	// Send file metadata to receiver
+	receiver.send(fileMetadataMessage(upload, receiver, meta))
+
+	// Notify host about new receiver
+	sendReceiversUpdate(upload)
+	sendHeldOffer(upload, receiver)
+	sendInlineFile(upload, receiver)
+	if upload.Meta.Kind != kindSnippet {
+		sendTransportPlan(upload, receiver)
+	}
+}
+
+// requestApproval parks receiver until the host decides.
+func requestApproval(upload *Upload, receiver *Receiver) {
+	upload.mutex.Lock()
+	upload.pending = append(upload.pending, receiver)
+	upload.mutex.Unlock()
+
+	receiver.send(Message{Type: "join_pending", Payload: map[string]string{"id": receiver.ID}})
+	sendToHost(upload, Message{
+		Type: "join_pending",
+		Payload: map[string]any{
+			"id":           receiver.ID,
+			"name":         receiver.Name,
+			"connected_at": receiver.ConnectedAt,
+		},
+	})
+}
+
+// takePending removes and returns the pending receiver with id.
+func takePending(upload *Upload, id string) *Receiver {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	for i, r := range upload.pending {
+		if r.ID == id {
+			upload.pending = append(upload.pending[:i], upload.pending[i+1:]...)
+			return r
+		}
+	}
+	return nil
+}
+
+// isAdmitted reports whether receiver made it past approval.
+func isAdmitted(upload *Upload, receiver *Receiver) bool {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	for _, r := range upload.Receivers {
+		if r == receiver {
+			return true
+		}
+	}
+	return false
+}
+
+func handleReceiverDecision(upload *Upload, msg Message, approve bool) {
+	var decision receiverDecision
+	if err := decodePayload(msg, &decision); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	receiver := takePending(upload, decision.ReceiverID)
+	if receiver == nil {
+		return
+	}
+
+	if approve {
+		admitReceiver(upload, receiver)
+		return
+	}
+
+	receiver.send(Message{Type: "join_rejected", Payload: map[string]string{"id": receiver.ID}})
+	receiver.close()
+	promoteQueued(upload)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Before a large transfer either side of a pair can ask for a bandwidth
+// probe: a short timed burst of junk data from the host to the receiver,
+// which tells both what to expect and which transport to pick up front.
+// The host names the receiver, a receiver probes its own pair:
+//
+//	bandwidth_probe  {"receiver_id": "...", "via": "peer", "duration_ms": 3000}
+//
+// Both sides get bandwidth_probe_start with the probe ID and how long and
+// how much the host may send. Via peer the host sends the junk over the
+// pair's data channel; via relay it goes through the server as binary
+// frames on the stream_id in the start, with the same credit as a relay
+// stream (see relay.go), and costs server bandwidth like one. The receiver
+// counts what it got and reports it with bandwidth_probe_result, and both
+// sides get the bandwidth_estimate. A probe without a result by
+// probeResultGrace after its duration ends with bandwidth_probe_end.
+//
+// The estimate is kept with the receiver for planning the transfer.
+
+const (
+	probeViaPeer  = "peer"
+	probeViaRelay = transportRelay
+
+	defaultProbeDuration = 3 * time.Second
+	maxProbeDuration     = 10 * time.Second
+	probeResultGrace     = 10 * time.Second
+)
+
+var errProbeRunning = errors.New("a bandwidth probe is already running for this receiver")
+
+type bandwidthProbeRequest struct {
+	ReceiverID string `json:"receiver_id"` // set by hosts, ignored from receivers
+	Via        string `json:"via"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type bandwidthProbeStart struct {
+	ProbeID    uint32 `json:"probe_id"`
+	ReceiverID string `json:"receiver_id"`
+	Via        string `json:"via"`
+	DurationMs int64  `json:"duration_ms"`
+	MaxBytes   int64  `json:"max_bytes"`
+	ChunkSize  int    `json:"chunk_size"`
+
+	// Set for probes via relay
+	StreamID uint32 `json:"stream_id,omitempty"`
+	Window   int64  `json:"window,omitempty"`
+}
+
+type bandwidthProbeResult struct {
+	ProbeID   uint32 `json:"probe_id"`
+	Bytes     int64  `json:"bytes"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+type bandwidthEstimate struct {
+	ProbeID        uint32 `json:"probe_id"`
+	ReceiverID     string `json:"receiver_id"`
+	Via            string `json:"via"`
+	Bytes          int64  `json:"bytes"`
+	ElapsedMs      int64  `json:"elapsed_ms"`
+	BytesPerSecond int64  `json:"bytes_per_second"`
+}
+
+type bandwidthProbeEnd struct {
+	ProbeID    uint32 `json:"probe_id"`
+	ReceiverID string `json:"receiver_id"`
+	Reason     string `json:"reason"`
+}
+
+type bandwidthProbe struct {
+	id       uint32
+	upload   *Upload
+	receiver *Receiver
+	via      string
+	stream   *relayStream // for probes via relay
+	timer    *time.Timer
+}
+
+var bandwidthProbes = struct {
+	mutex  sync.Mutex
+	probes map[uint32]*bandwidthProbe
+}{probes: make(map[uint32]*bandwidthProbe)}
+
+// handleBandwidthProbe starts a probe for the pair; from is nil for the
+// host.
+func handleBandwidthProbe(upload *Upload, msg Message, from *Receiver) {
+	var req bandwidthProbeRequest
+	if err := decodePayload(msg, &req); err != nil {
+		reply(upload, from, invalidPayload(msg, err))
+		return
+	}
+	if cfg.BandwidthProbeBytes <= 0 {
+		reply(upload, from, errorMessage(errCodeUnexpectedMessage, "bandwidth probes are disabled on this server", msg.Type))
+		return
+	}
+	receiver := from
+	if receiver == nil {
+		receiver = upload.findReceiver(req.ReceiverID)
+	}
+	if receiver == nil || !isAdmitted(upload, receiver) {
+		reply(upload, from, invalidPayload(msg, errNoPeer))
+		return
+	}
+
+	if req.Via == "" {
+		req.Via = probeViaPeer
+	}
+	switch req.Via {
+	case probeViaPeer:
+	case probeViaRelay:
+		upload.mutex.RLock()
+		ok := serverSupports(transportRelay) && supports(upload.hostCapabilities, transportRelay) &&
+			supports(receiver.capabilities, transportRelay) && upload.hostRouting.combine(receiver.routing).allows(transportRelay)
+		upload.mutex.RUnlock()
+		if !ok {
+			reply(upload, from, invalidPayload(msg, errors.New("the pair can't use the relay")))
+			return
+		}
+	default:
+		reply(upload, from, invalidPayload(msg, errors.New("via must be peer or relay")))
+		return
+	}
+	duration := defaultProbeDuration
+	if req.DurationMs > 0 {
+		duration = min(time.Duration(req.DurationMs)*time.Millisecond, maxProbeDuration)
+	}
+
+	p := &bandwidthProbe{id: relayNextID.Add(1), upload: upload, receiver: receiver, via: req.Via}
+	bandwidthProbes.mutex.Lock()
+	for _, other := range bandwidthProbes.probes {
+		if other.receiver == receiver {
+			bandwidthProbes.mutex.Unlock()
+			reply(upload, from, errorMessage(errCodeUnexpectedMessage, errProbeRunning.Error(), msg.Type))
+			return
+		}
+	}
+	bandwidthProbes.probes[p.id] = p
+	p.timer = time.AfterFunc(duration+probeResultGrace, func() { p.end("timeout") })
+	bandwidthProbes.mutex.Unlock()
+
+	start := bandwidthProbeStart{
+		ProbeID:    p.id,
+		ReceiverID: receiver.ID,
+		Via:        p.via,
+		DurationMs: duration.Milliseconds(),
+		MaxBytes:   cfg.BandwidthProbeBytes,
+		ChunkSize:  chunkSize(upload.hostConn(), receiver.currentConn()),
+	}
+	if p.via == probeViaRelay {
+		p.stream = &relayStream{
+			id:       p.id,
+			upload:   upload,
+			receiver: receiver,
+			window:   max(cfg.RelayWindow, int64(start.ChunkSize)),
+			limit:    cfg.BandwidthProbeBytes,
+		}
+		relays.mutex.Lock()
+		relays.streams[p.id] = p.stream
+		relays.mutex.Unlock()
+		start.StreamID, start.Window = p.id, p.stream.window
+	}
+
+	log.Info("Probing bandwidth", "id", upload.ID, "receiver", receiver.ID, "via", p.via, "duration", duration)
+	msg = Message{Type: "bandwidth_probe_start", Payload: start}
+	receiver.send(msg)
+	sendToHost(upload, msg)
+}
+
+// finish removes the probe, reporting false when it had already ended.
+func (p *bandwidthProbe) finish() bool {
+	bandwidthProbes.mutex.Lock()
+	defer bandwidthProbes.mutex.Unlock()
+	if bandwidthProbes.probes[p.id] != p {
+		return false
+	}
+	delete(bandwidthProbes.probes, p.id)
+	p.timer.Stop()
+	return true
+}
+
+// end gives up on the probe and tells both sides why.
+func (p *bandwidthProbe) end(reason string) {
+	if !p.finish() {
+		return
+	}
+	if p.stream != nil {
+		p.stream.end(reason)
+	}
+	msg := Message{Type: "bandwidth_probe_end", Payload: bandwidthProbeEnd{ProbeID: p.id, ReceiverID: p.receiver.ID, Reason: reason}}
+	p.receiver.send(msg)
+	sendToHost(p.upload, msg)
+}
+
+// endBandwidthProbes ends the probes of upload, or only receiver's when it
+// is set.
+func endBandwidthProbes(upload *Upload, receiver *Receiver, reason string) {
+	var ended []*bandwidthProbe
+	bandwidthProbes.mutex.Lock()
+	for _, p := range bandwidthProbes.probes {
+		if p.upload == upload && (receiver == nil || p.receiver == receiver) {
+			ended = append(ended, p)
+		}
+	}
+	bandwidthProbes.mutex.Unlock()
+	for _, p := range ended {
+		p.end(reason)
+	}
+}
+
+// handleBandwidthProbeResult turns what the receiver counted into the
+// estimate for both sides.
+func handleBandwidthProbeResult(upload *Upload, receiver *Receiver, msg Message) {
+	var result bandwidthProbeResult
+	err := decodePayload(msg, &result)
+	if err == nil && (result.Bytes < 0 || result.ElapsedMs <= 0) {
+		err = errors.New("bytes must not be negative and elapsed_ms must be positive")
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+	bandwidthProbes.mutex.Lock()
+	p := bandwidthProbes.probes[result.ProbeID]
+	bandwidthProbes.mutex.Unlock()
+	if p == nil || p.receiver != receiver || !p.finish() {
+		return
+	}
+
+	bytes := result.Bytes
+	if p.stream != nil {
+		// Not more than actually went through the server
+		p.stream.mutex.Lock()
+		bytes = min(bytes, p.stream.sent)
+		p.stream.mutex.Unlock()
+		p.stream.end("probe_done")
+	}
+	estimate := bandwidthEstimate{
+		ProbeID:        p.id,
+		ReceiverID:     receiver.ID,
+		Via:            p.via,
+		Bytes:          bytes,
+		ElapsedMs:      result.ElapsedMs,
+		BytesPerSecond: bytes * 1000 / result.ElapsedMs,
+	}
+
+	upload.mutex.Lock()
+	receiver.bandwidth = estimate.BytesPerSecond
+	upload.mutex.Unlock()
+
+	log.Info("Bandwidth probed", "id", upload.ID, "receiver", receiver.ID, "via", p.via, "bytes_per_second", estimate.BytesPerSecond)
+	recordEvent(upload, "bandwidth_probed", map[string]any{"receiver_id": receiver.ID, "via": p.via, "bytes_per_second": estimate.BytesPerSecond})
+	msg = Message{Type: "bandwidth_estimate", Payload: estimate}
+	receiver.send(msg)
+	sendToHost(upload, msg)
+}
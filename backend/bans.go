@@ -0,0 +1,125 @@
+package main
+
+// sessionBan keeps a banned receiver out of one session. A ban matches on
+// the receiver's IP or its public key, so reconnecting from the same device
+// or with the same identity doesn't get around it.
+type sessionBan struct {
+	ReceiverID string `json:"receiver_id"`
+	Name       string `json:"name"`
+	PublicKey  string `json:"public_key,omitempty"`
+	ip         string // never shown to the host
+}
+
+func (u *Upload) isBannedIP(ip string) bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	for _, ban := range u.bans {
+		if ban.ip == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Upload) isBannedKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	for _, ban := range u.bans {
+		if ban.PublicKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// findReceiver returns the admitted or pending receiver with id.
+func (u *Upload) findReceiver(id string) *Receiver {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	for _, r := range u.Receivers {
+		if r.ID == id {
+			return r
+		}
+	}
+	for _, r := range u.pending {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// kickReceiver disconnects a receiver; its connection handler removes it
+// from the session and updates the host.
+func kickReceiver(receiver *Receiver, reason string) {
+	receiver.send(Message{Type: "kicked", Payload: map[string]string{"reason": reason}})
+	receiver.close()
+}
+
+func handleKickReceiver(upload *Upload, msg Message) {
+	var req receiverDecision
+	if err := decodePayload(msg, &req); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	if receiver := upload.findReceiver(req.ReceiverID); receiver != nil {
+		kickReceiver(receiver, "kicked")
+	}
+}
+
+func handleBanReceiver(upload *Upload, msg Message) {
+	var req receiverDecision
+	if err := decodePayload(msg, &req); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	receiver := upload.findReceiver(req.ReceiverID)
+	if receiver == nil {
+		return
+	}
+
+	upload.mutex.Lock()
+	upload.bans = append(upload.bans, sessionBan{
+		ReceiverID: receiver.ID,
+		Name:       receiver.Name,
+		PublicKey:  receiver.PublicKey,
+		ip:         receiver.ip,
+	})
+	upload.mutex.Unlock()
+
+	kickReceiver(receiver, "banned")
+	sendBansUpdate(upload)
+}
+
+func handleUnbanReceiver(upload *Upload, msg Message) {
+	var req receiverDecision
+	if err := decodePayload(msg, &req); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	upload.mutex.Lock()
+	for i, ban := range upload.bans {
+		if ban.ReceiverID == req.ReceiverID {
+			upload.bans = append(upload.bans[:i], upload.bans[i+1:]...)
+			break
+		}
+	}
+	upload.mutex.Unlock()
+
+	sendBansUpdate(upload)
+}
+
+func sendBansUpdate(upload *Upload) {
+	upload.mutex.RLock()
+	bans := make([]sessionBan, len(upload.bans))
+	copy(bans, upload.bans)
+	upload.mutex.RUnlock()
+
+	sendToHost(upload, Message{Type: "bans_update", Payload: bans})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/charmbracelet/log"
+)
+
+// The spool keeps its blobs in a BlobStore chosen with -blob-store:
+//
+//	fs:/dir                 files in a local directory; -spool-dir is
+//	                        short for this
+//	s3:bucket[/prefix]      objects in an S3 bucket, or with -s3-endpoint
+//	                        in an S3-compatible service such as MinIO
+//
+// S3 credentials and region come from the usual AWS environment, as for
+// awskms secrets. With S3 the stored files and relay chunks the spool holds
+// are no longer bounded by one node's disk.
+
+// BlobStore keeps named blobs. Names are flat, without slashes.
+type BlobStore interface {
+	// Put stores r under name, replacing any blob there once r is read
+	// to the end.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// Open returns the blob, or an error matching os.ErrNotExist.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Delete removes the blob; deleting one that isn't there is no error.
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]BlobInfo, error)
+}
+
+type BlobInfo struct {
+	Name string
+	Size int64
+}
+
+func openBlobStore(ctx context.Context, spec string) (BlobStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "fs":
+		if arg == "" {
+			return nil, errors.New("fs blob store needs a directory: fs:/path")
+		}
+		return newFSBlobStore(arg)
+	case "s3":
+		bucket, prefix, _ := strings.Cut(arg, "/")
+		if bucket == "" {
+			return nil, errors.New("s3 blob store needs a bucket: s3:bucket[/prefix]")
+		}
+		return newS3BlobStore(ctx, bucket, prefix, cfg.S3Endpoint)
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", kind)
+	}
+}
+
+// fsBlobStore keeps blobs as files in a directory.
+type fsBlobStore struct {
+	dir string
+}
+
+func newFSBlobStore(dir string) (*fsBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fsBlobStore{dir: dir}, nil
+}
+
+func (s *fsBlobStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+func (s *fsBlobStore) Put(ctx context.Context, name string, r io.Reader) error {
+	tmp, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+func (s *fsBlobStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+// Delete overwrites the file before unlinking it. On copy-on-write or flash
+// storage the overwrite is best effort.
+func (s *fsBlobStore) Delete(ctx context.Context, name string) error {
+	path := s.path(name)
+	if err := shred(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warn("Could not shred spool file", "name", name, "err", err)
+	}
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *fsBlobStore) List(ctx context.Context) ([]BlobInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []BlobInfo
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".put-") {
+			continue
+		}
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			blobs = append(blobs, BlobInfo{Name: e.Name(), Size: info.Size()})
+		}
+	}
+	return blobs, nil
+}
+
+func shred(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 32*1024)
+	for remaining := info.Size(); remaining > 0; {
+		n := min(remaining, int64(len(zeros)))
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return f.Sync()
+}
+
+// s3BlobStore keeps blobs as objects under a prefix of a bucket.
+type s3BlobStore struct {
+	client   *s3.Client
+	uploader *transfermanager.Client
+	bucket   string
+	prefix   string
+}
+
+func newS3BlobStore(ctx context.Context, bucket, prefix, endpoint string) (*s3BlobStore, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true // MinIO and most S3 clones don't do virtual hosts
+		}
+	})
+	if prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+	return &s3BlobStore{client: client, uploader: transfermanager.New(client), bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3BlobStore) key(name string) *string {
+	return aws.String(s.prefix + name)
+}
+
+// Put streams r up in parts, so blobs of unknown size need no buffering.
+func (s *s3BlobStore) Put(ctx context.Context, name string, r io.Reader) error {
+	_, err := s.uploader.UploadObject(ctx, &transfermanager.UploadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
+		Body:   r,
+	})
+	return err
+}
+
+func (s *s3BlobStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: s.key(name)})
+	if err != nil {
+		var missing *types.NoSuchKey
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: s.key(name)})
+	return err
+}
+
+func (s *s3BlobStore) List(ctx context.Context) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			blobs = append(blobs, BlobInfo{Name: name, Size: aws.ToInt64(obj.Size)})
+		}
+	}
+	return blobs, nil
+}
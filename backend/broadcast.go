@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+)
+
+// broadcast lets the host tell every receiver the same thing at once, such
+// as "starting in 10 seconds" or "the link expires soon", instead of one
+// chat_message each. Besides the text it can carry a machine-readable code
+// for clients that want to show something other than the text.
+
+const (
+	maxBroadcastText = 500 // characters
+	maxBroadcastCode = 64
+)
+
+type broadcastRequest struct {
+	Text  string `json:"text"`
+	Code  string `json:"code,omitempty"`  // e.g. transfer_starting
+	Level string `json:"level,omitempty"` // info (the default) or warning
+}
+
+type broadcastNotice struct {
+	ID     string    `json:"id"`
+	Text   string    `json:"text"`
+	Code   string    `json:"code,omitempty"`
+	Level  string    `json:"level"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+func (req broadcastRequest) validate() error {
+	switch {
+	case req.Text == "":
+		return errors.New("text is required")
+	case utf8.RuneCountInString(req.Text) > maxBroadcastText:
+		return errors.New("text is too long")
+	case len(req.Code) > maxBroadcastCode:
+		return errors.New("code is too long")
+	case req.Level != "" && req.Level != "info" && req.Level != "warning":
+		return errors.New("level must be info or warning")
+	}
+	return nil
+}
+
+func handleBroadcast(upload *Upload, msg Message) {
+	var req broadcastRequest
+	err := decodePayload(msg, &req)
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	notice := broadcastNotice{
+		ID:     generateReceiverID(),
+		Text:   req.Text,
+		Code:   req.Code,
+		Level:  req.Level,
+		SentAt: time.Now(),
+	}
+	if notice.Level == "" {
+		notice.Level = "info"
+	}
+
+	upload.mutex.RLock()
+	receivers := len(upload.Receivers)
+	upload.mutex.RUnlock()
+	broadcastToReceivers(upload, Message{Type: "broadcast", Payload: notice})
+	sendToHost(upload, Message{Type: "broadcast_sent", Payload: map[string]any{
+		"id":             notice.ID,
+		"receiver_count": receivers,
+	}})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// For offline and high-security installs the files the server serves and
+// builds codes from can be pinned by a signed manifest: the embedded
+// frontend, and the vocabulary packs, join code recordings and page
+// templates in their directories. A manifest lists the SHA-256 of every
+// file under a prefix per source,
+//
+//	{"files": {"dist/index.html": "<hex>", "vocabulary/nl.txt": "<hex>",
+//	           "audio/7.wav": "<hex>", "templates/join.html": "<hex>"}}
+//
+// and <manifest>.sig next to it holds the base64 Ed25519 signature of its
+// bytes. `sendmyzip sign-bundle` writes both; `sendmyzip verify-bundle`
+// checks the files against them, and a server started with
+// -bundle-manifest and -bundle-key does the same and refuses to start when
+// a file was changed, added or removed. Sources that aren't configured
+// aren't checked, and several manifests can be given, comma-separated, for
+// files that are released separately. The server reads no GeoIP data; the
+// country comes from -country-header.
+
+type bundleManifest struct {
+	Files map[string]string `json:"files"`
+}
+
+type bundleSource struct {
+	prefix string
+	fsys   fs.FS
+	exts   []string // top-level files with these extensions; all files when empty
+}
+
+// bundleSources returns the sources c serves files from.
+func bundleSources(c config) []bundleSource {
+	dist, _ := fs.Sub(staticFiles, "dist")
+	sources := []bundleSource{{prefix: "dist/", fsys: dist}}
+	if c.IDVocabularyDir != "" {
+		sources = append(sources, bundleSource{prefix: "vocabulary/", fsys: os.DirFS(c.IDVocabularyDir), exts: []string{".txt"}})
+	}
+	if c.CodeAudioDir != "" {
+		sources = append(sources, bundleSource{prefix: "audio/", fsys: os.DirFS(c.CodeAudioDir), exts: []string{".wav", ".mp3"}})
+	}
+	if c.TemplatesDir != "" {
+		sources = append(sources, bundleSource{prefix: "templates/", fsys: os.DirFS(c.TemplatesDir), exts: []string{".html"}})
+	}
+	return sources
+}
+
+// hashBundle returns the SHA-256 of every file of sources by manifest path.
+func hashBundle(sources []bundleSource) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, src := range sources {
+		err := fs.WalkDir(src.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if name != "." && len(src.exts) > 0 {
+					return fs.SkipDir // the loaders only read the top level
+				}
+				return nil
+			}
+			if len(src.exts) > 0 && !slices.Contains(src.exts, path.Ext(name)) {
+				return nil
+			}
+			data, err := fs.ReadFile(src.fsys, name)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			hashes[src.prefix+name] = hex.EncodeToString(sum[:])
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// loadBundleManifests reads and merges the manifests at paths, each of
+// which must be signed by key.
+func loadBundleManifests(paths []string, key ed25519.PublicKey) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		sigText, err := os.ReadFile(p + ".sig")
+		if err != nil {
+			return nil, err
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+		if err != nil || !ed25519.Verify(key, data, sig) {
+			return nil, fmt.Errorf("%s: bad signature", p)
+		}
+		var m bundleManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		for name, sum := range m.Files {
+			files[name] = sum
+		}
+	}
+	return files, nil
+}
+
+// verifyBundle checks the files c serves against the signed manifests and
+// returns what doesn't match.
+func verifyBundle(c config) ([]string, error) {
+	key, _, err := parsePublicKey(c.BundleKey)
+	if err != nil {
+		return nil, errors.New("-bundle-key must be a base64 Ed25519 public key")
+	}
+	manifest, err := loadBundleManifests(parseCapabilities(c.BundleManifest), key)
+	if err != nil {
+		return nil, err
+	}
+	sources := bundleSources(c)
+	actual, err := hashBundle(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for name, sum := range actual {
+		switch want, ok := manifest[name]; {
+		case !ok:
+			problems = append(problems, name+": not in the manifest")
+		case want != sum:
+			problems = append(problems, name+": modified")
+		}
+	}
+	for name := range manifest {
+		checked := slices.ContainsFunc(sources, func(src bundleSource) bool { return strings.HasPrefix(name, src.prefix) })
+		if _, ok := actual[name]; checked && !ok {
+			problems = append(problems, name+": missing")
+		}
+	}
+	slices.Sort(problems)
+	return problems, nil
+}
+
+// bundleFlags registers the flags naming the sources on fs.
+func bundleFlags(fs *flag.FlagSet, c *config) {
+	fs.StringVar(&c.IDVocabularyDir, "id-vocabulary-dir", "", "vocabulary packs directory, as given to the server")
+	fs.StringVar(&c.CodeAudioDir, "code-audio-dir", "", "join code recordings directory, as given to the server")
+	fs.StringVar(&c.TemplatesDir, "templates-dir", "", "page templates directory, as given to the server")
+}
+
+// runVerifyBundle implements `sendmyzip verify-bundle`.
+func runVerifyBundle(args []string) {
+	var c config
+	fs := flag.NewFlagSet("verify-bundle", flag.ExitOnError)
+	fs.StringVar(&c.BundleManifest, "manifest", "", "comma-separated signed manifests")
+	fs.StringVar(&c.BundleKey, "key", os.Getenv("SENDMYZIP_BUNDLE_KEY"), "base64 Ed25519 public key the manifests are signed with (defaults to $SENDMYZIP_BUNDLE_KEY)")
+	bundleFlags(fs, &c)
+	fs.Parse(args)
+
+	problems, err := verifyBundle(c)
+	if err != nil {
+		log.Fatal("Could not verify bundle", "err", err)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("Bundle verified")
+}
+
+// runSignBundle implements `sendmyzip sign-bundle`, which writes a
+// manifest of the files and its signature.
+func runSignBundle(args []string) {
+	var c config
+	fs := flag.NewFlagSet("sign-bundle", flag.ExitOnError)
+	out := fs.String("o", "bundle.json", "manifest to write; the signature goes to <manifest>.sig")
+	keyFile := fs.String("key", "", "PEM (PKCS #8) Ed25519 private key, e.g. from openssl genpkey -algorithm ed25519")
+	bundleFlags(fs, &c)
+	fs.Parse(args)
+
+	keyPEM, err := os.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatal("Could not read key", "err", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		log.Fatal("Key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	key, ok := parsed.(ed25519.PrivateKey)
+	if err != nil || !ok {
+		log.Fatal("Key is not an Ed25519 private key", "err", err)
+	}
+
+	files, err := hashBundle(bundleSources(c))
+	if err != nil {
+		log.Fatal("Could not hash bundle", "err", err)
+	}
+	data, err := json.MarshalIndent(bundleManifest{Files: files}, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		log.Fatal("Could not write manifest", "err", err)
+	}
+	if err := os.WriteFile(*out+".sig", []byte(sig+"\n"), 0o644); err != nil {
+		log.Fatal("Could not write signature", "err", err)
+	}
+	fmt.Printf("Signed %d files into %s\nPublic key: %s\n", len(files), *out, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+}
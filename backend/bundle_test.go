@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// signedBundle writes a vocabulary directory and a manifest of it and the
+// frontend signed with a fresh key, and returns the configuration to check
+// them with.
+func signedBundle(t *testing.T) config {
+	t.Helper()
+	dir := t.TempDir()
+	vocab := filepath.Join(dir, "vocabulary")
+	os.Mkdir(vocab, 0o755)
+	for name, words := range map[string]string{"en.txt": "apple\nbanana\n", "nl.txt": "appel\nbanaan\n"} {
+		if err := os.WriteFile(filepath.Join(vocab, name), []byte(words), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := config{IDVocabularyDir: vocab}
+
+	files, err := hashBundle(bundleSources(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(bundleManifest{Files: files})
+	public, private, _ := ed25519.GenerateKey(nil)
+	c.BundleManifest = filepath.Join(dir, "bundle.json")
+	c.BundleKey = base64.StdEncoding.EncodeToString(public)
+	os.WriteFile(c.BundleManifest, data, 0o644)
+	os.WriteFile(c.BundleManifest+".sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, data))), 0o644)
+	return c
+}
+
+func TestVerifyBundle(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		change func(vocab string)
+		want   []string
+	}{
+		{"untouched", func(string) {}, nil},
+		{"modified", func(vocab string) {
+			os.WriteFile(filepath.Join(vocab, "nl.txt"), []byte("appel\nperen\n"), 0o644)
+		}, []string{"vocabulary/nl.txt: modified"}},
+		{"added", func(vocab string) {
+			os.WriteFile(filepath.Join(vocab, "de.txt"), []byte("apfel\n"), 0o644)
+		}, []string{"vocabulary/de.txt: not in the manifest"}},
+		{"removed", func(vocab string) {
+			os.Remove(filepath.Join(vocab, "en.txt"))
+		}, []string{"vocabulary/en.txt: missing"}},
+		{"not loaded", func(vocab string) {
+			os.WriteFile(filepath.Join(vocab, "README.md"), []byte("notes"), 0o644)
+			os.Mkdir(filepath.Join(vocab, "drafts"), 0o755)
+			os.WriteFile(filepath.Join(vocab, "drafts", "fr.txt"), []byte("pomme\n"), 0o644)
+		}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := signedBundle(t)
+			tt.change(c.IDVocabularyDir)
+			problems, err := verifyBundle(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(problems, tt.want) {
+				t.Errorf("got %q, want %q", problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyBundleSignature(t *testing.T) {
+	c := signedBundle(t)
+	other, _, _ := ed25519.GenerateKey(nil)
+	c.BundleKey = base64.StdEncoding.EncodeToString(other)
+	if _, err := verifyBundle(c); err == nil {
+		t.Error("manifest verified with another key")
+	}
+
+	c = signedBundle(t)
+	data, _ := os.ReadFile(c.BundleManifest)
+	os.WriteFile(c.BundleManifest, append(data, ' '), 0o644)
+	if _, err := verifyBundle(c); err == nil {
+		t.Error("modified manifest verified")
+	}
+
+	c.BundleKey = "not a key"
+	if _, err := verifyBundle(c); err == nil {
+		t.Error("verified with a malformed key")
+	}
+}
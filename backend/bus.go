@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// With a shared session store (see sessionstore.go) and -message-bus a
+// receiver doesn't have to reach the node that runs its session. The node
+// it lands on, the edge, bridges its socket to the owner over the bus:
+//
+//	redis://host:6379/0  a Redis stream per node, usually the same Redis as
+//	                     the session store
+//
+// The edge sends the join request to the owner, which runs the usual
+// checks and answers with a verdict. A refused join is answered by the
+// edge with the owner's problem; an accepted one is upgraded, and from
+// then on every frame either side reads is passed on to the other node as
+// is, binary relay frames included. On the owner the bridged receiver is
+// an ordinary wsConn whose socket is the bus, so signaling, relays and
+// everything else work as for a local receiver. Both ends ping each other
+// over the bus and close the bridge when the other node stops answering.
+//
+// Without -message-bus joins for another node's session are answered 421,
+// see writeSessionMissing.
+
+const (
+	busOpen    = "open"
+	busVerdict = "verdict"
+	busFrame   = "frame"
+	busPing    = "ping"
+	busPong    = "pong"
+	busClose   = "close"
+
+	busVerdictTimeout = 10 * time.Second
+	busLinkQueue      = 256
+)
+
+var (
+	errBridgeClosed  = errors.New("bridge closed")
+	errBridgeTimeout = errors.New("bridge timed out")
+)
+
+// MessageBus carries envelopes to the inbox of a node.
+type MessageBus interface {
+	Publish(ctx context.Context, node string, env busEnvelope) error
+	// Subscribe hands every envelope sent to node to handle, one at a
+	// time, until the bus is closed.
+	Subscribe(node string, handle func(busEnvelope))
+	Close() error
+}
+
+var bus MessageBus // nil unless -message-bus is set
+
+func openMessageBus(spec string) (MessageBus, error) {
+	switch {
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return openRedisBus(spec)
+	default:
+		return nil, fmt.Errorf("unknown message bus %q", spec)
+	}
+}
+
+type busEnvelope struct {
+	Kind    string `json:"kind"`
+	Link    string `json:"link"`
+	From    string `json:"from"` // node to answer
+	Session string `json:"session,omitempty"`
+
+	Join   *bridgedJoin `json:"join,omitempty"`
+	Status int          `json:"status,omitempty"` // of a refused join
+	Binary bool         `json:"binary,omitempty"`
+	Data   []byte       `json:"data,omitempty"` // frame, or the body of a refused join
+}
+
+// bridgedJoin is the part of a join request the owner checks.
+type bridgedJoin struct {
+	Query      string      `json:"query"`
+	Header     http.Header `json:"header"`
+	RemoteAddr string      `json:"remote_addr"`
+}
+
+// request rebuilds the join request on the owner.
+func (j bridgedJoin) request(ctx context.Context, session string) *http.Request {
+	u := &url.URL{Path: "/api/join/" + session, RawQuery: j.Query}
+	r := (&http.Request{Method: http.MethodGet, URL: u, Header: j.Header, RemoteAddr: j.RemoteAddr}).WithContext(ctx)
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	return r
+}
+
+// busLink is one end of a bridge.
+type busLink struct {
+	inbox chan busEnvelope
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *busLink) shut() {
+	l.once.Do(func() { close(l.done) })
+}
+
+var busLinks = struct {
+	mutex sync.Mutex
+	links map[string]*busLink
+}{links: make(map[string]*busLink)}
+
+func openLink(id string) *busLink {
+	l := &busLink{inbox: make(chan busEnvelope, busLinkQueue), done: make(chan struct{})}
+	busLinks.mutex.Lock()
+	busLinks.links[id] = l
+	busLinks.mutex.Unlock()
+	return l
+}
+
+func closeLink(id string) {
+	busLinks.mutex.Lock()
+	l := busLinks.links[id]
+	delete(busLinks.links, id)
+	busLinks.mutex.Unlock()
+	if l != nil {
+		l.shut()
+	}
+}
+
+func publish(node string, env busEnvelope) {
+	env.From = nodeID
+	if err := bus.Publish(context.Background(), node, env); err != nil {
+		log.Error("Could not publish to the message bus", "node", node, "kind", env.Kind, "err", err)
+	}
+}
+
+// handleBusEnvelope dispatches what the bus brought this node.
+func handleBusEnvelope(env busEnvelope) {
+	if env.Kind == busOpen {
+		go handleBridgeOpen(env)
+		return
+	}
+	busLinks.mutex.Lock()
+	l := busLinks.links[env.Link]
+	busLinks.mutex.Unlock()
+	if l == nil {
+		if env.Kind != busClose {
+			publish(env.From, busEnvelope{Kind: busClose, Link: env.Link})
+		}
+		return
+	}
+	select {
+	case l.inbox <- env:
+	default:
+		log.Warn("Dropping backed up bridge", "link", env.Link, "node", env.From)
+		closeLink(env.Link)
+		publish(env.From, busEnvelope{Kind: busClose, Link: env.Link})
+	}
+}
+
+// bridgeJoin is the edge's half of a join for session s: it asks the
+// owner, and once admitted passes frames between the receiver and it.
+func bridgeJoin(w http.ResponseWriter, r *http.Request, s LiveSession) {
+	id := generateReceiverID() + generateReceiverID()
+	l := openLink(id)
+	publish(s.Node, busEnvelope{
+		Kind:    busOpen,
+		Link:    id,
+		Session: s.ID,
+		Join:    &bridgedJoin{Query: r.URL.RawQuery, Header: r.Header, RemoteAddr: r.RemoteAddr},
+	})
+
+	var verdict busEnvelope
+	select {
+	case verdict = <-l.inbox:
+	case <-time.After(busVerdictTimeout):
+		closeLink(id)
+		writeProblem(w, http.StatusGatewayTimeout, problemSessionElsewhere, "The node running the session did not answer")
+		return
+	}
+	if verdict.Kind != busVerdict || verdict.Status != 0 {
+		closeLink(id)
+		if verdict.Kind != busVerdict {
+			writeProblem(w, http.StatusBadGateway, problemSessionElsewhere, "The node running the session dropped the join")
+			return
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(verdict.Status)
+		w.Write(verdict.Data)
+		return
+	}
+
+	conn, err := upgrade(w, r)
+	if err != nil {
+		closeLink(id)
+		publish(s.Node, busEnvelope{Kind: busClose, Link: id})
+		return
+	}
+	log.Info("Bridging receiver", "id", s.ID, "node", s.Node, "link", id)
+	go pumpToOwner(conn, id, s.Node)
+	go pumpFromOwner(conn, l, id, s.Node)
+}
+
+// pumpToOwner passes what the receiver sends on to the owner.
+func pumpToOwner(conn *wsConn, id, owner string) {
+	defer func() {
+		closeLink(id)
+		publish(owner, busEnvelope{Kind: busClose, Link: id})
+		conn.Close()
+	}()
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		publish(owner, busEnvelope{Kind: busFrame, Link: id, Binary: kind == websocket.BinaryMessage, Data: data})
+	}
+}
+
+// pumpFromOwner writes what the owner sends to the receiver, and pings the
+// owner so the bridge ends when it goes away.
+func pumpFromOwner(conn *wsConn, l *busLink, id, owner string) {
+	defer conn.Close()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	lastPong := time.Now()
+	for {
+		select {
+		case env := <-l.inbox:
+			switch env.Kind {
+			case busFrame:
+				var err error
+				if env.Binary {
+					err = conn.WriteBinary(env.Data, wsWriteTimeout)
+				} else {
+					err = conn.WriteJSON(json.RawMessage(env.Data))
+				}
+				if err != nil {
+					return
+				}
+			case busPing:
+				publish(owner, busEnvelope{Kind: busPong, Link: id})
+			case busPong:
+				lastPong = time.Now()
+			case busClose:
+				closeLink(id)
+				return
+			}
+		case <-ping.C:
+			if time.Since(lastPong) > wsPongWait {
+				log.Warn("Owner of bridged session stopped answering", "node", owner, "link", id)
+				closeLink(id)
+				publish(owner, busEnvelope{Kind: busClose, Link: id})
+				return
+			}
+			publish(owner, busEnvelope{Kind: busPing, Link: id})
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// handleBridgeOpen is the owner's half of a bridged join.
+func handleBridgeOpen(env busEnvelope) {
+	if env.Join == nil {
+		return
+	}
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(env.Join.Header))
+	ctx, span := tracer.Start(ctx, "upload.join.bridged",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("upload.id", env.Session), attribute.String("edge.node", env.From)),
+	)
+	defer span.End()
+
+	r := env.Join.request(ctx, env.Session)
+	rec := &verdictRecorder{header: http.Header{}}
+	var routing routingConstraint
+	upload, ok := lookupUpload(env.Session)
+	if !ok {
+		writeProblem(rec, http.StatusNotFound, problemUploadNotFound, "")
+	} else {
+		routing, ok = admitJoin(ctx, span, rec, r, upload)
+	}
+	if !ok {
+		publish(env.From, busEnvelope{Kind: busVerdict, Link: env.Link, Status: rec.status, Data: rec.body.Bytes()})
+		return
+	}
+
+	l := openLink(env.Link)
+	conn := newWSConn(&busSocket{id: env.Link, edge: env.From, link: l, remote: busAddr(r.RemoteAddr)})
+	conn.ip = clientIP(r)
+	publish(env.From, busEnvelope{Kind: busVerdict, Link: env.Link})
+	go handleReceiverConnection(trace.ContextWithSpanContext(context.Background(), span.SpanContext()), upload, conn, clientIP(r), acceptLocale(r), routing)
+}
+
+// verdictRecorder keeps the answer admitJoin gives a bridged join.
+type verdictRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (v *verdictRecorder) Header() http.Header         { return v.header }
+func (v *verdictRecorder) Write(p []byte) (int, error) { return v.body.Write(p) }
+func (v *verdictRecorder) WriteHeader(status int)      { v.status = status }
+
+type busAddr string
+
+func (a busAddr) Network() string { return "bus" }
+func (a busAddr) String() string  { return string(a) }
+
+// busSocket is the owner's side of a bridged receiver socket.
+type busSocket struct {
+	id     string
+	edge   string
+	link   *busLink
+	remote net.Addr
+
+	mutex        sync.Mutex
+	readDeadline time.Time
+	pongHandler  func(string) error
+	closed       bool
+}
+
+func (s *busSocket) ReadMessage() (int, []byte, error) {
+	for {
+		s.mutex.Lock()
+		deadline := s.readDeadline
+		s.mutex.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timeout = time.After(time.Until(deadline))
+		}
+
+		select {
+		case env := <-s.link.inbox:
+			switch env.Kind {
+			case busFrame:
+				kind := websocket.TextMessage
+				if env.Binary {
+					kind = websocket.BinaryMessage
+				}
+				return kind, env.Data, nil
+			case busPing:
+				publish(s.edge, busEnvelope{Kind: busPong, Link: s.id})
+			case busPong:
+				s.mutex.Lock()
+				h := s.pongHandler
+				s.mutex.Unlock()
+				if h != nil {
+					h("")
+				}
+			case busClose:
+				closeLink(s.id)
+				return 0, nil, errBridgeClosed
+			}
+		case <-s.link.done:
+			return 0, nil, errBridgeClosed
+		case <-timeout:
+			return 0, nil, errBridgeTimeout
+		}
+	}
+}
+
+func (s *busSocket) WriteMessage(kind int, data []byte) error {
+	select {
+	case <-s.link.done:
+		return errBridgeClosed
+	default:
+	}
+	return bus.Publish(context.Background(), s.edge, busEnvelope{
+		Kind:   busFrame,
+		Link:   s.id,
+		From:   nodeID,
+		Binary: kind == websocket.BinaryMessage,
+		Data:   data,
+	})
+}
+
+func (s *busSocket) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.WriteMessage(websocket.TextMessage, data)
+}
+
+func (s *busSocket) WriteControl(kind int, _ []byte, _ time.Time) error {
+	switch kind {
+	case websocket.PingMessage:
+		publish(s.edge, busEnvelope{Kind: busPing, Link: s.id})
+	case websocket.CloseMessage:
+		s.Close()
+	}
+	return nil
+}
+
+func (s *busSocket) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.readDeadline = t
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *busSocket) SetPongHandler(h func(string) error) {
+	s.mutex.Lock()
+	s.pongHandler = h
+	s.mutex.Unlock()
+}
+
+func (s *busSocket) SetWriteDeadline(time.Time) error { return nil }
+func (s *busSocket) SetReadLimit(int64)               {}
+func (s *busSocket) RemoteAddr() net.Addr             { return s.remote }
+
+func (s *busSocket) Close() error {
+	s.mutex.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mutex.Unlock()
+	if !closed {
+		closeLink(s.id)
+		publish(s.edge, busEnvelope{Kind: busClose, Link: s.id})
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBus gives every node a Redis stream as its inbox. Streams are capped
+// and expire when nobody has written to them for a while, so a node that
+// is gone for good doesn't leave its inbox behind.
+type redisBus struct {
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+const (
+	redisBusPrefix = "sendmyzip:bus:"
+	redisBusMaxLen = 10000
+	redisBusTTL    = 10 * time.Minute
+)
+
+func openRedisBus(url string) (*redisBus, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &redisBus{client: client, ctx: ctx, cancel: cancel}, nil
+}
+
+func (b *redisBus) Publish(ctx context.Context, node string, env busEnvelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	key := redisBusPrefix + node
+	pipe := b.client.Pipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{Stream: key, MaxLen: redisBusMaxLen, Approx: true, Values: []any{"env", data}})
+	pipe.Expire(ctx, key, redisBusTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (b *redisBus) Subscribe(node string, handle func(busEnvelope)) {
+	go func() {
+		key, last := redisBusPrefix+node, "$"
+		for b.ctx.Err() == nil {
+			streams, err := b.client.XRead(b.ctx, &redis.XReadArgs{Streams: []string{key, last}, Count: 100, Block: 5 * time.Second}).Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				if b.ctx.Err() == nil {
+					log.Error("Could not read the message bus", "err", err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+			for _, stream := range streams {
+				for _, msg := range stream.Messages {
+					last = msg.ID
+					var env busEnvelope
+					data, _ := msg.Values["env"].(string)
+					if err := json.Unmarshal([]byte(data), &env); err != nil {
+						log.Warn("Skipping malformed bus message", "id", msg.ID, "err", err)
+						continue
+					}
+					handle(env)
+				}
+			}
+		}
+	}()
+}
+
+func (b *redisBus) Close() error {
+	b.cancel()
+	return b.client.Close()
+}
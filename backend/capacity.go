@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+)
+
+// Native receivers can report their free disk space after seeing the
+// metadata. The host gets the report with a warning flag when the file
+// won't fit, so it doesn't start a transfer that is bound to fail.
+
+type capacityReport struct {
+	AvailableBytes int64 `json:"available_bytes"`
+}
+
+func handleCapacityReport(upload *Upload, receiver *Receiver, msg Message) {
+	var report capacityReport
+	err := decodePayload(msg, &report)
+	if err == nil && report.AvailableBytes < 0 {
+		err = errors.New("available_bytes must not be negative")
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	insufficient := report.AvailableBytes < upload.Meta.FileSize
+
+	upload.mutex.Lock()
+	receiver.availableBytes = report.AvailableBytes
+	upload.mutex.Unlock()
+
+	sendToHost(upload, Message{
+		Type: "capacity_report",
+		Payload: map[string]any{
+			"receiver_id":     receiver.ID,
+			"available_bytes": report.AvailableBytes,
+			"required_bytes":  upload.Meta.FileSize,
+			"insufficient":    insufficient,
+		},
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Entries of a manifest can carry a caption, a short text saying what the
+// file is, so receivers choosing among several files don't have to fetch
+// them to find out:
+//
+//	{"name": "q3.pdf", "type": "application/pdf", "size": 81234,
+//	 "caption": "Signed version, replaces the one from Monday",
+//	 "caption_expires_at": "2026-11-01T00:00:00Z"}
+//
+// A caption is up to maxCaptionBytes of UTF-8 without control characters
+// other than newlines and tabs. With caption_expires_at it stops being sent
+// once that time passes; receivers that got it before should stop showing
+// it then too.
+
+const maxCaptionBytes = 500
+
+func validateCaption(f ManifestFile, now time.Time) error {
+	switch {
+	case f.Caption == "":
+		if !f.CaptionExpiresAt.IsZero() {
+			return errors.New("caption_expires_at without a caption")
+		}
+		return nil
+	case len(f.Caption) > maxCaptionBytes:
+		return fmt.Errorf("caption is longer than %d bytes", maxCaptionBytes)
+	case !utf8.ValidString(f.Caption):
+		return errors.New("caption is not valid UTF-8")
+	case !f.CaptionExpiresAt.IsZero() && !f.CaptionExpiresAt.After(now):
+		return errors.New("caption_expires_at is in the past")
+	}
+	for _, r := range f.Caption {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return errors.New("caption contains control characters")
+		}
+	}
+	return nil
+}
+
+// captionExpired reports whether f had a caption that has run out by now.
+func captionExpired(f ManifestFile, now time.Time) bool {
+	return f.Caption != "" && !f.CaptionExpiresAt.IsZero() && !f.CaptionExpiresAt.After(now)
+}
+
+// currentCaptions returns meta for receivers, without the captions that
+// have expired.
+func currentCaptions(meta Metadata) Metadata {
+	now := time.Now()
+	if !slices.ContainsFunc(meta.Files, func(f ManifestFile) bool { return captionExpired(f, now) }) {
+		return meta
+	}
+	meta.Files = slices.Clone(meta.Files)
+	for i, f := range meta.Files {
+		if captionExpired(f, now) {
+			meta.Files[i].Caption = ""
+			meta.Files[i].CaptionExpiresAt = time.Time{}
+		}
+	}
+	return meta
+}
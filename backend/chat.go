@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+)
+
+// Host and receivers can talk in the session with chat_message. A receiver
+// always writes to the host; the host writes to one receiver (to) or to
+// everyone. The server stamps who sent it and relays it, nothing is kept.
+//
+// Clients that hold identity keys can encrypt instead of sending text: the
+// ciphertext and nonce are relayed untouched along with the sender's
+// verified key, so the recipient can derive the shared key from the keys
+// it already has. Encrypted host messages need a recipient, since every
+// receiver has its own key.
+
+const (
+	maxChatText       = 2000    // characters
+	maxChatCiphertext = 4 << 10 // bytes, base64
+)
+
+type chatRequest struct {
+	To         string `json:"to,omitempty"` // receiver ID, host messages only
+	Text       string `json:"text,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+}
+
+type chatMessage struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"` // "host" or a receiver ID
+	Name       string    `json:"name,omitempty"`
+	SenderKey  string    `json:"sender_key,omitempty"` // verified identity of the sender
+	Text       string    `json:"text,omitempty"`
+	Ciphertext string    `json:"ciphertext,omitempty"`
+	Nonce      string    `json:"nonce,omitempty"`
+	SentAt     time.Time `json:"sent_at"`
+}
+
+func (req chatRequest) validate() error {
+	switch {
+	case req.Text != "" && req.Ciphertext != "":
+		return errors.New("send either text or ciphertext")
+	case req.Text != "":
+		if utf8.RuneCountInString(req.Text) > maxChatText {
+			return errors.New("text is too long")
+		}
+	case req.Ciphertext != "":
+		if len(req.Ciphertext) > maxChatCiphertext {
+			return errors.New("ciphertext is too long")
+		}
+		if _, err := decodeBase64(req.Ciphertext); err != nil {
+			return errors.New("ciphertext must be base64")
+		}
+		if _, err := decodeBase64(req.Nonce); err != nil || req.Nonce == "" {
+			return errors.New("nonce must be base64")
+		}
+	default:
+		return errors.New("message is empty")
+	}
+	return nil
+}
+
+func (req chatRequest) message(from, name, key string) Message {
+	return Message{Type: "chat_message", Payload: chatMessage{
+		ID:         generateReceiverID(),
+		From:       from,
+		Name:       name,
+		SenderKey:  key,
+		Text:       req.Text,
+		Ciphertext: req.Ciphertext,
+		Nonce:      req.Nonce,
+		SentAt:     time.Now(),
+	}}
+}
+
+func handleHostChat(upload *Upload, msg Message) {
+	var req chatRequest
+	err := decodePayload(msg, &req)
+	if err == nil {
+		err = req.validate()
+	}
+	if err == nil && req.Ciphertext != "" && req.To == "" {
+		err = errors.New("encrypted messages need a recipient")
+	}
+	var target *Receiver
+	if err == nil && req.To != "" {
+		if target = upload.findReceiver(req.To); target == nil {
+			err = errors.New("no receiver with that ID")
+		}
+	}
+	if err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	out := req.message("host", "", upload.hostIdentity)
+	if target != nil {
+		target.send(out)
+	} else {
+		broadcastToReceivers(upload, out)
+	}
+	// Echo to the host, so every host device shows the conversation
+	sendToHost(upload, out)
+}
+
+func handleReceiverChat(upload *Upload, receiver *Receiver, msg Message) {
+	var req chatRequest
+	err := decodePayload(msg, &req)
+	if err == nil && req.To != "" {
+		err = errors.New("receivers can only write to the host")
+	}
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	out := req.message(receiver.ID, receiver.Name, receiver.verifiedKey)
+	sendToHost(upload, out)
+	receiver.send(out)
+}
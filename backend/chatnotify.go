@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Teams that live in Slack or Discord can have session activity posted to
+// a channel as plain sentences instead of wiring up -webhook-url:
+//
+//	alice started sharing report.zip (12.40 MB)
+//	bob joined report.zip from alice, 3 receivers connected
+//	bob received report.zip from alice in 8s
+//
+// -slack-webhook takes an incoming webhook URL, -discord-webhook a channel
+// webhook URL, and -chat-events the event types to post. The host is named
+// by the identity it proved, the receivers by the names they chose.
+// Messages go out through the webhook queue, so they are retried like any
+// other delivery.
+
+// defaultChatEvents are the event types posted to Slack and Discord unless
+// -chat-events says otherwise.
+const defaultChatEvents = "session_created,receiver_joined,transfer_completed,session_expired,session_ended"
+
+// slackEscaper escapes the characters Slack reads as markup.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// notifyChat posts ev to the Slack and Discord channels if they
+// subscribed to its type.
+func notifyChat(upload *Upload, ev Event) {
+	if cfg.SlackWebhook == "" && cfg.DiscordWebhook == "" {
+		return
+	}
+	if !slices.Contains(parseCapabilities(cfg.ChatEvents), ev.Type) {
+		return
+	}
+	text := channelMessage(upload, ev)
+	if text == "" {
+		return
+	}
+	if cfg.SlackWebhook != "" {
+		sendWebhook(cfg.SlackWebhook, "", ev.Type, map[string]string{"text": slackEscaper.Replace(text)})
+	}
+	if cfg.DiscordWebhook != "" {
+		sendWebhook(cfg.DiscordWebhook, "", ev.Type, map[string]any{
+			"content": text,
+			// Names are chosen by users, so they mustn't ping anyone
+			"allowed_mentions": map[string]any{"parse": []string{}},
+		})
+	}
+}
+
+// channelMessage describes ev in a sentence, or returns "" for events it has
+// no sentence for.
+func channelMessage(upload *Upload, ev Event) string {
+	host := chatHostName(upload)
+	upload.mutex.RLock()
+	file := chatFileLabel(upload.Meta)
+	size := max(upload.Meta.FileSize, upload.Meta.TotalSize)
+	receivers := len(upload.Receivers)
+	completions := slices.Clone(upload.completions)
+	upload.mutex.RUnlock()
+
+	switch ev.Type {
+	case "session_created":
+		if size == 0 {
+			return fmt.Sprintf("%s started sharing %s", host, file)
+		}
+		return fmt.Sprintf("%s started sharing %s (%s)", host, file, formatFileSize(size))
+	case "receiver_joined":
+		name, _ := ev.Data["name"].(string)
+		return fmt.Sprintf("%s joined %s from %s, %s connected", chatReceiverName(name), file, host, plural(receivers, "receiver"))
+	case "transfer_completed":
+		id, _ := ev.Data["receiver_id"].(string)
+		name := ""
+		if i := slices.IndexFunc(completions, func(c completion) bool { return c.ReceiverID == id }); i >= 0 {
+			name = completions[i].Name
+		}
+		ms, _ := ev.Data["duration_ms"].(int64)
+		took := (time.Duration(ms) * time.Millisecond).Round(time.Second)
+		return fmt.Sprintf("%s received %s from %s in %s", chatReceiverName(name), file, host, max(took, time.Second))
+	case "session_expired":
+		return fmt.Sprintf("%s from %s expired", file, host)
+	case "session_ended":
+		return fmt.Sprintf("%s stopped sharing %s, %d of %s got it", host, file, len(completions), plural(receivers, "receiver"))
+	}
+	return ""
+}
+
+// chatHostName names the host of upload by its identity.
+func chatHostName(upload *Upload) string {
+	if upload.hostIdentity != "" {
+		if identity, err := store.GetIdentity(context.Background(), upload.hostIdentity); err == nil && identity.Name != "" {
+			return identity.Name
+		}
+	}
+	return "Someone"
+}
+
+func chatReceiverName(name string) string {
+	if name == "" {
+		return "A receiver"
+	}
+	return name
+}
+
+// chatFileLabel names what a session shares.
+func chatFileLabel(meta Metadata) string {
+	switch {
+	case meta.Kind == kindSnippet:
+		return "a snippet"
+	case meta.FileName != "":
+		return meta.FileName
+	default:
+		return plural(len(meta.Files), "file")
+	}
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
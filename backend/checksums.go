@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Hosts can give a SHA-256 for each file in a manifest, either per file or
+// as a SHA256SUMS file in the manifest's checksums field, or for a single
+// file in the sha256 query parameter. Both the GNU format written by
+// sha256sum and the BSD tag format are understood. The hashes are served
+// back as a SHA256SUMS file from /api/upload/{id}/SHA256SUMS, so receivers
+// can run `sha256sum -c` on what they downloaded.
+//
+// Receivers that hash what they got send checksum_result. The server
+// compares it to the host's hash and tells both sides the verdict:
+// verified, mismatch, or unverified when the host gave no hash.
+
+var (
+	sha256Pattern  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	gnuSumLine     = regexp.MustCompile(`^([0-9a-fA-F]{64}) [ *](.+)$`)
+	bsdSumLine     = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+	errNoChecksums = errors.New("no checksums")
+)
+
+// manifestPath is where f is put on the receiver's side.
+func manifestPath(f ManifestFile) string {
+	if f.Path != "" {
+		return f.Path
+	}
+	return f.Name
+}
+
+// parseSHA256Sums reads a SHA256SUMS file into path:hash.
+func parseSHA256Sums(sums string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(sums))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var hash, path string
+		if m := gnuSumLine.FindStringSubmatch(line); m != nil {
+			hash, path = m[1], m[2]
+		} else if m := bsdSumLine.FindStringSubmatch(line); m != nil {
+			path, hash = m[1], m[2]
+		} else {
+			return nil, fmt.Errorf("checksums line %d is not in SHA256SUMS format", n)
+		}
+		hashes[strings.TrimPrefix(path, "./")] = strings.ToLower(hash)
+	}
+	return hashes, scanner.Err()
+}
+
+// applyChecksums merges a SHA256SUMS file into files and checks the
+// per-file hashes.
+func applyChecksums(files []ManifestFile, sums string) error {
+	var hashes map[string]string
+	if sums != "" {
+		var err error
+		if hashes, err = parseSHA256Sums(sums); err != nil {
+			return err
+		}
+	}
+
+	for i := range files {
+		if files[i].Kind == entryDirectory {
+			continue
+		}
+		p := manifestPath(files[i])
+		if hash, ok := hashes[p]; ok {
+			if files[i].SHA256 != "" && !strings.EqualFold(files[i].SHA256, hash) {
+				return fmt.Errorf("file %d: sha256 differs from the checksums for %s", i, p)
+			}
+			files[i].SHA256 = hash
+			delete(hashes, p)
+		}
+		files[i].SHA256 = strings.ToLower(files[i].SHA256)
+		if files[i].SHA256 != "" && !sha256Pattern.MatchString(files[i].SHA256) {
+			return fmt.Errorf("file %d: sha256 must be 64 hex characters", i)
+		}
+	}
+	for p := range hashes {
+		return fmt.Errorf("checksums list %s, which is not in the manifest", p)
+	}
+	return nil
+}
+
+// sha256Sums renders the hashes of files as a SHA256SUMS file. Files
+// without a hash are left out.
+func sha256Sums(files []ManifestFile) (string, error) {
+	var b strings.Builder
+	for _, f := range files {
+		if f.SHA256 != "" {
+			fmt.Fprintf(&b, "%s  %s\n", f.SHA256, manifestPath(f))
+		}
+	}
+	if b.Len() == 0 {
+		return "", errNoChecksums
+	}
+	return b.String(), nil
+}
+
+// checksummedFiles returns the files of meta, making a single-file session
+// look like a one-entry manifest.
+func checksummedFiles(meta Metadata) []ManifestFile {
+	if len(meta.Files) > 0 {
+		return meta.Files
+	}
+	return []ManifestFile{{Name: meta.FileName, Type: meta.FileType, Size: meta.FileSize, SHA256: meta.SHA256}}
+}
+
+const (
+	checksumVerified   = "verified"
+	checksumMismatch   = "mismatch"
+	checksumUnverified = "unverified"
+)
+
+type checksumReport struct {
+	Path   string `json:"path"` // manifest path; may be empty when there is one file
+	SHA256 string `json:"sha256"`
+}
+
+type checksumVerdict struct {
+	ReceiverID string `json:"receiver_id"`
+	Name       string `json:"name"`
+	Path       string `json:"path,omitempty"`
+	SHA256     string `json:"sha256"`
+	Expected   string `json:"expected,omitempty"`
+	Status     string `json:"status"`
+}
+
+// expectedChecksum finds the host's hash for path, which may be empty
+// when the session has a single file.
+func expectedChecksum(upload *Upload, path string) (string, bool) {
+	upload.mutex.RLock()
+	files := checksummedFiles(upload.Meta)
+	upload.mutex.RUnlock()
+
+	for _, f := range files {
+		if f.Kind == entryDirectory {
+			continue
+		}
+		if manifestPath(f) == path || path == "" && len(files) == 1 {
+			return f.SHA256, true
+		}
+	}
+	return "", false
+}
+
+func handleChecksumResult(upload *Upload, receiver *Receiver, msg Message) {
+	var report checksumReport
+	err := decodePayload(msg, &report)
+	report.SHA256 = strings.ToLower(report.SHA256)
+	if err == nil && !sha256Pattern.MatchString(report.SHA256) {
+		err = errors.New("sha256 must be 64 hex characters")
+	}
+	var expected string
+	if err == nil {
+		var ok bool
+		if expected, ok = expectedChecksum(upload, report.Path); !ok {
+			err = fmt.Errorf("no file at path %q", report.Path)
+		}
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	verdict := checksumVerdict{
+		ReceiverID: receiver.ID,
+		Name:       receiver.Name,
+		Path:       report.Path,
+		SHA256:     report.SHA256,
+		Expected:   expected,
+		Status:     checksumUnverified,
+	}
+	if expected != "" {
+		verdict.Status = checksumMismatch
+		if expected == report.SHA256 {
+			verdict.Status = checksumVerified
+		}
+	}
+
+	result := Message{Type: "checksum_result", Payload: verdict}
+	sendToHost(upload, result)
+	receiver.send(result)
+}
+
+func handleSHA256Sums(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+	if upload.isClosed() {
+		writeProblem(w, http.StatusGone, problemSessionClosed, "")
+		return
+	}
+
+	upload.mutex.RLock()
+	sums, err := sha256Sums(checksummedFiles(upload.Meta))
+	upload.mutex.RUnlock()
+	if err != nil {
+		writeProblem(w, http.StatusNotFound, problemNoChecksums, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="SHA256SUMS"`)
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, sums)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// GET /api/upload/{id}/code.wav and code.mp3 read the join code aloud, for
+// people who can't see it and for passing it on through a voice assistant
+// or a phone call. There is no speech synthesis in the server; the audio is
+// put together from recordings in -code-audio-dir, one per word or
+// character a code can contain:
+//
+//	7.wav, a.wav, bear.wav ...  PCM, all in the same format
+//	7.mp3, a.mp3, bear.mp3 ...  for code.mp3, and _pause.mp3 to put between
+//	                            them
+//
+// A word without a recording is spelled out letter by letter. The code is
+// read twice with a pause in between. The endpoints exist only with
+// -code-audio-dir, and like info they answer whether an ID exists, so they
+// share the join rate limit.
+
+const (
+	codeAudioGap    = 300 * time.Millisecond
+	codeAudioRepeat = time.Second
+)
+
+var errNoRecording = errors.New("no recording")
+
+type wavFormat struct {
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+}
+
+type codeRecordings struct {
+	format wavFormat
+	wav    map[string][]byte // PCM data
+	mp3    map[string][]byte // MPEG frames, without tags
+}
+
+var recordings *codeRecordings
+
+// loadCodeRecordings reads the recordings in dir.
+func loadCodeRecordings(dir string) (*codeRecordings, error) {
+	recs := &codeRecordings{wav: make(map[string][]byte), mp3: make(map[string][]byte)}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		token := strings.ToLower(strings.TrimSuffix(file.Name(), ext))
+		if file.IsDir() || (ext != ".wav" && ext != ".mp3") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if ext == ".mp3" {
+			recs.mp3[token] = stripID3(data)
+			continue
+		}
+		format, pcm, err := parseWAV(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+		if len(recs.wav) == 0 {
+			recs.format = format
+		} else if format != recs.format {
+			return nil, fmt.Errorf("%s: not in the same format as the other recordings", file.Name())
+		}
+		recs.wav[token] = pcm
+	}
+	return recs, nil
+}
+
+// parseWAV returns the format and samples of an uncompressed WAV file.
+func parseWAV(data []byte) (wavFormat, []byte, error) {
+	var format wavFormat
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return format, nil, errors.New("not a WAV file")
+	}
+	var pcm []byte
+	seenFormat := false
+	for rest := data[12:]; len(rest) >= 8; {
+		id, size := string(rest[:4]), int(binary.LittleEndian.Uint32(rest[4:8]))
+		rest = rest[8:]
+		if size > len(rest) {
+			return format, nil, errors.New("truncated " + id + " chunk")
+		}
+		switch id {
+		case "fmt ":
+			if err := binary.Read(bytes.NewReader(rest[:size]), binary.LittleEndian, &format); err != nil {
+				return format, nil, err
+			}
+			seenFormat = true
+		case "data":
+			pcm = rest[:size]
+		}
+		rest = rest[min(size+size%2, len(rest)):]
+	}
+	switch {
+	case !seenFormat || pcm == nil:
+		return format, nil, errors.New("missing fmt or data chunk")
+	case format.AudioFormat != 1:
+		return format, nil, errors.New("not PCM")
+	}
+	return format, pcm, nil
+}
+
+// stripID3 drops the ID3 tags around MPEG audio, so recordings can be
+// joined frame to frame.
+func stripID3(data []byte) []byte {
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		size := 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9]))
+		if data[5]&0x10 != 0 {
+			size += 10
+		}
+		data = data[min(size, len(data)):]
+	}
+	if len(data) >= 128 && string(data[len(data)-128:len(data)-125]) == "TAG" {
+		data = data[:len(data)-128]
+	}
+	return data
+}
+
+// spokenTokens splits id into what is read out: its words, or its
+// characters for packs of single characters.
+func spokenTokens(id string) []string {
+	if strings.Contains(id, "-") {
+		return strings.Split(id, "-")
+	}
+	return strings.Split(id, "")
+}
+
+// sequence returns the recordings reading id out of clips, each followed
+// by a gap, spelling words there is no recording of.
+func (c *codeRecordings) sequence(id string, clips map[string][]byte) ([][]byte, error) {
+	var seq [][]byte
+	for _, token := range spokenTokens(id) {
+		if clip, ok := clips[token]; ok {
+			seq = append(seq, clip)
+			continue
+		}
+		for _, letter := range strings.Split(token, "") {
+			clip, ok := clips[letter]
+			if !ok {
+				return nil, fmt.Errorf("%w of %q", errNoRecording, letter)
+			}
+			seq = append(seq, clip)
+		}
+	}
+	return seq, nil
+}
+
+func (c *codeRecordings) silence(d time.Duration) []byte {
+	n := int(d.Seconds()*float64(c.format.SampleRate)) * int(c.format.BlockAlign)
+	if c.format.BitsPerSample == 8 {
+		return bytes.Repeat([]byte{0x80}, n)
+	}
+	return make([]byte, n)
+}
+
+// renderWAV reads id out twice.
+func (c *codeRecordings) renderWAV(id string) ([]byte, error) {
+	seq, err := c.sequence(id, c.wav)
+	if err != nil {
+		return nil, err
+	}
+	var pcm bytes.Buffer
+	gap := c.silence(codeAudioGap)
+	for round := 0; round < 2; round++ {
+		if round > 0 {
+			pcm.Write(c.silence(codeAudioRepeat))
+		}
+		for _, clip := range seq {
+			pcm.Write(clip)
+			pcm.Write(gap)
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(36+pcm.Len()))
+	out.WriteString("WAVEfmt ")
+	binary.Write(&out, binary.LittleEndian, uint32(16))
+	binary.Write(&out, binary.LittleEndian, c.format)
+	out.WriteString("data")
+	binary.Write(&out, binary.LittleEndian, uint32(pcm.Len()))
+	out.Write(pcm.Bytes())
+	return out.Bytes(), nil
+}
+
+// renderMP3 reads id out twice, with _pause.mp3 between the recordings
+// when there is one.
+func (c *codeRecordings) renderMP3(id string) ([]byte, error) {
+	seq, err := c.sequence(id, c.mp3)
+	if err != nil {
+		return nil, err
+	}
+	pause := c.mp3["_pause"]
+	var out bytes.Buffer
+	for round := 0; round < 2; round++ {
+		if round > 0 {
+			out.Write(pause)
+			out.Write(pause)
+		}
+		for _, clip := range seq {
+			out.Write(clip)
+			out.Write(pause)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// handleCodeAudio answers GET /api/upload/{id}/code.{wav,mp3}.
+func handleCodeAudio(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := lookupUpload(id); !ok {
+		if _, elsewhere := lookupElsewhere(r.Context(), id); !elsewhere {
+			writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+			return
+		}
+	}
+
+	var audio []byte
+	var err error
+	contentType := "audio/wav"
+	if mux.Vars(r)["format"] == "mp3" {
+		contentType = "audio/mpeg"
+		audio, err = recordings.renderMP3(id)
+	} else {
+		audio, err = recordings.renderWAV(id)
+	}
+	if err != nil {
+		log.Error("Could not read join code aloud", "id", id, "err", err)
+		writeProblem(w, http.StatusNotImplemented, problemNoRecording, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(audio)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// The companion API lets a browser extension (through native messaging) or
+// an OS share-sheet helper send a file without the web UI. It listens on a
+// separate loopback-only address and every request must carry the
+// companion token. A file posted to it becomes a host-less session: the
+// bytes are kept like an inline file and handed to whoever joins, so only
+// files up to -inline-max-bytes can be sent this way. The response carries
+// the host and resume tokens, so the helper can still attach as the host
+// through /api/upload/{id}/resume to watch the session.
+
+// companionToken returns the configured token, or creates one and writes
+// it to -companion-token-file for the helper to read.
+func companionToken() (string, error) {
+	if cfg.CompanionToken != "" {
+		return cfg.CompanionToken, nil
+	}
+	if data, err := os.ReadFile(cfg.CompanionTokenFile); err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	}
+	token := generateReceiverID() + generateReceiverID()
+	if err := os.WriteFile(cfg.CompanionTokenFile, []byte(token+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// isLoopbackAddr reports whether addr only listens on the local machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func requireCompanionToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := bearerToken(r)
+		if got == "" {
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, "")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeProblem(w, http.StatusForbidden, problemForbidden, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// companionBaseURL is where share links from the companion point. The
+// companion is only reachable locally, so the request's own origin is no
+// use to the receiver.
+func companionBaseURL() string {
+	if cfg.PublicURL != "" {
+		return strings.TrimRight(cfg.PublicURL, "/")
+	}
+	_, port, _ := net.SplitHostPort(cfg.Addr)
+	return "http://localhost:" + port
+}
+
+type companionSession struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	HostToken   string    `json:"host_token"`
+	ResumeToken string    `json:"resume_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// handleCompanionSend creates a session from the request body. The file
+// name comes from the filename query parameter and the type from filetype
+// or Content-Type.
+func handleCompanionSend(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeProblem(w, http.StatusServiceUnavailable, problemDraining, "")
+		return
+	}
+
+	meta, data, ok := readFileBody(w, r)
+	if !ok {
+		return
+	}
+
+	upload := newHostlessUpload(meta, data, companionBaseURL(), cfg.InlineTTL)
+	if passphrase := requestPassphrase(r); passphrase != "" {
+		upload.passphrase = hashPassphrase(passphrase)
+	}
+	upload.fromCompanion = true
+	id := registerUpload(upload)
+	log.Info("Companion created session", "id", id, "bytes", len(data))
+
+	writeJSON(w, http.StatusCreated, companionSession{
+		ID:          id,
+		URL:         upload.baseURL + "/?code=" + url.QueryEscape(id),
+		HostToken:   upload.hostToken,
+		ResumeToken: upload.resumeToken,
+		ExpiresAt:   upload.inline.ExpiresAt,
+	})
+}
+
+// readFileBody reads a file posted as the request body, which has to fit
+// inline. The name comes from the filename query parameter and the type
+// from filetype or Content-Type. It writes the problem itself when the
+// request is unusable.
+func readFileBody(w http.ResponseWriter, r *http.Request) (Metadata, []byte, bool) {
+	query := r.URL.Query()
+	meta := Metadata{FileName: query.Get("filename"), FileType: query.Get("filetype")}
+	if meta.FileType == "" {
+		meta.FileType = r.Header.Get("Content-Type")
+	}
+	if meta.FileName == "" || meta.FileType == "" {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Missing filename or file type")
+		return meta, nil, false
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.InlineMaxBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, http.StatusRequestEntityTooLarge, problemFileTooLarge, fmt.Sprintf("Files posted to the server can be up to %d bytes", cfg.InlineMaxBytes))
+		return meta, nil, false
+	}
+	if err != nil || len(data) == 0 {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must contain the file")
+		return meta, nil, false
+	}
+	meta.FileSize = int64(len(data))
+	sum := sha256.Sum256(data)
+	meta.SHA256 = hex.EncodeToString(sum[:])
+	return meta, data, true
+}
+
+// newHostlessUpload makes a session that serves data inline for ttl
+// without a host socket. A host can still attach later with the resume
+// token. The caller registers it.
+func newHostlessUpload(meta Metadata, data []byte, baseURL string, ttl time.Duration) *Upload {
+	upload := &Upload{
+		Meta:      meta,
+		Receivers: make([]*Receiver, 0),
+		CreatedAt: time.Now(),
+		inline:    &inlineFile{Data: data, ExpiresAt: time.Now().Add(ttl)},
+		// Nobody is there to answer an offer, so inline is all it speaks
+		hostCapabilities: []string{transportInline},
+		hostDetached:     true,
+		hostToken:        generateReceiverID() + generateReceiverID(),
+		resumeToken:      generateReceiverID() + generateReceiverID(),
+		baseURL:          baseURL,
+		expiresAt:        time.Now().Add(ttl),
+		ctx:              context.Background(),
+	}
+	upload.holdTimer = time.AfterFunc(ttl, func() {
+		recordEvent(upload, "session_expired", map[string]any{"reason": "ttl"})
+		finalizeUpload(upload)
+	})
+	upload.touch()
+	return upload
+}
+
+// lookupCompanionSession finds a session the companion created. Other
+// sessions are not the helper's to see or close, so they are not found.
+func lookupCompanionSession(w http.ResponseWriter, r *http.Request) (*Upload, bool) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok || !upload.fromCompanion {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return nil, false
+	}
+	return upload, true
+}
+
+func handleCompanionGetSession(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupCompanionSession(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, summarizeUpload(upload, true))
+}
+
+func handleCompanionDeleteSession(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupCompanionSession(w, r)
+	if !ok {
+		return
+	}
+	broadcastToReceivers(upload, Message{Type: "host_disconnected"})
+	upload.mutex.RLock()
+	for _, receiver := range upload.Receivers {
+		receiver.close()
+	}
+	upload.mutex.RUnlock()
+	finalizeUpload(upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runCompanion serves the companion API until the process exits.
+func runCompanion() {
+	if !isLoopbackAddr(cfg.CompanionAddr) {
+		log.Fatal("The companion API must listen on a loopback address", "addr", cfg.CompanionAddr)
+	}
+	token, err := companionToken()
+	if err != nil {
+		log.Fatal("Could not set up the companion token", "err", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/companion/sessions", handleCompanionSend).Methods("POST")
+	router.HandleFunc("/companion/sessions/{id}", handleCompanionGetSession).Methods("GET")
+	router.HandleFunc("/companion/sessions/{id}", handleCompanionDeleteSession).Methods("DELETE")
+
+	log.Info("Starting companion API", "bind", cfg.CompanionAddr)
+	server := &http.Server{Addr: cfg.CompanionAddr, Handler: requireCompanionToken(token, router)}
+	if err := server.ListenAndServe(); err != nil {
+		log.Error("Companion API stopped", "err", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// companionRequest calls one of the companion handlers for session id.
+func companionRequest(handler http.HandlerFunc, method, id string) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(httptest.NewRequest(method, "/companion/sessions/"+id, nil), map[string]string{"id": id})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestCompanionSessions(t *testing.T) {
+	testServer(t)
+	w := httptest.NewRecorder()
+	handleCompanionSend(w, httptest.NewRequest("POST", "/companion/sessions?filename=note.txt&filetype=text%2Fplain", strings.NewReader("hello")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("sending: got %d %s", w.Code, w.Body)
+	}
+	var sent companionSession
+	if err := json.NewDecoder(w.Body).Decode(&sent); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session from the web UI isn't the helper's to see or close
+	_, other := openTestHost(t)
+	if w := companionRequest(handleCompanionGetSession, "GET", other); w.Code != http.StatusNotFound {
+		t.Errorf("getting another session: got %d", w.Code)
+	}
+	if w := companionRequest(handleCompanionDeleteSession, "DELETE", other); w.Code != http.StatusNotFound {
+		t.Errorf("deleting another session: got %d", w.Code)
+	}
+	if _, ok := lookupUpload(other); !ok {
+		t.Fatal("another session was closed")
+	}
+
+	if w := companionRequest(handleCompanionGetSession, "GET", sent.ID); w.Code != http.StatusOK {
+		t.Errorf("getting: got %d", w.Code)
+	}
+	if w := companionRequest(handleCompanionDeleteSession, "DELETE", sent.ID); w.Code != http.StatusNoContent {
+		t.Errorf("deleting: got %d", w.Code)
+	}
+	if _, ok := lookupUpload(sent.ID); ok {
+		t.Error("session still there after deleting")
+	}
+}
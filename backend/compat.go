@@ -0,0 +1,109 @@
+package main
+
+import (
+	"maps"
+	"slices"
+)
+
+// Handlers build and read messages in the newest protocol version only.
+// What a socket reads is brought up from the version negotiated in its
+// hello, and what it is sent taken down to it, by the translations of
+// every version newer than the client's. A frontend still cached from
+// before a deploy keeps working without the rest of the server knowing.
+//
+// Version 2 reports failed joins with error messages, which version 1
+// clients know as join_rejected and kicked. Version 3 routes on the
+// envelope (see envelope.go), where older clients put the peer in the
+// signaling payload.
+
+// translation converts between a protocol version and the one before it.
+// Either direction may be nil when only the other one changed.
+type translation struct {
+	version int
+	up      func(Message) Message
+	down    func(Message) Message
+}
+
+var translations = []translation{
+	{version: 2, down: joinErrorDown},
+	{version: 3, up: routingUp, down: routingDown},
+}
+
+// upgradeMessage brings msg from a client speaking version up to date.
+func upgradeMessage(msg Message, version int) Message {
+	for _, t := range translations {
+		if t.version > version && t.up != nil {
+			msg = t.up(msg)
+		}
+	}
+	return msg
+}
+
+// downgradeMessage rewrites msg for a client speaking version.
+func downgradeMessage(msg Message, version int) Message {
+	for _, t := range slices.Backward(translations) {
+		if t.version > version && t.down != nil {
+			msg = t.down(msg)
+		}
+	}
+	return msg
+}
+
+// protocolErrors are about the message itself, not the join it asked for,
+// and were error messages in version 1 too.
+var protocolErrors = []string{errCodeInvalidJSON, errCodeInvalidPayload, errCodeUnknownType, errCodeUnexpectedMessage}
+
+func joinErrorDown(msg Message) Message {
+	e, ok := msg.Payload.(wsError)
+	if msg.Type != "error" || !ok || e.Type != "join_request" || slices.Contains(protocolErrors, e.Code) {
+		return msg
+	}
+	if e.Code == problemBanned {
+		return Message{Type: "kicked", Payload: map[string]string{"reason": "banned"}}
+	}
+	return Message{Type: "join_rejected", Payload: map[string]string{"reason": e.Code}}
+}
+
+// routingUp moves the peer a signaling payload names into the envelope.
+// Hosts named the receiver as receiver_id in offers and answers and as
+// peer_id in candidates; receivers only ever wrote to the host.
+func routingUp(msg Message) Message {
+	payload, ok := msg.Payload.(map[string]any)
+	if !ok || !isSignaling(msg.Type) {
+		return msg
+	}
+	for _, key := range []string{"receiver_id", "peer_id"} {
+		if id, ok := payload[key].(string); ok && msg.To == "" {
+			msg.To = id
+		}
+	}
+	for _, key := range []string{"receiver_id", "peer_id", "sender_id"} {
+		delete(payload, key)
+	}
+	return msg
+}
+
+// routingDown puts the sender back into the payload where older clients
+// look for it.
+func routingDown(msg Message) Message {
+	payload, ok := msg.Payload.(map[string]any)
+	if !ok || msg.From == "" {
+		return msg
+	}
+	var key string
+	switch {
+	case msg.Type == "webrtc_ice_candidate" || msg.Type == "ice_restart":
+		key = "peer_id"
+	case msg.Type == "webrtc_answer" && msg.To == hostPeer:
+		key = "receiver_id"
+	case isSignaling(msg.Type):
+		key = "sender_id"
+	default:
+		return msg
+	}
+	payload = maps.Clone(payload) // may be shared with other receivers
+	payload[key] = msg.From
+	msg.Payload = payload
+	msg.From, msg.To = "", ""
+	return msg
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoutingUp(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		msg  Message
+		to   string
+	}{
+		{"offer", Message{Type: "webrtc_offer", Payload: map[string]any{"sdp": "v=0", "receiver_id": "r1"}}, "r1"},
+		{"candidate", Message{Type: "webrtc_ice_candidate", Payload: map[string]any{"candidate": "c", "peer_id": "r1"}}, "r1"},
+		{"from a receiver", Message{Type: "webrtc_answer", Payload: map[string]any{"sdp": "v=0", "sender_id": "r2"}}, ""},
+		{"envelope wins", Message{Type: "webrtc_offer", To: "r2", Payload: map[string]any{"sdp": "v=0", "receiver_id": "r1"}}, "r2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := upgradeMessage(tt.msg, 2)
+			if got.To != tt.to {
+				t.Errorf("to %q, want %q", got.To, tt.to)
+			}
+			payload := got.Payload.(map[string]any)
+			for _, key := range []string{"receiver_id", "peer_id", "sender_id"} {
+				if _, ok := payload[key]; ok {
+					t.Errorf("%s left in the payload", key)
+				}
+			}
+		})
+	}
+
+	other := Message{Type: "join_request", Payload: map[string]any{"receiver_id": "r1"}}
+	if got := upgradeMessage(other, 2); got.To != "" || got.Payload.(map[string]any)["receiver_id"] != "r1" {
+		t.Errorf("non-signaling message rewritten: %+v", got)
+	}
+	if got := upgradeMessage(Message{Type: "webrtc_offer", Payload: map[string]any{"receiver_id": "r1"}}, 3); got.To != "" {
+		t.Errorf("version 3 message rewritten: %+v", got)
+	}
+}
+
+func TestRoutingDown(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		msg  Message
+		key  string
+	}{
+		{"offer to a receiver", Message{Type: "webrtc_offer", From: hostPeer, To: "r1"}, "sender_id"},
+		{"answer to the host", Message{Type: "webrtc_answer", From: "r1", To: hostPeer}, "receiver_id"},
+		{"answer to a receiver", Message{Type: "webrtc_answer", From: "r1", To: "r2"}, "sender_id"},
+		{"candidate", Message{Type: "webrtc_ice_candidate", From: "r1", To: hostPeer}, "peer_id"},
+		{"restart", Message{Type: "ice_restart", From: hostPeer, To: "r1"}, "peer_id"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			shared := map[string]any{"sdp": "v=0"}
+			tt.msg.Payload = shared
+			got := downgradeMessage(tt.msg, 2)
+			if got.From != "" || got.To != "" {
+				t.Errorf("envelope kept: from %q to %q", got.From, got.To)
+			}
+			if from := got.Payload.(map[string]any)[tt.key]; from != tt.msg.From {
+				t.Errorf("%s = %v, want %q", tt.key, from, tt.msg.From)
+			}
+			if len(shared) != 1 {
+				t.Errorf("shared payload modified: %v", shared)
+			}
+		})
+	}
+
+	msg := Message{Type: "receivers_update", From: hostPeer, Payload: map[string]any{}}
+	if got := downgradeMessage(msg, 2); !reflect.DeepEqual(got, msg) {
+		t.Errorf("non-signaling message rewritten: %+v", got)
+	}
+}
+
+func TestJoinErrorDown(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		msg  Message
+		want Message
+	}{
+		{
+			"rejected",
+			errorMessage(problemSessionFull, "full", "join_request"),
+			Message{Type: "join_rejected", Payload: map[string]string{"reason": problemSessionFull}},
+		},
+		{
+			"banned",
+			errorMessage(problemBanned, "banned", "join_request"),
+			Message{Type: "kicked", Payload: map[string]string{"reason": "banned"}},
+		},
+		{
+			"protocol error",
+			errorMessage(errCodeInvalidPayload, "bad", "join_request"),
+			errorMessage(errCodeInvalidPayload, "bad", "join_request"),
+		},
+		{
+			"other type",
+			errorMessage(problemSessionFull, "full", "create_pin"),
+			errorMessage(problemSessionFull, "full", "create_pin"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := downgradeMessage(tt.msg, 1); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			// Version 2 clients read the error as it is
+			if got := downgradeMessage(tt.msg, 2); !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("version 2: got %+v", got)
+			}
+		})
+	}
+}
+
+func TestUpgradeDowngradeV1(t *testing.T) {
+	// A version 1 host answers a receiver the way it always did
+	in := Message{Type: "webrtc_ice_candidate", Payload: map[string]any{"candidate": "c", "peer_id": "r1"}}
+	up := upgradeMessage(in, 1)
+	if up.To != "r1" {
+		t.Fatalf("upgraded to %q, want r1", up.To)
+	}
+
+	// and hears back from it with the sender in the payload
+	out := downgradeMessage(Message{Type: "webrtc_ice_candidate", From: "r1", To: hostPeer, Payload: map[string]any{"candidate": "c"}}, 1)
+	if out.Payload.(map[string]any)["peer_id"] != "r1" {
+		t.Errorf("downgraded %+v, want peer_id r1", out)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"time"
+)
+
+// Receivers send transfer_complete once the file is on disk, or once per
+// file when they picked some with request_files. Each receiver counts
+// once; the host gets a transfer_summary after every completion, so it
+// knows when everyone it waited for has the file before it closes the lid.
+// The same summary is on the admin API.
+
+type completionReport struct {
+	DurationMs int64  `json:"duration_ms"` // measured by the receiver; the server's own estimate when 0
+	Bytes      int64  `json:"bytes"`       // defaults to the file size
+	Path       string `json:"path"`        // one file of a selection, see selection.go
+}
+
+type completion struct {
+	ReceiverID    string    `json:"receiver_id"`
+	Name          string    `json:"name"`
+	Bytes         int64     `json:"bytes"`
+	DurationMs    int64     `json:"duration_ms"`
+	ThroughputBps float64   `json:"throughput_bps"`
+	CompletedAt   time.Time `json:"completed_at"`
+
+	Feedback *transferFeedback `json:"feedback,omitempty"` // see feedback.go
+}
+
+type transferSummary struct {
+	CompletedCount       int          `json:"completed_count"`
+	ReceiverCount        int          `json:"receiver_count"`
+	MinDurationMs        int64        `json:"min_duration_ms"`
+	MaxDurationMs        int64        `json:"max_duration_ms"`
+	AverageDurationMs    int64        `json:"average_duration_ms"`
+	AverageThroughputBps float64      `json:"average_throughput_bps"`
+	FeedbackCount        int          `json:"feedback_count"`
+	AverageRating        float64      `json:"average_rating,omitempty"`
+	Completions          []completion `json:"completions"`
+}
+
+// summarizeTransfers builds the summary. The caller holds upload.mutex.
+func summarizeTransfers(upload *Upload) transferSummary {
+	summary := transferSummary{
+		CompletedCount: len(upload.completions),
+		ReceiverCount:  len(upload.Receivers),
+		// Copied, as feedback is filled in after the summary may be sent
+		Completions: slices.Clone(upload.completions),
+	}
+	if summary.Completions == nil {
+		summary.Completions = []completion{}
+	}
+	if len(upload.completions) == 0 {
+		return summary
+	}
+
+	var totalDuration int64
+	var totalThroughput float64
+	var measured int // completions quick enough to have no throughput are left out
+	var totalRating int
+	summary.MinDurationMs = math.MaxInt64
+	for _, c := range upload.completions {
+		totalDuration += c.DurationMs
+		summary.MinDurationMs = min(summary.MinDurationMs, c.DurationMs)
+		summary.MaxDurationMs = max(summary.MaxDurationMs, c.DurationMs)
+		if c.ThroughputBps > 0 {
+			totalThroughput += c.ThroughputBps
+			measured++
+		}
+		if c.Feedback != nil {
+			totalRating += c.Feedback.Rating
+			summary.FeedbackCount++
+		}
+	}
+	summary.AverageDurationMs = totalDuration / int64(len(upload.completions))
+	if measured > 0 {
+		summary.AverageThroughputBps = math.Round(totalThroughput / float64(measured))
+	}
+	if summary.FeedbackCount > 0 {
+		summary.AverageRating = math.Round(float64(totalRating)/float64(summary.FeedbackCount)*100) / 100
+	}
+	return summary
+}
+
+func handleTransferComplete(upload *Upload, receiver *Receiver, msg Message) {
+	var report completionReport
+	err := decodePayload(msg, &report)
+	if err == nil && (report.DurationMs < 0 || report.Bytes < 0) {
+		err = errors.New("duration_ms and bytes must not be negative")
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+	if report.Path != "" {
+		last, err := completeSelectedFile(upload, receiver, report.Path)
+		if err != nil {
+			receiver.send(invalidPayload(msg, err))
+			return
+		}
+		recordEvent(upload, "file_completed", map[string]any{"receiver_id": receiver.ID, "path": report.Path})
+		sendReceiversUpdate(upload)
+		if !last {
+			return
+		}
+		// The receiver has everything it picked, which completes it
+		report.Bytes, report.DurationMs = 0, 0
+	}
+
+	now := time.Now()
+	c := completion{
+		ReceiverID:  receiver.ID,
+		Name:        receiver.Name,
+		Bytes:       report.Bytes,
+		DurationMs:  report.DurationMs,
+		CompletedAt: now,
+	}
+	if c.DurationMs == 0 {
+		c.DurationMs = now.Sub(receiver.ConnectedAt).Milliseconds()
+	}
+
+	upload.mutex.Lock()
+	if selection := receiver.selection; selection != nil {
+		// Done without naming files means done with all of them
+		for _, p := range selection.Paths {
+			if _, ok := selection.Completed[p]; !ok {
+				selection.Completed[p] = now
+			}
+		}
+	}
+	if c.Bytes == 0 {
+		c.Bytes = receiverTotal(upload, receiver)
+	}
+	if c.DurationMs > 0 {
+		c.ThroughputBps = math.Round(float64(c.Bytes) * 1000 / float64(c.DurationMs))
+	}
+	for _, done := range upload.completions {
+		if done.ReceiverID == receiver.ID {
+			upload.mutex.Unlock()
+			return // already counted
+		}
+	}
+	upload.completions = append(upload.completions, c)
+	first := len(upload.completions) == 1
+	summary := summarizeTransfers(upload)
+	upload.mutex.Unlock()
+
+	if first && cfg.PublicStats {
+		publicStats.sessionCompleted(upload.country)
+	}
+
+	recordEvent(upload, "transfer_completed", map[string]any{
+		"receiver_id": c.ReceiverID,
+		"bytes":       c.Bytes,
+		"duration_ms": c.DurationMs,
+	})
+	sendToHost(upload, Message{Type: "transfer_summary", Payload: summary})
+	requestFeedback(receiver)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+type config struct {
+	Addr      string
+	PublicURL string
+	Debug     bool
+	Local     bool
+	LocalName string
+	IDBytes   int
+	Store     string // memory or bolt
+	StorePath string
+	HistoryDB string // sqlite:path or a postgres:// URL
+
+	IDVocabulary    string
+	IDVocabularyDir string
+
+	SessionStore string // memory or a redis:// URL
+	NodeID       string
+	NodeURL      string
+	MessageBus   string // empty or a redis:// URL
+
+	Snapshot         string // empty, a file or a redis:// URL
+	SnapshotInterval time.Duration
+	SnapshotGrace    time.Duration
+
+	DrainTimeout time.Duration
+
+	AdminToken string
+
+	SpoolDir     string
+	SpoolKeyFile string
+	BlobStore    string
+	S3Endpoint   string
+
+	Secrets       string
+	SecretRefresh time.Duration
+
+	TrustProxy bool
+	RateLimit  float64 // requests per minute per IP, 0 disables
+	RateBurst  int
+
+	TLSCert       string
+	TLSKey        string
+	TLSCommonName string
+	VaultPKIRole  string
+	VaultPKITTL   time.Duration
+
+	IdempotencyWindow time.Duration
+	RestoreWindow     time.Duration
+	HoldOpenTTL       time.Duration
+
+	InlineMaxBytes int64
+	InlineTTL      time.Duration
+
+	Relay        bool
+	RelayWindow  int64
+	HTTPRelay    bool
+	HTTPRelayTTL time.Duration
+
+	BandwidthProbeBytes int64
+
+	StoredMaxBytes   int64
+	StoredTotalBytes int64
+	StoredMaxTTL     time.Duration
+
+	IPBytesPerDay int64
+	IPMaxRelays   int
+
+	TransportPolicy string // recommend or mandate
+	RoutingPolicy   string
+	CountryHeader   string
+
+	SessionMaxAge       time.Duration
+	SessionIdleTimeout  time.Duration
+	HostGracePeriod     time.Duration
+	ReceiverGracePeriod time.Duration
+
+	SMTPAddr string
+	SMTPFrom string
+	SMTPUser string
+
+	PublishMaxTTL time.Duration
+
+	ReceiverWaitAlert  time.Duration
+	NetworkChangeGrace time.Duration
+	RequestFeedback    bool
+
+	PublicStats          bool
+	PublicStatsEpsilon   float64
+	PublicStatsThreshold int64
+
+	WebhookURLs        string
+	WebhookSecret      string
+	WebhookEvents      string
+	WebhookMaxAttempts int
+	WebhookMaxBackoff  time.Duration
+
+	SlackWebhook   string
+	DiscordWebhook string
+	ChatEvents     string
+
+	TenantSessionsPerDay int64
+	TenantBytesPerDay    int64
+	QuotaWarnAt          float64
+
+	SiteName     string
+	TemplatesDir string
+	CodeAudioDir string
+
+	BundleManifest string
+	BundleKey      string
+
+	ICEServers     string
+	ICEServersFile string
+	TURNURLs       string
+	TURNTTL        time.Duration
+
+	CompanionAddr      string
+	CompanionToken     string
+	CompanionTokenFile string
+}
+
+var cfg config
+
+// parseFlags reads the server flags from args.
+func parseFlags(args []string) {
+	flag.StringVar(&cfg.Addr, "addr", ":3000", "address to listen on")
+	flag.StringVar(&cfg.PublicURL, "public-url", "", "external base URL used in generated links (derived from the request when empty)")
+	flag.BoolVar(&cfg.Local, "local", false, "LAN-only mode: no outbound calls, local clients only, advertised over mDNS")
+	flag.StringVar(&cfg.LocalName, "local-name", "sendmyzip", "name advertised over mDNS in -local mode, as <name>.local")
+	flag.BoolVar(&cfg.Debug, "debug", false, "mount net/http/pprof under /debug/pprof")
+	flag.StringVar(&cfg.IDVocabulary, "id-vocabulary", "hex", "vocabulary pack upload IDs are drawn from: hex, digits, en, da, animals or one from -id-vocabulary-dir")
+	flag.StringVar(&cfg.IDVocabularyDir, "id-vocabulary-dir", "", "directory of <name>.txt word lists, one word per line, adding or replacing vocabulary packs")
+	flag.StringVar(&cfg.Store, "store", "memory", "persistence backend: memory or bolt")
+	flag.StringVar(&cfg.StorePath, "store-path", "sendmyzip.db", "database file used by the bolt store")
+	flag.StringVar(&cfg.HistoryDB, "history-db", "", "database for the transfer history instead of -store: sqlite:path or a postgres:// URL")
+	flag.StringVar(&cfg.SessionStore, "session-store", "memory", "where live sessions are registered for other nodes: memory, or a redis:// URL shared by all nodes")
+	flag.StringVar(&cfg.NodeID, "node-id", "", "name of this node in the session store (the hostname and a random suffix when empty)")
+	flag.StringVar(&cfg.NodeURL, "node-url", "", "base URL that reaches this node directly, for requests that land on the wrong one")
+	flag.StringVar(&cfg.MessageBus, "message-bus", "", "redis:// URL of a bus that bridges receivers to the node running their session (needs a shared -session-store)")
+	flag.StringVar(&cfg.Snapshot, "snapshot", "", "file or redis:// URL where live sessions are saved so they survive a restart (disabled when empty)")
+	flag.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", 30*time.Second, "how often live sessions are saved to -snapshot")
+	flag.DurationVar(&cfg.SnapshotGrace, "snapshot-grace", 2*time.Minute, "how long a restored session waits for its host and receivers to reattach")
+	flag.DurationVar(&cfg.DrainTimeout, "drain-timeout", 30*time.Second, "how long to wait for active sessions when shutting down")
+	flag.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("SENDMYZIP_ADMIN_TOKEN"), "bearer token for the admin API (defaults to $SENDMYZIP_ADMIN_TOKEN)")
+	flag.StringVar(&cfg.SpoolDir, "spool-dir", "", "directory for server-held transfer data (disabled when empty)")
+	flag.StringVar(&cfg.BlobStore, "blob-store", "", "where the spool keeps its data instead of -spool-dir: fs:/dir or s3:bucket[/prefix]")
+	flag.StringVar(&cfg.S3Endpoint, "s3-endpoint", "", "endpoint of an S3-compatible service such as MinIO for an s3 blob store (AWS when empty)")
+	flag.StringVar(&cfg.SpoolKeyFile, "spool-key-file", "", "file with id:base64key lines from which the keys sealing each session's spooled data are derived; the first key is current (without one a random key is used, lost on restart)")
+	flag.StringVar(&cfg.Secrets, "secrets", "env", "secret provider: env, file:/dir, vault[:mount/path] or awskms:/dir")
+	flag.DurationVar(&cfg.SecretRefresh, "secret-refresh", 5*time.Minute, "how often secrets are re-read from the provider to pick up rotations")
+	flag.BoolVar(&cfg.TrustProxy, "trust-proxy", false, "take the client IP from the last X-Forwarded-For entry (only behind a reverse proxy)")
+	flag.Float64Var(&cfg.RateLimit, "rate-limit", 30, "requests per minute each IP may make to the upload and join endpoints (0 disables)")
+	flag.IntVar(&cfg.RateBurst, "rate-burst", 10, "burst size for -rate-limit")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM certificate to serve HTTPS with (reloaded hourly)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "PEM private key for -tls-cert")
+	flag.StringVar(&cfg.TLSCommonName, "tls-cn", "", "common name to request from -vault-pki-role for the HTTPS certificate")
+	flag.StringVar(&cfg.VaultPKIRole, "vault-pki-role", "", "Vault PKI issue path, e.g. pki/issue/sendmyzip")
+	flag.DurationVar(&cfg.VaultPKITTL, "vault-pki-ttl", 72*time.Hour, "lifetime to request for Vault-issued certificates")
+	flag.IntVar(&cfg.IDBytes, "id-bytes", 4, "random bytes of entropy upload IDs have at least; busy instances draw longer ones")
+	flag.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", 10*time.Minute, "how long an Idempotency-Key on /api/upload replays the original session")
+	flag.DurationVar(&cfg.RestoreWindow, "restore-window", 2*time.Minute, "how long a session closed by its host can be restored")
+	flag.DurationVar(&cfg.HoldOpenTTL, "hold-open-ttl", time.Hour, "how long a hold-open session survives without its host")
+	flag.Int64Var(&cfg.InlineMaxBytes, "inline-max-bytes", 256<<10, "largest file a host may send through the signaling channel instead of WebRTC (0 disables)")
+	flag.DurationVar(&cfg.InlineTTL, "inline-ttl", 10*time.Minute, "how long an inline file is kept for receivers that join later")
+	flag.BoolVar(&cfg.Relay, "relay", false, "stream files through the server over WebSocket for pairs WebRTC can't connect (costs server bandwidth)")
+	flag.Int64Var(&cfg.RelayWindow, "relay-window", 1<<20, "bytes a relay may hold on the way to its receiver before the host has to wait")
+	flag.BoolVar(&cfg.HTTPRelay, "http-relay", false, "as a last resort, let pairs ferry file chunks through the server with plain HTTP requests (costs server bandwidth)")
+	flag.DurationVar(&cfg.HTTPRelayTTL, "http-relay-ttl", 2*time.Minute, "how long a chunk put to an HTTP relay waits for its receiver")
+	flag.Int64Var(&cfg.BandwidthProbeBytes, "bandwidth-probe-bytes", 32<<20, "most junk data a host may send in one bandwidth probe (0 disables probes)")
+	flag.Int64Var(&cfg.StoredMaxBytes, "stored-max-bytes", 0, "largest encrypted file a host may leave in the spool for receivers who come later (0 disables; needs -spool-dir or -blob-store)")
+	flag.Int64Var(&cfg.StoredTotalBytes, "stored-total-bytes", 10<<30, "how much the spool may hold in stored files altogether (0 for no limit)")
+	flag.DurationVar(&cfg.StoredMaxTTL, "stored-max-ttl", 7*24*time.Hour, "longest ttl a stored file may ask for")
+	flag.Int64Var(&cfg.IPBytesPerDay, "ip-bytes-per-day", 0, "bytes a client address may relay, store or download from stored files per UTC day (0 is unlimited)")
+	flag.IntVar(&cfg.IPMaxRelays, "ip-max-relays", 0, "relays and stored file uploads a client address may have going at once (0 is unlimited)")
+	flag.StringVar(&cfg.TransportPolicy, "transport-policy", "recommend", "whether transport_plan messages recommend or mandate a transport")
+	flag.StringVar(&cfg.RoutingPolicy, "routing-policy", "", "JSON file with rules restricting transports by client network or country")
+	flag.StringVar(&cfg.CountryHeader, "country-header", "", "request header a trusted proxy sets to the client's country code, e.g. CF-IPCountry (needs -trust-proxy)")
+	flag.DurationVar(&cfg.SessionMaxAge, "session-max-age", 0, "sessions older than this are closed (0 disables)")
+	flag.DurationVar(&cfg.SessionIdleTimeout, "session-idle-timeout", 0, "sessions without any messages for this long are closed (0 disables)")
+	flag.DurationVar(&cfg.HostGracePeriod, "host-grace-period", time.Minute, "how long a session waits for its host to resume after the host connection drops (0 ends it at once)")
+	flag.DurationVar(&cfg.ReceiverGracePeriod, "receiver-grace-period", 30*time.Second, "how long a disconnected receiver keeps its place and can resume (0 removes it at once)")
+	flag.StringVar(&cfg.SMTPAddr, "smtp-addr", "", "SMTP server (host:port) for e-mailing registered identities (disabled when empty)")
+	flag.StringVar(&cfg.SMTPFrom, "smtp-from", "sendmyzip@localhost", "sender address for e-mails")
+	flag.StringVar(&cfg.SMTPUser, "smtp-user", "", "SMTP username; the password is read from $SENDMYZIP_SMTP_PASSWORD")
+	flag.DurationVar(&cfg.PublishMaxTTL, "publish-max-ttl", 7*24*time.Hour, "longest ttl a session created through /api/publish may ask for")
+	flag.DurationVar(&cfg.ReceiverWaitAlert, "receiver-wait-alert", 30*time.Second, "alert the host when an admitted receiver has had no offer for this long (0 disables)")
+	flag.DurationVar(&cfg.NetworkChangeGrace, "network-change-grace", 2*time.Minute, "how long a client that reported network_changed gets before its socket counts as gone, and to resume after")
+	flag.BoolVar(&cfg.RequestFeedback, "request-feedback", false, "ask receivers to rate the transfer after transfer_complete")
+	flag.BoolVar(&cfg.PublicStats, "public-stats", false, "publish differentially private usage per day and country at /api/stats/public")
+	flag.Float64Var(&cfg.PublicStatsEpsilon, "public-stats-epsilon", 1, "privacy budget for each published count; smaller adds more noise")
+	flag.Int64Var(&cfg.PublicStatsThreshold, "public-stats-threshold", 10, "published countries need at least this many (noisy) sessions a day, the rest are folded into other")
+	flag.StringVar(&cfg.WebhookURLs, "webhook-url", "", "comma-separated URLs that session lifecycle events are POSTed to (disabled when empty)")
+	flag.StringVar(&cfg.WebhookSecret, "webhook-secret", os.Getenv("SENDMYZIP_WEBHOOK_SECRET"), "secret -webhook-url deliveries are signed with (defaults to $SENDMYZIP_WEBHOOK_SECRET)")
+	flag.StringVar(&cfg.WebhookEvents, "webhook-events", defaultWebhookEvents, "comma-separated event types sent to -webhook-url")
+	flag.StringVar(&cfg.SlackWebhook, "slack-webhook", "", "Slack incoming webhook URL that session activity is posted to (disabled when empty)")
+	flag.StringVar(&cfg.DiscordWebhook, "discord-webhook", "", "Discord channel webhook URL that session activity is posted to (disabled when empty)")
+	flag.StringVar(&cfg.ChatEvents, "chat-events", defaultChatEvents, "comma-separated event types posted to -slack-webhook and -discord-webhook")
+	flag.IntVar(&cfg.WebhookMaxAttempts, "webhook-max-attempts", 8, "how many times a webhook delivery is tried before it goes to the dead-letter list")
+	flag.DurationVar(&cfg.WebhookMaxBackoff, "webhook-max-backoff", time.Hour, "longest wait between two webhook delivery attempts")
+	flag.Int64Var(&cfg.TenantSessionsPerDay, "tenant-sessions-per-day", 0, "sessions an API key may create per UTC day (0 is unlimited)")
+	flag.Int64Var(&cfg.TenantBytesPerDay, "tenant-bytes-per-day", 0, "bytes the sessions of an API key may offer per UTC day (0 is unlimited)")
+	flag.Float64Var(&cfg.QuotaWarnAt, "quota-warn-at", 0.8, "share of a quota used after which hosts are warned")
+	flag.StringVar(&cfg.SiteName, "site-name", "Send My Zip", "name shown on server-rendered pages and link previews")
+	flag.StringVar(&cfg.CodeAudioDir, "code-audio-dir", "", "directory of recorded words and characters that join codes are read aloud from at /api/upload/{id}/code.wav and code.mp3 (disabled when empty)")
+	flag.StringVar(&cfg.BundleManifest, "bundle-manifest", "", "comma-separated signed manifests the served files must match, see sendmyzip verify-bundle (unchecked when empty)")
+	flag.StringVar(&cfg.BundleKey, "bundle-key", os.Getenv("SENDMYZIP_BUNDLE_KEY"), "base64 Ed25519 public key -bundle-manifest is signed with (defaults to $SENDMYZIP_BUNDLE_KEY)")
+	flag.StringVar(&cfg.TemplatesDir, "templates-dir", "", "directory of *.html templates overriding the built-in join, expired and status pages")
+	flag.StringVar(&cfg.ICEServers, "ice-servers", "stun:stun.l.google.com:19302", "comma-separated STUN URLs clients use to connect (empty for none)")
+	flag.StringVar(&cfg.ICEServersFile, "ice-servers-file", "", "JSON file of STUN and TURN servers with credentials; replaces -ice-servers")
+	flag.StringVar(&cfg.TURNURLs, "turn-urls", "", "comma-separated TURN URLs of a coturn server sharing the turn secret; clients get credentials minted for them")
+	flag.DurationVar(&cfg.TURNTTL, "turn-ttl", 12*time.Hour, "how long minted TURN credentials are valid")
+	flag.StringVar(&cfg.CompanionAddr, "companion-addr", "", "loopback address for the companion API used by browser extensions and share helpers (disabled when empty)")
+	flag.StringVar(&cfg.CompanionToken, "companion-token", os.Getenv("SENDMYZIP_COMPANION_TOKEN"), "bearer token for the companion API (defaults to $SENDMYZIP_COMPANION_TOKEN)")
+	flag.StringVar(&cfg.CompanionTokenFile, "companion-token-file", "companion.token", "where a generated companion token is stored when -companion-token is empty")
+	flag.CommandLine.Parse(args)
+
+	// The default STUN server is outside the network, and -local hands out
+	// none; setting -ice-servers explicitly is a conflict, see local.go
+	if cfg.Local && !flagSet("ice-servers") {
+		cfg.ICEServers = ""
+	}
+
+	// Below 3 bytes the ID space is small enough to fill up and guess
+	if cfg.IDBytes < 3 {
+		cfg.IDBytes = 3
+	}
+	if cfg.SnapshotInterval <= 0 {
+		cfg.SnapshotInterval = 30 * time.Second
+	}
+	if cfg.PublicStatsEpsilon <= 0 {
+		cfg.PublicStatsEpsilon = 1
+	}
+	if cfg.WebhookMaxAttempts < 1 {
+		cfg.WebhookMaxAttempts = 1
+	}
+	if cfg.WebhookMaxBackoff < webhookBaseBackoff {
+		cfg.WebhookMaxBackoff = webhookBaseBackoff
+	}
+}
+
+// flagSet reports whether the server flag name was given on the command
+// line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// Identities can keep a contact book: other identities they send to, and
+// their own other devices, each with a label. Requests are signed by the
+// owner's key with three headers:
+//
+//	Sendmyzip-Key:       owner public key
+//	Sendmyzip-Timestamp: unix seconds
+//	Sendmyzip-Signature: signature over "<METHOD> <path>:<timestamp>"
+//
+// A host that proves its identity when creating a session (host_key,
+// host_timestamp and host_signature over "sendmyzip-host:<key>:<timestamp>")
+// gets receivers that prove a key in its contact book marked as trusted in
+// receivers_update.
+
+const (
+	contactKindContact = "contact"
+	contactKindDevice  = "device"
+)
+
+// signedOwner authenticates a contact book request and returns the owner.
+func signedOwner(r *http.Request) (string, bool) {
+	ts, err := strconv.ParseInt(r.Header.Get("Sendmyzip-Timestamp"), 10, 64)
+	if err != nil {
+		return "", false
+	}
+	pub, key, err := parsePublicKey(r.Header.Get("Sendmyzip-Key"))
+	if err != nil {
+		return "", false
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > identityClockSkew || skew < -identityClockSkew {
+		return "", false
+	}
+	message := r.Method + " " + r.URL.Path + ":" + strconv.FormatInt(ts, 10)
+	return key, verifyIdentity(pub, message, r.Header.Get("Sendmyzip-Signature"))
+}
+
+func requireOwner(next func(w http.ResponseWriter, r *http.Request, owner string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := signedOwner(r)
+		if !ok {
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, "Request must be signed by an identity key")
+			return
+		}
+		next(w, r, owner)
+	}
+}
+
+func handleListContacts(w http.ResponseWriter, r *http.Request, owner string) {
+	contacts, err := store.ListContacts(r.Context(), owner)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not list contacts")
+		return
+	}
+	if contacts == nil {
+		contacts = []Contact{}
+	}
+	writeJSON(w, http.StatusOK, contacts)
+}
+
+type contactRequest struct {
+	Label string `json:"label"`
+	Kind  string `json:"kind"`
+}
+
+// handlePutContact adds a contact or device, or relabels an existing one.
+// The key in the path is URL-safe base64.
+func handlePutContact(w http.ResponseWriter, r *http.Request, owner string) {
+	_, key, err := parsePublicKey(mux.Vars(r)["key"])
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, err.Error())
+		return
+	}
+	var req contactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must be JSON")
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = contactKindContact
+	}
+	if req.Kind != contactKindContact && req.Kind != contactKindDevice {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "kind must be contact or device")
+		return
+	}
+
+	contact := Contact{Owner: owner, PublicKey: key, Label: req.Label, Kind: req.Kind, CreatedAt: time.Now()}
+	if existing, err := store.GetContact(r.Context(), owner, key); err == nil {
+		contact.CreatedAt = existing.CreatedAt
+	}
+	if err := store.PutContact(r.Context(), contact); err != nil {
+		log.Error("Could not store contact", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store contact")
+		return
+	}
+	writeJSON(w, http.StatusOK, contact)
+}
+
+// handleRevokeContact removes a contact or device; it is no longer trusted.
+func handleRevokeContact(w http.ResponseWriter, r *http.Request, owner string) {
+	_, key, err := parsePublicKey(mux.Vars(r)["key"])
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, err.Error())
+		return
+	}
+	if err := store.DeleteContact(r.Context(), owner, key); err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not revoke contact")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hostIdentity verifies the identity a host claims on /api/upload.
+func hostIdentity(r *http.Request) (string, bool) {
+	q := r.URL.Query()
+	if q.Get("host_key") == "" {
+		return "", true
+	}
+	ts, err := strconv.ParseInt(q.Get("host_timestamp"), 10, 64)
+	if err != nil {
+		return "", false
+	}
+	req := identityRequest{PublicKey: q.Get("host_key"), Timestamp: ts, Signature: q.Get("host_signature")}
+	return req.verify("sendmyzip-host")
+}
+
+// trustReceiver marks receiver as trusted if its proven key is in the
+// host's contact book.
+func trustReceiver(upload *Upload, receiver *Receiver) {
+	if upload.hostIdentity == "" || receiver.verifiedKey == "" {
+		return
+	}
+	contact, err := store.GetContact(upload.ctx, upload.hostIdentity, receiver.verifiedKey)
+	if err != nil {
+		return
+	}
+	receiver.contact = &contact
+}
+
+func registerContactRoutes(api *mux.Router) {
+	api.HandleFunc("/contacts", requireOwner(handleListContacts)).Methods("GET")
+	api.HandleFunc("/contacts/{key}", requireOwner(handlePutContact)).Methods("PUT")
+	api.HandleFunc("/contacts/{key}", requireOwner(handleRevokeContact)).Methods("DELETE")
+}
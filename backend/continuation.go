@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// A host can pick up a running session on a second device, typically by
+// scanning a QR code on the desktop with a phone. The host asks for a
+// continuation with create_continuation and renders the returned URL; the
+// second device connects to /api/upload/{id}/continue with the token and
+// becomes a linked host. Every message for the host goes to all of its
+// sockets, and signaling from any of them is handled the same way, so a
+// transfer started on one device can be watched or answered from another.
+// The primary socket still owns the session: a linked host leaving never
+// ends it.
+
+const continuationTTL = 5 * time.Minute
+
+type continuation struct {
+	token     string
+	expiresAt time.Time
+}
+
+func handleCreateContinuation(upload *Upload, conn *wsConn) {
+	c := continuation{
+		token:     generateReceiverID() + generateReceiverID(),
+		expiresAt: time.Now().Add(continuationTTL).Truncate(time.Second),
+	}
+
+	upload.mutex.Lock()
+	now := time.Now()
+	upload.continuations = slices.DeleteFunc(upload.continuations, func(c continuation) bool { return now.After(c.expiresAt) })
+	upload.continuations = append(upload.continuations, c)
+	base := upload.baseURL
+	upload.mutex.Unlock()
+
+	conn.WriteJSON(Message{
+		Type: "continuation_created",
+		Payload: map[string]any{
+			"token":      c.token,
+			"url":        base + "/?host=" + url.QueryEscape(upload.ID) + "&continue=" + url.QueryEscape(c.token),
+			"expires_at": c.expiresAt,
+		},
+	})
+}
+
+// takeContinuation consumes token if it is a live continuation of upload.
+func (u *Upload) takeContinuation(token string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for i, c := range u.continuations {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+			u.continuations = slices.Delete(u.continuations, i, i+1)
+			return time.Now().Before(c.expiresAt)
+		}
+	}
+	return false
+}
+
+// linkedHostConns returns a snapshot of the secondary host sockets.
+func (u *Upload) linkedHostConns() []*wsConn {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return slices.Clone(u.linkedHosts)
+}
+
+// handleContinueHost is the WebSocket endpoint a second host device
+// connects through.
+func handleContinueHost(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" || !upload.takeContinuation(token) {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid or expired continuation token")
+		return
+	}
+
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	upload.mutex.Lock()
+	upload.linkedHosts = append(upload.linkedHosts, conn)
+	linked := len(upload.linkedHosts)
+	upload.mutex.Unlock()
+
+	log.Info("Host linked a second device", "id", upload.ID, "linked", linked)
+
+	conn.WriteJSON(Message{Type: "upload_created", Payload: map[string]any{
+		"id":          upload.ID,
+		"linked":      true,
+		"metadata":    upload.Meta,
+		"ice_servers": iceServersFor(upload.ctx, upload, hostPeer),
+	}})
+	sendToHost(upload, Message{Type: "host_linked", Payload: map[string]int{"linked_hosts": linked}})
+	sendReceiversUpdate(upload)
+
+	go handleLinkedHost(upload, conn)
+}
+
+func handleLinkedHost(upload *Upload, conn *wsConn) {
+	defer func() {
+		conn.Close()
+		upload.mutex.Lock()
+		upload.linkedHosts = slices.DeleteFunc(upload.linkedHosts, func(c *wsConn) bool { return c == conn })
+		linked := len(upload.linkedHosts)
+		upload.mutex.Unlock()
+		sendToHost(upload, Message{Type: "host_unlinked", Payload: map[string]int{"linked_hosts": linked}})
+	}()
+
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type == "create_upload" {
+			// Extra uploads belong to the socket that made the session
+			conn.WriteJSON(errorMessage(errCodeInvalidPayload, "create_upload is only accepted on the primary host connection", msg.Type))
+			continue
+		}
+		upload.touch()
+		handleHostMessage(upload, conn, msg)
+	}
+}
+
+// closeLinkedHosts disconnects every secondary host socket.
+func closeLinkedHosts(upload *Upload) {
+	for _, conn := range upload.linkedHostConns() {
+		conn.Close()
+	}
+}
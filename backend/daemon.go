@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+)
+
+// `sendmyzip daemon` watches a drop directory and turns every file put
+// there into a session on a sendmyzip server, printing the link (and
+// optionally running a command with it, e.g. to show a desktop
+// notification). It connects as an ordinary host and sends the file inline,
+// so it works against any server but only for files up to the server's
+// -inline-max-bytes; larger files are left where they are. Sent files are
+// moved into a "sent" directory next to them.
+//
+// With -room every session is also published into that room, so its
+// subscribers hear about each new file as it lands (see rooms.go).
+
+var (
+	errUnexpectedReply   = errors.New("unexpected reply from server")
+	errTooLargeForDaemon = errors.New("file is larger than the server sends inline")
+)
+
+type daemonConfig struct {
+	Server          string
+	APIKey          string
+	Dir             string
+	Interval        time.Duration
+	Passphrase      string
+	RequireApproval bool
+	NotifyCommand   string
+	Room            string
+	RoomKey         string
+}
+
+func parseDaemonFlags(args []string) daemonConfig {
+	var c daemonConfig
+	home, _ := os.UserHomeDir()
+
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	fs.StringVar(&c.Server, "server", "http://localhost:3000", "base URL of the sendmyzip server")
+	fs.StringVar(&c.APIKey, "api-key", os.Getenv("SENDMYZIP_API_KEY"), "API key whose quotas the sessions count against (defaults to $SENDMYZIP_API_KEY)")
+	fs.StringVar(&c.Dir, "dir", filepath.Join(home, "Sendmyzip"), "drop directory to watch")
+	fs.DurationVar(&c.Interval, "interval", 2*time.Second, "how often the drop directory is scanned")
+	fs.StringVar(&c.Passphrase, "passphrase", os.Getenv("SENDMYZIP_PASSPHRASE"), "passphrase receivers must enter (defaults to $SENDMYZIP_PASSPHRASE)")
+	fs.BoolVar(&c.RequireApproval, "require-approval", false, "hold receivers until they are approved (they can't be from the daemon, so only useful with a linked device)")
+	fs.StringVar(&c.NotifyCommand, "notify-command", "", "command run with the file name and link as arguments for every new session, e.g. notify-send")
+	fs.StringVar(&c.Room, "room", "", "room to announce every session in")
+	fs.StringVar(&c.RoomKey, "room-key", os.Getenv("SENDMYZIP_ROOM_KEY"), "key for -room; the first publisher claims the room with it (defaults to $SENDMYZIP_ROOM_KEY)")
+	fs.Parse(args)
+
+	c.Server = strings.TrimRight(c.Server, "/")
+	return c
+}
+
+// pendingFile is a file seen in the drop directory. It is sent once its
+// size has stopped changing between two scans.
+type pendingFile struct {
+	size    int64
+	modTime time.Time
+}
+
+func runDaemon(args []string) {
+	c := parseDaemonFlags(args)
+	sentDir := filepath.Join(c.Dir, "sent")
+	if err := os.MkdirAll(sentDir, 0o700); err != nil {
+		log.Fatal("Could not create drop directory", "dir", c.Dir, "err", err)
+	}
+
+	log.Info("Watching drop directory", "dir", c.Dir, "server", c.Server)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	pending := make(map[string]pendingFile)
+	skipped := make(map[string]pendingFile) // too large or failed, until they change
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-signals:
+			return
+		case <-ticker.C:
+		}
+
+		entries, err := os.ReadDir(c.Dir)
+		if err != nil {
+			log.Error("Could not read drop directory", "err", err)
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			name := entry.Name()
+			seen[name] = true
+			current := pendingFile{size: info.Size(), modTime: info.ModTime()}
+			if skipped[name] == current {
+				continue
+			}
+			if pending[name] != current {
+				pending[name] = current
+				continue
+			}
+
+			delete(pending, name)
+			path := filepath.Join(c.Dir, name)
+			if err := daemonSend(c, path, current.size); err != nil {
+				log.Error("Could not send file", "file", name, "err", err)
+				skipped[name] = current
+				continue
+			}
+			if err := os.Rename(path, filepath.Join(sentDir, name)); err != nil {
+				log.Error("Could not move sent file", "file", name, "err", err)
+				skipped[name] = current
+			}
+		}
+		for name := range pending {
+			if !seen[name] {
+				delete(pending, name)
+			}
+		}
+		for name := range skipped {
+			if !seen[name] {
+				delete(skipped, name)
+			}
+		}
+	}
+}
+
+type daemonCreated struct {
+	ID             string         `json:"id"`
+	InlineMaxBytes int64          `json:"inline_max_bytes"`
+	QuotaWarnings  []quotaWarning `json:"quota_warnings"`
+}
+
+// daemonSend creates a session for the file at path and leaves a goroutine
+// holding it open.
+func daemonSend(c daemonConfig, path string, size int64) error {
+	filetype := mime.TypeByExtension(filepath.Ext(path))
+	if filetype == "" {
+		filetype = "application/octet-stream"
+	}
+	query := url.Values{
+		"filename":     {filepath.Base(path)},
+		"filetype":     {filetype},
+		"filesize":     {strconv.FormatInt(size, 10)},
+		"capabilities": {transportInline},
+	}
+	if c.RequireApproval {
+		query.Set("require_approval", "true")
+	}
+	header := http.Header{}
+	if c.APIKey != "" {
+		header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	if c.Passphrase != "" {
+		header.Set("Sendmyzip-Passphrase", c.Passphrase)
+	}
+	if c.Room != "" {
+		query.Set("room", c.Room)
+		header.Set("Sendmyzip-Room-Key", c.RoomKey)
+	}
+
+	wsURL := strings.Replace(c.Server, "http", "ws", 1) + "/api/upload?" + query.Encode()
+	ws, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return err
+	}
+
+	var msg Message
+	if err := ws.ReadJSON(&msg); err != nil || msg.Type != "upload_created" {
+		ws.Close()
+		return errUnexpectedReply
+	}
+	var created daemonCreated
+	data, _ := json.Marshal(msg.Payload)
+	json.Unmarshal(data, &created)
+	for _, w := range created.QuotaWarnings {
+		log.Warn("Nearing the API key's daily quota", "quota", w.Quota, "used", w.Used, "limit", w.Limit, "resets_at", w.ResetsAt)
+	}
+
+	if size > created.InlineMaxBytes {
+		ws.WriteJSON(Message{Type: "close_session"})
+		ws.Close()
+		return errTooLargeForDaemon
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		ws.WriteJSON(Message{Type: "close_session"})
+		ws.Close()
+		return err
+	}
+	ws.WriteJSON(Message{Type: "inline_file", Payload: inlineFile{Data: contents}})
+
+	link := c.Server + "/?code=" + url.QueryEscape(created.ID)
+	log.Info("Session ready", "file", filepath.Base(path), "link", link)
+	if c.NotifyCommand != "" {
+		if err := exec.Command(c.NotifyCommand, filepath.Base(path), link).Start(); err != nil {
+			log.Error("Could not run notify command", "err", err)
+		}
+	}
+
+	// Stay connected as the host until the server ends the session
+	go func() {
+		defer ws.Close()
+		for {
+			var msg Message
+			if err := ws.ReadJSON(&msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case "error", "inline_rejected":
+				log.Warn("Server reported a problem", "file", filepath.Base(path), "type", msg.Type, "payload", msg.Payload)
+			case "quota_warning":
+				log.Warn("Nearing the API key's daily quota", "payload", msg.Payload)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build e2e
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/barealek/sendmyzip/internal/e2e"
+)
+
+// TestE2E runs the scenarios of internal/e2e against the test server:
+// headless WebRTC hosts and receivers that signal like the frontend and
+// send real files over data channels. CI runs
+//
+//	go test -tags e2e -run E2E .
+//
+// with -server-flags for the configurations it covers.
+func TestE2E(t *testing.T) {
+	baseURL := testServer(t)
+	for _, s := range e2e.Scenarios {
+		t.Run(s.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(t.Context(), e2e.ScenarioTimeout)
+			defer cancel()
+			if err := s.Run(ctx, baseURL); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
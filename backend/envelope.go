@@ -0,0 +1,45 @@
+package main
+
+import "errors"
+
+// Routing lives in the Message envelope, the same for every message type:
+// from and to name peers of a session, "host" or a receiver ID, and
+// session_id names the upload on sockets that run several (see mux.go).
+// The server stamps from on everything it reads, so no peer can speak for
+// another, and relays on to alone. Payloads hold only what the peers
+// exchange, which is what lets sealed signaling keep them opaque and what
+// any peer-to-peer route, receiver to receiver included, goes through.
+//
+// Clients from before the envelope, protocol version 3, put routing in
+// signaling payloads; compat.go moves it out.
+
+const hostPeer = "host"
+
+var (
+	errNoPeer       = errors.New("to must name the host or a receiver of this session")
+	errHostOnlyPeer = errors.New("receivers can only signal the host")
+)
+
+// address stamps msg as sent by from and fills in to where the client left
+// it out: receivers talk to the host unless they say otherwise.
+func address(msg Message, from string) Message {
+	msg.From = from
+	if msg.To == "" && from != hostPeer {
+		msg.To = hostPeer
+	}
+	return msg
+}
+
+// deliver sends msg to the peer named in its to. It returns the receiver
+// it went to, nil for the host.
+func deliver(upload *Upload, msg Message) (*Receiver, error) {
+	if msg.To == hostPeer {
+		sendToHost(upload, msg)
+		return nil, nil
+	}
+	receiver := upload.findReceiver(msg.To)
+	if receiver == nil || msg.To == msg.From || !isAdmitted(upload, receiver) {
+		return nil, errNoPeer
+	}
+	return receiver, receiver.send(msg)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddress(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		msg      Message
+		from, to string
+	}{
+		{"receiver to host", Message{}, "r1", hostPeer},
+		{"receiver to receiver", Message{To: "r2"}, "r1", "r2"},
+		{"host to receiver", Message{To: "r1"}, hostPeer, "r1"},
+		{"host without to", Message{}, hostPeer, ""},
+		{"forged from", Message{From: hostPeer}, "r1", hostPeer},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := address(tt.msg, tt.from)
+			if got.From != tt.from || got.To != tt.to {
+				t.Errorf("from %q to %q, want from %q to %q", got.From, got.To, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+// bufferedUpload is a session whose host and receivers queue what they are
+// sent instead of writing to sockets.
+func bufferedUpload(admitted, pending []string) *Upload {
+	upload := &Upload{ID: "test", hostDetached: true}
+	for _, id := range admitted {
+		upload.Receivers = append(upload.Receivers, &Receiver{ID: id, away: true})
+	}
+	for _, id := range pending {
+		upload.pending = append(upload.pending, &Receiver{ID: id, away: true})
+	}
+	return upload
+}
+
+func TestDeliver(t *testing.T) {
+	upload := bufferedUpload([]string{"r1", "r2"}, []string{"p1"})
+
+	msg := address(Message{Type: "webrtc_answer"}, "r1")
+	if receiver, err := deliver(upload, msg); receiver != nil || err != nil {
+		t.Fatalf("to the host: got %v, %v", receiver, err)
+	}
+	if len(upload.hostOutbox) != 1 || upload.hostOutbox[0].From != "r1" {
+		t.Errorf("host got %+v", upload.hostOutbox)
+	}
+
+	msg = address(Message{Type: "webrtc_offer", To: "r2"}, "r1")
+	receiver, err := deliver(upload, msg)
+	if err != nil || receiver == nil || receiver.ID != "r2" {
+		t.Fatalf("to a receiver: got %v, %v", receiver, err)
+	}
+	if len(receiver.outbox) != 1 || receiver.outbox[0].From != "r1" {
+		t.Errorf("r2 got %+v", receiver.outbox)
+	}
+
+	for _, to := range []string{"p1", "r1", "unknown"} {
+		msg := address(Message{Type: "webrtc_offer", To: to}, "r1")
+		if _, err := deliver(upload, msg); !errors.Is(err, errNoPeer) {
+			t.Errorf("to %s: got %v, want errNoPeer", to, err)
+		}
+	}
+	if pending := upload.pending[0]; len(pending.outbox) != 0 {
+		t.Errorf("pending receiver got %+v", pending.outbox)
+	}
+}
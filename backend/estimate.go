@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/charmbracelet/log"
+)
+
+// When a transport plan goes through TURN or the server, the plan carries
+// an estimate of what that will take before any of it is spent: the bytes
+// the receiver is to get, the bandwidth the pair's last probe measured
+// (see bandwidth.go) and the time that works out to, and, where
+// -ip-bytes-per-day meters the relays, how much of the host's daily budget
+// is used and whether the transfer fits the rest (see ipquota.go).
+//
+// A host that lists relay_confirm in its hello capabilities is asked
+// before such a transport starts. Both sides get the plan with
+// confirm_required, and nothing is relayed until the host answers:
+//
+//	relay_confirm {"receiver_id": "...", "accept": true}
+//
+// Accepting starts the transport and sends both sides transport_confirmed.
+// Declining rules the transport out for the pair as if it had failed, and
+// both get the next plan.
+
+const featureRelayConfirm = "relay_confirm"
+
+type transportEstimate struct {
+	Bytes          int64 `json:"bytes"`
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"` // from the last probe, unknown without one
+	Seconds        int64 `json:"seconds,omitempty"`
+
+	// Set where relays are metered
+	BudgetLimit   int64 `json:"budget_limit,omitempty"`
+	BudgetUsed    int64 `json:"budget_used,omitempty"`
+	ExceedsBudget bool  `json:"exceeds_budget,omitempty"`
+}
+
+type relayConfirm struct {
+	ReceiverID string `json:"receiver_id"`
+	Accept     bool   `json:"accept"`
+}
+
+// costsServer reports whether transport runs over the server's or the
+// TURN server's bandwidth.
+func costsServer(transport string) bool {
+	return transport == transportTURN || transport == transportRelay || transport == transportHTTP
+}
+
+// estimateTransport works out the estimate for a plan picking transport.
+// Caller holds upload.mutex.
+func estimateTransport(upload *Upload, receiver *Receiver, transport string) *transportEstimate {
+	est := &transportEstimate{Bytes: receiverTotal(upload, receiver), BytesPerSecond: receiver.bandwidth}
+	if est.BytesPerSecond > 0 {
+		est.Seconds = int64(math.Ceil(float64(est.Bytes) / float64(est.BytesPerSecond)))
+	}
+	if cfg.IPBytesPerDay > 0 && transport != transportTURN {
+		est.BudgetLimit = cfg.IPBytesPerDay
+		est.BudgetUsed = ipBytesUsed(upload.Host.clientIP())
+		est.ExceedsBudget = est.BudgetUsed+est.Bytes > est.BudgetLimit
+	}
+	return est
+}
+
+// handleRelayConfirm starts or rules out the transport a plan asked the
+// host to confirm.
+func handleRelayConfirm(upload *Upload, msg Message) {
+	var req relayConfirm
+	if err := decodePayload(msg, &req); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+	receiver := upload.findReceiver(req.ReceiverID)
+	if receiver == nil {
+		sendToHost(upload, invalidPayload(msg, errNoPeer))
+		return
+	}
+
+	upload.mutex.Lock()
+	transport := receiver.unconfirmed
+	receiver.unconfirmed = ""
+	if transport != "" && !req.Accept {
+		receiver.failedTransports = append(receiver.failedTransports, transport)
+	}
+	upload.mutex.Unlock()
+	if transport == "" {
+		sendToHost(upload, invalidPayload(msg, errors.New("no transport is waiting for confirmation for that receiver")))
+		return
+	}
+
+	if !req.Accept {
+		log.Info("Host declined relayed transport", "id", upload.ID, "receiver", receiver.ID, "transport", transport)
+		recordEvent(upload, "relay_declined", map[string]any{"receiver_id": receiver.ID, "transport": transport})
+		sendTransportPlan(upload, receiver)
+		return
+	}
+	confirmed := Message{Type: "transport_confirmed", Payload: map[string]string{"receiver_id": receiver.ID, "transport": transport}}
+	receiver.send(confirmed)
+	sendToHost(upload, confirmed)
+	startTransport(upload, receiver, transport, chunkSize(upload.hostConn(), receiver.currentConn()))
+}
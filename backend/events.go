@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Session lifecycle events are appended to a stream in the store, each
+// with a sequence number that never repeats. GET /api/events?cursor=<n>
+// returns what came after n together with the cursor to ask with next, so
+// a consumer that saves the cursor after handling a page sees every event
+// exactly once, even across its own or the server's downtime. Webhooks
+// push the same moments; the stream is for catching up.
+//
+// The stream is scoped per tenant: an API key only sees sessions it
+// published, the admin token sees everything.
+
+const (
+	defaultEventPage = 100
+	maxEventPage     = 1000
+)
+
+// allTenants lists events regardless of which tenant they belong to.
+const allTenants = "*"
+
+type Event struct {
+	Seq       uint64         `json:"seq"`
+	Tenant    string         `json:"tenant,omitempty"` // API key ID, empty for sessions from the web UI
+	Type      string         `json:"type"`
+	SessionID string         `json:"session_id"`
+	Time      time.Time      `json:"time"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+type eventPage struct {
+	Events     []Event `json:"events"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+// recordEvent appends an event about upload to the stream.
+func recordEvent(upload *Upload, typ string, data map[string]any) {
+	ev := Event{
+		Tenant:    upload.tenant,
+		Type:      typ,
+		SessionID: upload.ID,
+		Time:      time.Now(),
+		Data:      data,
+	}
+	if err := store.AppendEvent(context.Background(), &ev); err != nil {
+		log.Error("Could not record event", "id", upload.ID, "type", typ, "err", err)
+	}
+	notifyEventWebhooks(ev)
+	notifyChat(upload, ev)
+}
+
+type tenantKey struct{}
+
+// tenantFrom returns the tenant the request was authenticated as, see
+// requireAPIKey. It reports false for requests without an API key,
+// including ones made with the -admin-token.
+func tenantFrom(r *http.Request) (string, bool) {
+	if key, ok := apiKeyFrom(r); ok {
+		return key.ID, true
+	}
+	return "", false
+}
+
+// listingTenant returns the tenant whose records the request may list:
+// allTenants for the -admin-token, otherwise the API key's own.
+func listingTenant(r *http.Request) (string, bool) {
+	if hasAdminScope(r) {
+		return allTenants, true
+	}
+	return tenantFrom(r)
+}
+
+// apiKeyFrom returns the API key the request was authenticated with.
+func apiKeyFrom(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(tenantKey{}).(APIKey)
+	return key, ok
+}
+
+func handleListEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var after uint64
+	if s := query.Get("cursor"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid cursor")
+			return
+		}
+		after = n
+	}
+	limit := defaultEventPage
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid limit parameter")
+			return
+		}
+		limit = min(n, maxEventPage)
+	}
+
+	tenant, ok := listingTenant(r)
+	if !ok {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "")
+		return
+	}
+	events, err := store.ListEvents(r.Context(), tenant, after, limit)
+	if err != nil {
+		log.Error("Could not list events", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not list events")
+		return
+	}
+
+	page := eventPage{Events: events, NextCursor: strconv.FormatUint(after, 10)}
+	if len(events) > 0 {
+		page.NextCursor = strconv.FormatUint(events[len(events)-1].Seq, 10)
+	} else {
+		page.Events = []Event{}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// With -request-feedback, a receiver that reports transfer_complete is sent
+// a feedback_request. Its feedback (a rating and an optional comment) is
+// kept on its completion in the transfer summary, forwarded to the host,
+// and counted in the admin stats so operators see how transfers go in
+// practice.
+
+const (
+	maxFeedbackRating  = 5
+	maxFeedbackComment = 500 // characters
+)
+
+type transferFeedback struct {
+	Rating      int       `json:"rating"`
+	Comment     string    `json:"comment,omitempty"`
+	SubmittedAt time.Time `json:"submitted_at"`
+}
+
+type feedbackStats struct {
+	mutex   sync.Mutex
+	ratings [maxFeedbackRating]int64
+}
+
+var receiverFeedback feedbackStats
+
+type feedbackSummary struct {
+	Count         int64   `json:"count"`
+	AverageRating float64 `json:"average_rating"`
+	Ratings       []int64 `json:"ratings"` // how many gave 1, 2, ... stars
+}
+
+func (s *feedbackStats) observe(rating int) {
+	s.mutex.Lock()
+	s.ratings[rating-1]++
+	s.mutex.Unlock()
+}
+
+func (s *feedbackStats) summary() feedbackSummary {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	summary := feedbackSummary{Ratings: slices.Clone(s.ratings[:])}
+	var total int64
+	for i, n := range s.ratings {
+		summary.Count += n
+		total += int64(i+1) * n
+	}
+	if summary.Count > 0 {
+		summary.AverageRating = math.Round(float64(total)/float64(summary.Count)*100) / 100
+	}
+	return summary
+}
+
+// requestFeedback asks a receiver that just completed how it went.
+func requestFeedback(receiver *Receiver) {
+	if !cfg.RequestFeedback {
+		return
+	}
+	receiver.send(Message{Type: "feedback_request", Payload: map[string]int{
+		"max_rating":         maxFeedbackRating,
+		"max_comment_length": maxFeedbackComment,
+	}})
+}
+
+func handleFeedback(upload *Upload, receiver *Receiver, msg Message) {
+	var req struct {
+		Rating  int    `json:"rating"`
+		Comment string `json:"comment"`
+	}
+	err := decodePayload(msg, &req)
+	switch {
+	case err != nil:
+	case !cfg.RequestFeedback:
+		err = errors.New("feedback is not collected on this server")
+	case req.Rating < 1 || req.Rating > maxFeedbackRating:
+		err = errors.New("rating must be between 1 and 5")
+	case utf8.RuneCountInString(req.Comment) > maxFeedbackComment:
+		err = errors.New("comment is too long")
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	feedback := &transferFeedback{
+		Rating:      req.Rating,
+		Comment:     strings.TrimSpace(strings.ToValidUTF8(req.Comment, "")),
+		SubmittedAt: time.Now(),
+	}
+
+	upload.mutex.Lock()
+	i := slices.IndexFunc(upload.completions, func(c completion) bool { return c.ReceiverID == receiver.ID })
+	switch {
+	case i < 0:
+		err = errors.New("feedback follows transfer_complete")
+	case upload.completions[i].Feedback != nil:
+		err = errors.New("feedback was already given")
+	default:
+		upload.completions[i].Feedback = feedback
+	}
+	summary := summarizeTransfers(upload)
+	upload.mutex.Unlock()
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	receiverFeedback.observe(feedback.Rating)
+	recordEvent(upload, "feedback_received", map[string]any{"receiver_id": receiver.ID, "rating": feedback.Rating})
+	sendToHost(upload, Message{Type: "transfer_feedback", Payload: map[string]any{
+		"receiver_id":  receiver.ID,
+		"name":         receiver.Name,
+		"rating":       feedback.Rating,
+		"comment":      feedback.Comment,
+		"submitted_at": feedback.SubmittedAt,
+	}})
+	sendToHost(upload, Message{Type: "transfer_summary", Payload: summary})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// In pull mode a receiver asks for the files it wants instead of taking
+// whatever the host offers. It sends file_request naming a path from the
+// manifest; the host approves or denies with file_request_response. The
+// server keeps every request so receivers_update can show the host who
+// asked for what.
+
+// maxFileRequests caps the requests a receiver may have waiting.
+const maxFileRequests = 100
+
+const (
+	fileRequestPending  = "pending"
+	fileRequestApproved = "approved"
+	fileRequestDenied   = "denied"
+)
+
+type fileRequest struct {
+	ID          string    `json:"request_id"`
+	ReceiverID  string    `json:"receiver_id"`
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+type fileRequestResponse struct {
+	RequestID string `json:"request_id"`
+	Approve   bool   `json:"approve"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// requestablePath reports whether path names a file of the session. Single
+// file sessions are addressed by their filename.
+func requestablePath(meta Metadata, path string) bool {
+	if len(meta.Files) == 0 {
+		return meta.Kind == "" && path == meta.FileName
+	}
+	return slices.ContainsFunc(meta.Files, func(f ManifestFile) bool {
+		return f.Kind != entryDirectory && manifestPath(f) == path
+	})
+}
+
+func handleFileRequest(upload *Upload, receiver *Receiver, msg Message) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := decodePayload(msg, &req); err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	upload.mutex.Lock()
+	if !requestablePath(upload.Meta, req.Path) {
+		upload.mutex.Unlock()
+		receiver.send(invalidPayload(msg, errors.New("path must name a file of the session")))
+		return
+	}
+	// Asking again for a file that is waiting or approved is a no-op
+	i := slices.IndexFunc(upload.fileRequests, func(r *fileRequest) bool {
+		return r.ReceiverID == receiver.ID && r.Path == req.Path && r.Status != fileRequestDenied
+	})
+	if i >= 0 {
+		existing := *upload.fileRequests[i]
+		upload.mutex.Unlock()
+		receiver.send(Message{Type: "file_request_pending", Payload: existing})
+		return
+	}
+	waiting := 0
+	for _, r := range upload.fileRequests {
+		if r.ReceiverID == receiver.ID && r.Status == fileRequestPending {
+			waiting++
+		}
+	}
+	if waiting >= maxFileRequests {
+		upload.mutex.Unlock()
+		receiver.send(invalidPayload(msg, errors.New("too many requests are waiting for the host")))
+		return
+	}
+	request := &fileRequest{
+		ID:          generateReceiverID(),
+		ReceiverID:  receiver.ID,
+		Name:        receiver.Name,
+		Path:        req.Path,
+		Status:      fileRequestPending,
+		RequestedAt: time.Now(),
+	}
+	upload.fileRequests = append(upload.fileRequests, request)
+	snapshot := *request
+	upload.mutex.Unlock()
+
+	receiver.send(Message{Type: "file_request_pending", Payload: snapshot})
+	sendToHost(upload, Message{Type: "file_request", Payload: snapshot})
+	sendReceiversUpdate(upload)
+}
+
+func handleFileRequestResponse(upload *Upload, msg Message) {
+	var resp fileRequestResponse
+	if err := decodePayload(msg, &resp); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+	if len(resp.Reason) > maxNotesLength {
+		sendToHost(upload, invalidPayload(msg, errors.New("reason is too long")))
+		return
+	}
+
+	upload.mutex.Lock()
+	i := slices.IndexFunc(upload.fileRequests, func(r *fileRequest) bool { return r.ID == resp.RequestID })
+	if i < 0 || upload.fileRequests[i].Status != fileRequestPending {
+		upload.mutex.Unlock()
+		sendToHost(upload, invalidPayload(msg, errors.New("no pending request with that ID")))
+		return
+	}
+	request := upload.fileRequests[i]
+	request.Status = fileRequestDenied
+	if resp.Approve {
+		request.Status = fileRequestApproved
+	}
+	request.Reason = resp.Reason
+	snapshot := *request
+	upload.mutex.Unlock()
+
+	if receiver := upload.findReceiver(snapshot.ReceiverID); receiver != nil {
+		receiver.send(Message{Type: "file_request_answered", Payload: snapshot})
+	}
+	sendReceiversUpdate(upload)
+}
+
+// receiverFileRequests lists the requests of one receiver. The caller holds
+// upload.mutex.
+func receiverFileRequests(upload *Upload, receiverID string) []fileRequest {
+	var list []fileRequest
+	for _, r := range upload.fileRequests {
+		if r.ReceiverID == receiverID {
+			list = append(list, *r)
+		}
+	}
+	return list
+}
+
+// dropFileRequests forgets the requests of a receiver that left.
+func dropFileRequests(upload *Upload, receiverID string) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	upload.fileRequests = slices.DeleteFunc(upload.fileRequests, func(r *fileRequest) bool { return r.ReceiverID == receiverID })
+}
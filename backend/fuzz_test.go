@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The fuzz targets throw frames at the read loops of a fresh session: the
+// host's, an admitted receiver's, and that of a receiver that hasn't asked
+// to join yet. Each input is a frame, whether it goes as a binary frame,
+// and whether the socket declared low-power mode, which changes how the
+// server queues messages to it. After the frame the server has to
+//
+//   - keep answering: a probe with a type of its own is answered with
+//     unknown_type within fuzzProbeTimeout
+//   - answer what it can't take, frames that aren't a JSON message of a
+//     type the socket handles, with an error message or a close frame
+//   - put a code and a message in every error message
+//   - end sockets with a close frame, not a dropped connection
+//
+// A panic takes the test binary down with its stack, or, where net/http
+// recovers it, drops the connection without a close frame; both fail the
+// input. The seeds run with every go test; to look further,
+//
+//	go test -run '^$' -fuzz FuzzReceiverFrames .
+//
+// one target at a time, which keeps what it finds in testdata/fuzz.
+
+const fuzzProbeTimeout = 5 * time.Second
+
+var (
+	fuzzHostTypes = []string{
+		"hello", "get_receivers", "create_upload", "close_session", "approve_receiver",
+		"reject_receiver", "kick_receiver", "ban_receiver", "unban_receiver", "ice_outcome",
+		"webrtc_failed", "relay_end", "bandwidth_probe", "relay_confirm", "inline_file", "register_offers", "set_notes",
+		"update_metadata", "network_changed", "chat_message", "broadcast", "snippet",
+		"reverse_offer_response", "file_request_response", "create_continuation", "create_pin", "restore_session",
+		"webrtc_offer", "webrtc_answer", "webrtc_ice_candidate",
+	}
+	fuzzReceiverTypes = []string{
+		"hello", "transfer_progress", "ice_outcome", "webrtc_failed", "relay_ack", "relay_end",
+		"bandwidth_probe", "bandwidth_probe_result",
+		"capacity_report", "transfer_complete", "feedback", "checksum_result", "network_changed",
+		"chat_message", "reverse_offer", "file_request", "request_files", "webrtc_offer", "webrtc_answer",
+		"webrtc_ice_candidate",
+	}
+	fuzzJoinTypes = []string{"hello", "join_request"}
+)
+
+func FuzzHostFrames(f *testing.F) {
+	seedFrames(f, fuzzHostTypes)
+	f.Fuzz(func(t *testing.T, lowPower, binary bool, frame []byte) {
+		host, _ := openFuzzHost(t, lowPower)
+		checkFrame(t, host, nil, fuzzHostTypes, binary, frame)
+	})
+}
+
+func FuzzReceiverFrames(f *testing.F) {
+	seedFrames(f, fuzzReceiverTypes)
+	f.Fuzz(func(t *testing.T, lowPower, binary bool, frame []byte) {
+		host, id := openFuzzHost(t, false)
+		receiver := dialTest(t, "/api/join/"+url.PathEscape(id))
+		receiver.send(Message{Type: "hello", Payload: fuzzHello(lowPower)})
+		receiver.send(Message{Type: "join_request", Payload: map[string]string{"name": "fuzz"}})
+		receiver.await("file_metadata", nil)
+		checkFrame(t, receiver, host, fuzzReceiverTypes, binary, frame)
+	})
+}
+
+func FuzzJoinFrames(f *testing.F) {
+	seedFrames(f, fuzzJoinTypes)
+	f.Fuzz(func(t *testing.T, lowPower, binary bool, frame []byte) {
+		host, id := openFuzzHost(t, false)
+		joining := dialTest(t, "/api/join/"+url.PathEscape(id))
+		if lowPower {
+			joining.send(Message{Type: "hello", Payload: fuzzHello(true)})
+		}
+		checkFrame(t, joining, host, fuzzJoinTypes, binary, frame)
+	})
+}
+
+func fuzzHello(lowPower bool) clientHello {
+	if lowPower {
+		return clientHello{Version: protocolMaxVersion, Capabilities: []string{"low_power"}}
+	}
+	return clientHello{Version: protocolMaxVersion}
+}
+
+func openFuzzHost(t *testing.T, lowPower bool) (*testConn, string) {
+	host := dialTest(t, "/api/upload?filename=fuzz.bin&filetype=application%2Foctet-stream&filesize=1024")
+	host.send(Message{Type: "hello", Payload: fuzzHello(lowPower)})
+	var created struct {
+		ID string `json:"id"`
+	}
+	host.await("upload_created", &created)
+	return host, created.ID
+}
+
+// seedFrames adds well-formed messages of each of types, with and without
+// made-up payloads and routing, and frames no socket takes.
+func seedFrames(f *testing.F, types []string) {
+	payloads := []string{
+		`{}`,
+		`{"receiver_id": "nobody", "bytes": -1, "reason": "", "name": "\u0000‮", "files": [{}], "version": 1e308}`,
+		`{"offer": {"type": "offer", "sdp": "v=0"}, "candidate": {"candidate": ""}, "stream_id": 9223372036854775807}`,
+		`[]`,
+		`"text"`,
+		`null`,
+	}
+	for _, typ := range types {
+		for i, payload := range payloads {
+			frame := fmt.Sprintf(`{"type": %q, "payload": %s}`, typ, payload)
+			f.Add(i%2 == 1, false, []byte(frame))
+		}
+		f.Add(false, false, fmt.Appendf(nil, `{"type": %q, "to": "nobody", "from": "host", "session_id": "x", "payload": {}}`, typ))
+		f.Add(false, false, fmt.Appendf(nil, `{"type": %q, "payload": {"receiver_id": 1}`, typ))
+	}
+	for _, frame := range []string{
+		`{"type": "no_such_type", "payload": {}}`,
+		`{"type": 3}`,
+		`{"payload": {}}`,
+		`{"type": "hello", "trace": {"traceparent": "00-bad"}}`,
+		`{"type": "hel`,
+		`[]`,
+		``,
+		"\xff\xfe\x00{",
+	} {
+		f.Add(false, false, []byte(frame))
+	}
+	f.Add(false, true, []byte(`{"type": "hello"}`))
+	// Past the read limit, which the server answers with a close
+	f.Add(false, false, []byte(`{"type": "chat_message", "payload": {"text": "`+strings.Repeat("x", 70<<10)+`"}}`))
+}
+
+// mustAnswer reports whether the server has to reject frame on a socket
+// handling types: it isn't a message the server can decode, or its type
+// isn't one of them.
+func mustAnswer(binary bool, frame []byte, types []string) bool {
+	if binary {
+		return true
+	}
+	var envelope struct {
+		Type      string            `json:"type"`
+		Payload   any               `json:"payload"`
+		Trace     map[string]string `json:"trace"`
+		From      string            `json:"from"`
+		To        string            `json:"to"`
+		SessionID string            `json:"session_id"`
+	}
+	if err := json.Unmarshal(frame, &envelope); err != nil {
+		return true
+	}
+	return !slices.Contains(types, envelope.Type)
+}
+
+// checkFrame sends frame to c, which handles types, and holds the server
+// to the properties above. The host, when c isn't it, only has to keep
+// answering.
+func checkFrame(t *testing.T, c, host *testConn, types []string, binary bool, frame []byte) {
+	kind := websocket.TextMessage
+	if binary {
+		kind = websocket.BinaryMessage
+	}
+	if err := c.ws.WriteMessage(kind, frame); err != nil {
+		t.Fatalf("sending the frame: %v", err)
+	}
+	answered, err := probe(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustAnswer(binary, frame, types) && !answered {
+		t.Fatal("no error before the probe was answered")
+	}
+	if host != nil {
+		if _, err := probe(host); err != nil {
+			t.Fatalf("host: %v", err)
+		}
+	}
+}
+
+// probe sends c a message of a type the server doesn't know and reads up to
+// its answer. It reports whether an error or close came first.
+func probe(c *testConn) (bool, error) {
+	// The frame may have closed the socket already; reading tells how
+	c.ws.WriteJSON(Message{Type: "fuzz_probe"})
+	c.ws.SetReadDeadline(time.Now().Add(fuzzProbeTimeout))
+	answered := false
+	for {
+		var msg struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := c.ws.ReadJSON(&msg); err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return true, nil
+			}
+			var netErr interface{ Timeout() bool }
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, fmt.Errorf("probe not answered within %s", fuzzProbeTimeout)
+			}
+			return false, fmt.Errorf("socket ended without a close frame: %w", err)
+		}
+		if msg.Type != "error" {
+			continue
+		}
+		var e wsError
+		if err := json.Unmarshal(msg.Payload, &e); err != nil {
+			return false, fmt.Errorf("malformed error message %s: %w", msg.Payload, err)
+		}
+		if e.Code == "" || e.Message == "" {
+			return false, fmt.Errorf("error message without code or message: %s", msg.Payload)
+		}
+		if e.Type == "fuzz_probe" {
+			return answered, nil
+		}
+		answered = true
+	}
+}
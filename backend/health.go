@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	startedAt = time.Now()
+	draining  atomic.Bool // set once shutdown has begun
+)
+
+type healthStatus struct {
+	Status         string  `json:"status"`
+	UptimeSeconds  float64 `json:"uptime_seconds"`
+	ActiveSessions int     `json:"active_sessions"`
+	Draining       bool    `json:"draining"`
+}
+
+func currentHealth() healthStatus {
+	uploadsMutex.RLock()
+	active := len(uploads)
+	uploadsMutex.RUnlock()
+
+	return healthStatus{
+		Status:         "ok",
+		UptimeSeconds:  time.Since(startedAt).Seconds(),
+		ActiveSessions: active,
+		Draining:       draining.Load(),
+	}
+}
+
+// handleHealthz is the liveness probe: the process is up and serving.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, currentHealth())
+}
+
+// handleReadyz is the readiness probe: it fails while draining so load
+// balancers stop sending new sessions before the process exits.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := currentHealth()
+	code := http.StatusOK
+	if status.Draining {
+		status.Status = "draining"
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, status)
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
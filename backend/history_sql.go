@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// sqlHistoryStore keeps the transfer history in SQLite or Postgres, one
+// row per session. Times are stored as unix milliseconds so the two agree
+// on the schema.
+type sqlHistoryStore struct {
+	db     *sql.DB
+	driver string
+}
+
+const historySchema = `CREATE TABLE IF NOT EXISTS transfer_history (
+	id                  TEXT NOT NULL,
+	tenant              TEXT NOT NULL DEFAULT '',
+	filename            TEXT NOT NULL,
+	filetype            TEXT NOT NULL,
+	filesize            BIGINT NOT NULL,
+	receiver_count      INTEGER NOT NULL,
+	completed_count     INTEGER NOT NULL,
+	average_duration_ms BIGINT NOT NULL,
+	status              TEXT NOT NULL,
+	notes               TEXT NOT NULL DEFAULT '',
+	created_at          BIGINT NOT NULL,
+	ended_at            BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transfer_history_ended ON transfer_history (tenant, ended_at)`
+
+func openSQLHistoryStore(driver, dsn string) (*sqlHistoryStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite" {
+		// One writer at a time, which is all the history needs
+		db.SetMaxOpenConns(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, stmt := range strings.Split(historySchema, ";\n") {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqlHistoryStore{db: db, driver: driver}, nil
+}
+
+// rebind turns the ? placeholders of query into Postgres' $n.
+func (s *sqlHistoryStore) rebind(query string) string {
+	if s.driver != "pgx" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlHistoryStore) RecordSession(ctx context.Context, rec SessionRecord) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO transfer_history
+		(id, tenant, filename, filetype, filesize, receiver_count, completed_count, average_duration_ms, status, notes, created_at, ended_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		rec.ID, rec.Tenant, rec.FileName, rec.FileType, rec.FileSize, rec.ReceiverCount, rec.CompletedCount,
+		rec.AverageDurationMs, rec.Status, rec.Notes, rec.CreatedAt.UnixMilli(), rec.EndedAt.UnixMilli())
+	return err
+}
+
+func (s *sqlHistoryStore) ListSessions(ctx context.Context, tenant string, before time.Time, limit int) ([]SessionRecord, error) {
+	query := `SELECT id, tenant, filename, filetype, filesize, receiver_count, completed_count, average_duration_ms, status, notes, created_at, ended_at
+		FROM transfer_history WHERE 1 = 1`
+	var args []any
+	if tenant != allTenants {
+		query += ` AND tenant = ?`
+		args = append(args, tenant)
+	}
+	if !before.IsZero() {
+		query += ` AND ended_at < ?`
+		args = append(args, before.UnixMilli())
+	}
+	query += ` ORDER BY ended_at DESC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SessionRecord
+	for rows.Next() {
+		var rec SessionRecord
+		var created, ended int64
+		if err := rows.Scan(&rec.ID, &rec.Tenant, &rec.FileName, &rec.FileType, &rec.FileSize, &rec.ReceiverCount,
+			&rec.CompletedCount, &rec.AverageDurationMs, &rec.Status, &rec.Notes, &created, &ended); err != nil {
+			return nil, err
+		}
+		rec.CreatedAt, rec.EndedAt = time.UnixMilli(created), time.UnixMilli(ended)
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlHistoryStore) Close() error {
+	return s.db.Close()
+}
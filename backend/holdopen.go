@@ -0,0 +1,138 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Hold-open sessions let a host without a screen (a script, a CLI) do all
+// of its signaling up front. The host registers one complete offer per
+// expected receiver with register_offers and may then disconnect: each
+// receiver that joins is handed the next stored offer, and the answers and
+// candidates meant for the host are kept until it reattaches with its
+// Idempotency-Key. The session ends once every offer is used and all
+// receivers have left, or after -hold-open-ttl.
+
+type heldOffer struct {
+	Index int `json:"offer_index"`
+	Offer any `json:"offer"`
+}
+
+type registerOffersRequest struct {
+	Offers []any `json:"offers"`
+}
+
+func handleRegisterOffers(upload *Upload, msg Message) {
+	var req registerOffersRequest
+	if err := decodePayload(msg, &req); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	upload.mutex.Lock()
+	for _, offer := range req.Offers {
+		upload.heldOffers = append(upload.heldOffers, heldOffer{Index: upload.offersRegistered, Offer: offer})
+		upload.offersRegistered++
+	}
+	remaining := len(upload.heldOffers)
+	upload.mutex.Unlock()
+
+	sendToHost(upload, Message{Type: "offers_registered", Payload: map[string]int{"remaining": remaining}})
+}
+
+// sendHeldOffer gives a newly admitted receiver the next stored offer, if
+// the host registered any.
+func sendHeldOffer(upload *Upload, receiver *Receiver) {
+	upload.mutex.Lock()
+	if len(upload.heldOffers) == 0 {
+		upload.mutex.Unlock()
+		return
+	}
+	offer := upload.heldOffers[0]
+	upload.heldOffers = upload.heldOffers[1:]
+	receiver.offerIndex = offer.Index
+	receiver.presignaled = true
+	upload.mutex.Unlock()
+
+	receiver.send(Message{
+		Type: "webrtc_offer",
+		Payload: map[string]any{
+			"offer":       offer.Offer,
+			"offer_index": offer.Index,
+		},
+		From: hostPeer,
+		To:   receiver.ID,
+	})
+	receiverServed(upload, receiver)
+}
+
+// holdsOpen reports whether the session should outlive its host socket.
+func (u *Upload) holdsOpen() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.offersRegistered > 0 && u.closedAt.IsZero() && (len(u.heldOffers) > 0 || len(u.Receivers) > 0)
+}
+
+// detachHost keeps the session running without its host for up to ttl.
+func detachHost(upload *Upload, ttl time.Duration) {
+	upload.mutex.Lock()
+	upload.hostDetached = true
+	if upload.holdTimer == nil {
+		upload.holdTimer = time.AfterFunc(ttl, func() { finalizeUpload(upload) })
+	}
+	upload.mutex.Unlock()
+
+	log.Info("Host detached, holding session open", "id", upload.ID, "for", ttl)
+}
+
+// attachHost ends a detachment and delivers what the host missed.
+func attachHost(upload *Upload) {
+	upload.mutex.Lock()
+	upload.hostDetached = false
+	if upload.holdTimer != nil {
+		upload.holdTimer.Stop()
+		upload.holdTimer = nil
+	}
+	outbox := upload.hostOutbox
+	upload.hostOutbox = nil
+	conn := upload.Host
+	upload.mutex.Unlock()
+
+	for _, msg := range outbox {
+		conn.WriteJSON(msg)
+	}
+}
+
+// sendToHost delivers msg to the host and any linked host devices. While
+// the primary host of a hold-open session is away its copy is queued.
+func sendToHost(upload *Upload, msg Message) {
+	upload.mutex.Lock()
+	var conn *wsConn
+	if upload.hostDetached {
+		upload.hostOutbox = append(upload.hostOutbox, msg)
+	} else {
+		conn = upload.Host
+	}
+	linked := slices.Clone(upload.linkedHosts)
+	upload.mutex.Unlock()
+
+	if conn != nil {
+		conn.WriteJSON(msg)
+	}
+	for _, c := range linked {
+		c.WriteJSON(msg)
+	}
+}
+
+// finishIfDrained ends a detached session once nothing is left to serve.
+func finishIfDrained(upload *Upload) {
+	upload.mutex.RLock()
+	done := upload.hostDetached && upload.offersRegistered > 0 && len(upload.heldOffers) == 0 && len(upload.Receivers) == 0
+	upload.mutex.RUnlock()
+
+	if done {
+		finalizeUpload(upload)
+	}
+}
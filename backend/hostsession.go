@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// A host that reloads its page opens /api/upload again and would get a
+// second session, leaving the first without a host and its receivers
+// stranded. To avoid that the client can send a random host_session key it
+// keeps for the tab. Opening /api/upload with a key that belongs to a live
+// session for the same file reattaches that session: the stale socket is
+// closed, the new one gets the session's ID and tokens back, and receivers
+// hear host_reconnected. The same key with a different file ends the old
+// session before the new one starts.
+
+const (
+	minHostSessionKey = 16
+	maxHostSessionKey = 128
+)
+
+var errHostSessionKey = errors.New("host_session must be 16-128 characters")
+
+var (
+	hostSessions      = make(map[string]*Upload) // SHA-256 of the key:upload
+	hostSessionsMutex sync.Mutex
+)
+
+// hostSessionKey returns the hashed host_session of r, or "" when the
+// client didn't send one.
+func hostSessionKey(r *http.Request) (string, error) {
+	key := r.Header.Get("Sendmyzip-Host-Session")
+	if key == "" {
+		key = r.URL.Query().Get("host_session")
+	}
+	if key == "" {
+		return "", nil
+	}
+	if len(key) < minHostSessionKey || len(key) > maxHostSessionKey {
+		return "", errHostSessionKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// claimHostSession returns the live session key belongs to if it is for
+// meta. A live session for other files is ended, as its host moved on.
+func claimHostSession(key string, meta Metadata) *Upload {
+	hostSessionsMutex.Lock()
+	upload, ok := hostSessions[key]
+	hostSessionsMutex.Unlock()
+	if !ok || upload.isClosed() {
+		return nil
+	}
+	if current, ok := lookupUpload(upload.ID); !ok || current != upload {
+		return nil
+	}
+
+	upload.mutex.RLock()
+	same := sameMetadata(upload.Meta, meta)
+	upload.mutex.RUnlock()
+	if same {
+		return upload
+	}
+
+	log.Info("Host started over with other files, ending its previous session", "id", upload.ID)
+	upload.mutex.RLock()
+	receivers := slices.Clone(upload.Receivers)
+	upload.mutex.RUnlock()
+	for _, receiver := range receivers {
+		receiver.send(Message{Type: "host_disconnected", Payload: map[string]string{"reason": "host_replaced"}})
+		receiver.close()
+	}
+	finalizeUpload(upload)
+	return nil
+}
+
+// bindHostSession makes key lead to upload.
+func bindHostSession(key string, upload *Upload) {
+	if key == "" {
+		return
+	}
+	upload.mutex.Lock()
+	upload.hostSession = key
+	upload.mutex.Unlock()
+
+	hostSessionsMutex.Lock()
+	hostSessions[key] = upload
+	hostSessionsMutex.Unlock()
+}
+
+// unbindHostSession forgets the key of a session that ended.
+func unbindHostSession(upload *Upload) {
+	upload.mutex.RLock()
+	key := upload.hostSession
+	upload.mutex.RUnlock()
+	if key == "" {
+		return
+	}
+
+	hostSessionsMutex.Lock()
+	defer hostSessionsMutex.Unlock()
+	if hostSessions[key] == upload {
+		delete(hostSessions, key)
+	}
+}
+
+// reattachHostSession hands upload to the reloaded host on conn.
+func reattachHostSession(upload *Upload, conn *wsConn) {
+	log.Info("Host reattached after a reload", "id", upload.ID)
+	reattachHost(upload, conn, map[string]any{
+		"id":               upload.ID,
+		"host_token":       upload.hostToken,
+		"resume_token":     upload.resumeToken,
+		"inline_max_bytes": cfg.InlineMaxBytes,
+		"reattached":       true,
+	})
+	broadcastToReceivers(upload, Message{Type: "host_reconnected", Payload: map[string]string{"id": upload.ID}})
+}
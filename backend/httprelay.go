@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// With -http-relay the last transport left is plain HTTP, for clients that
+// can't keep a WebSocket open for data either. When a transport_plan picks
+// http_relay both sides get http_relay_start over signaling, with the chunk
+// URL and a token of their own, and the file goes through the server one
+// chunk at a time:
+//
+//	PUT /api/relay/{id}/chunks/{n}  host, body up to chunk_size bytes
+//	GET /api/relay/{id}/chunks/{n}  receiver, waits up to httpRelayPollWait
+//
+// Tokens go in an "Authorization: Bearer" header. Chunks are kept until
+// the receiver has fetched them, or for -http-relay-ttl, whichever comes
+// first: in the spool when there is one, so a large -relay-window can live
+// in the blob store sealed with a key derived for the session, and
+// otherwise in memory. A relay holds at most
+// -relay-window bytes; a host that gets further ahead is answered 503 with
+// Retry-After and tries the chunk again. A GET for a chunk that hasn't come in by the end of the
+// wait is answered 404 and polled again. The relay ends with the receiver
+// or the session, announced with http_relay_end.
+
+// httpRelayPollWait is how long a GET waits for its chunk to be put.
+const httpRelayPollWait = 20 * time.Second
+
+type httpRelay struct {
+	id            string
+	upload        *Upload
+	receiver      *Receiver
+	hostToken     string
+	receiverToken string
+	chunkSize     int
+	ip            string // host address holding a relay slot, see ipquota.go
+
+	mutex    sync.Mutex
+	chunks   map[int]relayChunk
+	buffered int64
+	arrived  chan struct{} // closed and replaced whenever a chunk is put
+}
+
+type relayChunk struct {
+	data    []byte // nil when spooled
+	size    int64
+	spooled bool
+	at      time.Time
+}
+
+var httpRelays = struct {
+	mutex  sync.Mutex
+	relays map[string]*httpRelay
+}{relays: make(map[string]*httpRelay)}
+
+var (
+	httpRelayStarted atomic.Int64
+	httpRelayBytes   atomic.Int64
+)
+
+type httpRelayStart struct {
+	RelayID    string `json:"relay_id"`
+	ReceiverID string `json:"receiver_id"`
+	ChunkURL   string `json:"chunk_url"` // with {n} for the chunk number
+	Token      string `json:"token"`
+	ChunkSize  int    `json:"chunk_size"`
+	Window     int64  `json:"window"`
+	TTLMs      int64  `json:"ttl_ms"`
+}
+
+func httpRelaySummary() relayStats {
+	httpRelays.mutex.Lock()
+	active := len(httpRelays.relays)
+	httpRelays.mutex.Unlock()
+	return relayStats{Active: active, Started: httpRelayStarted.Load(), Bytes: httpRelayBytes.Load()}
+}
+
+// startHTTPRelay opens an HTTP relay for the pair unless one is already
+// open.
+func startHTTPRelay(upload *Upload, receiver *Receiver, chunkSize int) {
+	ip := upload.hostConn().clientIP()
+	httpRelays.mutex.Lock()
+	for _, hr := range httpRelays.relays {
+		if hr.receiver == receiver {
+			httpRelays.mutex.Unlock()
+			return
+		}
+	}
+	if !acquireRelaySlot(ip) {
+		httpRelays.mutex.Unlock()
+		sendToHost(upload, errorMessage(problemRelayLimit, "this address has as many relays going as it may", "http_relay_start"))
+		return
+	}
+	hr := &httpRelay{
+		id:            generateReceiverID() + generateReceiverID(),
+		upload:        upload,
+		receiver:      receiver,
+		hostToken:     generateReceiverID() + generateReceiverID(),
+		receiverToken: generateReceiverID() + generateReceiverID(),
+		chunkSize:     chunkSize,
+		ip:            ip,
+		chunks:        make(map[int]relayChunk),
+		arrived:       make(chan struct{}),
+	}
+	httpRelays.relays[hr.id] = hr
+	httpRelays.mutex.Unlock()
+	httpRelayStarted.Add(1)
+
+	log.Info("Relaying transfer over HTTP", "id", upload.ID, "receiver", receiver.ID)
+	recordEvent(upload, "http_relay_started", map[string]any{"receiver_id": receiver.ID})
+	start := httpRelayStart{
+		RelayID:    hr.id,
+		ReceiverID: receiver.ID,
+		ChunkURL:   upload.baseURL + "/api/relay/" + url.PathEscape(hr.id) + "/chunks/{n}",
+		ChunkSize:  chunkSize,
+		Window:     max(cfg.RelayWindow, int64(chunkSize)),
+		TTLMs:      cfg.HTTPRelayTTL.Milliseconds(),
+	}
+	start.Token = hr.receiverToken
+	receiver.send(Message{Type: "http_relay_start", Payload: start})
+	start.Token = hr.hostToken
+	sendToHost(upload, Message{Type: "http_relay_start", Payload: start})
+}
+
+// endHTTPRelays ends the relays of upload, or only receiver's when it is
+// set.
+func endHTTPRelays(upload *Upload, receiver *Receiver, reason string) {
+	var ended []*httpRelay
+	httpRelays.mutex.Lock()
+	for id, hr := range httpRelays.relays {
+		if hr.upload == upload && (receiver == nil || hr.receiver == receiver) {
+			ended = append(ended, hr)
+			delete(httpRelays.relays, id)
+		}
+	}
+	httpRelays.mutex.Unlock()
+
+	for _, hr := range ended {
+		releaseRelaySlot(hr.ip)
+		hr.mutex.Lock()
+		chunks := hr.chunks
+		hr.chunks, hr.buffered = nil, 0
+		close(hr.arrived) // wakes waiting GETs
+		hr.mutex.Unlock()
+		for n, chunk := range chunks {
+			hr.dropChunk(n, chunk)
+		}
+		msg := Message{Type: "http_relay_end", Payload: map[string]string{
+			"relay_id":    hr.id,
+			"receiver_id": hr.receiver.ID,
+			"reason":      reason,
+		}}
+		hr.receiver.send(msg)
+		sendToHost(hr.upload, msg)
+	}
+}
+
+// sweepHTTPRelays drops chunks nobody fetched within -http-relay-ttl.
+func sweepHTTPRelays() {
+	cutoff := time.Now().Add(-cfg.HTTPRelayTTL)
+	httpRelays.mutex.Lock()
+	list := make([]*httpRelay, 0, len(httpRelays.relays))
+	for _, hr := range httpRelays.relays {
+		list = append(list, hr)
+	}
+	httpRelays.mutex.Unlock()
+
+	for _, hr := range list {
+		expired := make(map[int]relayChunk)
+		hr.mutex.Lock()
+		for n, chunk := range hr.chunks {
+			if chunk.at.Before(cutoff) {
+				hr.buffered -= chunk.size
+				delete(hr.chunks, n)
+				expired[n] = chunk
+			}
+		}
+		hr.mutex.Unlock()
+		for n, chunk := range expired {
+			hr.dropChunk(n, chunk)
+		}
+	}
+}
+
+func (hr *httpRelay) chunkName(n int) string {
+	return "relay-" + hr.id + "-" + strconv.Itoa(n)
+}
+
+// blobKey seals spooled chunks with a key derived for the session.
+func (hr *httpRelay) blobKey() blobKey {
+	return blobKey{session: hr.upload.ID}
+}
+
+// dropChunk deletes a chunk nobody will fetch from the spool.
+func (hr *httpRelay) dropChunk(n int, chunk relayChunk) {
+	if chunk.spooled {
+		spool.Delete(hr.chunkName(n))
+	}
+}
+
+// readChunk returns the data of a chunk taken off the relay.
+func (hr *httpRelay) readChunk(n int, chunk relayChunk) ([]byte, error) {
+	if !chunk.spooled {
+		return chunk.data, nil
+	}
+	defer spool.Delete(hr.chunkName(n))
+	rc, err := spool.Open(hr.chunkName(n), hr.blobKey())
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func runHTTPRelaySweeper() {
+	for range time.Tick(cfg.HTTPRelayTTL / 2) {
+		sweepHTTPRelays()
+	}
+}
+
+// relayRequest finds the relay and chunk number of r and checks that it
+// carries token for the right side.
+func relayRequest(w http.ResponseWriter, r *http.Request, host bool) (*httpRelay, int, bool) {
+	vars := mux.Vars(r)
+	httpRelays.mutex.Lock()
+	hr := httpRelays.relays[vars["id"]]
+	httpRelays.mutex.Unlock()
+	if hr == nil {
+		writeProblem(w, http.StatusNotFound, problemRelayNotFound, "")
+		return nil, 0, false
+	}
+
+	token := hr.receiverToken
+	if host {
+		token = hr.hostToken
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid relay token")
+		return nil, 0, false
+	}
+
+	n, err := strconv.Atoi(vars["n"])
+	if err != nil || n < 0 {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Chunk numbers are integers from 0")
+		return nil, 0, false
+	}
+	return hr, n, true
+}
+
+func handlePutRelayChunk(w http.ResponseWriter, r *http.Request) {
+	hr, n, ok := relayRequest(w, r, true)
+	if !ok {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(hr.chunkSize)))
+	if err != nil {
+		writeProblem(w, http.StatusRequestEntityTooLarge, problemFileTooLarge, "Chunks can be up to chunk_size bytes")
+		return
+	}
+	if !chargeIP(clientIP(r), int64(len(data))) {
+		writeIPQuotaProblem(w)
+		return
+	}
+
+	chunk := relayChunk{data: data, size: int64(len(data)), at: time.Now()}
+	hr.mutex.Lock()
+	if hr.chunks == nil {
+		hr.mutex.Unlock()
+		writeProblem(w, http.StatusNotFound, problemRelayNotFound, "")
+		return
+	}
+	previous := hr.chunks[n].size // a retried put replaces the chunk
+	if hr.buffered-previous+chunk.size > max(cfg.RelayWindow, int64(hr.chunkSize)) {
+		hr.mutex.Unlock()
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, http.StatusServiceUnavailable, problemRelayFull, "")
+		return
+	}
+	delete(hr.chunks, n)
+	hr.buffered += chunk.size - previous
+	hr.mutex.Unlock()
+
+	if spool != nil {
+		err := spool.Put(hr.chunkName(n), bytes.NewReader(data), cfg.HTTPRelayTTL, hr.blobKey())
+		if err != nil {
+			hr.mutex.Lock()
+			if hr.chunks != nil {
+				hr.buffered -= chunk.size
+			}
+			hr.mutex.Unlock()
+			log.Error("Could not spool relay chunk", "relay", hr.id, "err", err)
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+			return
+		}
+		chunk.data, chunk.spooled = nil, true
+	}
+
+	hr.mutex.Lock()
+	if hr.chunks == nil { // the relay ended meanwhile
+		hr.mutex.Unlock()
+		hr.dropChunk(n, chunk)
+		writeProblem(w, http.StatusNotFound, problemRelayNotFound, "")
+		return
+	}
+	hr.chunks[n] = chunk
+	close(hr.arrived)
+	hr.arrived = make(chan struct{})
+	hr.mutex.Unlock()
+
+	hr.upload.touch()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetRelayChunk(w http.ResponseWriter, r *http.Request) {
+	hr, n, ok := relayRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	timeout := time.NewTimer(httpRelayPollWait)
+	defer timeout.Stop()
+	for {
+		hr.mutex.Lock()
+		chunk, found := hr.chunks[n]
+		if found {
+			delete(hr.chunks, n)
+			hr.buffered -= chunk.size
+		}
+		arrived := hr.arrived
+		gone := hr.chunks == nil
+		hr.mutex.Unlock()
+
+		switch {
+		case found:
+			data, err := hr.readChunk(n, chunk)
+			if err != nil {
+				log.Error("Could not read spooled relay chunk", "relay", hr.id, "err", err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+				return
+			}
+			httpRelayBytes.Add(chunk.size)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write(data)
+			return
+		case gone:
+			writeProblem(w, http.StatusNotFound, problemRelayNotFound, "")
+			return
+		}
+
+		select {
+		case <-arrived:
+		case <-timeout.C:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusNotFound, problemChunkNotReady, "")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
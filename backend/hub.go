@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+)
+
+// gorilla/websocket allows one concurrent writer per connection, but host
+// and receiver sockets are written from every goroutine that relays to
+// them. wsConn gives each socket an outbound queue drained by its own
+// writer goroutine, so writes can come from anywhere. Reads still belong
+// to the one goroutine handling the connection.
+//
+// Every socket is pinged every wsPingInterval and must show a sign of life
+// (a pong or any message) within wsPongWait, so a peer that vanished behind
+// a NAT timeout or a network switch fails its pending read instead of
+// leaving the handler blocked forever.
+
+const (
+	// wsSendQueue is how many messages may wait for a slow socket before
+	// it is dropped.
+	wsSendQueue = 256
+
+	wsWriteTimeout = 10 * time.Second
+
+	// wsReadLimit caps a single message from a client. Larger messages
+	// close the socket with 1009 (message too big). Inline files raise it,
+	// see readLimit.
+	wsReadLimit = 64 << 10
+
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = wsPongWait * 4 / 10
+)
+
+var (
+	errConnClosed = errors.New("connection closed")
+	errSendQueued = errors.New("send queue stayed full")
+)
+
+// wsSocket is what wsConn needs of a WebSocket. Besides a real one it can
+// be a receiver socket on another node, bridged over the message bus (see
+// bus.go).
+type wsSocket interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(kind int, data []byte) error
+	WriteJSON(v any) error
+	WriteControl(kind int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPongHandler(h func(string) error)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+type wsConn struct {
+	ws      wsSocket
+	out     chan any
+	closing chan struct{}
+	once    sync.Once
+
+	helloMutex sync.RWMutex
+	hello      clientHello // what the client declared, see protocol.go
+
+	relaxedUntil atomic.Int64 // unix nanos; deadlines are longer until then, see network.go
+
+	ip string // the client's address, see ipquota.go
+
+	// Low-power mode, see lowpower.go
+	lowPower   atomic.Bool
+	batchMutex sync.Mutex
+	batch      map[string]any
+	batchOrder []string
+
+	// Extra uploads run over the socket, see mux.go. A channel has a parent
+	// and no socket of its own.
+	channels connChannels
+	parent   *wsConn
+	channel  string
+}
+
+func newWSConn(ws wsSocket) *wsConn {
+	c := &wsConn{
+		ws:      ws,
+		out:     make(chan any, wsSendQueue),
+		closing: make(chan struct{}),
+	}
+	ws.SetReadLimit(readLimit())
+	c.extendReadDeadline()
+	ws.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+	go c.writeLoop()
+	return c
+}
+
+// upgrade turns the request into a WebSocket wrapped in a wsConn.
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	ws, err := upgrader.Upgrade(w, r, responseHeader(r))
+	if err != nil {
+		return nil, err
+	}
+	c := newWSConn(ws)
+	c.ip = clientIP(r)
+	return c, nil
+}
+
+// clientIP returns the address of the client on the socket, empty for none.
+func (c *wsConn) clientIP() string {
+	if c = c.root(); c == nil {
+		return ""
+	}
+	return c.ip
+}
+
+func (c *wsConn) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	flush := time.NewTicker(lowPowerBatchInterval)
+	defer flush.Stop()
+	defer c.ws.Close()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-ping.C:
+			if time.Since(lastPing) < c.pingInterval()-time.Second {
+				continue // low-power sockets skip most ticks
+			}
+			lastPing = time.Now()
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				c.Close()
+				return
+			}
+		case <-flush.C:
+			for _, v := range c.takeBatch() {
+				if err := c.write(v); err != nil {
+					c.Close()
+					return
+				}
+			}
+		case v := <-c.out:
+			if err := c.write(v); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.closing:
+			// Flush what was queued before Close, e.g. the reason for a kick
+			for {
+				select {
+				case v := <-c.out:
+					if c.write(v) != nil {
+						return
+					}
+				default:
+					c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+					c.discardInput()
+					return
+				}
+			}
+		}
+	}
+}
+
+// binaryFrame is queued as a binary message instead of JSON.
+type binaryFrame []byte
+
+func (c *wsConn) write(v any) error {
+	c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if frame, ok := v.(binaryFrame); ok {
+		return c.ws.WriteMessage(websocket.BinaryMessage, frame)
+	}
+	return c.ws.WriteJSON(v)
+}
+
+// WriteJSON queues v for the socket. It never blocks; a peer that falls
+// wsSendQueue messages behind is disconnected.
+func (c *wsConn) WriteJSON(v any) error {
+	select {
+	case <-c.closing:
+		return errConnClosed
+	default:
+	}
+	if c.parent != nil {
+		return c.parent.WriteJSON(tagUpload(v, c.channel))
+	}
+	if msg, ok := v.(Message); ok {
+		v = downgradeMessage(msg, c.protocolVersion())
+	}
+	if c.hold(v) {
+		return nil
+	}
+	select {
+	case c.out <- v:
+		return nil
+	default:
+		log.Warn("Dropping slow connection", "remote", c.ws.RemoteAddr())
+		c.Close()
+		return errConnClosed
+	}
+}
+
+// WriteBinary queues a binary frame for the socket. Unlike WriteJSON it
+// waits up to timeout for room in the queue, which is how relay.go pushes
+// back on a host sending faster than the receiver reads.
+func (c *wsConn) WriteBinary(frame []byte, timeout time.Duration) error {
+	c = c.root()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c.out <- binaryFrame(frame):
+		return nil
+	case <-c.closing:
+		return errConnClosed
+	case <-timer.C:
+		return errSendQueued
+	}
+}
+
+func (c *wsConn) extendReadDeadline() {
+	c.ws.SetReadDeadline(time.Now().Add(max(c.pongWait(), c.relaxedFor())))
+}
+
+// readLimit leaves room for an inline_file message carrying the largest
+// allowed file as base64, and for relay frames.
+func readLimit() int64 {
+	limit := max(wsReadLimit, cfg.InlineMaxBytes*4/3+wsReadLimit)
+	if cfg.Relay {
+		limit = max(limit, defaultChunkSize+relayHeaderSize)
+	}
+	return limit
+}
+
+// ReadJSON reads the next message that decodes into v. Frames that aren't
+// valid JSON are answered with an error message and skipped, and binary
+// frames go to the relay (see relay.go). Messages come out in the current
+// protocol version, see compat.go.
+func (c *wsConn) ReadJSON(v any) error {
+	for {
+		kind, data, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if kind == websocket.BinaryMessage {
+			handleRelayFrame(c, data)
+			continue
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			c.WriteJSON(errorMessage(errCodeInvalidJSON, err.Error(), ""))
+			continue
+		}
+		if msg, ok := v.(*Message); ok {
+			*msg = upgradeMessage(*msg, c.protocolVersion())
+		}
+		return nil
+	}
+}
+
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	kind, data, err := c.ws.ReadMessage()
+	if err == nil {
+		c.extendReadDeadline()
+	}
+	return kind, data, err
+}
+
+// discardInput reads what the peer still sends, such as the rest of a
+// message over the read limit or its reply to the close frame, until it
+// hangs up or for at most a second. Closing with input unread resets the
+// connection, and the peer may lose the close frame and what came before.
+func (c *wsConn) discardInput() {
+	ws, ok := c.ws.(*websocket.Conn)
+	if !ok {
+		return
+	}
+	conn := ws.UnderlyingConn()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, conn)
+}
+
+// Close sends what is already queued and then closes the socket. It is
+// safe to call more than once, and on the nil host of a companion session.
+func (c *wsConn) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.once.Do(func() { close(c.closing) })
+	return nil
+}
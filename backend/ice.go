@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Clients learn which STUN and TURN servers to use from the server, in the
+// ice_servers of upload_created and file_metadata, so a deployment behind
+// strict NATs can change them without rebuilding the frontend. Plain URLs
+// come from -ice-servers. TURN servers need credentials and are listed in
+// the JSON file given with -ice-servers-file instead, which replaces the
+// flag:
+//
+//	[{"urls": ["stun:stun.example.com:3478"]},
+//	 {"urls": ["turn:turn.example.com:3478?transport=udp", "turns:turn.example.com:5349"],
+//	  "username": "sendmyzip", "credential": "secret"}]
+
+// iceServer is an RTCIceServer as the browser takes it.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// iceServers is sent to every client. Empty means clients use none, not
+// their built-in default.
+var iceServers = []iceServer{}
+
+// fileMetadata is the file_metadata payload: the metadata plus how to reach
+// the host.
+type fileMetadata struct {
+	Metadata
+	ICEServers []iceServer `json:"ice_servers"`
+}
+
+func fileMetadataMessage(upload *Upload, receiver *Receiver, meta Metadata) Message {
+	return Message{Type: "file_metadata", Payload: fileMetadata{
+		Metadata:   currentCaptions(meta),
+		ICEServers: iceServersFor(receiver.ctx, upload, receiver.ID),
+	}}
+}
+
+func (s iceServer) validate() error {
+	if len(s.URLs) == 0 {
+		return errors.New("no urls")
+	}
+	for _, u := range s.URLs {
+		scheme, _, _ := strings.Cut(u, ":")
+		switch scheme {
+		case "stun", "stuns":
+		case "turn", "turns":
+			if s.Username == "" || s.Credential == "" {
+				return fmt.Errorf("%s: TURN servers need a username and credential", u)
+			}
+		default:
+			return fmt.Errorf("%s: not a stun, stuns, turn or turns URL", u)
+		}
+	}
+	return nil
+}
+
+// parseICEServers reads the comma-separated URLs of -ice-servers.
+func parseICEServers(list string) ([]iceServer, error) {
+	servers := []iceServer{}
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		server := iceServer{URLs: []string{u}}
+		if err := server.validate(); err != nil {
+			return nil, fmt.Errorf("%w (use -ice-servers-file)", err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func loadICEServers(path string) ([]iceServer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []iceServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if servers == nil {
+		servers = []iceServer{}
+	}
+	for i, server := range servers {
+		if err := server.validate(); err != nil {
+			return nil, fmt.Errorf("%s: server %d: %w", path, i, err)
+		}
+	}
+	return servers, nil
+}
+
+// configureICEServers sets iceServers and turnURLs from the flags.
+func configureICEServers() error {
+	var err error
+	if cfg.ICEServersFile != "" {
+		iceServers, err = loadICEServers(cfg.ICEServersFile)
+	} else {
+		iceServers, err = parseICEServers(cfg.ICEServers)
+	}
+	if err != nil {
+		return err
+	}
+	turnURLs, err = parseTURNURLs(cfg.TURNURLs)
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type idempotentCreate struct {
+	upload  *Upload
+	meta    Metadata
+	expires time.Time
+}
+
+var (
+	idempotentCreates = make(map[string]idempotentCreate) // IP+key:create
+	idempotencyMutex  sync.Mutex
+)
+
+// idempotencyKey returns the client's key scoped to its IP. Browsers can't
+// set headers on WebSocket requests, so the query parameter is accepted too.
+func idempotencyKey(r *http.Request) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = r.URL.Query().Get("idempotency_key")
+	}
+	if key == "" || len(key) > 255 {
+		return ""
+	}
+	return clientIP(r) + "|" + key
+}
+
+// lookupIdempotent returns the live upload created earlier with key, if
+// any. conflict is set when the key was used for different metadata.
+func lookupIdempotent(key string, meta Metadata) (upload *Upload, conflict bool) {
+	idempotencyMutex.Lock()
+	entry, ok := idempotentCreates[key]
+	idempotencyMutex.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	if !sameMetadata(entry.meta, meta) {
+		return nil, true
+	}
+
+	// The session may have ended since; then the retry starts a new one
+	if current, ok := lookupUpload(entry.upload.ID); !ok || current != entry.upload {
+		return nil, false
+	}
+	return entry.upload, false
+}
+
+func rememberIdempotent(key string, upload *Upload) {
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	idempotentCreates[key] = idempotentCreate{
+		upload:  upload,
+		meta:    upload.Meta,
+		expires: time.Now().Add(cfg.IdempotencyWindow),
+	}
+}
+
+func sweepIdempotencyKeys() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		idempotencyMutex.Lock()
+		for key, entry := range idempotentCreates {
+			if now.After(entry.expires) {
+				delete(idempotentCreates, key)
+			}
+		}
+		idempotencyMutex.Unlock()
+	}
+}
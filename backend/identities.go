@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Receivers can register their public key together with channels to be
+// reached on. A host that creates a session with recipient=<key> then
+// doesn't need to share a link: the server tells the identity through its
+// inbox socket, webhook and e-mail, and only admits a receiver that signs a
+// challenge with that key.
+//
+// An e-mail address is only written to after its owner confirmed it through
+// the link in a confirmation e-mail, so registering can't make the server
+// mail strangers about files. Webhooks go to public addresses only, see
+// webhookClient.
+
+// identityClockSkew is how far registration timestamps may be off.
+const identityClockSkew = 5 * time.Minute
+
+type identityRequest struct {
+	PublicKey     string `json:"public_key"`
+	Name          string `json:"name"`
+	WebhookURL    string `json:"webhook_url"`
+	WebhookSecret string `json:"webhook_secret"` // generated when empty
+	Email         string `json:"email"`
+	Locale        string `json:"locale"`    // from Accept-Language when empty
+	Timestamp     int64  `json:"timestamp"` // unix seconds
+	Signature     string `json:"signature"` // over "<action>:<public key>:<timestamp>"
+}
+
+// verify checks the request signature for action and returns the key in
+// normalized form.
+func (req identityRequest) verify(action string) (string, bool) {
+	pub, key, err := parsePublicKey(req.PublicKey)
+	if err != nil {
+		return "", false
+	}
+	skew := time.Since(time.Unix(req.Timestamp, 0))
+	if skew > identityClockSkew || skew < -identityClockSkew {
+		return "", false
+	}
+	message := action + ":" + key + ":" + strconv.FormatInt(req.Timestamp, 10)
+	return key, verifyIdentity(pub, message, req.Signature)
+}
+
+func handleRegisterIdentity(w http.ResponseWriter, r *http.Request) {
+	var req identityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must be JSON")
+		return
+	}
+	key, ok := req.verify("sendmyzip-register")
+	if !ok {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid key, timestamp or signature")
+		return
+	}
+	if req.WebhookURL != "" {
+		if u, err := url.Parse(req.WebhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "webhook_url must be an http(s) URL")
+			return
+		}
+	}
+
+	locale, err := clientLocale(req.Locale, acceptLocale(r))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, err.Error())
+		return
+	}
+
+	identity := Identity{
+		PublicKey:  key,
+		Name:       req.Name,
+		WebhookURL: req.WebhookURL,
+		Email:      req.Email,
+		Locale:     locale,
+		CreatedAt:  time.Now(),
+	}
+	if req.WebhookURL != "" {
+		identity.WebhookSecret = req.WebhookSecret
+		if identity.WebhookSecret == "" {
+			identity.WebhookSecret = newWebhookSecret()
+		}
+	}
+	var token string
+	if req.Email != "" {
+		// Registering again keeps an address that was already confirmed
+		if previous, err := store.GetIdentity(r.Context(), key); err == nil && previous.EmailConfirmed && previous.Email == req.Email {
+			identity.EmailConfirmed = true
+		} else {
+			token = generateReceiverID() + generateReceiverID()
+			identity.EmailToken = hashAPIToken(token)
+		}
+	}
+	if err := store.PutIdentity(r.Context(), identity); err != nil {
+		log.Error("Could not store identity", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store identity")
+		return
+	}
+
+	if token != "" && cfg.SMTPAddr != "" {
+		link := publicBaseURL(r) + "/api/identities/confirm?key=" + url.QueryEscape(key) + "&token=" + token
+		go func() {
+			if err := sendConfirmMail(identity.Email, identity.Locale, link); err != nil {
+				log.Warn("Could not send confirmation e-mail", "key", key, "err", err)
+			}
+		}()
+	}
+	identity.EmailToken = ""
+	writeJSON(w, http.StatusCreated, identity)
+}
+
+// handleConfirmEmail is where the link in the confirmation e-mail leads.
+func handleConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	_, key, err := parsePublicKey(query.Get("key"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid key")
+		return
+	}
+	identity, err := store.GetIdentity(r.Context(), key)
+	if err == nil && identity.EmailConfirmed {
+		writeJSON(w, http.StatusOK, identity)
+		return
+	}
+	if err != nil || identity.EmailToken == "" ||
+		subtle.ConstantTimeCompare([]byte(hashAPIToken(query.Get("token"))), []byte(identity.EmailToken)) != 1 {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Unknown or used confirmation link")
+		return
+	}
+
+	identity.EmailConfirmed = true
+	identity.EmailToken = ""
+	if err := store.PutIdentity(r.Context(), identity); err != nil {
+		log.Error("Could not store identity", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store identity")
+		return
+	}
+	writeJSON(w, http.StatusOK, identity)
+}
+
+func handleDeleteIdentity(w http.ResponseWriter, r *http.Request) {
+	var req identityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must be JSON")
+		return
+	}
+	key, ok := req.verify("sendmyzip-unregister")
+	if !ok {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid key, timestamp or signature")
+		return
+	}
+	if err := store.DeleteIdentity(r.Context(), key); err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not delete identity")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyClient delivers to the operator's own webhooks, see webhookClient for
+// the rest.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyIdentity tells the upload's recipient about the session on every
+// channel it registered.
+func notifyIdentity(upload *Upload, joinURL string) {
+	notifyInbox(upload)
+
+	identity, err := store.GetIdentity(context.Background(), upload.recipient)
+	if err != nil {
+		return // not registered; the inbox socket is all there is
+	}
+
+	if identity.WebhookURL != "" {
+		sendWebhook(identity.WebhookURL, identity.WebhookSecret, "session_offer", map[string]any{
+			"type":     "session_offer",
+			"id":       upload.ID,
+			"metadata": currentCaptions(upload.Meta),
+			"url":      joinURL,
+		})
+	}
+
+	if identity.Email != "" && identity.EmailConfirmed && cfg.SMTPAddr != "" {
+		if err := sendOfferMail(identity.Email, identity.Locale, upload, joinURL); err != nil {
+			log.Warn("Could not e-mail identity", "key", identity.PublicKey, "err", err)
+		}
+	}
+}
+
+func sendOfferMail(to, locale string, upload *Upload, joinURL string) error {
+	mail := offerMailFor(locale)
+	return sendMail(to, mail, fmt.Sprintf(mail.Body, upload.Meta.FileName, formatFileSize(upload.Meta.FileSize), joinURL))
+}
+
+func sendConfirmMail(to, locale, link string) error {
+	mail := confirmMailFor(locale)
+	return sendMail(to, mail, fmt.Sprintf(mail.Body, link))
+}
+
+func sendMail(to string, mail offerMail, body string) error {
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", cfg.SMTPUser, os.Getenv("SENDMYZIP_SMTP_PASSWORD"), host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Language: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		cfg.SMTPFrom, to, mail.Subject, mail.Language) + body
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.SMTPFrom, []string{to}, []byte(msg))
+}
+
+type identityProof struct {
+	Signature string `json:"signature"`
+}
+
+// proveIdentity makes a joining receiver sign a fresh challenge with
+// publicKey. It returns the key in normalized form.
+func proveIdentity(conn *wsConn, publicKey string) (string, bool) {
+	pub, key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return "", false
+	}
+
+	challenge := generateReceiverID() + generateReceiverID()
+	conn.WriteJSON(Message{Type: "identity_challenge", Payload: map[string]string{"challenge": challenge}})
+
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "identity_proof" {
+		return "", false
+	}
+	var proof identityProof
+	if err := decodePayload(msg, &proof); err != nil {
+		conn.WriteJSON(invalidPayload(msg, err))
+		return "", false
+	}
+	return key, verifyIdentity(pub, challenge, proof.Signature)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerIdentity registers a new key with email and returns the key.
+func registerIdentity(t *testing.T, priv ed25519.PrivateKey, email string) Identity {
+	t.Helper()
+	key := base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+	ts := time.Now().Unix()
+	sig := ed25519.Sign(priv, []byte("sendmyzip-register:"+key+":"+strconv.FormatInt(ts, 10)))
+	body, _ := json.Marshal(identityRequest{
+		PublicKey: key,
+		Email:     email,
+		Timestamp: ts,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	})
+	resp, err := http.Post(testServer(t)+"/api/identities", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registering: got %s", resp.Status)
+	}
+	var identity Identity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DeleteIdentity(context.Background(), key) })
+	return identity
+}
+
+func confirmEmail(t *testing.T, key, token string) int {
+	t.Helper()
+	resp, err := http.Get(testServer(t) + "/api/identities/confirm?key=" + url.QueryEscape(key) + "&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestConfirmEmail(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	identity := registerIdentity(t, priv, "someone@example.com")
+	if identity.EmailConfirmed || identity.EmailToken != "" {
+		t.Fatalf("registered %+v, want an unconfirmed address and no token", identity)
+	}
+	key := identity.PublicKey
+
+	if status := confirmEmail(t, key, "guess"); status != http.StatusForbidden {
+		t.Errorf("wrong token: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	// The token only goes out by e-mail, so put one in place
+	stored, err := store.GetIdentity(context.Background(), key)
+	if err != nil || stored.EmailToken == "" {
+		t.Fatalf("stored %+v, %v, want a pending token", stored, err)
+	}
+	stored.EmailToken = hashAPIToken("token")
+	store.PutIdentity(context.Background(), stored)
+	if status := confirmEmail(t, key, "token"); status != http.StatusOK {
+		t.Fatalf("confirming: got %d", status)
+	}
+	if stored, _ := store.GetIdentity(context.Background(), key); !stored.EmailConfirmed || stored.EmailToken != "" {
+		t.Fatalf("after confirming: %+v", stored)
+	}
+
+	if again := registerIdentity(t, priv, "someone@example.com"); !again.EmailConfirmed {
+		t.Error("registering the same address again lost the confirmation")
+	}
+	if other := registerIdentity(t, priv, "someone.else@example.com"); other.EmailConfirmed {
+		t.Error("a new address came out confirmed")
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	for _, address := range []string{
+		"127.0.0.1:80",
+		"10.1.2.3:443",
+		"192.168.0.1:80",
+		"169.254.169.254:80",
+		"0.0.0.0:80",
+		"[::1]:80",
+		"[fe80::1]:80",
+		"[fd00::1]:80",
+		"[::ffff:127.0.0.1]:80",
+		"224.0.0.1:80",
+	} {
+		if err := publicOnly("tcp", address, nil); !errors.Is(err, errPrivateTarget) {
+			t.Errorf("%s: got %v, want it refused", address, err)
+		}
+	}
+	for _, address := range []string{"93.184.216.34:443", "[2606:2800:220:1::]:443"} {
+		if err := publicOnly("tcp", address, nil); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+}
+
+func TestWebhookToLoopback(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached a loopback target")
+	}))
+	defer target.Close()
+
+	err := postWebhook(&WebhookDelivery{URL: target.URL, Event: "session_offer", Body: []byte("{}")})
+	if !errors.Is(err, errPermanent) || !errors.Is(err, errPrivateTarget) {
+		t.Fatalf("got %v, want a permanent refusal", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// Identities are Ed25519 public keys, sent as base64 (standard or URL
+// alphabet, padded or not). They are compared in normalized form.
+
+var errInvalidPublicKey = errors.New("public key must be a base64 Ed25519 key")
+
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// parsePublicKey decodes an identity and returns it with its normalized
+// string form.
+func parsePublicKey(s string) (ed25519.PublicKey, string, error) {
+	raw, err := decodeBase64(s)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, "", errInvalidPublicKey
+	}
+	return ed25519.PublicKey(raw), base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// verifyIdentity checks that signature is key's signature over challenge.
+func verifyIdentity(key ed25519.PublicKey, challenge, signature string) bool {
+	sig, err := decodeBase64(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, []byte(challenge), sig)
+}
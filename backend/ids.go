@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Upload IDs are short, so on a busy instance a fresh one can already be in
+// use. registerUpload draws again until it finds a free one; after
+// maxIDAttempts collisions in a row, or when the entropy source fails, it
+// switches to a counter so it always makes progress. Counter IDs are
+// guessable, which is why they are only the fallback and are counted in
+// the admin stats. Random IDs are drawn from the session's vocabulary pack,
+// see vocab.go.
+
+const maxIDAttempts = 16
+
+type idStats struct {
+	Collisions      atomic.Int64
+	EntropyFailures atomic.Int64
+	Fallbacks       atomic.Int64
+}
+
+var uploadIDStats idStats
+
+type idSummary struct {
+	Collisions      int64 `json:"collisions"`
+	EntropyFailures int64 `json:"entropy_failures"`
+	Fallbacks       int64 `json:"fallbacks"`
+}
+
+func (s *idStats) summary() idSummary {
+	return idSummary{
+		Collisions:      s.Collisions.Load(),
+		EntropyFailures: s.EntropyFailures.Load(),
+		Fallbacks:       s.Fallbacks.Load(),
+	}
+}
+
+// idCounter feeds fallbackID. Seeding it from the clock keeps a restarted
+// server from handing out the IDs of its previous run in the same order.
+var idCounter atomic.Uint64
+
+func init() {
+	idCounter.Store(uint64(time.Now().UnixNano()))
+}
+
+// generateID returns a random upload ID from v sized for active sessions,
+// or false if the entropy source failed.
+func generateID(v *idVocabulary, active int) (string, bool) {
+	id, err := v.draw(v.codeLength(active))
+	if err != nil {
+		uploadIDStats.EntropyFailures.Add(1)
+		log.Error("Could not read random bytes for an upload ID", "err", err)
+		return "", false
+	}
+	return id, true
+}
+
+// fallbackID returns the next counter ID, as long as a random one.
+func fallbackID() string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], idCounter.Add(1))
+	if cfg.IDBytes <= len(buf) {
+		return hex.EncodeToString(buf[len(buf)-cfg.IDBytes:])
+	}
+	return hex.EncodeToString(append(make([]byte, cfg.IDBytes-len(buf)), buf[:]...))
+}
+
+// reservedIDs are IDs being claimed in the session store, which they
+// are kept out of the way for. Guarded by uploadsMutex.
+var reservedIDs = make(map[string]struct{})
+
+// registerUpload assigns upload an ID that is not in use and adds it to the
+// uploads map.
+func registerUpload(upload *Upload) string {
+	reserveUploadID(upload)
+	publishUpload(upload)
+	return upload.ID
+}
+
+// reserveUploadID assigns upload an ID that no other session has or will
+// get, without making it findable yet. Generating and reserving under the
+// same lock means two sessions can never end up sharing an ID; the session
+// store is asked outside it, since that can be a network round-trip.
+func reserveUploadID(upload *Upload) {
+	vocabulary := upload.vocabulary
+	if vocabulary == nil {
+		vocabulary, _ = vocabularyFor("")
+	}
+	for attempt := 0; ; attempt++ {
+		uploadsMutex.Lock()
+		id, ok := "", false
+		if attempt < maxIDAttempts {
+			id, ok = generateID(vocabulary, len(uploads))
+		}
+		if !ok {
+			if attempt == maxIDAttempts {
+				log.Warn("Falling back to counter upload IDs", "active", len(uploads))
+			}
+			uploadIDStats.Fallbacks.Add(1)
+			id = fallbackID()
+		}
+		_, taken := uploads[id]
+		if _, reserved := reservedIDs[id]; taken || reserved {
+			uploadsMutex.Unlock()
+			uploadIDStats.Collisions.Add(1)
+			continue
+		}
+		reservedIDs[id] = struct{}{}
+		uploadsMutex.Unlock()
+
+		// Other nodes may have it, see sessionstore.go. Without the store
+		// the session still works here, just unseen by the others
+		upload.ID = id
+		claimed, err := sessions.Claim(context.Background(), liveSessionOf(upload))
+		if err != nil {
+			log.Error("Could not register session", "id", id, "err", err)
+		} else if !claimed {
+			uploadsMutex.Lock()
+			delete(reservedIDs, id)
+			uploadsMutex.Unlock()
+			uploadIDStats.Collisions.Add(1)
+			continue
+		}
+		return
+	}
+}
+
+// publishUpload adds upload, with the ID reserveUploadID gave it, to the
+// uploads map, from where receivers can find it.
+func publishUpload(upload *Upload) {
+	uploadsMutex.Lock()
+	delete(reservedIDs, upload.ID)
+	uploads[upload.ID] = upload
+	uploadsMutex.Unlock()
+
+	if cfg.PublicStats {
+		publicStats.sessionCreated(upload.country)
+	}
+	recordEvent(upload, "session_created", map[string]any{
+		"metadata": upload.Meta,
+		"labels":   upload.labels,
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// Headless receivers (a NAS, an always-on CLI) can keep one idle WebSocket
+// open on /api/inbox instead of a full session. After proving they hold
+// their key, they are told about every session created for that key with
+// the recipient parameter, and join it the normal way.
+//
+// Server:   {"type": "inbox_challenge", "payload": {"challenge": "..."}}
+// Receiver: {"type": "inbox_register", "payload": {"public_key": "...", "signature": "..."}}
+// Server:   {"type": "inbox_registered"}
+// Server:   {"type": "session_offer", "payload": {"id": "...", "metadata": {...}}}
+
+type inboxRegistration struct {
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"` // over the challenge
+}
+
+var (
+	inboxes      = make(map[string][]*wsConn) // normalized key:listeners
+	inboxesMutex sync.Mutex
+)
+
+func sessionOffer(upload *Upload) Message {
+	return Message{Type: "session_offer", Payload: map[string]any{
+		"id":       upload.ID,
+		"metadata": currentCaptions(upload.Meta),
+	}}
+}
+
+// notifyInbox wakes the listeners of the upload's recipient.
+func notifyInbox(upload *Upload) {
+	if upload.recipient == "" {
+		return
+	}
+	inboxesMutex.Lock()
+	listeners := slices.Clone(inboxes[upload.recipient])
+	inboxesMutex.Unlock()
+
+	for _, conn := range listeners {
+		conn.WriteJSON(sessionOffer(upload))
+	}
+}
+
+// pendingFor returns the live sessions addressed to key.
+func pendingFor(key string) []*Upload {
+	uploadsMutex.RLock()
+	defer uploadsMutex.RUnlock()
+	var list []*Upload
+	for _, upload := range uploads {
+		if upload.recipient == key && !upload.isClosed() {
+			list = append(list, upload)
+		}
+	}
+	return list
+}
+
+func handleInbox(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	challenge := generateReceiverID() + generateReceiverID()
+	conn.WriteJSON(Message{Type: "inbox_challenge", Payload: map[string]string{"challenge": challenge}})
+
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "inbox_register" {
+		return
+	}
+	var reg inboxRegistration
+	if err := decodePayload(msg, &reg); err != nil {
+		conn.WriteJSON(invalidPayload(msg, err))
+		return
+	}
+
+	pub, key, err := parsePublicKey(reg.PublicKey)
+	if err != nil || !verifyIdentity(pub, challenge, reg.Signature) {
+		conn.WriteJSON(Message{Type: "inbox_rejected", Payload: map[string]string{"reason": "invalid_signature"}})
+		return
+	}
+
+	inboxesMutex.Lock()
+	inboxes[key] = append(inboxes[key], conn)
+	inboxesMutex.Unlock()
+	defer func() {
+		inboxesMutex.Lock()
+		inboxes[key] = slices.DeleteFunc(inboxes[key], func(c *wsConn) bool { return c == conn })
+		if len(inboxes[key]) == 0 {
+			delete(inboxes, key)
+		}
+		inboxesMutex.Unlock()
+	}()
+
+	log.Info("Inbox registered", "key", key)
+	conn.WriteJSON(Message{Type: "inbox_registered"})
+
+	// Catch up on anything that was sent while the receiver was away
+	for _, upload := range pendingFor(key) {
+		conn.WriteJSON(sessionOffer(upload))
+	}
+
+	// Nothing is expected from the receiver; reading notices when it leaves
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Files up to -inline-max-bytes can skip WebRTC: the host sends the
+// (client-encrypted) bytes in an inline_file message, the server keeps them
+// on the Upload for -inline-ttl and hands them to every receiver that is or
+// becomes part of the session.
+
+type inlineFile struct {
+	Data      []byte    `json:"data"` // base64 on the wire
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func handleInlineFile(upload *Upload, msg Message) {
+	var req inlineFile
+	if err := decodePayload(msg, &req); err != nil || len(req.Data) == 0 {
+		sendToHost(upload, Message{Type: "inline_rejected", Payload: map[string]any{"reason": "invalid"}})
+		return
+	}
+	if int64(len(req.Data)) > cfg.InlineMaxBytes {
+		sendToHost(upload, Message{Type: "inline_rejected", Payload: map[string]any{
+			"reason":    "too_large",
+			"max_bytes": cfg.InlineMaxBytes,
+		}})
+		return
+	}
+
+	file := &inlineFile{Data: req.Data, ExpiresAt: time.Now().Add(cfg.InlineTTL)}
+
+	upload.mutex.Lock()
+	upload.inline = file
+	receivers := make([]*Receiver, len(upload.Receivers))
+	copy(receivers, upload.Receivers)
+	upload.mutex.Unlock()
+
+	time.AfterFunc(cfg.InlineTTL, func() {
+		upload.mutex.Lock()
+		if upload.inline == file {
+			upload.inline = nil
+		}
+		upload.mutex.Unlock()
+	})
+
+	log.Info("Stored inline file", "id", upload.ID, "bytes", len(req.Data))
+	sendToHost(upload, Message{Type: "inline_stored", Payload: map[string]any{
+		"size":       len(req.Data),
+		"expires_at": file.ExpiresAt,
+	}})
+
+	for _, receiver := range receivers {
+		receiver.send(Message{Type: "inline_file", Payload: file})
+		receiverServed(upload, receiver)
+	}
+}
+
+// sendInlineFile gives a newly admitted receiver the stored payload, if any.
+func sendInlineFile(upload *Upload, receiver *Receiver) {
+	upload.mutex.RLock()
+	file := upload.inline
+	upload.mutex.RUnlock()
+
+	if file != nil {
+		receiver.send(Message{Type: "inline_file", Payload: file})
+		receiverServed(upload, receiver)
+		countDownload(upload, receiver)
+	}
+}
@@ -0,0 +1,79 @@
+// Package e2e runs whole transfers against a sendmyzip server. A host and
+// its receivers signal through the server the way the frontend does, and
+// the file then goes host to receiver over a real WebRTC data channel
+// between headless pion peers, with ICE over loopback. A protocol change
+// that breaks signaling, transport planning or completion reporting fails
+// here even when every message still looks right on its own. The scenarios
+// run as tests of the server, with the e2e tag that keeps pion out of the
+// deployed binary:
+//
+//	go test -tags e2e -run E2E .
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ScenarioTimeout bounds one scenario, ICE included.
+const ScenarioTimeout = 30 * time.Second
+
+// Scenario is one flow run against a server at a base URL.
+type Scenario struct {
+	Name string
+	Run  func(ctx context.Context, baseURL string) error
+}
+
+// Scenarios are the flows to run, in order.
+var Scenarios = []Scenario{
+	{"transfer", func(ctx context.Context, baseURL string) error {
+		return transfer(ctx, baseURL, flow{size: 1 << 20, receivers: 1})
+	}},
+	{"approval", func(ctx context.Context, baseURL string) error {
+		return transfer(ctx, baseURL, flow{size: 256 << 10, receivers: 1, approve: true})
+	}},
+	{"two_receivers", func(ctx context.Context, baseURL string) error {
+		return transfer(ctx, baseURL, flow{size: 1 << 20, receivers: 2})
+	}},
+}
+
+type flow struct {
+	size      int
+	receivers int
+	approve   bool // create the session with require_approval
+}
+
+// transfer sends size random bytes to the receivers at once and waits for
+// the server to count every transfer complete.
+func transfer(ctx context.Context, baseURL string, f flow) error {
+	data := make([]byte, f.size)
+	rand.Read(data)
+	query := url.Values{}
+	if f.approve {
+		query.Set("require_approval", "true")
+	}
+
+	h, err := openHost(ctx, baseURL, data, query)
+	if err != nil {
+		return fmt.Errorf("opening session: %w", err)
+	}
+	defer h.close()
+	h.approve = f.approve
+	go h.run(ctx)
+
+	errs := make(chan error, f.receivers)
+	for i := range f.receivers {
+		go func() {
+			errs <- receive(ctx, baseURL, h.id, fmt.Sprintf("receiver %d", i+1), f.approve)
+		}()
+	}
+	for range f.receivers {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return h.waitCompleted(ctx, f.receivers)
+}
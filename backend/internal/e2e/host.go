@@ -0,0 +1,262 @@
+package e2e
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// maxBuffered is how far the host lets a data channel's send buffer fill
+// before it waits for it to drain.
+const maxBuffered = 1 << 20
+
+type hello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+type transportPlan struct {
+	ReceiverID string `json:"receiver_id"`
+	Transport  string `json:"transport"`
+	ChunkSize  int    `json:"chunk_size"`
+}
+
+type transferSummary struct {
+	CompletedCount int `json:"completed_count"`
+}
+
+// host offers data in a session of its own and sends it to every receiver
+// the server plans a direct connection for.
+type host struct {
+	sig     *signaling
+	id      string
+	data    []byte
+	approve bool // approve receivers waiting for it
+	peers   map[string]*peer
+
+	errs      chan error
+	summaries chan transferSummary
+}
+
+func wsURL(baseURL string) string {
+	return strings.Replace(baseURL, "http", "ws", 1)
+}
+
+// openHost creates the session, with query adding to the file's metadata.
+func openHost(ctx context.Context, baseURL string, data []byte, query url.Values) (*host, error) {
+	sum := sha256.Sum256(data)
+	query.Set("filename", "e2e.bin")
+	query.Set("filetype", "application/octet-stream")
+	query.Set("filesize", strconv.Itoa(len(data)))
+	query.Set("sha256", hex.EncodeToString(sum[:]))
+	sig, err := dial(ctx, wsURL(baseURL)+"/api/upload?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	h := &host{
+		sig:       sig,
+		data:      data,
+		peers:     make(map[string]*peer),
+		errs:      make(chan error, 1),
+		summaries: make(chan transferSummary, 16),
+	}
+	if err := sig.send("hello", "", hello{Version: 3}); err != nil {
+		sig.close()
+		return nil, err
+	}
+	for h.id == "" {
+		msg, err := sig.next(ctx)
+		if err != nil {
+			sig.close()
+			return nil, err
+		}
+		if msg.Type == "upload_created" {
+			var created struct {
+				ID string `json:"id"`
+			}
+			if err := msg.decode(&created); err != nil {
+				sig.close()
+				return nil, err
+			}
+			h.id = created.ID
+		}
+	}
+	return h, nil
+}
+
+// run handles the host's messages until the socket or ctx ends.
+func (h *host) run(ctx context.Context) {
+	defer func() {
+		for _, p := range h.peers {
+			p.close()
+		}
+	}()
+	for {
+		msg, err := h.sig.next(ctx)
+		if err == nil {
+			err = h.handle(msg)
+		}
+		if err != nil {
+			h.fail(fmt.Errorf("host: %s: %w", msg.Type, err))
+			return
+		}
+	}
+}
+
+func (h *host) fail(err error) {
+	select {
+	case h.errs <- err:
+	default:
+	}
+}
+
+func (h *host) handle(msg message) error {
+	switch msg.Type {
+	case "join_pending":
+		if !h.approve {
+			return nil
+		}
+		var pending struct {
+			ID string `json:"id"`
+		}
+		if err := msg.decode(&pending); err != nil {
+			return err
+		}
+		return h.sig.send("approve_receiver", "", map[string]string{"receiver_id": pending.ID})
+	case "transport_plan":
+		var plan transportPlan
+		if err := msg.decode(&plan); err != nil {
+			return err
+		}
+		if plan.Transport != "p2p" {
+			return fmt.Errorf("planned %q for %s, want p2p", plan.Transport, plan.ReceiverID)
+		}
+		if h.peers[plan.ReceiverID] != nil {
+			return nil
+		}
+		return h.offer(plan.ReceiverID, plan.ChunkSize)
+	case "webrtc_answer":
+		p := h.peers[msg.From]
+		if p == nil {
+			return fmt.Errorf("answer from %q, which was sent no offer", msg.From)
+		}
+		var answer sdpPayload
+		if err := msg.decode(&answer); err != nil {
+			return err
+		}
+		if answer.Answer == nil {
+			return errors.New("no answer in payload")
+		}
+		return p.setRemote(*answer.Answer)
+	case "webrtc_ice_candidate":
+		p := h.peers[msg.From]
+		if p == nil {
+			return fmt.Errorf("candidate from %q, which was sent no offer", msg.From)
+		}
+		var candidate candidatePayload
+		if err := msg.decode(&candidate); err != nil {
+			return err
+		}
+		return p.addCandidate(candidate.Candidate)
+	case "transfer_summary":
+		var summary transferSummary
+		if err := msg.decode(&summary); err != nil {
+			return err
+		}
+		h.summaries <- summary
+	}
+	return nil
+}
+
+// offer connects to the receiver and sends it the data once the channel
+// opens.
+func (h *host) offer(receiverID string, chunkSize int) error {
+	p, err := newPeer(h.sig, receiverID)
+	if err != nil {
+		return err
+	}
+	h.peers[receiverID] = p
+
+	dc, err := p.pc.CreateDataChannel("file", nil)
+	if err != nil {
+		return err
+	}
+	dc.OnOpen(func() {
+		go func() {
+			if err := sendData(dc, h.data, chunkSize); err != nil {
+				h.fail(fmt.Errorf("host: sending to %s: %w", receiverID, err))
+			}
+		}()
+	})
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	// Gathering starts with the local description, and its candidates
+	// mustn't overtake the offer
+	if err := h.sig.send("webrtc_offer", receiverID, sdpPayload{Offer: &offer}); err != nil {
+		return err
+	}
+	return p.pc.SetLocalDescription(offer)
+}
+
+// sendData writes data to dc in chunks, keeping at most maxBuffered bytes
+// queued.
+func sendData(dc *webrtc.DataChannel, data []byte, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = 16 << 10
+	}
+	drained := make(chan struct{}, 1)
+	dc.SetBufferedAmountLowThreshold(maxBuffered / 2)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case drained <- struct{}{}:
+		default:
+		}
+	})
+
+	for len(data) > 0 {
+		n := min(chunkSize, len(data))
+		if err := dc.Send(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		if dc.BufferedAmount() > maxBuffered {
+			select {
+			case <-drained:
+			case <-time.After(30 * time.Second):
+				return errors.New("data channel stopped draining")
+			}
+		}
+	}
+	return nil
+}
+
+// waitCompleted waits until the server reports n completed transfers.
+func (h *host) waitCompleted(ctx context.Context, n int) error {
+	for {
+		select {
+		case summary := <-h.summaries:
+			if summary.CompletedCount >= n {
+				return nil
+			}
+		case err := <-h.errs:
+			return err
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d completed transfers: %w", n, ctx.Err())
+		}
+	}
+}
+
+func (h *host) close() {
+	h.sig.close()
+}
@@ -0,0 +1,88 @@
+package e2e
+
+import (
+	"net"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The peers connect over loopback only, with no STUN or TURN server, so a
+// run needs no network and ICE has exactly one pair of host candidates to
+// find.
+//
+// Loopback still drops a datagram now and then when two transfers fill the
+// socket buffers at once. The retransmission timeout that follows takes
+// SCTP's congestion window down to one packet, and with the receiver
+// acknowledging every 200ms it never grew back: the other receiver got a
+// chunk per acknowledgement and ran into the scenario timeout. There is no
+// congestion to back off from here, so the window stays at minCwnd.
+var api = func() *webrtc.API {
+	var settings webrtc.SettingEngine
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetIPFilter(func(ip net.IP) bool { return ip.IsLoopback() })
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	settings.SetSCTPMinCwnd(minCwnd)
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+}()
+
+// minCwnd is the least SCTP may have in flight, in bytes.
+const minCwnd = 128 << 10
+
+type sdpPayload struct {
+	Offer  *webrtc.SessionDescription `json:"offer,omitempty"`
+	Answer *webrtc.SessionDescription `json:"answer,omitempty"`
+}
+
+type candidatePayload struct {
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+// peer is one side's connection to another peer of the session, signaled
+// through the server. Remote candidates that come in before the remote
+// description are held until it is set.
+type peer struct {
+	pc        *webrtc.PeerConnection
+	remoteSet bool
+	held      []webrtc.ICECandidateInit
+}
+
+// newPeer opens a connection to the peer named to, trickling local
+// candidates to it over sig as they are gathered.
+func newPeer(sig *signaling, to string) (*peer, error) {
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			sig.send("webrtc_ice_candidate", to, candidatePayload{Candidate: c.ToJSON()})
+		}
+	})
+	return &peer{pc: pc}, nil
+}
+
+func (p *peer) setRemote(desc webrtc.SessionDescription) error {
+	if err := p.pc.SetRemoteDescription(desc); err != nil {
+		return err
+	}
+	p.remoteSet = true
+	for _, c := range p.held {
+		if err := p.pc.AddICECandidate(c); err != nil {
+			return err
+		}
+	}
+	p.held = nil
+	return nil
+}
+
+func (p *peer) addCandidate(c webrtc.ICECandidateInit) error {
+	if !p.remoteSet {
+		p.held = append(p.held, c)
+		return nil
+	}
+	return p.pc.AddICECandidate(c)
+}
+
+func (p *peer) close() {
+	p.pc.Close()
+}
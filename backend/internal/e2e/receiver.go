@@ -0,0 +1,149 @@
+package e2e
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	errClosed   = errors.New("server closed the socket")
+	errReceived = errors.New("received")
+)
+
+type fileMetadata struct {
+	FileSize int64  `json:"filesize"`
+	SHA256   string `json:"sha256"`
+}
+
+// receive joins session id as name, answers the host's offer and reads the
+// file off the data channel, checking it against the metadata's checksum.
+// With pending set, the join has to be held for approval first.
+func receive(ctx context.Context, baseURL, id, name string, pending bool) error {
+	sig, err := dial(ctx, wsURL(baseURL)+"/api/join/"+url.PathEscape(id))
+	if err != nil {
+		return err
+	}
+	defer sig.close()
+	if err := sig.send("hello", "", hello{Version: 3}); err != nil {
+		return err
+	}
+	if err := sig.send("join_request", "", map[string]any{"name": name}); err != nil {
+		return err
+	}
+
+	// The data channel ends the wait with errReceived or what went wrong
+	ctx, finish := context.WithCancelCause(ctx)
+	defer finish(nil)
+
+	var (
+		meta       *fileMetadata
+		p          *peer
+		sawPending bool
+	)
+	defer func() {
+		if p != nil {
+			p.close()
+		}
+	}()
+	for {
+		msg, err := sig.next(ctx)
+		if err != nil {
+			if cause := context.Cause(ctx); errors.Is(cause, errReceived) {
+				return sig.send("transfer_complete", "", map[string]int64{"bytes": meta.FileSize})
+			} else if cause != nil {
+				err = cause
+			}
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		switch msg.Type {
+		case "join_pending":
+			sawPending = true
+		case "file_metadata":
+			if pending && !sawPending {
+				return fmt.Errorf("%s: admitted without waiting for approval", name)
+			}
+			meta = new(fileMetadata)
+			err = msg.decode(meta)
+		case "transport_plan":
+			var plan transportPlan
+			if err = msg.decode(&plan); err == nil && plan.Transport != "p2p" {
+				err = fmt.Errorf("planned %q, want p2p", plan.Transport)
+			}
+		case "webrtc_offer":
+			if meta == nil || p != nil {
+				return fmt.Errorf("%s: unexpected offer", name)
+			}
+			p, err = answer(sig, msg, *meta, finish)
+		case "webrtc_ice_candidate":
+			if p == nil {
+				return fmt.Errorf("%s: candidate before the offer", name)
+			}
+			var candidate candidatePayload
+			if err = msg.decode(&candidate); err == nil {
+				err = p.addCandidate(candidate.Candidate)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", name, msg.Type, err)
+		}
+	}
+}
+
+// answer accepts the host's offer and checks what comes over its data
+// channel, calling finish when the whole file is in.
+func answer(sig *signaling, msg message, meta fileMetadata, finish context.CancelCauseFunc) (*peer, error) {
+	var offer sdpPayload
+	if err := msg.decode(&offer); err != nil {
+		return nil, err
+	}
+	if offer.Offer == nil {
+		return nil, errors.New("no offer in payload")
+	}
+	p, err := newPeer(sig, "host")
+	if err != nil {
+		return nil, err
+	}
+
+	p.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		sum := sha256.New()
+		var received int64
+		dc.OnMessage(func(m webrtc.DataChannelMessage) {
+			sum.Write(m.Data)
+			received += int64(len(m.Data))
+			switch {
+			case received > meta.FileSize:
+				finish(fmt.Errorf("received %d bytes of a %d byte file", received, meta.FileSize))
+			case received == meta.FileSize:
+				if got := hex.EncodeToString(sum.Sum(nil)); got != meta.SHA256 {
+					finish(fmt.Errorf("received data has checksum %s, want %s", got, meta.SHA256))
+					return
+				}
+				finish(errReceived)
+			}
+		})
+	})
+
+	if err := p.setRemote(*offer.Offer); err != nil {
+		p.close()
+		return nil, err
+	}
+	desc, err := p.pc.CreateAnswer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(desc)
+	}
+	if err == nil {
+		err = sig.send("webrtc_answer", "host", sdpPayload{Answer: &desc})
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,102 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// message is the server's envelope, with the payload left raw for whoever
+// handles the type.
+type message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+}
+
+func (m message) decode(v any) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("%s payload: %w", m.Type, err)
+	}
+	return nil
+}
+
+// signaling is a WebSocket to the server. Messages are read on a goroutine
+// of their own, so waiting for one never leaves the socket half read.
+type signaling struct {
+	ws       *websocket.Conn
+	mutex    sync.Mutex // writes
+	messages chan message
+	err      error // why reading stopped, set before messages is closed
+}
+
+func dial(ctx context.Context, url string) (*signaling, error) {
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return nil, err
+	}
+	s := &signaling{ws: ws, messages: make(chan message, 64)}
+	go s.read()
+	return s, nil
+}
+
+func (s *signaling) read() {
+	defer close(s.messages)
+	for {
+		var msg message
+		if err := s.ws.ReadJSON(&msg); err != nil {
+			s.err = err
+			return
+		}
+		s.messages <- msg
+	}
+}
+
+func (s *signaling) send(typ, to string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ws.WriteJSON(message{Type: typ, To: to, Payload: data})
+}
+
+// sendRaw writes a frame as it is.
+func (s *signaling) sendRaw(kind int, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ws.WriteMessage(kind, data)
+}
+
+// next returns the next message, failing on error messages from the server
+// and on a closed socket.
+func (s *signaling) next(ctx context.Context) (message, error) {
+	select {
+	case msg, ok := <-s.messages:
+		switch {
+		case !ok:
+			return message{}, errClosed
+		case msg.Type == "error":
+			return msg, fmt.Errorf("server error: %s", msg.Payload)
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return message{}, ctx.Err()
+	}
+}
+
+func (s *signaling) close() {
+	s.mutex.Lock()
+	s.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	s.mutex.Unlock()
+	s.ws.Close()
+}
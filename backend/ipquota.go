@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Relays and stored files cost the server bandwidth and disk, so a public
+// instance can hold each client address to a budget for them. With
+// -ip-bytes-per-day the bytes an address sends through a relay (over the
+// WebSocket or HTTP), puts into stored files or downloads from them count
+// against it per UTC day; a request that would go over is answered 429
+// with quota_exceeded and a Retry-After for the next day, and a relay
+// stream that does is ended with ip_quota_exceeded. With -ip-max-relays an
+// address can have that many relays and stored file uploads going at once;
+// one more is answered 403 with relay_limit. Transport plans leave the
+// relays out for a host that has reached either limit. Usage is kept in
+// memory and starts over when the server does.
+
+var ipQuotas = struct {
+	mutex  sync.Mutex
+	day    time.Time
+	bytes  map[string]int64
+	relays map[string]int
+}{bytes: make(map[string]int64), relays: make(map[string]int)}
+
+func ipQuotaResetsAt() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// rollIPQuotaDay starts the byte counts over on a new day. Caller holds
+// ipQuotas.mutex.
+func rollIPQuotaDay() {
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	if !ipQuotas.day.Equal(day) {
+		ipQuotas.day = day
+		clear(ipQuotas.bytes)
+	}
+}
+
+// chargeIP counts n bytes against ip, reporting false without counting
+// them when they don't fit its budget for the day.
+func chargeIP(ip string, n int64) bool {
+	if cfg.IPBytesPerDay <= 0 {
+		return true
+	}
+	ipQuotas.mutex.Lock()
+	defer ipQuotas.mutex.Unlock()
+	rollIPQuotaDay()
+	if ipQuotas.bytes[ip]+n > cfg.IPBytesPerDay {
+		return false
+	}
+	ipQuotas.bytes[ip] += n
+	return true
+}
+
+// ipBytesUsed returns the bytes ip has used of its budget today.
+func ipBytesUsed(ip string) int64 {
+	ipQuotas.mutex.Lock()
+	defer ipQuotas.mutex.Unlock()
+	rollIPQuotaDay()
+	return ipQuotas.bytes[ip]
+}
+
+// ipMayRelay reports whether ip could start another relay now.
+func ipMayRelay(ip string) bool {
+	ipQuotas.mutex.Lock()
+	defer ipQuotas.mutex.Unlock()
+	rollIPQuotaDay()
+	if cfg.IPBytesPerDay > 0 && ipQuotas.bytes[ip] >= cfg.IPBytesPerDay {
+		return false
+	}
+	return cfg.IPMaxRelays <= 0 || ipQuotas.relays[ip] < cfg.IPMaxRelays
+}
+
+// acquireRelaySlot takes one of ip's concurrent relays, reporting false
+// when it has none left. The caller gives it back with releaseRelaySlot.
+func acquireRelaySlot(ip string) bool {
+	ipQuotas.mutex.Lock()
+	defer ipQuotas.mutex.Unlock()
+	if cfg.IPMaxRelays > 0 && ipQuotas.relays[ip] >= cfg.IPMaxRelays {
+		return false
+	}
+	ipQuotas.relays[ip]++
+	return true
+}
+
+func releaseRelaySlot(ip string) {
+	ipQuotas.mutex.Lock()
+	defer ipQuotas.mutex.Unlock()
+	if ipQuotas.relays[ip]--; ipQuotas.relays[ip] <= 0 {
+		delete(ipQuotas.relays, ip)
+	}
+}
+
+// writeIPQuotaProblem answers a request that went over its address's
+// daily budget.
+func writeIPQuotaProblem(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(ipQuotaResetsAt()).Seconds()))))
+	writeProblem(w, http.StatusTooManyRequests, problemQuotaExceeded, "This address has used up its daily relay and storage budget")
+}
+
+// writeRelayLimitProblem answers a request for one relay too many.
+func writeRelayLimitProblem(w http.ResponseWriter) {
+	writeProblem(w, http.StatusForbidden, problemRelayLimit, "This address can have "+strconv.Itoa(cfg.IPMaxRelays)+" relays and stored file uploads going at once")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// Join tokens are single-use invitations to one session. A token is
+// "<payload>.<mac>" where the payload is uploadID|tokenID|expiry and the
+// MAC is HMAC-SHA256 under the join-tokens secret. Only used token IDs are
+// stored; the signature proves everything else.
+
+const (
+	defaultJoinTokenTTL  = 24 * time.Hour
+	maxJoinTokensPerCall = 50
+)
+
+var (
+	// fallbackJoinKey signs tokens when no join-tokens secret is configured.
+	// Sessions don't survive a restart either, so losing it is harmless.
+	fallbackJoinKey     []byte
+	fallbackJoinKeyOnce sync.Once
+)
+
+// joinTokenKeys returns the signing key first, then the keys that still
+// verify.
+func joinTokenKeys(ctx context.Context) [][]byte {
+	versions, err := secrets.Versions(ctx, secretJoinTokens)
+	if err == nil && len(versions) > 0 {
+		keys := make([][]byte, len(versions))
+		for i, v := range versions {
+			keys[i] = v.Value
+		}
+		return keys
+	}
+
+	fallbackJoinKeyOnce.Do(func() {
+		if !errors.Is(err, ErrNotFound) {
+			log.Warn("Could not load join token secret, using a per-process key", "err", err)
+		}
+		fallbackJoinKey = make([]byte, 32)
+		rand.Read(fallbackJoinKey)
+	})
+	return [][]byte{fallbackJoinKey}
+}
+
+func signJoinToken(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func mintJoinToken(ctx context.Context, uploadID string, expires time.Time) string {
+	payload := uploadID + "|" + generateReceiverID() + "|" + strconv.FormatInt(expires.Unix(), 10)
+	return signJoinToken(joinTokenKeys(ctx)[0], payload)
+}
+
+// parseJoinToken verifies token for uploadID and returns its ID.
+func parseJoinToken(ctx context.Context, uploadID, token string) (string, bool) {
+	encoded, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	payload := string(raw)
+
+	valid := false
+	for _, key := range joinTokenKeys(ctx) {
+		if hmac.Equal([]byte(signJoinToken(key, payload)), []byte(token)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", false
+	}
+
+	parts := strings.Split(payload, "|")
+	if len(parts) != 3 || parts[0] != uploadID {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// redeemJoinToken checks token and burns it.
+func (u *Upload) redeemJoinToken(ctx context.Context, token string) bool {
+	id, ok := parseJoinToken(ctx, u.ID, token)
+	if !ok {
+		return false
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, used := u.usedTokens[id]; used {
+		return false
+	}
+	if u.usedTokens == nil {
+		u.usedTokens = make(map[string]struct{})
+	}
+	u.usedTokens[id] = struct{}{}
+	return true
+}
+
+// isHost reports whether r carries the upload's host token.
+func (u *Upload) isHost(r *http.Request) bool {
+	token := bearerToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(u.hostToken)) == 1
+}
+
+type mintTokensRequest struct {
+	Count      int `json:"count"`
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+type joinToken struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleMintJoinTokens is POST /api/upload/{id}/tokens. Only the host, with
+// the host_token it got in upload_created, may mint.
+func handleMintJoinTokens(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+	if !upload.isHost(r) {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Only the host can mint join tokens")
+		return
+	}
+
+	req := mintTokensRequest{Count: 1}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must be JSON")
+			return
+		}
+	}
+	if req.Count < 1 || req.Count > maxJoinTokensPerCall || req.TTLSeconds < 0 {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "count must be between 1 and 50")
+		return
+	}
+	ttl := defaultJoinTokenTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	base := publicBaseURL(r)
+	tokens := make([]joinToken, req.Count)
+	for i := range tokens {
+		token := mintJoinToken(r.Context(), upload.ID, expires)
+		tokens[i] = joinToken{
+			Token:     token,
+			URL:       base + "/?code=" + url.QueryEscape(upload.ID) + "&token=" + url.QueryEscape(token),
+			ExpiresAt: expires,
+		}
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"tokens": tokens})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJoinToken(t *testing.T) {
+	testServer(t) // for the secret cache
+	ctx := context.Background()
+	token := mintJoinToken(ctx, "upload", time.Now().Add(time.Hour))
+	id, ok := parseJoinToken(ctx, "upload", token)
+	if !ok || id == "" {
+		t.Fatalf("fresh token: %q, %v", id, ok)
+	}
+
+	payload, _, _ := strings.Cut(token, ".")
+	_, otherMAC, _ := strings.Cut(mintJoinToken(ctx, "upload", time.Now().Add(time.Hour)), ".")
+	for name, bad := range map[string]string{
+		"expired":        mintJoinToken(ctx, "upload", time.Now().Add(-time.Second)),
+		"other key":      signJoinToken(bytes.Repeat([]byte{9}, 32), "upload|"+id+"|9999999999"),
+		"no signature":   payload,
+		"swapped mac":    payload + "." + otherMAC,
+		"garbage":        "not.a token",
+		"other upload's": mintJoinToken(ctx, "other", time.Now().Add(time.Hour)),
+	} {
+		if _, ok := parseJoinToken(ctx, "upload", bad); ok {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+}
+
+func TestRedeemJoinToken(t *testing.T) {
+	testServer(t)
+	ctx := context.Background()
+	upload := &Upload{ID: "upload"}
+	token := mintJoinToken(ctx, upload.ID, time.Now().Add(time.Hour))
+	if !upload.redeemJoinToken(ctx, token) {
+		t.Fatal("first use refused")
+	}
+	if upload.redeemJoinToken(ctx, token) {
+		t.Error("second use accepted")
+	}
+	if other := mintJoinToken(ctx, upload.ID, time.Now().Add(time.Hour)); !upload.redeemJoinToken(ctx, other) {
+		t.Error("burning one token burnt another")
+	}
+}
+
+// TestJoinTokenRotation mints under the join-tokens secret and rotates it.
+func TestJoinTokenRotation(t *testing.T) {
+	testServer(t) // for the secret cache
+	ctx := context.Background()
+	t.Cleanup(func() {
+		secrets.mutex.Lock()
+		delete(secrets.values, secretJoinTokens)
+		secrets.mutex.Unlock()
+	})
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	setEnvSecret(t, secretJoinTokens, first, nil)
+	secrets.load(ctx, secretJoinTokens)
+	token := mintJoinToken(ctx, "upload", time.Now().Add(time.Hour))
+
+	setEnvSecret(t, secretJoinTokens, second, first)
+	secrets.load(ctx, secretJoinTokens)
+	if _, ok := parseJoinToken(ctx, "upload", token); !ok {
+		t.Error("token refused while its key is still kept")
+	}
+
+	setEnvSecret(t, secretJoinTokens, second, nil)
+	secrets.load(ctx, secretJoinTokens)
+	if _, ok := parseJoinToken(ctx, "upload", token); ok {
+		t.Error("token accepted after its key was dropped")
+	}
+}
+
+func TestMintJoinTokens(t *testing.T) {
+	base := testServer(t)
+	id, hostToken := openStoringHost(t)
+	mint := func(token, body string) *http.Response {
+		return storedRequest(t, "POST", base+"/api/upload/"+id+"/tokens", token, []byte(body), nil)
+	}
+
+	expectStatus(t, "minting without the host token", mint("", ""), http.StatusForbidden)
+	expectStatus(t, "minting too many", mint(hostToken, `{"count": 51}`), http.StatusBadRequest)
+
+	resp := mint(hostToken, `{"count": 3, "ttl_seconds": 60}`)
+	expectStatus(t, "minting", resp, http.StatusCreated)
+	var minted struct {
+		Tokens []joinToken `json:"tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&minted); err != nil || len(minted.Tokens) != 3 {
+		t.Fatalf("minted %+v, %v", minted, err)
+	}
+	upload, _ := lookupUpload(id)
+	for _, token := range minted.Tokens {
+		if time.Until(token.ExpiresAt) > time.Minute {
+			t.Errorf("token expires at %v, want within a minute", token.ExpiresAt)
+		}
+		if !strings.Contains(token.URL, "token=") || !upload.redeemJoinToken(context.Background(), token.Token) {
+			t.Errorf("token %+v doesn't let a receiver in", token)
+		}
+	}
+}
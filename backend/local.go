@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/pion/mdns/v2"
+	"golang.org/x/net/ipv4"
+)
+
+// -local runs the server for a LAN party or an air-gapped site, where it
+// replaces passing a USB stick around and nothing may leave the network:
+//
+//   - it makes no outbound calls: no webhooks, no telemetry even with the
+//     OTEL_* variables set, and flags that would reach out (TURN and ICE
+//     servers, Redis, S3, Postgres, Vault, AWS KMS, SMTP, webhooks, Slack
+//     and Discord) refuse to start it instead of being ignored
+//   - it only serves clients on the local network: loopback, private and
+//     link-local addresses; anyone else gets 403
+//   - it answers mDNS for <-local-name>.local, so people can type
+//     http://sendmyzip.local:3000 instead of an address
+//
+// Plain HTTP is all it needs. Peers find each other through their host
+// candidates, which is why no ICE servers are handed out.
+
+// localConflicts lists the flags that would make a -local server reach
+// outside the network.
+func localConflicts(c config) []string {
+	var conflicts []string
+	check := func(set bool, flag string) {
+		if set {
+			conflicts = append(conflicts, flag)
+		}
+	}
+	check(c.TURNURLs != "", "-turn-urls")
+	check(c.ICEServers != "" || c.ICEServersFile != "", "-ice-servers")
+	check(c.SessionStore != "" && c.SessionStore != "memory", "-session-store")
+	check(c.MessageBus != "", "-message-bus")
+	check(strings.Contains(c.Snapshot, "://"), "-snapshot")
+	check(c.HistoryDB != "" && !strings.HasPrefix(c.HistoryDB, "sqlite:"), "-history-db")
+	check(strings.HasPrefix(c.BlobStore, "s3:"), "-blob-store")
+	check(c.Secrets != "env" && !strings.HasPrefix(c.Secrets, "file:"), "-secrets")
+	check(c.VaultPKIRole != "", "-vault-pki-role")
+	check(c.SMTPAddr != "", "-smtp-addr")
+	check(c.WebhookURLs != "", "-webhook-url")
+	check(c.SlackWebhook != "", "-slack-webhook")
+	check(c.DiscordWebhook != "", "-discord-webhook")
+	return conflicts
+}
+
+// setupLocalMode checks the configuration and starts advertising the
+// server over mDNS.
+func setupLocalMode() error {
+	if conflicts := localConflicts(cfg); len(conflicts) > 0 {
+		return errors.New("-local does not allow " + strings.Join(conflicts, ", "))
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", mdns.DefaultAddressIPv4)
+	if err != nil {
+		return err
+	}
+	l, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return err
+	}
+	name := cfg.LocalName + ".local"
+	if _, err := mdns.Server(ipv4.NewPacketConn(l), nil, &mdns.Config{LocalNames: []string{name}}); err != nil {
+		l.Close()
+		return err
+	}
+
+	_, port, _ := net.SplitHostPort(cfg.Addr)
+	urls := []string{"http://" + net.JoinHostPort(name, port)}
+	for _, ip := range lanAddresses() {
+		urls = append(urls, "http://"+net.JoinHostPort(ip.String(), port))
+	}
+	log.Info("Local mode: serving the local network only", "urls", urls)
+	return nil
+}
+
+// lanAddresses returns this machine's private IPv4 addresses.
+func lanAddresses() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && ipnet.IP.IsPrivate() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+// isLocalClient reports whether ip is on the local network.
+func isLocalClient(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && (parsed.IsLoopback() || parsed.IsPrivate() || parsed.IsLinkLocalUnicast())
+}
+
+// localOnly turns away clients from outside the local network.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalClient(clientIP(r)) {
+			writeProblem(w, http.StatusForbidden, problemForbidden, "This server only serves its local network")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
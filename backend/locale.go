@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/text/language"
+)
+
+// Clients can say which language they read, as locale in join_request or
+// identity registration, or else through the Accept-Language of the
+// request that opened them. A receiver's is relayed in receivers_update so
+// the host can word what it shows about that receiver in its language, and
+// the e-mails the server writes an identity use the identity's.
+
+// maxLocale caps a BCP 47 tag; real ones are far shorter.
+const maxLocale = 35
+
+var errLocale = errors.New("locale must be a BCP 47 language tag")
+
+// parseLocale returns s as a canonical BCP 47 tag.
+func parseLocale(s string) (string, error) {
+	if len(s) > maxLocale {
+		return "", errLocale
+	}
+	tag, err := language.Parse(s)
+	if err != nil {
+		return "", errLocale
+	}
+	return tag.String(), nil
+}
+
+// acceptLocale returns the language r prefers most, or "".
+func acceptLocale(r *http.Request) string {
+	header := r.Header.Get("Accept-Language")
+	if header == "" || len(header) > 1024 {
+		return ""
+	}
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil || len(tags) == 0 || tags[0] == language.Und {
+		return ""
+	}
+	return tags[0].String()
+}
+
+// clientLocale is the locale a client asked for, or the one its request
+// prefers when it didn't.
+func clientLocale(explicit, fallback string) (string, error) {
+	if explicit == "" {
+		return fallback, nil
+	}
+	return parseLocale(explicit)
+}
+
+// offerMail is the e-mail telling an identity a file is waiting. Body takes
+// the file name, its size and the link. The confirmation e-mail has the same
+// shape, with just the link.
+type offerMail struct {
+	Language string
+	Subject  string
+	Body     string
+}
+
+// offerMails and confirmMails are matched by mailLanguages, in the same
+// order. Identities without a locale get the first, as before locales
+// existed.
+var (
+	mailLanguages = language.NewMatcher([]language.Tag{language.Danish, language.English})
+	offerMails    = []offerMail{
+		{"da", "Du har modtaget en fil", "Nogen vil sende dig %s (%s).\r\n\r\nHent den her: %s\r\n"},
+		{"en", "You have received a file", "Someone wants to send you %s (%s).\r\n\r\nGet it here: %s\r\n"},
+	}
+	confirmMails = []offerMail{
+		{"da", "Bekræft din e-mailadresse", "Bekræft at du vil have besked om filer på denne adresse: %s\r\n\r\nHar du ikke bedt om det, kan du se bort fra denne e-mail.\r\n"},
+		{"en", "Confirm your e-mail address", "Confirm that you want to hear about files at this address: %s\r\n\r\nIf you didn't ask for this, you can ignore this e-mail.\r\n"},
+	}
+)
+
+// offerMailFor returns the offer e-mail in locale, or in English when
+// there is no translation.
+func offerMailFor(locale string) offerMail {
+	return mailFor(offerMails, locale)
+}
+
+// confirmMailFor is offerMailFor for the confirmation e-mail.
+func confirmMailFor(locale string) offerMail {
+	return mailFor(confirmMails, locale)
+}
+
+func mailFor(mails []offerMail, locale string) offerMail {
+	if locale == "" {
+		return mails[0]
+	}
+	_, i, confidence := mailLanguages.Match(language.Make(locale))
+	if confidence == language.No {
+		return mails[1]
+	}
+	return mails[i]
+}
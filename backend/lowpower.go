@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+)
+
+// A client on an old phone or a battery saver can list low_power in its
+// hello capabilities. For that socket the server then pings less often and
+// waits longer for a sign of life, holds back receivers_update and
+// transfer_progress and sends only the newest of each every
+// lowPowerBatchInterval, and transport plans involving it advise a smaller
+// chunk size, which older WebRTC stacks cope with better.
+
+const (
+	featureLowPower = "low_power"
+
+	wsLowPowerPongWait     = 3 * time.Minute
+	wsLowPowerPingInterval = wsLowPowerPongWait * 4 / 10
+
+	lowPowerBatchInterval = 5 * time.Second
+
+	defaultChunkSize  = 64 << 10
+	lowPowerChunkSize = 16 << 10
+)
+
+func (c *wsConn) isLowPower() bool {
+	return c != nil && c.root().lowPower.Load()
+}
+
+func (c *wsConn) pongWait() time.Duration {
+	if c.isLowPower() {
+		return wsLowPowerPongWait
+	}
+	return wsPongWait
+}
+
+func (c *wsConn) pingInterval() time.Duration {
+	if c.isLowPower() {
+		return wsLowPowerPingInterval
+	}
+	return wsPingInterval
+}
+
+// batchKey names the slot a message takes while batched; messages with the
+// same key replace each other. It is empty for messages that are sent at
+// once.
+func batchKey(v any) string {
+	msg, ok := v.(Message)
+	if !ok {
+		return ""
+	}
+	switch msg.Type {
+	case "receivers_update":
+		return msg.Type + ":" + msg.SessionID
+	case "transfer_progress":
+		if p, ok := msg.Payload.(*hostProgress); ok {
+			return msg.Type + ":" + msg.SessionID + ":" + p.ReceiverID
+		}
+	}
+	return ""
+}
+
+// hold batches v for a low-power socket. It reports false when v has to
+// be sent right away.
+func (c *wsConn) hold(v any) bool {
+	if !c.isLowPower() {
+		return false
+	}
+	key := batchKey(v)
+	if key == "" {
+		return false
+	}
+
+	c.batchMutex.Lock()
+	defer c.batchMutex.Unlock()
+	if _, ok := c.batch[key]; !ok {
+		c.batchOrder = append(c.batchOrder, key)
+	}
+	if c.batch == nil {
+		c.batch = make(map[string]any)
+	}
+	c.batch[key] = v
+	return true
+}
+
+// takeBatch empties the batch, oldest slot first.
+func (c *wsConn) takeBatch() []any {
+	c.batchMutex.Lock()
+	defer c.batchMutex.Unlock()
+	out := make([]any, len(c.batchOrder))
+	for i, key := range c.batchOrder {
+		out[i] = c.batch[key]
+	}
+	c.batch, c.batchOrder = nil, nil
+	return out
+}
+
+// chunkSize is the data channel chunk size to advise for a pair.
+func chunkSize(host, receiver *wsConn) int {
+	if host.isLowPower() || receiver.isLowPower() {
+		return lowPowerChunkSize
+	}
+	return defaultChunkSize
+}
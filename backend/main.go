@@ -1,60 +1,226 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"embed"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"io/fs"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Receiver struct {
 	ID          string          `json:"id"`
 	Name        string          `json:"name"` // self-chosen name to display to the host
-	Conn        *websocket.Conn `json:"-"`
+	PublicKey   string          `json:"public_key,omitempty"`
+	Conn        *wsConn         `json:"-"`
 	ConnectedAt time.Time       `json:"connected_at"`
+	ctx         context.Context // trace context of the join request
+	ip          string
+	progress    receiverProgress
+
+	presignaled bool // was handed a held offer
+	offerIndex  int
+
+	capabilities     []string // transports the client supports
+	failedTransports []string
+	routing          routingConstraint
+
+	availableBytes int64  // free disk space the receiver reported, -1 if unknown
+	bandwidth      int64  // bytes per second from the last probe, 0 if unknown; see bandwidth.go
+	unconfirmed    string // transport waiting for the host to confirm it, see estimate.go
+
+	selection *fileSelection // files picked with request_files, see selection.go
+
+	queuedAt time.Time // when it asked to join, see queue.go
+
+	// Time to the first offer, see waiting.go
+	admittedAt time.Time
+	served     bool
+	waitTimer  *time.Timer
+
+	locale        string   // BCP 47, see locale.go
+	verifiedKey   string   // public key the receiver proved it holds
+	encryptionKey string   // X25519 key snippets are encrypted to
+	contact       *Contact // set when the host has the receiver in its contact book
+
+	// Guards Conn, which changes when the receiver resumes; see rejoin.go
+	connMutex   sync.Mutex
+	resumeToken string
+	away        bool
+	closed      bool
+	outbox      []Message
+	awayTimer   *time.Timer
 }
 
 type Metadata struct {
+	Kind     string `json:"kind,omitempty"` // "snippet" for text sessions, see snippet.go
 	FileName string `json:"filename"`
 	FileType string `json:"filetype"`
 	FileSize int64  `json:"filesize"`
+	SHA256   string `json:"sha256,omitempty"` // lowercase hex, see checksums.go
+
+	// Set for sessions created with a manifest, see manifest.go
+	Files     []ManifestFile `json:"files,omitempty"`
+	TotalSize int64          `json:"total_size,omitempty"`
 }
 
 type Upload struct {
-	ID        string          `json:"id"`
-	Host      *websocket.Conn `json:"-"`
-	Meta      Metadata        `json:"metadata"`
-	Receivers []*Receiver     `json:"receivers"`
-	CreatedAt time.Time       `json:"created_at"`
-	mutex     sync.RWMutex
+	ID        string      `json:"id"`
+	Host      *wsConn     `json:"-"`
+	Meta      Metadata    `json:"metadata"`
+	Receivers []*Receiver `json:"receivers"`
+	CreatedAt time.Time   `json:"created_at"`
+
+	RequireApproval bool        `json:"require_approval"`
+	MaxReceivers    int         `json:"max_receivers"` // 0 means no limit
+	pending         []*Receiver // joined, waiting for the host to approve
+	queue           []*Receiver // waiting for a place, see queue.go
+
+	progressSentAt time.Time // last receivers_update caused by progress
+	reverseOffers  []*reverseOffer
+	fileRequests   []*fileRequest // pull-mode requests, see filerequest.go
+	completions    []completion   // receivers that confirmed the transfer, see completion.go
+
+	bans []sessionBan
+
+	// Hold-open state, see holdopen.go
+	heldOffers       []heldOffer
+	offersRegistered int
+	hostDetached     bool
+	hostOutbox       []Message
+	holdTimer        *time.Timer
+
+	inline *inlineFile // small file delivered over signaling, see inline.go
+
+	hostCapabilities []string
+	hostRouting      routingConstraint
+
+	passphrase *passphraseHash // nil when the session is open to anyone with the link
+	recipient  string          // normalized public key the session is addressed to, if any
+
+	hostIdentity string // key the host proved when creating the session, if any
+
+	// Secondary host devices, see continuation.go
+	linkedHosts   []*wsConn
+	continuations []continuation
+	baseURL       string // public origin the session was created through
+
+	room string // room the session is announced in, see rooms.go
+
+	// Set for sessions published through the API, see publish.go
+	expiresAt     time.Time // zero for sessions that live as long as their host
+	labels        []string
+	maxDownloads  int // 0 means no limit
+	downloads     int
+	webhookURL    string
+	webhookSecret string
+	tenant        string // API key that published the session, see events.go
+	fromCompanion bool   // created through the companion API, see companion.go
+
+	country string // host's country for the public stats, see publicstats.go
+
+	vocabulary *idVocabulary // its ID was drawn from, see vocab.go
+
+	sealedSignaling bool // signaling payloads are end-to-end encrypted, see sealed.go
+
+	hostToken    string // authenticates the host on the REST API
+	resumeToken  string
+	hostSession  string // hashed key a reloaded host reattaches with, see hostsession.go
+	RequireToken bool   `json:"require_token"`
+	usedTokens   map[string]struct{}
+
+	lastActivity atomic.Int64 // unix nanos of the last message, see reaper.go
+
+	mutex sync.RWMutex
+	ctx   context.Context // trace context of the creating request
+
+	notes string // private to the host, never sent to receivers
+
+	// Set while the host has closed the session but can still undo it
+	closedAt      time.Time
+	restoreToken  string
+	finalizeTimer *time.Timer
+}
+
+// hostConn returns the current host socket. It can change when a host
+// reattaches, so always go through this instead of reading Host directly.
+func (u *Upload) hostConn() *wsConn {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.Host
+}
+
+// isFull reports whether the session has reached its receiver limit.
+// Receivers waiting for approval count toward it.
+func (u *Upload) isFull() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.MaxReceivers > 0 && len(u.Receivers)+len(u.pending) >= u.MaxReceivers
+}
+
+// swapHost makes conn the host socket and returns the previous one.
+func (u *Upload) swapHost(conn *wsConn) *wsConn {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	old := u.Host
+	u.Host = conn
+	return old
 }
 
 type Message struct {
-	Type    string `json:"type"`
-	Payload any    `json:"payload"`
+	Type    string            `json:"type"`
+	Payload any               `json:"payload"`
+	Trace   map[string]string `json:"trace,omitempty"` // W3C trace context carrier
+
+	// Routing, see envelope.go
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	SessionID string `json:"session_id,omitempty"` // for sockets running several uploads, see mux.go
 }
 
 type JoinRequest struct {
-	Name string `json:"name"`
+	Name         string   `json:"name"`
+	PublicKey    string   `json:"public_key,omitempty"`
+	Passphrase   string   `json:"passphrase,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	ResumeToken  string   `json:"resume_token,omitempty"`
+
+	EncryptionKey string `json:"encryption_key,omitempty"` // X25519, required for snippet sessions
+	Locale        string `json:"locale,omitempty"`         // BCP 47, see locale.go
 }
 
+// WebRTCSignalingMessage is the plain payload of signaling messages. Who it
+// is from and for is in the envelope, see envelope.go.
 type WebRTCSignalingMessage struct {
-	Type       string `json:"type"`
-	SenderID   string `json:"sender_id,omitempty"`
-	ReceiverID string `json:"receiver_id,omitempty"`
-	PeerID     string `json:"peer_id,omitempty"`
-	Offer      any    `json:"offer,omitempty"`
-	Answer     any    `json:"answer,omitempty"`
-	Candidate  any    `json:"candidate,omitempty"`
+	Offer     any    `json:"offer,omitempty"`
+	Answer    any    `json:"answer,omitempty"`
+	Candidate any    `json:"candidate,omitempty"`
+	OfferID   string `json:"offer_id,omitempty"` // set for receiver-to-host transfers, see reverse.go
 }
 
 var (
@@ -66,12 +232,9 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Tillad alle origins for nu
 	},
-}
-
-func generateID() string {
-	bytes := make([]byte, 4)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeProblem(w, status, problemInvalidRequest, reason.Error())
+	},
 }
 
 func generateReceiverID() string {
@@ -80,88 +243,447 @@ func generateReceiverID() string {
 	return hex.EncodeToString(bytes)
 }
 
+// clientIP returns the address of the peer that made the request. Behind a
+// trusted proxy that is the last X-Forwarded-For hop, which the proxy itself
+// appended; earlier entries are client-controlled.
+func clientIP(r *http.Request) string {
+	if cfg.TrustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func handleNewFileUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "upload.create", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	if draining.Load() {
+		span.SetStatus(codes.Error, "draining")
+		writeProblem(w, http.StatusServiceUnavailable, problemDraining, "")
+		return
+	}
+
+	if isBanned(ctx, clientIP(r)) {
+		span.SetStatus(codes.Error, "banned")
+		writeProblem(w, http.StatusForbidden, problemBanned, "")
+		return
+	}
+
 	// Parse metadata from query parameters
 	meta := &Metadata{
 		FileName: r.URL.Query().Get("filename"),
 		FileType: r.URL.Query().Get("filetype"),
+		SHA256:   strings.ToLower(r.URL.Query().Get("sha256")),
 	}
 
 	filesizeStr := r.URL.Query().Get("filesize")
-	if meta.FileName == "" || meta.FileType == "" || filesizeStr == "" { // Der er noget data der ikke er validt
-		http.Error(w, "Missing required query parameters: filename, filetype, filesize", http.StatusBadRequest)
-		return
-	}
+
+	snippet := r.URL.Query().Get("kind") == kindSnippet
+	// Without any of them the host sends a manifest once connected
+	withManifest := !snippet && meta.FileName == "" && meta.FileType == "" && filesizeStr == ""
 
 	var err error
-	meta.FileSize, err = strconv.ParseInt(filesizeStr, 10, 64)
+	if snippet {
+		var ok bool
+		if *meta, ok = snippetMetadata(r.URL.Query()); !ok {
+			span.SetStatus(codes.Error, "invalid snippet type")
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Snippets are text/plain or text/uri-list")
+			return
+		}
+	} else if !withManifest {
+		if meta.FileName == "" || meta.FileType == "" || filesizeStr == "" { // Der er noget data der ikke er validt
+			span.SetStatus(codes.Error, "missing query parameters")
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Missing required query parameters: filename, filetype, filesize")
+			return
+		}
+
+		meta.FileSize, err = strconv.ParseInt(filesizeStr, 10, 64)
+		if err != nil {
+			span.SetStatus(codes.Error, "invalid filesize")
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid filesize parameter")
+			return
+		}
+		if meta.SHA256 != "" && !sha256Pattern.MatchString(meta.SHA256) {
+			span.SetStatus(codes.Error, "invalid sha256")
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "sha256 must be 64 hex characters")
+			return
+		}
+	}
+
+	// A reloaded host gets its session back, see hostsession.go
+	hostSession, err := hostSessionKey(r)
 	if err != nil {
-		http.Error(w, "Invalid filesize parameter", http.StatusBadRequest)
+		span.SetStatus(codes.Error, "invalid host session")
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, err.Error())
 		return
 	}
+	if hostSession != "" && !withManifest {
+		if existing := claimHostSession(hostSession, *meta); existing != nil {
+			span.SetAttributes(attribute.String("upload.id", existing.ID), attribute.Bool("upload.reattached", true))
+			conn, err := upgrade(w, r)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "upgrade failed")
+				return
+			}
+			reattachHostSession(existing, conn)
+			return
+		}
+	}
 
-	// Generate unique upload ID
-	uploadID := generateID()
+	// A retried request with the same Idempotency-Key gets the session the
+	// first attempt created instead of a new one
+	idemKey := idempotencyKey(r)
+	if idemKey != "" && !withManifest {
+		existing, conflict := lookupIdempotent(idemKey, *meta)
+		if conflict {
+			span.SetStatus(codes.Error, "idempotency conflict")
+			writeProblem(w, http.StatusUnprocessableEntity, problemIdempotencyConflict, "Idempotency-Key was already used for a different file")
+			return
+		}
+		if existing != nil {
+			span.SetAttributes(attribute.String("upload.id", existing.ID), attribute.Bool("upload.replayed", true))
+			conn, err := upgrade(w, r)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "upgrade failed")
+				return
+			}
+			reattachHost(existing, conn, map[string]any{"id": existing.ID, "replayed": true})
+			return
+		}
+	}
+
+	span.SetAttributes(
+		attribute.String("file.type", meta.FileType),
+		attribute.Int64("file.size", meta.FileSize),
+	)
+
+	// Sessions can be addressed to a receiver identity instead of a link
+	var recipient string
+	if key := r.URL.Query().Get("recipient"); key != "" {
+		if _, recipient, err = parsePublicKey(key); err != nil {
+			span.SetStatus(codes.Error, "invalid recipient")
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	var maxReceivers int
+	if s := r.URL.Query().Get("max_receivers"); s != "" {
+		if maxReceivers, err = strconv.Atoi(s); err != nil || maxReceivers < 0 {
+			span.SetStatus(codes.Error, "invalid max_receivers")
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid max_receivers parameter")
+			return
+		}
+	}
+
+	// Publishing into a room needs the room's key
+	room := r.URL.Query().Get("room")
+	if room != "" {
+		if !roomNamePattern.MatchString(room) {
+			span.SetStatus(codes.Error, "invalid room")
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Room names are 1-64 lowercase letters, digits, - and _")
+			return
+		}
+		ok, err := authorizeRoom(ctx, room, roomKey(r))
+		if err != nil {
+			span.RecordError(err)
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not look up room")
+			return
+		}
+		if !ok {
+			span.SetStatus(codes.Error, "invalid room key")
+			writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid or missing Sendmyzip-Room-Key")
+			return
+		}
+	}
+
+	vocabulary, ok := vocabularyFor(r.URL.Query().Get("vocabulary"))
+	if !ok {
+		span.SetStatus(codes.Error, "unknown vocabulary")
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Unknown vocabulary "+r.URL.Query().Get("vocabulary"))
+		return
+	}
+
+	hostKey, ok := hostIdentity(r)
+	if !ok {
+		span.SetStatus(codes.Error, "invalid host identity")
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid host_key, host_timestamp or host_signature")
+		return
+	}
+
+	// Hosts with an API key are held to its quotas, see quota.go
+	apiKey, withKey, err := requestAPIKey(r)
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid api key")
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid API key")
+		return
+	}
+	var tenant string
+	var quotaWarnings []quotaWarning
+	if withKey {
+		tenant = apiKey.ID
+		limits := limitsFor(apiKey)
+		// A manifest's size is only known once it is read
+		if !withManifest {
+			if quotaWarnings, err = chargeQuota(tenant, &limits, quotaBytesOf(*meta)); err != nil {
+				span.SetStatus(codes.Error, "quota exceeded")
+				writeQuotaProblem(w, err)
+				return
+			}
+		}
+	}
 
 	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrade(w, r)
 	if err != nil {
-		http.Error(w, "Could not upgrade connection", http.StatusBadRequest)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upgrade failed")
 		return
 	}
 
+	if withManifest {
+		if *meta, err = readManifest(conn); err != nil {
+			span.SetStatus(codes.Error, "invalid manifest")
+			conn.WriteJSON(errorMessage(errCodeInvalidPayload, err.Error(), "manifest"))
+			conn.Close()
+			return
+		}
+		if idemKey != "" {
+			existing, conflict := lookupIdempotent(idemKey, *meta)
+			if conflict {
+				span.SetStatus(codes.Error, "idempotency conflict")
+				conn.WriteJSON(errorMessage(problemIdempotencyConflict, "Idempotency-Key was already used for different files", "manifest"))
+				conn.Close()
+				return
+			}
+			if existing != nil {
+				span.SetAttributes(attribute.String("upload.id", existing.ID), attribute.Bool("upload.replayed", true))
+				reattachHost(existing, conn, map[string]any{"id": existing.ID, "replayed": true})
+				return
+			}
+		}
+		if hostSession != "" {
+			if existing := claimHostSession(hostSession, *meta); existing != nil {
+				span.SetAttributes(attribute.String("upload.id", existing.ID), attribute.Bool("upload.reattached", true))
+				reattachHostSession(existing, conn)
+				return
+			}
+		}
+		if withKey {
+			limits := limitsFor(apiKey)
+			if quotaWarnings, err = chargeQuota(tenant, &limits, quotaBytesOf(*meta)); err != nil {
+				span.SetStatus(codes.Error, "quota exceeded")
+				conn.WriteJSON(errorMessage(problemQuotaExceeded, err.Error(), "manifest"))
+				conn.Close()
+				return
+			}
+		}
+	}
+
 	// Create upload session
 	upload := &Upload{
-		ID:        uploadID,
-		Host:      conn,
-		Meta:      *meta,
-		Receivers: make([]*Receiver, 0),
-		CreatedAt: time.Now(),
+		Host:             conn,
+		Meta:             *meta,
+		Receivers:        make([]*Receiver, 0),
+		CreatedAt:        time.Now(),
+		RequireApproval:  r.URL.Query().Get("require_approval") == "true",
+		MaxReceivers:     maxReceivers,
+		hostCapabilities: parseCapabilities(r.URL.Query().Get("capabilities")),
+		hostRouting:      routingFor(r),
+		RequireToken:     r.URL.Query().Get("require_token") == "true",
+		sealedSignaling:  r.URL.Query().Get("sealed_signaling") == "true",
+		hostToken:        generateReceiverID() + generateReceiverID(),
+		resumeToken:      generateReceiverID() + generateReceiverID(),
+		recipient:        recipient,
+		hostIdentity:     hostKey,
+		baseURL:          publicBaseURL(r),
+		room:             room,
+		country:          clientCountry(r),
+		tenant:           tenant,
+		vocabulary:       vocabulary,
+		ctx:              trace.ContextWithSpanContext(context.Background(), span.SpanContext()),
+	}
+
+	if passphrase := requestPassphrase(r); passphrase != "" {
+		upload.passphrase = hashPassphrase(passphrase)
 	}
 
-	uploadsMutex.Lock()
-	uploads[uploadID] = upload
-	uploadsMutex.Unlock()
+	upload.touch()
+	uploadID := registerUpload(upload)
+	span.SetAttributes(attribute.String("upload.id", uploadID))
+	bindHostSession(hostSession, upload)
+	if idemKey != "" {
+		rememberIdempotent(idemKey, upload)
+	}
 
 	// Send upload ID to host
+	payload := map[string]any{
+		"id":               uploadID,
+		"host_token":       upload.hostToken,
+		"resume_token":     upload.resumeToken,
+		"inline_max_bytes": cfg.InlineMaxBytes,
+		"ice_servers":      iceServersFor(ctx, upload, hostPeer),
+	}
+	if status, ok := rateStatusFrom(r); ok {
+		payload["rate_limit"] = status
+	}
+	if len(quotaWarnings) > 0 {
+		payload["quota_warnings"] = quotaWarnings
+	}
 	response := Message{
 		Type:    "upload_created",
-		Payload: map[string]string{"id": uploadID},
+		Payload: payload,
+		Trace:   injectTrace(ctx),
 	}
 	conn.WriteJSON(response)
 
+	announceUpload(upload)
+	if upload.recipient != "" {
+		go notifyIdentity(upload, publicBaseURL(r)+"/?code="+url.QueryEscape(uploadID))
+	}
+
 	// Handle host messages
-	go handleHostConnection(upload)
+	go handleHostConnection(upload, conn)
 }
 
-func handleHostConnection(upload *Upload) {
+// reattachHost hands an existing upload to a new host socket, closing the
+// previous one, and tells the host which session it is attached to.
+func reattachHost(upload *Upload, conn *wsConn, payload map[string]any) {
+	old := upload.swapHost(conn)
+	old.Close()
+
+	payload["ice_servers"] = iceServersFor(upload.ctx, upload, hostPeer)
+	conn.WriteJSON(Message{Type: "upload_created", Payload: payload})
+	attachHost(upload)
+	sendReceiversUpdate(upload)
+
+	go handleHostConnection(upload, conn)
+}
+
+func handleHostConnection(upload *Upload, conn *wsConn) {
 	defer func() {
-		upload.Host.Close()
-		uploadsMutex.Lock()
-		delete(uploads, upload.ID)
-		uploadsMutex.Unlock()
+		conn.Close()
+		conn.closeChannels()
+		hostGone(upload, conn)
 	}()
 
 	for {
 		var msg Message
-		err := upload.Host.ReadJSON(&msg)
+		err := conn.ReadJSON(&msg)
 		if err != nil {
 			log.Printf("Host connection error: %v", err)
 			break
 		}
+		target, ok := upload, true
+		if id := cmp.Or(msg.SessionID, upload.ID); id != upload.ID || conn.multiplexing() {
+			target, ok = conn.channelUpload(id)
+		}
+		// The upload may have ended or moved to another socket since
+		var targetConn *wsConn
+		if ok {
+			targetConn = target.hostConn()
+		}
+		if targetConn.root() != conn {
+			conn.WriteJSON(errorMessage(errCodeInvalidPayload, "no upload with that session_id on this connection", msg.Type))
+			continue
+		}
+		target.touch()
+		handleHostMessage(target, targetConn, address(msg, hostPeer))
+	}
+}
 
-		switch msg.Type {
-		case "get_receivers":
-			sendReceiversUpdate(upload)
-		case "webrtc_offer":
-			handleWebRTCSignaling(upload, msg, true)
-		case "webrtc_answer":
-			handleWebRTCSignaling(upload, msg, true)
-		case "webrtc_ice_candidate":
-			handleWebRTCSignaling(upload, msg, true)
-		default:
-			// Unknown message type
+// hostGone ends or suspends upload once its host connection conn is gone.
+func hostGone(upload *Upload, conn *wsConn) {
+	if upload.hostConn() != conn {
+		// Another socket took over the session; it isn't over
+		return
+	}
+	if hostAway(upload, conn) {
+		return
+	}
+	finalizeUpload(upload)
+}
+
+// handleHostMessage handles one message from any of the host's sockets.
+func handleHostMessage(upload *Upload, conn *wsConn, msg Message) {
+	switch msg.Type {
+	case "hello":
+		if !handleHello(conn, msg) {
+			conn.Close()
+		}
+	case "get_receivers":
+		sendReceiversUpdate(upload)
+	case "create_upload":
+		handleCreateUpload(upload, conn, msg)
+	case "close_session":
+		softDelete(upload)
+	case "approve_receiver":
+		handleReceiverDecision(upload, msg, true)
+	case "reject_receiver":
+		handleReceiverDecision(upload, msg, false)
+	case "kick_receiver":
+		handleKickReceiver(upload, msg)
+	case "ban_receiver":
+		handleBanReceiver(upload, msg)
+	case "unban_receiver":
+		handleUnbanReceiver(upload, msg)
+	case "ice_outcome":
+		handleICEOutcome(upload, msg, nil)
+	case "webrtc_failed":
+		handleWebRTCFailed(upload, msg, nil)
+	case "relay_end":
+		handleRelayEnd(upload, msg, nil)
+	case "bandwidth_probe":
+		handleBandwidthProbe(upload, msg, nil)
+	case "relay_confirm":
+		handleRelayConfirm(upload, msg)
+	case "inline_file":
+		handleInlineFile(upload, msg)
+	case "register_offers":
+		handleRegisterOffers(upload, msg)
+	case "set_notes":
+		handleSetNotes(upload, msg)
+	case "update_metadata":
+		handleUpdateMetadata(upload, msg)
+	case "network_changed":
+		handleHostNetworkChanged(upload, conn, msg)
+	case "chat_message":
+		handleHostChat(upload, msg)
+	case "broadcast":
+		handleBroadcast(upload, msg)
+	case "snippet":
+		handleSnippet(upload, msg)
+	case "reverse_offer_response":
+		handleReverseOfferResponse(upload, msg)
+	case "file_request_response":
+		handleFileRequestResponse(upload, msg)
+	case "create_continuation":
+		handleCreateContinuation(upload, conn)
+	case "create_pin":
+		handleCreatePIN(upload, conn, msg)
+	case "restore_session":
+		if restoreUpload(upload, "", false) {
+			conn.WriteJSON(Message{Type: "session_restored", Payload: map[string]string{"id": upload.ID}})
 		}
+	case "webrtc_offer", "webrtc_answer", "webrtc_ice_candidate":
+		if err := handleWebRTCSignaling(upload.ctx, upload, msg); err != nil {
+			conn.WriteJSON(invalidPayload(msg, err))
+		}
+	default:
+		conn.WriteJSON(unknownType(msg))
 	}
 }
 
@@ -169,67 +691,267 @@ func handleJoinUpload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	uploadID := vars["id"]
 
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "upload.join",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("upload.id", uploadID)),
+	)
+	defer span.End()
+
 	uploadsMutex.RLock()
 	upload, exists := uploads[uploadID]
 	uploadsMutex.RUnlock()
 
 	if !exists {
-		http.Error(w, "Upload not found", http.StatusNotFound)
+		// With a message bus the join is bridged to the node running the
+		// session, see bus.go
+		if s, elsewhere := lookupElsewhere(ctx, uploadID); elsewhere && bus != nil {
+			span.SetAttributes(attribute.String("upload.node", s.Node))
+			bridgeJoin(w, r, s)
+			return
+		}
+		span.SetStatus(codes.Error, "upload not found")
+		writeSessionMissing(w, r, uploadID)
+		return
+	}
+
+	routing, ok := admitJoin(ctx, span, w, r, upload)
+	if !ok {
 		return
 	}
 
 	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrade(w, r)
 	if err != nil {
-		http.Error(w, "Could not upgrade connection", http.StatusBadRequest)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upgrade failed")
 		return
 	}
 
 	// Handle receiver connection
-	go handleReceiverConnection(upload, conn)
+	go handleReceiverConnection(trace.ContextWithSpanContext(context.Background(), span.SpanContext()), upload, conn, clientIP(r), acceptLocale(r), routing)
+}
+
+// admitJoin checks whether the receiver making r may join upload,
+// answering the request when it may not.
+func admitJoin(ctx context.Context, span trace.Span, w http.ResponseWriter, r *http.Request, upload *Upload) (routingConstraint, bool) {
+	if isBanned(ctx, clientIP(r)) || upload.isBannedIP(clientIP(r)) {
+		span.SetStatus(codes.Error, "banned")
+		writeProblem(w, http.StatusForbidden, problemBanned, "")
+		return routingConstraint{}, false
+	}
+
+	if upload.isClosed() {
+		span.SetStatus(codes.Error, "session closed")
+		writeProblem(w, http.StatusGone, problemSessionClosed, "")
+		return routingConstraint{}, false
+	}
+
+	// Refuse pairs that the routing policy leaves no way to connect
+	routing := routingFor(r)
+	if upload.hostRouting.combine(routing).blocksEverything() {
+		span.SetStatus(codes.Error, "routing policy")
+		writeProblem(w, http.StatusForbidden, problemRoutingPolicy, "No transport is allowed between you and the host")
+		return routingConstraint{}, false
+	}
+
+	// A presented token is always redeemed; sessions created with
+	// require_token can't be joined without one
+	if token := r.URL.Query().Get("token"); token != "" || upload.RequireToken {
+		if !upload.redeemJoinToken(ctx, token) {
+			span.SetStatus(codes.Error, "invalid join token")
+			writeProblem(w, http.StatusForbidden, problemInvalidJoinToken, "")
+			return routingConstraint{}, false
+		}
+	}
+
+	// Tie the join to the trace of the session it belongs to
+	span.AddLink(trace.LinkFromContext(upload.ctx))
+	return routing, true
+}
+
+type uploadInfo struct {
+	ID            string `json:"id"`
+	FileName      string `json:"filename"`
+	FileType      string `json:"filetype"`
+	FileSize      int64  `json:"filesize"`
+	SHA256        string `json:"sha256,omitempty"`
+	ReceiverCount int    `json:"receiver_count"`
+
+	PassphraseRequired bool `json:"passphrase_required"`
+}
+
+// handleUploadInfo lets the download page show what's on offer before the
+// receiver commits to joining over WebSocket.
+func handleUploadInfo(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	upload, ok := lookupUpload(id)
+	if !ok {
+		// Another node may run it, see sessionstore.go
+		s, elsewhere := lookupElsewhere(r.Context(), id)
+		switch {
+		case !elsewhere:
+			writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		case s.Closed:
+			writeProblem(w, http.StatusGone, problemSessionClosed, "")
+		default:
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusOK, uploadInfo{
+				ID:            s.ID,
+				FileName:      s.Metadata.FileName,
+				FileType:      s.Metadata.FileType,
+				FileSize:      s.Metadata.FileSize,
+				SHA256:        s.Metadata.SHA256,
+				ReceiverCount: s.ReceiverCount,
+
+				PassphraseRequired: s.PassphraseRequired,
+			})
+		}
+		return
+	}
+	if upload.isClosed() {
+		writeProblem(w, http.StatusGone, problemSessionClosed, "")
+		return
+	}
+
+	upload.mutex.RLock()
+	info := uploadInfo{
+		ID:            upload.ID,
+		FileName:      upload.Meta.FileName,
+		FileType:      upload.Meta.FileType,
+		FileSize:      upload.Meta.FileSize,
+		SHA256:        upload.Meta.SHA256,
+		ReceiverCount: len(upload.Receivers),
+
+		PassphraseRequired: upload.passphrase != nil,
+	}
+	upload.mutex.RUnlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, info)
 }
 
-func handleReceiverConnection(upload *Upload, conn *websocket.Conn) {
+func handleReceiverConnection(ctx context.Context, upload *Upload, conn *wsConn, ip, acceptedLocale string, routing routingConstraint) {
 	defer conn.Close()
 
-	// Wait for join request
+	// Wait for join request, optionally after a hello
 	var msg Message
 	err := conn.ReadJSON(&msg)
 	if err != nil {
 		return
 	}
+	if msg.Type == "hello" {
+		if !handleHello(conn, msg) {
+			return
+		}
+		msg = Message{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+	}
 
 	if msg.Type != "join_request" {
+		conn.WriteJSON(errorMessage(errCodeUnexpectedMessage, "expected join_request", msg.Type))
 		return
 	}
 
 	var joinReq JoinRequest
-	data, _ := json.Marshal(msg.Payload)
-	json.Unmarshal(data, &joinReq)
+	err = decodePayload(msg, &joinReq)
+	var locale string
+	if err == nil {
+		locale, err = clientLocale(joinReq.Locale, acceptedLocale)
+	}
+	if err != nil {
+		conn.WriteJSON(invalidPayload(msg, err))
+		return
+	}
+
+	// A returning receiver picks up where it left off; an unknown token
+	// just means a fresh join
+	if joinReq.ResumeToken != "" {
+		if receiver := resumeReceiver(upload, joinReq.ResumeToken, conn); receiver != nil {
+			receiverLoop(upload, receiver, conn)
+			return
+		}
+	}
+
+	if upload.isBannedKey(joinReq.PublicKey) {
+		rejectJoin(conn, problemBanned, "You are banned from this session")
+		return
+	}
+
+	if !upload.checkPassphrase(joinReq.Passphrase) {
+		rejectJoin(conn, problemPasswordRequired, "A passphrase is required to join")
+		return
+	}
+
+	if upload.isFull() && !upload.hasQueueRoom() {
+		rejectJoin(conn, problemSessionFull, "The session has as many receivers as the host allows")
+		return
+	}
+
+	if upload.downloadsExhausted() {
+		rejectJoin(conn, problemDownloadLimit, "The file has been downloaded as many times as allowed")
+		return
+	}
+
+	if upload.Meta.Kind == kindSnippet && !validEncryptionKey(joinReq.EncryptionKey) {
+		rejectJoin(conn, errCodeEncryptionKeyRequired, "This session needs an encryption_key to send the text to")
+		return
+	}
+
+	// Keys are only taken at face value once proven. Sessions sent to an
+	// identity only admit its key holder; otherwise a proven key can match
+	// the host's contact book.
+	var verifiedKey string
+	if joinReq.PublicKey != "" && (upload.recipient != "" || upload.hostIdentity != "") {
+		key, ok := proveIdentity(conn, joinReq.PublicKey)
+		if !ok {
+			rejectJoin(conn, errCodeIdentityRequired, "Could not verify your identity")
+			return
+		}
+		verifiedKey = key
+	}
+	if upload.recipient != "" && verifiedKey != upload.recipient {
+		rejectJoin(conn, errCodeIdentityRequired, "This session was sent to someone else")
+		return
+	}
 
 	// Create receiver
 	receiver := &Receiver{
-		ID:          generateReceiverID(),
-		Name:        joinReq.Name,
-		Conn:        conn,
-		ConnectedAt: time.Now(),
+		ID:             generateReceiverID(),
+		Name:           joinReq.Name,
+		PublicKey:      joinReq.PublicKey,
+		Conn:           conn,
+		ConnectedAt:    time.Now(),
+		ctx:            ctx,
+		ip:             ip,
+		capabilities:   joinReq.Capabilities,
+		routing:        routing,
+		availableBytes: -1,
+		resumeToken:    generateReceiverID() + generateReceiverID(),
+		verifiedKey:    verifiedKey,
+		encryptionKey:  joinReq.EncryptionKey,
+		locale:         locale,
 	}
+	trustReceiver(upload, receiver)
+	conn.WriteJSON(Message{Type: "receiver_session", Payload: map[string]any{
+		"receiver_id":      receiver.ID,
+		"resume_token":     receiver.resumeToken,
+		"sealed_signaling": upload.sealsSignaling(),
+	}})
 
-	// Add receiver to upload
-	upload.mutex.Lock()
-	upload.Receivers = append(upload.Receivers, receiver)
-	upload.mutex.Unlock()
-
-	// Send file metadata to receiver
-	metaMsg := Message{
-		Type:    "file_metadata",
-		Payload: upload.Meta,
+	if !enterSession(upload, receiver) {
+		rejectJoin(conn, problemSessionFull, "The session has as many receivers as the host allows")
+		return
 	}
-	conn.WriteJSON(metaMsg)
 
-	// Notify host about new receiver
-	sendReceiversUpdate(upload)
+	receiverLoop(upload, receiver, conn)
+}
 
+// receiverLoop handles an admitted or pending receiver's messages until its
+// socket ends.
+func receiverLoop(upload *Upload, receiver *Receiver, conn *wsConn) {
 	// Handle receiver messages
 	for {
 		var receiverMsg Message
@@ -237,166 +959,603 @@ func handleReceiverConnection(upload *Upload, conn *websocket.Conn) {
 		if err != nil {
 			break
 		}
+		upload.touch()
+
+		if receiverMsg.Type == "hello" {
+			if !handleHello(conn, receiverMsg) {
+				break
+			}
+			continue
+		}
+
+		// Nothing is relayed for receivers still waiting for approval
+		if !isAdmitted(upload, receiver) {
+			continue
+		}
+
+		receiverMsg = address(receiverMsg, receiver.ID)
 
 		// Handle WebRTC signaling messages from receiver
 		switch receiverMsg.Type {
-		case "webrtc_answer":
-			if payload, ok := receiverMsg.Payload.(map[string]any); ok {
-				payload["sender_id"] = receiver.ID
-				receiverMsg.Payload = payload
-			}
-			handleWebRTCSignaling(upload, receiverMsg, false)
-		case "webrtc_ice_candidate":
-			if payload, ok := receiverMsg.Payload.(map[string]any); ok {
-				payload["peer_id"] = receiver.ID
-				receiverMsg.Payload = payload
+		case "transfer_progress":
+			handleTransferProgress(upload, receiver, receiverMsg)
+		case "ice_outcome":
+			handleICEOutcome(upload, receiverMsg, receiver)
+		case "webrtc_failed":
+			handleWebRTCFailed(upload, receiverMsg, receiver)
+		case "relay_ack":
+			handleRelayAck(upload, receiver, receiverMsg)
+		case "relay_end":
+			handleRelayEnd(upload, receiverMsg, receiver)
+		case "bandwidth_probe":
+			handleBandwidthProbe(upload, receiverMsg, receiver)
+		case "bandwidth_probe_result":
+			handleBandwidthProbeResult(upload, receiver, receiverMsg)
+		case "capacity_report":
+			handleCapacityReport(upload, receiver, receiverMsg)
+		case "transfer_complete":
+			handleTransferComplete(upload, receiver, receiverMsg)
+		case "feedback":
+			handleFeedback(upload, receiver, receiverMsg)
+		case "checksum_result":
+			handleChecksumResult(upload, receiver, receiverMsg)
+		case "network_changed":
+			handleReceiverNetworkChanged(upload, receiver, conn, receiverMsg)
+		case "chat_message":
+			handleReceiverChat(upload, receiver, receiverMsg)
+		case "reverse_offer":
+			handleReverseOffer(upload, receiver, receiverMsg)
+		case "file_request":
+			handleFileRequest(upload, receiver, receiverMsg)
+		case "request_files":
+			handleRequestFiles(upload, receiver, receiverMsg)
+		case "webrtc_offer", "webrtc_answer", "webrtc_ice_candidate":
+			if err := handleWebRTCSignaling(receiver.ctx, upload, receiverMsg); err != nil {
+				receiver.send(invalidPayload(receiverMsg, err))
 			}
-			handleWebRTCSignaling(upload, receiverMsg, false)
 		default:
-			// Unknown message type
+			receiver.send(unknownType(receiverMsg))
 		}
 	}
 
-	// Remove receiver when disconnected
-	upload.mutex.Lock()
-	for i, r := range upload.Receivers {
-		if r.ID == receiver.ID {
-			upload.Receivers = append(upload.Receivers[:i], upload.Receivers[i+1:]...)
-			break
-		}
+	// A receiver that leaves while in line or pending just withdraws
+	if takeQueued(upload, receiver.ID) != nil {
+		return
+	}
+	if takePending(upload, receiver.ID) != nil {
+		sendToHost(upload, Message{Type: "join_cancelled", Payload: receiverDecision{ReceiverID: receiver.ID}})
+		promoteQueued(upload)
+		return
 	}
-	upload.mutex.Unlock()
 
-	// Notify host about receiver leaving
-	sendReceiversUpdate(upload)
+	if receiver.leave(upload, conn) {
+		sendToHost(upload, Message{Type: "receiver_away", Payload: receiverDecision{ReceiverID: receiver.ID}})
+		return
+	}
+	removeReceiver(upload, receiver)
 }
 
-func sendReceiversUpdate(upload *Upload) {
+// recordSession writes the ended upload to the history store.
+func recordSession(upload *Upload) {
 	upload.mutex.RLock()
-	receivers := make([]*Receiver, len(upload.Receivers))
-	copy(receivers, upload.Receivers)
+	summary := summarizeTransfers(upload)
+	rec := SessionRecord{
+		ID:            upload.ID,
+		Tenant:        upload.tenant,
+		FileName:      upload.Meta.FileName,
+		FileType:      upload.Meta.FileType,
+		FileSize:      upload.Meta.FileSize,
+		ReceiverCount: len(upload.Receivers),
+		Notes:         upload.notes,
+		CreatedAt:     upload.CreatedAt,
+		EndedAt:       time.Now(),
+
+		CompletedCount:    summary.CompletedCount,
+		AverageDurationMs: summary.AverageDurationMs,
+		Status:            historyStatus(upload),
+	}
 	upload.mutex.RUnlock()
 
+	recordHistory(rec)
+}
+
+// maxNotesLength caps host notes, in bytes.
+const maxNotesLength = 4096
+
+type notesRequest struct {
+	Notes string `json:"notes"`
+}
+
+// handleSetNotes stores the host's private bookkeeping notes for the
+// session. They show up in the admin API and the session history only.
+func handleSetNotes(upload *Upload, msg Message) {
+	var req notesRequest
+	if err := decodePayload(msg, &req); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	if len(req.Notes) > maxNotesLength {
+		req.Notes = strings.ToValidUTF8(req.Notes[:maxNotesLength], "")
+	}
+
+	upload.mutex.Lock()
+	upload.notes = req.Notes
+	upload.mutex.Unlock()
+
+	sendToHost(upload, Message{Type: "notes_updated", Payload: req})
+}
+
+func sendReceiversUpdate(upload *Upload) {
 	// Create safe receiver list (without connection objects)
-	safeReceivers := make([]map[string]any, len(receivers))
-	for i, r := range receivers {
+	upload.mutex.RLock()
+	safeReceivers := make([]map[string]any, len(upload.Receivers))
+	for i, r := range upload.Receivers {
 		safeReceivers[i] = map[string]any{
-			"id":           r.ID,
-			"name":         r.Name,
-			"connected_at": r.ConnectedAt,
+			"id":              r.ID,
+			"name":            r.Name,
+			"connected_at":    r.ConnectedAt,
+			"bytes_received":  r.progress.BytesReceived,
+			"percent":         r.progress.Percent,
+			"throughput_bps":  math.Round(r.progress.Throughput),
+			"eta_seconds":     etaSeconds(r.progress, receiverTotal(upload, r)),
+			"available_bytes": r.availableBytes,
+			"trusted":         r.contact != nil,
+		}
+		if r.encryptionKey != "" {
+			safeReceivers[i]["encryption_key"] = r.encryptionKey
+		}
+		if r.locale != "" {
+			safeReceivers[i]["locale"] = r.locale
+		}
+		if requests := receiverFileRequests(upload, r.ID); requests != nil {
+			safeReceivers[i]["file_requests"] = requests
+		}
+		if selection := selectionView(r); selection != nil {
+			safeReceivers[i]["selection"] = selection
+		}
+		if r.contact != nil {
+			safeReceivers[i]["contact_label"] = r.contact.Label
+			safeReceivers[i]["contact_kind"] = r.contact.Kind
 		}
 	}
+	upload.mutex.RUnlock()
 
 	msg := Message{
 		Type:    "receivers_update",
 		Payload: safeReceivers,
 	}
 
-	upload.Host.WriteJSON(msg)
+	sendToHost(upload, msg)
 }
 
-func handleWebRTCSignaling(upload *Upload, msg Message, isFromHost bool) {
+// handleWebRTCSignaling relays a signaling message to its to. It returns
+// an error when the message is malformed or not allowed, for the caller to
+// report to the sender.
+func handleWebRTCSignaling(ctx context.Context, upload *Upload, msg Message) error {
+	fromHost := msg.From == hostPeer
+	switch {
+	case fromHost && (msg.To == "" || msg.To == hostPeer):
+		return errNoPeer
+	case !fromHost && msg.To != hostPeer:
+		return errHostOnlyPeer
+	}
+	receiverID := msg.From
+	if fromHost {
+		receiverID = msg.To
+	}
+
+	// Sealed payloads are relayed as they are, plain ones are rebuilt from
+	// the fields the peers need
+	sealed := upload.sealsSignaling()
+	var payload any
 	var signalingMsg WebRTCSignalingMessage
-	data, _ := json.Marshal(msg.Payload)
-	json.Unmarshal(data, &signalingMsg)
+	if sealed {
+		var s sealedSignal
+		err := decodePayload(msg, &s)
+		if err == nil {
+			err = s.validate()
+		}
+		if err != nil {
+			return err
+		}
+		payload = s
+	} else if err := decodePayload(msg, &signalingMsg); err != nil {
+		return err
+	}
 
-	log.Info("Fik besked", "type", msg.Type, "paylod", msg.Payload)
+	// Continue the sender's trace if it propagated one, otherwise hang the
+	// span off the session so the whole exchange ends up in one trace
+	ctx, span := tracer.Start(extractTrace(ctx, msg.Trace), "signaling."+msg.Type,
+		trace.WithAttributes(
+			attribute.String("upload.id", upload.ID),
+			attribute.Bool("signaling.from_host", fromHost),
+			attribute.Bool("signaling.sealed", sealed),
+		),
+	)
+	defer span.End()
 
-	switch msg.Type {
-	case "webrtc_offer":
-		// Forward offer from host to receiver
-		if isFromHost {
-			upload.mutex.RLock()
-			var targetReceiver *Receiver
-			for _, receiver := range upload.Receivers {
-				if receiver.ID == signalingMsg.ReceiverID {
-					targetReceiver = receiver
-					break
-				}
-			}
-			upload.mutex.RUnlock()
-
-			if targetReceiver != nil {
-				offerMsg := Message{
-					Type: "webrtc_offer",
-					Payload: map[string]any{
-						"sender_id": "host",
-						"offer":     signalingMsg.Offer,
-					},
-				}
-				err := targetReceiver.Conn.WriteJSON(offerMsg)
-				if err != nil {
-					log.Printf("Failed to send WebRTC offer: %v", err)
-				}
-			}
+	log.Info("Fik besked", "type", msg.Type, "from", msg.From, "to", msg.To)
+
+	// A receiver offers, and the host answers, for a file sent back to the
+	// host. Sealed offers can't show which one, see sealed.go
+	if (msg.Type == "webrtc_offer" && !fromHost) || (msg.Type == "webrtc_answer" && fromHost) {
+		if sealed && !hasAcceptedReverseOffer(upload, receiverID) ||
+			!sealed && acceptedReverseOffer(upload, signalingMsg.OfferID, receiverID) == nil {
+			return errNoReverseOffer
 		}
+	}
 
-	case "webrtc_answer":
-		// Forward answer from receiver to host
-		if !isFromHost {
-			answerMsg := Message{
-				Type: "webrtc_answer",
-				Payload: map[string]any{
-					"receiver_id": signalingMsg.SenderID,
-					"answer":      signalingMsg.Answer,
-				},
-			}
-			upload.Host.WriteJSON(answerMsg)
-		}
-
-	case "webrtc_ice_candidate":
-		// Forward ICE candidates between host and receiver
-		if isFromHost {
-			// From host to receiver
-			upload.mutex.RLock()
-			var targetReceiver *Receiver
-			for _, receiver := range upload.Receivers {
-				if receiver.ID == signalingMsg.PeerID {
-					targetReceiver = receiver
-					break
-				}
-			}
-			upload.mutex.RUnlock()
-
-			if targetReceiver != nil {
-				candidateMsg := Message{
-					Type: "webrtc_ice_candidate",
-					Payload: map[string]any{
-						"peer_id":   "host",
-						"candidate": signalingMsg.Candidate,
-					},
-				}
-				targetReceiver.Conn.WriteJSON(candidateMsg)
-			}
-		} else {
-			// From receiver to host
-			candidateMsg := Message{
-				Type: "webrtc_ice_candidate",
-				Payload: map[string]any{
-					"peer_id":   signalingMsg.PeerID,
-					"candidate": signalingMsg.Candidate,
-				},
+	if !sealed {
+		plain := map[string]any{}
+		switch msg.Type {
+		case "webrtc_offer":
+			plain["offer"] = signalingMsg.Offer
+		case "webrtc_answer":
+			plain["answer"] = signalingMsg.Answer
+			// Tell the host which of its held offers is being answered
+			if receiver := upload.findReceiver(msg.From); !fromHost && receiver != nil && receiver.presignaled {
+				plain["offer_index"] = receiver.offerIndex
 			}
-			upload.Host.WriteJSON(candidateMsg)
+		case "webrtc_ice_candidate":
+			plain["candidate"] = signalingMsg.Candidate
+		}
+		if signalingMsg.OfferID != "" {
+			plain["offer_id"] = signalingMsg.OfferID
 		}
+		payload = plain
+	}
+
+	target, err := deliver(upload, Message{
+		Type:    msg.Type,
+		Payload: payload,
+		Trace:   injectTrace(ctx),
+		From:    msg.From,
+		To:      msg.To,
+	})
+	if errors.Is(err, errNoPeer) {
+		span.SetStatus(codes.Error, "receiver not found")
+		return err
 	}
+	if err != nil {
+		span.RecordError(err)
+		log.Printf("Failed to relay %s: %v", msg.Type, err)
+		return nil
+	}
+	if target != nil && msg.Type == "webrtc_offer" {
+		receiverServed(upload, target)
+	}
+	return nil
 }
 
 //go:embed dist/*
 var staticFiles embed.FS
 
+// commands are the subcommands; without one the binary runs the server.
+var commands = map[string]func(args []string){
+	"daemon":        runDaemon,
+	"publish":       runPublish,
+	"admin":         runAdmin,
+	"verify-bundle": runVerifyBundle,
+	"sign-bundle":   runSignBundle,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+	parseFlags(os.Args[1:])
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatal("Could not set up tracing", "err", err)
+	}
+
+	setupServer()
+	router := newRouter()
+
+	server := &http.Server{Addr: cfg.Addr, Handler: router}
+	if serverCert != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: serverCert.GetCertificate}
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		draining.Store(true)
+		// Sessions in a snapshot outlive the restart, see snapshot.go
+		if snapshots == nil {
+			log.Info("Draining", "timeout", cfg.DrainTimeout)
+			waitForSessions(cfg.DrainTimeout)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Info("Starting server", "bind", cfg.Addr, "store", cfg.Store, "tls", serverCert != nil)
+
+	if serverCert != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if snapshots != nil {
+		if err := saveSnapshot(); err != nil {
+			log.Error("Could not save session snapshot", "err", err)
+		}
+		suspendAllUploads()
+		// Give the write loops a moment to deliver server_restarting
+		time.Sleep(time.Second)
+		snapshots.Close()
+	} else {
+		closeAllUploads()
+		waitForSessions(2 * time.Second)
+	}
+	shutdownTracing(context.Background())
+	store.Close()
+	closeHistory()
+	sessions.Close()
+	if bus != nil {
+		bus.Close()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// setupServer loads what the handlers depend on and starts the background
+// jobs. It exits on configuration errors.
+func setupServer() {
+	var err error
+	if cfg.Local {
+		if err := setupLocalMode(); err != nil {
+			log.Fatal("Could not start in local mode", "err", err)
+		}
+	}
+	if cfg.BundleManifest != "" {
+		problems, err := verifyBundle(cfg)
+		if err != nil {
+			log.Fatal("Could not verify bundle", "err", err)
+		}
+		if len(problems) > 0 {
+			log.Fatal("Refusing to serve files that don't match the bundle manifest", "problems", problems)
+		}
+		log.Info("Bundle verified", "manifest", cfg.BundleManifest)
+	}
+	if cfg.WebhookURLs != "" && cfg.WebhookSecret == "" {
+		log.Fatal("-webhook-url needs -webhook-secret to sign its deliveries")
+	}
+	pages, err = loadPages(cfg.TemplatesDir)
+	if err != nil {
+		log.Fatal("Could not load page templates", "dir", cfg.TemplatesDir, "err", err)
+	}
+
+	if err := configureICEServers(); err != nil {
+		log.Fatal("Could not configure ICE servers", "err", err)
+	}
+	if vocabularies, err = loadVocabularies(cfg.IDVocabularyDir); err != nil {
+		log.Fatal("Could not load ID vocabularies", "dir", cfg.IDVocabularyDir, "err", err)
+	}
+	if _, ok := vocabularyFor(""); !ok {
+		log.Fatal("Unknown ID vocabulary", "vocabulary", cfg.IDVocabulary)
+	}
+	if cfg.CodeAudioDir != "" {
+		if recordings, err = loadCodeRecordings(cfg.CodeAudioDir); err != nil {
+			log.Fatal("Could not load join code recordings", "dir", cfg.CodeAudioDir, "err", err)
+		}
+	}
+
+	if cfg.RoutingPolicy != "" {
+		routingRules, err = loadRoutingPolicy(cfg.RoutingPolicy)
+		if err != nil {
+			log.Fatal("Could not load routing policy", "err", err)
+		}
+		log.Info("Loaded routing policy", "rules", len(routingRules))
+	}
+
+	store, err = openStore(cfg)
+	if err != nil {
+		log.Fatal("Could not open store", "store", cfg.Store, "err", err)
+	}
+	history = store
+	if cfg.HistoryDB != "" {
+		if history, err = openHistoryStore(cfg.HistoryDB); err != nil {
+			log.Fatal("Could not open history database", "err", err)
+		}
+	}
+	if sessions, err = openSessionStore(cfg); err != nil {
+		log.Fatal("Could not open session store", "err", err)
+	}
+	if nodeID = cfg.NodeID; nodeID == "" {
+		nodeID = defaultNodeID()
+	}
+	go runSessionHeartbeat()
+	if cfg.MessageBus != "" {
+		if bus, err = openMessageBus(cfg.MessageBus); err != nil {
+			log.Fatal("Could not open message bus", "err", err)
+		}
+		bus.Subscribe(nodeID, handleBusEnvelope)
+	}
+	if cfg.Snapshot != "" {
+		if snapshots, err = openSnapshotStore(cfg.Snapshot); err != nil {
+			log.Fatal("Could not open snapshot store", "err", err)
+		}
+		restoreSnapshot()
+		go runSnapshots()
+	}
+
+	provider, err := openSecretProvider(context.Background(), cfg.Secrets)
+	if err != nil {
+		log.Fatal("Could not open secret provider", "secrets", cfg.Secrets, "err", err)
+	}
+	secrets = newSecretCache(provider)
+	go secrets.runRefresher(cfg.SecretRefresh)
+
+	blobSpec := cfg.BlobStore
+	if blobSpec == "" && cfg.SpoolDir != "" {
+		blobSpec = "fs:" + cfg.SpoolDir
+	}
+	if blobSpec != "" {
+		ring, err := loadSpoolKeyring(context.Background())
+		if err != nil {
+			log.Fatal("Could not load spool keys", "err", err)
+		}
+		blobs, err := openBlobStore(context.Background(), blobSpec)
+		if err != nil {
+			log.Fatal("Could not open blob store", "store", blobSpec, "err", err)
+		}
+		if spool, err = newSpool(blobs, ring); err != nil {
+			log.Fatal("Could not set up the spool", "err", err)
+		}
+		go spool.runSweeper(time.Minute)
+	} else if cfg.StoredMaxBytes > 0 {
+		log.Warn("Store-and-forward needs -spool-dir or -blob-store, leaving it off")
+	}
+	if cfg.HTTPRelay {
+		go runHTTPRelaySweeper()
+	}
+
+	if err := setupCertificates(context.Background(), cfg); err != nil {
+		log.Fatal("Could not load certificates", "err", err)
+	}
+
+	go sweepIdempotencyKeys()
+	go runReaper(time.Minute)
+	if cfg.CompanionAddr != "" {
+		go runCompanion()
+	}
+}
+
+// newRouter returns the handler serving the API and the frontend.
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
+	if cfg.Local {
+		router.Use(localOnly)
+	}
+
+	router.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", handleReadyz).Methods("GET")
+
+	if cfg.Debug {
+		// Registered explicitly since the router doesn't use http.DefaultServeMux
+		debug := router.PathPrefix("/debug/pprof").Subrouter()
+		debug.HandleFunc("/cmdline", pprof.Cmdline)
+		debug.HandleFunc("/profile", pprof.Profile)
+		debug.HandleFunc("/symbol", pprof.Symbol)
+		debug.HandleFunc("/trace", pprof.Trace)
+		debug.PathPrefix("/").HandlerFunc(pprof.Index)
+		log.Warn("Debug mode: pprof is exposed under /debug/pprof")
+	}
 
 	// API routes first
 	api := router.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/upload", handleNewFileUpload).Methods("GET")
-	api.HandleFunc("/join/{id}", handleJoinUpload).Methods("GET")
+	uploadHandler, joinHandler, infoHandler, resumeHandler := handleNewFileUpload, handleJoinUpload, handleUploadInfo, handleResumeHost
+	continueHandler := handleContinueHost
+	inboxHandler, roomHandler := handleInbox, handleRoomSubscribe
+	sumsHandler, codeAudioHandler := handleSHA256Sums, handleCodeAudio
+	turnHandler := handleTURNCredentials
+	registerHandler := handleRegisterIdentity
+	if cfg.RateLimit > 0 {
+		uploadLimiter := newIPLimiter(cfg.RateLimit, cfg.RateBurst)
+		joinLimiter := newIPLimiter(cfg.RateLimit, cfg.RateBurst)
+		go uploadLimiter.runSweeper(time.Minute)
+		go joinLimiter.runSweeper(time.Minute)
+		uploadHandler = rateLimited(uploadLimiter, uploadHandler)
+		resumeHandler = rateLimited(uploadLimiter, resumeHandler)
+		continueHandler = rateLimited(uploadLimiter, continueHandler)
+		// Registering an e-mail address sends a confirmation e-mail
+		registerHandler = rateLimited(uploadLimiter, registerHandler)
+		joinHandler = rateLimited(joinLimiter, joinHandler)
+		// Info reveals whether an ID exists, so it shares the join budget
+		infoHandler = rateLimited(joinLimiter, infoHandler)
+		sumsHandler = rateLimited(joinLimiter, sumsHandler)
+		codeAudioHandler = rateLimited(joinLimiter, codeAudioHandler)
+		inboxHandler = rateLimited(joinLimiter, inboxHandler)
+		roomHandler = rateLimited(joinLimiter, roomHandler)
+		turnHandler = rateLimited(joinLimiter, turnHandler)
+	}
+	api.HandleFunc("/upload", uploadHandler).Methods("GET")
+	api.HandleFunc("/upload/{id}/info", infoHandler).Methods("GET")
+	api.HandleFunc("/upload/{id}/SHA256SUMS", sumsHandler).Methods("GET")
+	if recordings != nil {
+		api.HandleFunc("/upload/{id}/code.{format:wav|mp3}", codeAudioHandler).Methods("GET")
+	}
+	api.HandleFunc("/upload/{id}/restore", handleRestoreUpload).Methods("POST")
+	api.HandleFunc("/upload/{id}/tokens", handleMintJoinTokens).Methods("POST")
+	api.HandleFunc("/upload/{id}/resume", resumeHandler).Methods("GET")
+	api.HandleFunc("/upload/{id}/continue", continueHandler).Methods("GET")
+	api.HandleFunc("/join/{id}", joinHandler).Methods("GET")
+	// PINs are throttled even without -rate-limit, see pin.go
+	go pinLimiter.runSweeper(time.Minute)
+	api.HandleFunc("/pin", rateLimited(pinLimiter, handleRedeemPIN)).Methods("POST")
+	api.HandleFunc("/inbox", inboxHandler).Methods("GET")
+	api.HandleFunc("/rooms/{name}", roomHandler).Methods("GET")
+	api.Handle("/publish", requireAPIKey(http.HandlerFunc(handlePublish))).Methods("POST")
+	api.Handle("/events", requireAPIKey(http.HandlerFunc(handleListEvents))).Methods("GET")
+	api.Handle("/history", requireAPIKey(http.HandlerFunc(handleListHistory))).Methods("GET")
+	api.HandleFunc("/identities", registerHandler).Methods("POST")
+	api.HandleFunc("/identities", handleDeleteIdentity).Methods("DELETE")
+	api.HandleFunc("/identities/confirm", handleConfirmEmail).Methods("GET")
+	if cfg.PublicStats {
+		api.HandleFunc("/stats/public", handlePublicStats).Methods("GET")
+	}
+	if len(turnURLs) > 0 {
+		api.HandleFunc("/turn-credentials", turnHandler).Methods("GET")
+	}
+	if cfg.HTTPRelay {
+		api.HandleFunc("/relay/{id}/chunks/{n}", handlePutRelayChunk).Methods("PUT")
+		api.HandleFunc("/relay/{id}/chunks/{n}", handleGetRelayChunk).Methods("GET")
+	}
+	if spool != nil && cfg.StoredMaxBytes > 0 {
+		api.HandleFunc("/upload/{id}/stored", handleStoreFile).Methods("PUT")
+		api.HandleFunc("/stored/{id}", handleGetStored).Methods("GET")
+		api.HandleFunc("/stored/{id}", handleDeleteStored).Methods("DELETE")
+		api.HandleFunc("/stored/{id}/info", handleStoredInfo).Methods("GET")
+		api.HandleFunc("/upload/{id}/stored", handleTusCreate).Methods("POST")
+		api.HandleFunc("/upload/{id}/stored", handleTusOptions).Methods("OPTIONS")
+		api.HandleFunc("/tus/{id}", handleTusHead).Methods("HEAD")
+		api.HandleFunc("/tus/{id}", handleTusPatch).Methods("PATCH")
+		api.HandleFunc("/tus/{id}", handleTusDelete).Methods("DELETE")
+		api.HandleFunc("/tus/{id}", handleTusOptions).Methods("OPTIONS")
+	}
+	registerContactRoutes(api)
+	registerAdminRoutes(api)
+
+	router.HandleFunc("/d/{id}", handleSharePreview).Methods("GET")
+	router.HandleFunc("/status", handleStatusPage).Methods("GET")
 
 	distFS, _ := fs.Sub(staticFiles, "dist")
 	router.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.FS(distFS))))
+	return router
+}
 
-	log.Info("Starting server", "bind", ":3000")
+// waitForSessions blocks until every upload has ended or timeout passes.
+func waitForSessions(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		uploadsMutex.RLock()
+		active := len(uploads)
+		uploadsMutex.RUnlock()
+		if active == 0 {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
 
-	log.Fatal(http.ListenAndServe(":3000", router))
+// closeAllUploads drops the host sockets of the remaining uploads; their
+// connection handlers then clean up and record the sessions.
+func closeAllUploads() {
+	uploadsMutex.RLock()
+	defer uploadsMutex.RUnlock()
+	for _, upload := range uploads {
+		upload.hostConn().Close()
+	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+)
+
+// The tests share the server configuration and, for those that talk to it,
+// one server on a loopback port. It runs with the defaults but no STUN
+// server to reach and no rate limit for the clients to run into;
+// -server-flags adds to them, e.g.
+//
+//	go test -tags e2e -run E2E . -server-flags "-relay"
+
+var serverFlags = flag.String("server-flags", "", "flags for the server under test")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	parseFlags(append([]string{"-ice-servers", "", "-rate-limit", "0"}, strings.Fields(*serverFlags)...))
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+var testServerOnce struct {
+	sync.Once
+	url string
+}
+
+// testServer returns the base URL of the shared server, starting it on
+// first use.
+func testServer(tb testing.TB) string {
+	tb.Helper()
+	testServerOnce.Do(func() {
+		setupServer()
+		testServerOnce.url = httptest.NewServer(newRouter()).URL
+	})
+	return testServerOnce.url
+}
+
+// testConn is a WebSocket to the test server.
+type testConn struct {
+	tb testing.TB
+	ws *websocket.Conn
+}
+
+func dialTest(tb testing.TB, path string) *testConn {
+	tb.Helper()
+	url := strings.Replace(testServer(tb), "http", "ws", 1) + path
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		tb.Fatalf("dial %s: %v", path, err)
+	}
+	tb.Cleanup(func() { ws.Close() })
+	return &testConn{tb: tb, ws: ws}
+}
+
+func (c *testConn) send(msg Message) {
+	c.tb.Helper()
+	if err := c.ws.WriteJSON(msg); err != nil {
+		c.tb.Fatalf("send %s: %v", msg.Type, err)
+	}
+}
+
+// await reads until a message of type typ, which it decodes into payload,
+// and returns its envelope.
+func (c *testConn) await(typ string, payload any) Message {
+	c.tb.Helper()
+	c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg struct {
+			Message
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := c.ws.ReadJSON(&msg); err != nil {
+			c.tb.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if msg.Type == "error" && typ != "error" {
+			c.tb.Fatalf("waiting for %s: error %s", typ, msg.Payload)
+		}
+		if msg.Type != typ {
+			continue
+		}
+		if payload != nil {
+			if err := json.Unmarshal(msg.Payload, payload); err != nil {
+				c.tb.Fatalf("%s payload: %v", typ, err)
+			}
+		}
+		return msg.Message
+	}
+}
+
+// openTestHost creates a session and returns its host socket and ID.
+func openTestHost(tb testing.TB) (*testConn, string) {
+	tb.Helper()
+	host := dialTest(tb, "/api/upload?filename=test.bin&filetype=application%2Foctet-stream&filesize=1024")
+	host.send(Message{Type: "hello", Payload: clientHello{Version: protocolMaxVersion}})
+	var created struct {
+		ID string `json:"id"`
+	}
+	host.await("upload_created", &created)
+	return host, created.ID
+}
+
+// TestCreateUploadOnSocket runs a second upload over the first one's host
+// socket and checks the server keeps answering.
+func TestCreateUploadOnSocket(t *testing.T) {
+	host, first := openTestHost(t)
+
+	host.send(Message{Type: "create_upload", Payload: createUploadRequest{
+		RequestID:       "second",
+		metadataRequest: metadataRequest{FileName: "second.bin", FileType: "application/octet-stream", FileSize: 2048},
+	}})
+	var created struct {
+		ID        string `json:"id"`
+		RequestID string `json:"request_id"`
+	}
+	msg := host.await("upload_created", &created)
+	if created.RequestID != "second" || created.ID == "" || created.ID == first {
+		t.Fatalf("upload_created = %+v, first upload %s", created, first)
+	}
+	if msg.SessionID != created.ID {
+		t.Errorf("upload_created tagged %q, want %q", msg.SessionID, created.ID)
+	}
+
+	for _, id := range []string{first, created.ID} {
+		receiver := dialTest(t, "/api/join/"+id)
+		receiver.send(Message{Type: "hello", Payload: clientHello{Version: protocolMaxVersion}})
+		receiver.send(Message{Type: "join_request", Payload: map[string]string{"name": "receiver"}})
+		receiver.await("file_metadata", nil)
+	}
+}
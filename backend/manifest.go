@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A host can share several files in one session. Instead of the filename,
+// filetype and filesize query parameters it connects to /api/upload without
+// them and sends a manifest as its first message:
+//
+//	{"type": "manifest", "payload": {"files": [{"name": "a.txt", "type": "text/plain", "size": 3, "path": "docs/a.txt"}]}}
+//
+// The manifest is kept in Metadata.Files and reaches receivers with
+// file_metadata. The single-file fields still describe the session as a
+// whole, so clients that don't know about manifests show something sensible.
+//
+// A folder is sent as entries with relative paths. Entries of kind
+// "directory" describe directories, which lets empty ones survive the trip;
+// receivers rebuild the tree from the paths. TotalSize sums the files.
+// Any entry can carry a caption, see captions.go.
+
+const (
+	maxManifestFiles = 1000
+
+	// manifestFileType is the filetype of a session with several files.
+	manifestFileType = "application/x-sendmyzip-manifest"
+)
+
+const (
+	entryFile      = "file"
+	entryDirectory = "directory"
+)
+
+type ManifestFile struct {
+	Kind string `json:"kind,omitempty"` // file (the default) or directory
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Path string `json:"path,omitempty"` // relative, slash-separated, includes Name
+
+	SHA256 string `json:"sha256,omitempty"` // lowercase hex, see checksums.go
+
+	// See captions.go
+	Caption          string    `json:"caption,omitempty"`
+	CaptionExpiresAt time.Time `json:"caption_expires_at,omitzero"`
+}
+
+type manifestRequest struct {
+	Files     []ManifestFile `json:"files"`
+	Checksums string         `json:"checksums,omitempty"` // SHA256SUMS file
+}
+
+// sameMetadata reports whether a and b describe the same files.
+func sameMetadata(a, b Metadata) bool {
+	return a.Kind == b.Kind && a.FileName == b.FileName && a.FileType == b.FileType && a.FileSize == b.FileSize && a.SHA256 == b.SHA256 &&
+		a.TotalSize == b.TotalSize && slices.Equal(a.Files, b.Files)
+}
+
+func validateManifest(files []ManifestFile) error {
+	if len(files) == 0 {
+		return errors.New("manifest lists no files")
+	}
+	if len(files) > maxManifestFiles {
+		return fmt.Errorf("manifest lists more than %d files", maxManifestFiles)
+	}
+	kinds := make(map[string]string, len(files)) // path:kind
+	now := time.Now()
+	for i, f := range files {
+		if f.Name == "" || strings.ContainsAny(f.Name, "/\\") {
+			return fmt.Errorf("file %d: name must be set and contain no slashes", i)
+		}
+		switch f.Kind {
+		case "", entryFile:
+			if f.Size < 0 {
+				return fmt.Errorf("file %d: size must not be negative", i)
+			}
+		case entryDirectory:
+			if f.Size != 0 || f.Type != "" || f.SHA256 != "" {
+				return fmt.Errorf("file %d: directories have no size, type or sha256", i)
+			}
+		default:
+			return fmt.Errorf("file %d: kind must be file or directory", i)
+		}
+		if err := validateCaption(f, now); err != nil {
+			return fmt.Errorf("file %d: %w", i, err)
+		}
+		p := manifestPath(f)
+		if path.IsAbs(p) || path.Clean(p) != p || strings.HasPrefix(p, "../") || p == ".." || strings.Contains(p, "\\") {
+			return fmt.Errorf("file %d: path must be a clean relative path", i)
+		}
+		if path.Base(p) != f.Name {
+			return fmt.Errorf("file %d: path must end in the file name", i)
+		}
+		if _, ok := kinds[p]; ok {
+			return fmt.Errorf("file %d: %s is listed twice", i, p)
+		}
+		kinds[p] = f.Kind
+	}
+
+	// A file can't also be a directory something else lives in
+	for p := range kinds {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if kind, ok := kinds[dir]; ok && kind != entryDirectory {
+				return fmt.Errorf("%s is a file but %s is inside it", dir, p)
+			}
+		}
+	}
+	return nil
+}
+
+// topDirectory returns the directory every entry lives in, if there is one.
+func topDirectory(files []ManifestFile) string {
+	var top string
+	for _, f := range files {
+		first, _, _ := strings.Cut(manifestPath(f), "/")
+		if first == manifestPath(f) && f.Kind != entryDirectory {
+			return "" // a file at the top level
+		}
+		if top != "" && first != top {
+			return ""
+		}
+		top = first
+	}
+	return top
+}
+
+// metadataFromManifest summarizes files in the single-file fields.
+func metadataFromManifest(files []ManifestFile) Metadata {
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+
+	if len(files) == 1 && files[0].Kind != entryDirectory {
+		f := files[0]
+		return Metadata{FileName: f.Name, FileType: f.Type, FileSize: f.Size, SHA256: f.SHA256, TotalSize: total, Files: files}
+	}
+
+	name := topDirectory(files)
+	if name == "" {
+		name = fmt.Sprintf("%d filer", len(files))
+	}
+	return Metadata{
+		FileName:  name,
+		FileType:  manifestFileType,
+		FileSize:  total,
+		TotalSize: total,
+		Files:     files,
+	}
+}
+
+// readManifest waits for the manifest message a host sends when it didn't
+// describe the file in the query.
+func readManifest(conn *wsConn) (Metadata, error) {
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		return Metadata{}, err
+	}
+	if msg.Type != "manifest" {
+		return Metadata{}, fmt.Errorf("expected manifest, got %q", msg.Type)
+	}
+	var req manifestRequest
+	if err := decodePayload(msg, &req); err != nil {
+		return Metadata{}, err
+	}
+	return parseManifest(req)
+}
+
+// parseManifest checks a manifest and turns it into the session metadata.
+func parseManifest(req manifestRequest) (Metadata, error) {
+	if err := validateManifest(req.Files); err != nil {
+		return Metadata{}, err
+	}
+	if err := applyChecksums(req.Files, req.Checksums); err != nil {
+		return Metadata{}, err
+	}
+	return metadataFromManifest(req.Files), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// A host that re-exported its file can swap it without ending the session:
+// update_metadata describes the new file the same way the query or the
+// manifest did, and every receiver gets a fresh file_metadata. What the
+// server knew about the old file (progress, completions, file requests,
+// selections and an inline copy) is dropped with it.
+
+// metadataRequest describes a file, or a manifest of files, in a message.
+type metadataRequest struct {
+	FileName  string         `json:"filename"`
+	FileType  string         `json:"filetype"`
+	FileSize  int64          `json:"filesize"`
+	SHA256    string         `json:"sha256,omitempty"`
+	Files     []ManifestFile `json:"files,omitempty"`
+	Checksums string         `json:"checksums,omitempty"`
+}
+
+func (req metadataRequest) metadata() (Metadata, error) {
+	if len(req.Files) > 0 {
+		return parseManifest(manifestRequest{Files: req.Files, Checksums: req.Checksums})
+	}
+	meta := Metadata{FileName: req.FileName, FileType: req.FileType, FileSize: req.FileSize, SHA256: strings.ToLower(req.SHA256)}
+	switch {
+	case meta.FileName == "" || meta.FileType == "":
+		return Metadata{}, errors.New("filename and filetype, or files, are required")
+	case meta.FileSize < 0:
+		return Metadata{}, errors.New("filesize must not be negative")
+	case meta.SHA256 != "" && !sha256Pattern.MatchString(meta.SHA256):
+		return Metadata{}, errors.New("sha256 must be 64 hex characters")
+	}
+	return meta, nil
+}
+
+func handleUpdateMetadata(upload *Upload, msg Message) {
+	var req metadataRequest
+	err := decodePayload(msg, &req)
+	var meta Metadata
+	if err == nil {
+		meta, err = req.metadata()
+	}
+	if err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	upload.mutex.Lock()
+	switch {
+	case upload.Meta.Kind == kindSnippet:
+		err = errors.New("snippet sessions have no file to replace")
+	case !upload.expiresAt.IsZero():
+		err = errors.New("the server holds this session's file, publish a new session instead")
+	}
+	if err != nil {
+		upload.mutex.Unlock()
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+	previous := upload.Meta
+	upload.Meta = meta
+	upload.inline = nil
+	upload.completions = nil
+	upload.fileRequests = nil
+	receivers := make([]*Receiver, len(upload.Receivers))
+	copy(receivers, upload.Receivers)
+	for _, r := range receivers {
+		r.progress = receiverProgress{}
+		r.selection = nil
+	}
+	upload.mutex.Unlock()
+
+	log.Info("Host replaced the file", "id", upload.ID, "from", previous.FileName, "to", meta.FileName)
+	recordEvent(upload, "metadata_updated", map[string]any{"metadata": meta, "previous": previous})
+
+	for _, r := range receivers {
+		r.send(fileMetadataMessage(upload, r, meta))
+	}
+	sendToHost(upload, Message{Type: "metadata_updated", Payload: map[string]any{
+		"metadata":       meta,
+		"receiver_count": len(receivers),
+		"updated_at":     time.Now(),
+	}})
+	sendReceiversUpdate(upload)
+	announceUpload(upload)
+}
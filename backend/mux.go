@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// A host can run more than one upload over the socket it opened the first
+// one with. create_upload starts another; the server answers with
+// upload_created and from then on tags everything about that upload with
+// its session_id. Host messages carrying a session_id go to that upload,
+// untagged ones to the first. A socket opened with an API key counts all
+// of them against the key's quotas.
+//
+// Each upload on a socket that multiplexes gets a channel: a wsConn without
+// a socket of its own that tags what is written to it and hands it to the
+// real one. The first upload moves onto an untagged channel of its own when
+// the second is created, so the sessions are independent of each other:
+// closing, expiring or resuming one elsewhere ends only its channel, and
+// the socket stays open as long as any of them runs on it. To the rest of
+// the server a channel is just the upload's host connection. When the
+// socket goes away every channel is closed and its upload treated as if
+// its host had left.
+
+// maxUploadsPerConn caps the uploads one socket may run, the first included.
+const maxUploadsPerConn = 8
+
+type connChannels struct {
+	mutex   sync.Mutex
+	uploads map[string]*Upload
+}
+
+type createUploadRequest struct {
+	RequestID string `json:"request_id,omitempty"` // echoed back to match the reply
+	metadataRequest
+	RequireApproval bool `json:"require_approval,omitempty"`
+	MaxReceivers    int  `json:"max_receivers,omitempty"`
+	SealedSignaling bool `json:"sealed_signaling,omitempty"`
+}
+
+// newChannel returns a connection for uploadID multiplexed over c.
+func newChannel(c *wsConn, uploadID string) *wsConn {
+	return &wsConn{parent: c, channel: uploadID, closing: make(chan struct{})}
+}
+
+// root is the connection with the actual socket.
+func (c *wsConn) root() *wsConn {
+	if c != nil && c.parent != nil {
+		return c.parent
+	}
+	return c
+}
+
+// tagUpload marks v as being about the channel's upload.
+func tagUpload(v any, uploadID string) any {
+	if msg, ok := v.(Message); ok {
+		msg.SessionID = uploadID
+		return msg
+	}
+	return v
+}
+
+// channelUpload returns the upload c runs under id, if any.
+func (c *wsConn) channelUpload(id string) (*Upload, bool) {
+	c.channels.mutex.Lock()
+	defer c.channels.mutex.Unlock()
+	upload, ok := c.channels.uploads[id]
+	return upload, ok
+}
+
+// multiplexing reports whether c runs its uploads on channels.
+func (c *wsConn) multiplexing() bool {
+	c.channels.mutex.Lock()
+	defer c.channels.mutex.Unlock()
+	return c.channels.uploads != nil
+}
+
+// closeChannels ends every extra upload of a socket that went away.
+func (c *wsConn) closeChannels() {
+	c.channels.mutex.Lock()
+	uploads := make([]*Upload, 0, len(c.channels.uploads))
+	for _, upload := range c.channels.uploads {
+		uploads = append(uploads, upload)
+	}
+	c.channels.mutex.Unlock()
+
+	for _, upload := range uploads {
+		if host := upload.hostConn(); host.root() == c {
+			host.Close()
+		}
+	}
+}
+
+func handleCreateUpload(upload *Upload, conn *wsConn, msg Message) {
+	conn = conn.root()
+
+	var req createUploadRequest
+	err := decodePayload(msg, &req)
+	var meta Metadata
+	if err == nil {
+		meta, err = req.metadata()
+	}
+	if err == nil && req.MaxReceivers < 0 {
+		err = errors.New("max_receivers must not be negative")
+	}
+	if err != nil {
+		conn.WriteJSON(invalidPayload(msg, err))
+		return
+	}
+	if draining.Load() {
+		conn.WriteJSON(errorMessage(problemDraining, "The server is shutting down", msg.Type))
+		return
+	}
+
+	conn.channels.mutex.Lock()
+	if conn.channels.uploads == nil {
+		conn.channels.uploads = make(map[string]*Upload)
+		if upload.hostConn() == conn {
+			first := newChannel(conn, "")
+			upload.swapHost(first)
+			conn.channels.uploads[upload.ID] = upload
+			go runChannel(conn, upload, first)
+		}
+	}
+	if len(conn.channels.uploads) >= maxUploadsPerConn {
+		conn.channels.mutex.Unlock()
+		conn.WriteJSON(errorMessage(errCodeInvalidPayload, "too many uploads on this connection", msg.Type))
+		return
+	}
+	conn.channels.mutex.Unlock()
+
+	// Counted against the quotas of the connection's first session
+	quotaWarnings, err := chargeQuota(upload.tenant, nil, quotaBytesOf(meta))
+	if err != nil {
+		conn.WriteJSON(errorMessage(problemQuotaExceeded, err.Error(), msg.Type))
+		return
+	}
+
+	upload.mutex.RLock()
+	baseURL, country := upload.baseURL, upload.country
+	upload.mutex.RUnlock()
+
+	extra := &Upload{
+		Meta:             meta,
+		Receivers:        make([]*Receiver, 0),
+		CreatedAt:        time.Now(),
+		RequireApproval:  req.RequireApproval,
+		MaxReceivers:     req.MaxReceivers,
+		sealedSignaling:  req.SealedSignaling,
+		hostCapabilities: upload.hostCapabilities,
+		hostRouting:      upload.hostRouting,
+		hostToken:        generateReceiverID() + generateReceiverID(),
+		resumeToken:      generateReceiverID() + generateReceiverID(),
+		hostIdentity:     upload.hostIdentity,
+		baseURL:          baseURL,
+		country:          country,
+		tenant:           upload.tenant,
+		vocabulary:       upload.vocabulary,
+		ctx:              upload.ctx,
+	}
+	extra.touch()
+	// The channel is in place before the session can be found, so a
+	// receiver that joins at once doesn't find it without a host
+	reserveUploadID(extra)
+	id := extra.ID
+	channel := newChannel(conn, id)
+	extra.Host = channel
+	publishUpload(extra)
+
+	conn.channels.mutex.Lock()
+	conn.channels.uploads[id] = extra
+	conn.channels.mutex.Unlock()
+
+	log.Info("Upload created over an existing connection", "id", id, "first", upload.ID)
+	payload := map[string]any{
+		"id":               id,
+		"request_id":       req.RequestID,
+		"host_token":       extra.hostToken,
+		"resume_token":     extra.resumeToken,
+		"inline_max_bytes": cfg.InlineMaxBytes,
+		"ice_servers":      iceServersFor(extra.ctx, extra, hostPeer),
+	}
+	if len(quotaWarnings) > 0 {
+		payload["quota_warnings"] = quotaWarnings
+	}
+	channel.WriteJSON(Message{Type: "upload_created", Payload: payload})
+
+	go runChannel(conn, extra, channel)
+}
+
+// runChannel waits for upload's channel on conn to close and lets the
+// upload go. The socket closes with its last channel.
+func runChannel(conn *wsConn, upload *Upload, channel *wsConn) {
+	<-channel.closing
+	conn.channels.mutex.Lock()
+	delete(conn.channels.uploads, upload.ID)
+	last := len(conn.channels.uploads) == 0
+	conn.channels.mutex.Unlock()
+	hostGone(upload, channel)
+	if last {
+		conn.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"time"
+)
+
+// Mobile clients send network_changed as soon as the OS reports a switch
+// (Wi-Fi to cellular, a new address), before the peer connection notices.
+// The server asks the counterpart to restart ICE right away with an
+// ice_restart message, and for -network-change-grace gives the sender's
+// socket a longer read deadline and, should it drop anyway, a longer grace
+// period to resume in. A receiver walking out of Wi-Fi range then keeps its
+// place and its transfer instead of timing out.
+
+type networkChange struct {
+	Network string `json:"network,omitempty"` // e.g. wifi or cellular, informational
+}
+
+// relax gives the socket until d from now to show a sign of life.
+func (c *wsConn) relax(d time.Duration) {
+	c = c.root()
+	c.relaxedUntil.Store(time.Now().Add(d).UnixNano())
+	c.extendReadDeadline()
+}
+
+// relaxedFor is how much of a relaxation window is left, 0 when none.
+func (c *wsConn) relaxedFor() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return max(0, time.Until(time.Unix(0, c.root().relaxedUntil.Load())))
+}
+
+// graceAfter stretches a grace period to cover what is left of conn's
+// relaxation window.
+func graceAfter(conn *wsConn, grace time.Duration) time.Duration {
+	if grace <= 0 {
+		return grace
+	}
+	return max(grace, conn.relaxedFor())
+}
+
+func handleReceiverNetworkChanged(upload *Upload, receiver *Receiver, conn *wsConn, msg Message) {
+	var change networkChange
+	if err := decodePayload(msg, &change); err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+	conn.relax(cfg.NetworkChangeGrace)
+
+	sendToHost(upload, Message{Type: "ice_restart", Payload: map[string]any{
+		"receiver_id": receiver.ID,
+		"reason":      "network_changed",
+		"network":     change.Network,
+	}})
+	receiver.send(Message{Type: "network_change_ack", Payload: map[string]any{
+		"grace_seconds": cfg.NetworkChangeGrace.Seconds(),
+	}})
+}
+
+// handleHostNetworkChanged tells every receiver to expect a fresh offer;
+// the host, which makes the offers, restarts ICE with each receiver named
+// in the ack.
+func handleHostNetworkChanged(upload *Upload, conn *wsConn, msg Message) {
+	var change networkChange
+	if err := decodePayload(msg, &change); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+	conn.relax(cfg.NetworkChangeGrace)
+
+	upload.mutex.RLock()
+	ids := make([]string, len(upload.Receivers))
+	for i, r := range upload.Receivers {
+		ids[i] = r.ID
+	}
+	upload.mutex.RUnlock()
+
+	broadcastToReceivers(upload, Message{Type: "ice_restart", Payload: map[string]any{
+		"reason":  "network_changed",
+		"network": change.Network,
+	}, From: hostPeer})
+	conn.WriteJSON(Message{Type: "network_change_ack", Payload: map[string]any{
+		"grace_seconds": cfg.NetworkChangeGrace.Seconds(),
+		"receiver_ids":  ids,
+	}})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultPages are the built-in server-rendered pages. Each is a named
+// template; a file with the same name in -templates-dir replaces it, and any
+// other *.html file there is parsed alongside so pages can share partials.
+// Overrides can {{template "layout.html" .}} to keep the built-in frame, or
+// redefine layout.html to restyle every page at once.
+var defaultPages = map[string]string{
+	"layout.html": `<!doctype html>
+<html lang="da">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} · {{.Site.Name}}</title>
+{{block "head" .}}{{end}}
+<style>
+body{font-family:system-ui,sans-serif;max-width:32rem;margin:4rem auto;padding:0 1rem;color:#1f2937}
+h1{font-size:1.5rem}
+code{font-size:1.25rem;background:#f3f4f6;padding:.1rem .4rem;border-radius:.25rem}
+footer{margin-top:3rem;font-size:.875rem;color:#6b7280}
+</style>
+</head>
+<body>
+<main>{{block "body" .}}{{end}}</main>
+<footer><a href="{{.Site.URL}}/">{{.Site.Name}}</a></footer>
+</body>
+</html>
+`,
+	"join.html": `{{define "head"}}<meta name="description" content="{{.Description}}">
+<meta property="og:type" content="website">
+<meta property="og:site_name" content="{{.Site.Name}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:image" content="{{.Image}}">
+<meta name="twitter:card" content="summary">
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:description" content="{{.Description}}">
+<meta name="robots" content="noindex">
+<script>location.replace({{.JoinURL}})</script>{{end}}
+{{- define "body"}}<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>
+<p><a href="{{.JoinURL}}">Modtag filen</a></p>
+<noscript><p>Modtagelse foregår direkte mellem browsere og kræver JavaScript. Slå det til, eller brug koden <code>{{.Code}}</code> på en anden enhed.</p></noscript>{{end}}
+{{- template "layout.html" .}}`,
+	"expired.html": `{{define "head"}}<meta property="og:site_name" content="{{.Site.Name}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta name="robots" content="noindex">{{end}}
+{{- define "body"}}<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>{{end}}
+{{- template "layout.html" .}}`,
+	"status.html": `{{define "head"}}<meta name="robots" content="noindex">{{end}}
+{{- define "body"}}<h1>{{.Title}}</h1>
+{{with .Health}}<p>{{if .Draining}}Serveren lukker ned og tager ikke imod nye delinger.{{else}}Alt kører normalt.{{end}}</p>
+<p>{{.ActiveSessions}} aktive delinger · oppe i {{$.Uptime}}</p>{{end}}{{end}}
+{{- template "layout.html" .}}`,
+}
+
+// pageNames are the templates served as pages; everything else is a partial.
+var pageNames = []string{"join.html", "expired.html", "status.html"}
+
+// pageSet holds the parsed page templates. Every page is parsed into its own
+// set so the "head" and "body" blocks of one page can't leak into another.
+type pageSet map[string]*template.Template
+
+var pages pageSet
+
+// siteInfo is available to every page as .Site.
+type siteInfo struct {
+	Name string
+	URL  string
+}
+
+// loadPages parses the built-in pages and, when dir is set, the operator's
+// overrides from it.
+func loadPages(dir string) (pageSet, error) {
+	sources := make(map[string]string, len(defaultPages))
+	for name, src := range defaultPages {
+		sources[name] = src
+	}
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			sources[filepath.Base(path)] = string(src)
+		}
+	}
+
+	set := make(pageSet)
+	for _, page := range pageNames {
+		// Partials go in first so the page's own blocks win
+		t := template.New(page)
+		for name, src := range sources {
+			if slices.Contains(pageNames, name) {
+				continue
+			}
+			if _, err := t.New(name).Parse(src); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if _, err := t.Parse(sources[page]); err != nil {
+			return nil, fmt.Errorf("%s: %w", page, err)
+		}
+		set[page] = t
+	}
+	return set, nil
+}
+
+// render executes page into a buffer first so a template error becomes a
+// plain 500 rather than half a page.
+func (s pageSet) render(w http.ResponseWriter, status int, page string, data any) {
+	var buf bytes.Buffer
+	if err := s[page].Execute(&buf, data); err != nil {
+		log.Error("Could not render page", "page", page, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+type statusPageData struct {
+	Site   siteInfo
+	Title  string
+	Health healthStatus
+	Uptime string
+}
+
+// handleStatusPage is the human-readable counterpart to /readyz.
+func handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	health := currentHealth()
+	code := http.StatusOK
+	if health.Draining {
+		code = http.StatusServiceUnavailable
+	}
+	pages.render(w, code, "status.html", statusPageData{
+		Site:   siteInfo{Name: cfg.SiteName, URL: publicBaseURL(r)},
+		Title:  "Status",
+		Health: health,
+		Uptime: time.Since(startedAt).Round(time.Second).String(),
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"net/http"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Hosts can protect a session with a passphrase. Only an argon2id hash is
+// kept, in memory, and receivers have to send the passphrase in their
+// join_request.
+
+// argon2id parameters, following the OWASP minimums.
+const (
+	passphraseTime    = 2
+	passphraseMemory  = 19 * 1024 // KiB
+	passphraseThreads = 1
+	passphraseKeyLen  = 32
+)
+
+type passphraseHash struct {
+	salt []byte
+	hash []byte
+}
+
+func hashPassphrase(passphrase string) *passphraseHash {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return &passphraseHash{
+		salt: salt,
+		hash: argon2.IDKey([]byte(passphrase), salt, passphraseTime, passphraseMemory, passphraseThreads, passphraseKeyLen),
+	}
+}
+
+func (p *passphraseHash) verify(passphrase string) bool {
+	hash := argon2.IDKey([]byte(passphrase), p.salt, passphraseTime, passphraseMemory, passphraseThreads, passphraseKeyLen)
+	return subtle.ConstantTimeCompare(hash, p.hash) == 1
+}
+
+// requestPassphrase reads the passphrase a host set on /api/upload. The
+// header is preferred since query strings end up in logs, but browsers
+// can't set headers on WebSocket requests.
+func requestPassphrase(r *http.Request) string {
+	if p := r.Header.Get("Sendmyzip-Passphrase"); p != "" {
+		return p
+	}
+	return r.URL.Query().Get("passphrase")
+}
+
+// checkPassphrase reports whether a receiver may join with passphrase.
+func (u *Upload) checkPassphrase(passphrase string) bool {
+	if u.passphrase == nil {
+		return true
+	}
+	if passphrase == "" {
+		return false
+	}
+	return u.passphrase.verify(passphrase)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Two people standing next to each other can pair with a PIN instead of a
+// link. The host asks for one with create_pin and gets
+//
+//	pin_created {"pin": "042817", "expires_at": "..."}
+//
+// to show. The receiver types it on its device, which redeems it with
+// POST /api/pin {"pin": "042817"} for the session ID and then joins as
+// usual, passphrase and all. A PIN is six digits, lasts pinTTL and works
+// once; a session has at most one, so asking again replaces it. Redeeming
+// is held to pinAttemptsPerMinute per address whatever -rate-limit says,
+// which keeps guessing one of a million PINs within a minute hopeless.
+// PINs live on the node that handed them out.
+
+const (
+	pinDigits            = 6
+	pinTTL               = 60 * time.Second
+	pinAttemptsPerMinute = 5
+)
+
+type pairingPIN struct {
+	upload    *Upload
+	expiresAt time.Time
+}
+
+var pins = struct {
+	mutex sync.Mutex
+	byPIN map[string]pairingPIN
+}{byPIN: make(map[string]pairingPIN)}
+
+// pinLimiter throttles redeeming, see handleRedeemPIN.
+var pinLimiter = newIPLimiter(pinAttemptsPerMinute, pinAttemptsPerMinute)
+
+type redeemPINRequest struct {
+	PIN string `json:"pin"`
+}
+
+// newPIN draws a PIN that isn't in use. Caller holds pins.mutex.
+func newPIN() (string, error) {
+	limit := big.NewInt(1)
+	for range pinDigits {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	for {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		pin := fmt.Sprintf("%0*d", pinDigits, n)
+		if _, taken := pins.byPIN[pin]; !taken {
+			return pin, nil
+		}
+	}
+}
+
+// handleCreatePIN gives the session a fresh PIN, revoking its last one.
+func handleCreatePIN(upload *Upload, conn *wsConn, msg Message) {
+	now := time.Now()
+	pins.mutex.Lock()
+	for pin, p := range pins.byPIN {
+		if p.upload == upload || now.After(p.expiresAt) {
+			delete(pins.byPIN, pin)
+		}
+	}
+	pin, err := newPIN()
+	expiresAt := now.Add(pinTTL).Truncate(time.Second)
+	if err == nil {
+		pins.byPIN[pin] = pairingPIN{upload: upload, expiresAt: expiresAt}
+	}
+	pins.mutex.Unlock()
+	if err != nil {
+		log.Error("Could not draw a pairing PIN", "id", upload.ID, "err", err)
+		conn.WriteJSON(errorMessage(problemInternal, "Could not create a PIN", msg.Type))
+		return
+	}
+
+	conn.WriteJSON(Message{Type: "pin_created", Payload: map[string]any{"pin": pin, "expires_at": expiresAt}})
+}
+
+// handleRedeemPIN answers POST /api/pin with the session the PIN pairs
+// with, using it up.
+func handleRedeemPIN(w http.ResponseWriter, r *http.Request) {
+	var req redeemPINRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil || len(req.PIN) != pinDigits {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, fmt.Sprintf("Body must be JSON with a %d-digit pin", pinDigits))
+		return
+	}
+
+	pins.mutex.Lock()
+	p, ok := pins.byPIN[req.PIN]
+	delete(pins.byPIN, req.PIN)
+	pins.mutex.Unlock()
+	if !ok || time.Now().After(p.expiresAt) {
+		writeProblem(w, http.StatusNotFound, problemInvalidPIN, "")
+		return
+	}
+	if current, live := lookupUpload(p.upload.ID); !live || current != p.upload || p.upload.isClosed() {
+		writeProblem(w, http.StatusGone, problemSessionClosed, "")
+		return
+	}
+
+	recordEvent(p.upload, "pin_redeemed", nil)
+	writeJSON(w, http.StatusOK, map[string]string{"id": p.upload.ID})
+}
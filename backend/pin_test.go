@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func redeemPIN(t *testing.T, pin string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(testServer(t)+"/api/pin", "application/json", strings.NewReader(`{"pin": "`+pin+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// TestPIN pairs through a PIN and runs out of attempts. It is the only test
+// to redeem PINs, since the loopback address has just pinAttemptsPerMinute.
+func TestPIN(t *testing.T) {
+	pinLimiter.mutex.Lock()
+	clear(pinLimiter.buckets) // from an earlier -count
+	pinLimiter.mutex.Unlock()
+
+	host, id := openTestHost(t)
+	host.send(Message{Type: "create_pin"})
+	var created struct {
+		PIN string `json:"pin"`
+	}
+	host.await("pin_created", &created)
+	if len(created.PIN) != pinDigits {
+		t.Fatalf("pin %q, want %d digits", created.PIN, pinDigits)
+	}
+
+	resp := redeemPIN(t, created.PIN)
+	var redeemed struct {
+		ID string `json:"id"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("redeeming: got %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&redeemed); err != nil || redeemed.ID != id {
+		t.Fatalf("redeemed %+v, %v, want session %s", redeemed, err, id)
+	}
+
+	if resp := redeemPIN(t, created.PIN); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("redeeming again: got %s, want %d", resp.Status, http.StatusNotFound)
+	}
+
+	// Two attempts down, the rest go to guessing
+	wrong := "000000"
+	if created.PIN == wrong {
+		wrong = "000001"
+	}
+	for attempt := 3; attempt <= pinAttemptsPerMinute; attempt++ {
+		if resp := redeemPIN(t, wrong); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("attempt %d: got %s, want %d", attempt, resp.Status, http.StatusNotFound)
+		}
+	}
+	resp = redeemPIN(t, wrong)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("attempt %d: got %s, want %d", pinAttemptsPerMinute+1, resp.Status, http.StatusTooManyRequests)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("no Retry-After")
+	}
+}
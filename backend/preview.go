@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type previewData struct {
+	Site        siteInfo
+	Code        string
+	Title       string
+	Description string
+	URL         string
+	JoinURL     string
+	Image       string
+}
+
+// formatFileSize matches the frontend's formatting.
+func formatFileSize(bytes int64) string {
+	switch {
+	case bytes == 0:
+		return "0 B"
+	case bytes < 1_000_000:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/1000)
+	default:
+		return fmt.Sprintf("%.2f MB", float64(bytes)/1_000_000)
+	}
+}
+
+// publicBaseURL is the origin links should point at: -public-url when set,
+// otherwise derived from the request.
+func publicBaseURL(r *http.Request) string {
+	if cfg.PublicURL != "" {
+		return strings.TrimRight(cfg.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); cfg.TrustProxy && proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// handleSharePreview serves /d/{id}: link unfurlers read the OpenGraph tags,
+// browsers are sent on to the join page, and without JavaScript the page
+// itself explains what is being shared. Gone sessions get the expired page.
+func handleSharePreview(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	base := publicBaseURL(r)
+
+	data := previewData{
+		Site:        siteInfo{Name: cfg.SiteName, URL: base},
+		Code:        id,
+		Title:       "Delingen er udløbet",
+		Description: "Linket virker ikke længere. Bed afsenderen om et nyt.",
+		URL:         base + "/d/" + url.PathEscape(id),
+		JoinURL:     base + "/?code=" + url.QueryEscape(id),
+		Image:       base + "/icon.svg",
+	}
+
+	upload, ok := lookupUpload(id)
+	if !ok || upload.isClosed() {
+		pages.render(w, http.StatusNotFound, "expired.html", data)
+		return
+	}
+
+	upload.mutex.RLock()
+	data.Title = upload.Meta.FileName
+	data.Description = fmt.Sprintf("%s · %s — delt via %s", formatFileSize(upload.Meta.FileSize), upload.Meta.FileType, cfg.SiteName)
+	upload.mutex.RUnlock()
+	pages.render(w, http.StatusOK, "join.html", data)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Problem types returned by the REST API. Clients should branch on these
+// rather than on the human-readable title or detail.
+const (
+	problemInvalidRequest   = "invalid_request"
+	problemUploadNotFound   = "upload_not_found"
+	problemSessionFull      = "session_full"
+	problemPasswordRequired = "password_required"
+	problemBanned           = "banned"
+	problemRateLimited      = "rate_limited"
+	problemUnauthorized     = "unauthorized"
+	problemForbidden        = "forbidden"
+	problemDraining         = "server_draining"
+	problemInternal         = "internal_error"
+
+	problemIdempotencyConflict = "idempotency_conflict"
+	problemSessionClosed       = "session_closed"
+	problemInvalidJoinToken    = "invalid_join_token"
+	problemRoutingPolicy       = "routing_policy"
+	problemFileTooLarge        = "file_too_large"
+	problemDownloadLimit       = "download_limit_reached"
+	problemNoChecksums         = "no_checksums"
+	problemDeadLetterNotFound  = "dead_letter_not_found"
+	problemQuotaExceeded       = "quota_exceeded"
+	problemRelayNotFound       = "relay_not_found"
+	problemRelayFull           = "relay_full"
+	problemChunkNotReady       = "chunk_not_ready"
+	problemStoredNotFound      = "stored_not_found"
+	problemStorageFull         = "storage_full"
+	problemStorageKeyRequired  = "storage_key_required"
+	problemUploadLocked        = "upload_locked"
+	problemOffsetMismatch      = "offset_mismatch"
+	problemRelayLimit          = "relay_limit"
+	problemSessionElsewhere    = "session_elsewhere"
+	problemNoRecording         = "no_recording"
+	problemInvalidPIN          = "invalid_pin"
+)
+
+var problemTitles = map[string]string{
+	problemInvalidRequest:   "The request is invalid",
+	problemUploadNotFound:   "Upload not found",
+	problemSessionFull:      "The session is full",
+	problemPasswordRequired: "A passphrase is required to join",
+	problemBanned:           "You are banned from this server",
+	problemRateLimited:      "Too many requests",
+	problemUnauthorized:     "Authentication required",
+	problemForbidden:        "Forbidden",
+	problemDraining:         "The server is shutting down",
+	problemInternal:         "Internal server error",
+
+	problemIdempotencyConflict: "Idempotency key reused with a different request",
+	problemSessionClosed:       "The session has been closed by the host",
+	problemInvalidJoinToken:    "The join token is invalid, expired or already used",
+	problemRoutingPolicy:       "The routing policy does not allow this transfer",
+	problemFileTooLarge:        "The file is too large",
+	problemDownloadLimit:       "The download limit has been reached",
+	problemNoChecksums:         "The host did not provide checksums",
+	problemDeadLetterNotFound:  "Dead letter not found",
+	problemQuotaExceeded:       "The API key has used up a daily quota",
+	problemRelayNotFound:       "Relay not found",
+	problemRelayFull:           "The relay is full, try the chunk again",
+	problemChunkNotReady:       "The chunk has not arrived yet",
+	problemStoredNotFound:      "Stored file not found or expired",
+	problemStorageFull:         "The server has no room for more stored files",
+	problemStorageKeyRequired:  "The stored file is sealed with a key the request did not carry",
+	problemUploadLocked:        "Another request is appending to the upload",
+	problemOffsetMismatch:      "Upload-Offset does not match the upload",
+	problemRelayLimit:          "Too many relayed transfers from this address",
+	problemSessionElsewhere:    "The session runs on another node",
+	problemNoRecording:         "The server has no recording for part of the code",
+	problemInvalidPIN:          "The PIN is wrong, expired or already used",
+}
+
+// Problem is an RFC 7807 problem details body. Code repeats the last
+// segment of Type so clients don't have to parse the URI.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+}
+
+func newProblem(status int, code, detail string) Problem {
+	return Problem{
+		Type:   "/problems/" + code,
+		Title:  problemTitles[code],
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// writeProblem replaces http.Error for API responses.
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newProblem(status, code, detail))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Receivers report how many bytes they have received. The server keeps an
+// exponentially smoothed throughput per receiver and derives an ETA from
+// it, so hosts just render what arrives in receivers_update. Each report
+// is also relayed to the host as a transfer_progress message naming the
+// receiver, throttled per receiver, for progress bars that shouldn't wait
+// for the next receivers_update.
+
+// progressSmoothing is the weight of the newest throughput sample.
+const progressSmoothing = 0.3
+
+// progressUpdateInterval throttles receivers_update caused by progress.
+const progressUpdateInterval = time.Second
+
+type receiverProgress struct {
+	BytesReceived int64
+	Percent       float64
+	Throughput    float64 // bytes per second, smoothed
+	sampledAt     time.Time
+	relayedAt     time.Time
+}
+
+type progressReport struct {
+	BytesReceived int64    `json:"bytes_received"`
+	Percent       *float64 `json:"percent,omitempty"` // used when the server doesn't know the size
+}
+
+// hostProgress is the transfer_progress message relayed to the host.
+type hostProgress struct {
+	ReceiverID    string  `json:"receiver_id"`
+	Name          string  `json:"name"`
+	BytesReceived int64   `json:"bytes_received"`
+	Percent       float64 `json:"percent"`
+	ThroughputBps float64 `json:"throughput_bps"`
+	ETASeconds    float64 `json:"eta_seconds"`
+}
+
+// recordProgress updates receiver's progress. It returns the message to
+// relay to the host, if one is due, and whether the host should get a
+// fresh receivers_update now.
+func recordProgress(upload *Upload, receiver *Receiver, report progressReport) (*hostProgress, bool) {
+	bytes := report.BytesReceived
+	now := time.Now()
+
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	p := &receiver.progress
+	if bytes < p.BytesReceived {
+		// A restarted transfer starts over
+		*p = receiverProgress{}
+	}
+	if !p.sampledAt.IsZero() {
+		if elapsed := now.Sub(p.sampledAt).Seconds(); elapsed > 0 {
+			sample := float64(bytes-p.BytesReceived) / elapsed
+			if p.Throughput == 0 {
+				p.Throughput = sample
+			} else {
+				p.Throughput = progressSmoothing*sample + (1-progressSmoothing)*p.Throughput
+			}
+		}
+	}
+	p.BytesReceived = bytes
+	p.sampledAt = now
+	total := receiverTotal(upload, receiver)
+	switch {
+	case total > 0:
+		p.Percent = min(100, math.Round(float64(bytes)*1000/float64(total))/10)
+	case report.Percent != nil:
+		p.Percent = *report.Percent
+	}
+
+	done := total > 0 && bytes >= total || p.Percent >= 100
+
+	var relay *hostProgress
+	if done || now.Sub(p.relayedAt) >= progressUpdateInterval {
+		p.relayedAt = now
+		relay = &hostProgress{
+			ReceiverID:    receiver.ID,
+			Name:          receiver.Name,
+			BytesReceived: p.BytesReceived,
+			Percent:       p.Percent,
+			ThroughputBps: math.Round(p.Throughput),
+			ETASeconds:    etaSeconds(*p, total),
+		}
+	}
+
+	if done || now.Sub(upload.progressSentAt) >= progressUpdateInterval {
+		upload.progressSentAt = now
+		return relay, true
+	}
+	return relay, false
+}
+
+// etaSeconds estimates the remaining transfer time, or -1 when unknown.
+func etaSeconds(p receiverProgress, fileSize int64) float64 {
+	remaining := fileSize - p.BytesReceived
+	if remaining <= 0 {
+		return 0
+	}
+	if p.Throughput <= 0 {
+		return -1
+	}
+	return math.Round(float64(remaining) / p.Throughput)
+}
+
+func handleTransferProgress(upload *Upload, receiver *Receiver, msg Message) {
+	var report progressReport
+	err := decodePayload(msg, &report)
+	if err == nil && report.BytesReceived < 0 {
+		err = errors.New("bytes_received must not be negative")
+	}
+	if err == nil && report.Percent != nil && (*report.Percent < 0 || *report.Percent > 100) {
+		err = errors.New("percent must be between 0 and 100")
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	relay, update := recordProgress(upload, receiver, report)
+	if relay != nil {
+		sendToHost(upload, Message{Type: "transfer_progress", Payload: relay})
+	}
+	if update {
+		sendReceiversUpdate(upload)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Clients can open with a hello message declaring the newest protocol
+// version they speak and the optional features they understand. The server
+// answers with the version it will use on that socket, the range it
+// supports and its own features, so the message format can change without
+// breaking frontends that were loaded before a deploy. Clients that never
+// say hello are spoken to in version 1, which is what the protocol looked
+// like before the handshake existed.
+//
+// Version 2 reports failed joins with error messages instead of
+// join_rejected and kicked, see wserror.go. Version 3 routes signaling on
+// the envelope, see envelope.go. Older versions are translated to and from
+// the newest in compat.go.
+
+const (
+	protocolMinVersion = 1
+	protocolMaxVersion = 3
+)
+
+// serverFeatures are the optional parts of the protocol this server
+// implements. Clients should check for a feature before relying on it.
+var serverFeatures = []string{
+	"approval",
+	"bandwidth_probe",
+	"bans",
+	"broadcast",
+	"capacity_report",
+	"continuation",
+	"create_upload",
+	"error_messages",
+	"file_request",
+	"http_relay",
+	"hold_open",
+	"ice_servers",
+	"host_resume",
+	"identity",
+	"inline",
+	"low_power",
+	"progress",
+	"quota_warnings",
+	"receiver_resume",
+	"relay",
+	"relay_confirm",
+	"request_files",
+	"reverse_offer",
+	"sealed_signaling",
+	"snippet",
+	"store_and_forward",
+	"transport_plan",
+	"update_metadata",
+	"waiting_room",
+}
+
+type clientHello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+type serverHello struct {
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"min_version"`
+	MaxVersion   int      `json:"max_version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// handleHello negotiates the protocol for conn. It reports false when the
+// client is too old to be served.
+func handleHello(conn *wsConn, msg Message) bool {
+	conn = conn.root() // the hello is about the socket, not one of its uploads
+	var hello clientHello
+	if err := decodePayload(msg, &hello); err != nil {
+		conn.WriteJSON(invalidPayload(msg, err))
+		return true
+	}
+	if hello.Version < protocolMinVersion {
+		conn.WriteJSON(errorMessage(errCodeUnsupportedVersion,
+			fmt.Sprintf("protocol version %d is no longer supported, the oldest is %d", hello.Version, protocolMinVersion), msg.Type))
+		return false
+	}
+
+	hello.Version = min(hello.Version, protocolMaxVersion)
+	conn.setHello(hello)
+	if slices.Contains(hello.Capabilities, featureLowPower) {
+		conn.lowPower.Store(true)
+		conn.extendReadDeadline()
+	}
+	conn.WriteJSON(Message{Type: "hello", Payload: serverHello{
+		Version:      hello.Version,
+		MinVersion:   protocolMinVersion,
+		MaxVersion:   protocolMaxVersion,
+		Capabilities: serverFeatures,
+	}})
+	return true
+}
+
+func (c *wsConn) setHello(hello clientHello) {
+	c = c.root()
+	c.helloMutex.Lock()
+	defer c.helloMutex.Unlock()
+	c.hello = hello
+}
+
+// protocolVersion is the version negotiated on the socket.
+func (c *wsConn) protocolVersion() int {
+	c = c.root()
+	c.helloMutex.RLock()
+	defer c.helloMutex.RUnlock()
+	if c.hello.Version == 0 {
+		return protocolMinVersion
+	}
+	return c.hello.Version
+}
+
+// understands reports whether the client declared feature in its hello.
+func (c *wsConn) understands(feature string) bool {
+	c = c.root()
+	c.helloMutex.RLock()
+	defer c.helloMutex.RUnlock()
+	return slices.Contains(c.hello.Capabilities, feature)
+}
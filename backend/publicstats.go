@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Public instances can publish usage at GET /api/stats/public without
+// giving away individual transfers. Exact counts per day and country stay
+// in memory and are never served. What is published is differentially
+// private:
+//
+//   - only finished days are shown, so a new transfer can't be spotted by
+//     polling;
+//   - each count gets Laplace noise scaled to -public-stats-epsilon, drawn
+//     once per cell and then reused, so asking again doesn't average the
+//     noise away;
+//   - cells whose noisy count is below -public-stats-threshold are folded
+//     into the day's "other" bucket, and dropped if that is too small too.
+
+// publicStatsDays is how many finished days are kept and published.
+const publicStatsDays = 30
+
+// unknownCountry buckets sessions without -country-header.
+const unknownCountry = "ZZ"
+
+type statsCell struct {
+	Sessions  int64
+	Completed int64
+
+	// Set when the cell is first published
+	noisy *statsCounts
+}
+
+type statsCounts struct {
+	Sessions  int64 `json:"sessions"`
+	Completed int64 `json:"completed"` // sessions where at least one receiver finished
+}
+
+type usageStats struct {
+	mutex sync.Mutex
+	days  map[string]map[string]*statsCell // day -> country -> counts
+}
+
+var publicStats = usageStats{days: make(map[string]map[string]*statsCell)}
+
+func statsDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+func (s *usageStats) cell(country string) *statsCell {
+	if country == "" {
+		country = unknownCountry
+	}
+	day := statsDay(time.Now())
+	cells, ok := s.days[day]
+	if !ok {
+		cells = make(map[string]*statsCell)
+		s.days[day] = cells
+		s.prune()
+	}
+	c, ok := cells[country]
+	if !ok {
+		c = &statsCell{}
+		cells[country] = c
+	}
+	return c
+}
+
+// prune forgets days that are no longer published. The caller holds
+// s.mutex.
+func (s *usageStats) prune() {
+	oldest := statsDay(time.Now().AddDate(0, 0, -publicStatsDays))
+	for day := range s.days {
+		if day < oldest {
+			delete(s.days, day)
+		}
+	}
+}
+
+func (s *usageStats) sessionCreated(country string) {
+	s.mutex.Lock()
+	s.cell(country).Sessions++
+	s.mutex.Unlock()
+}
+
+func (s *usageStats) sessionCompleted(country string) {
+	s.mutex.Lock()
+	s.cell(country).Completed++
+	s.mutex.Unlock()
+}
+
+// laplace draws from a Laplace distribution centred on 0 with scale b.
+func laplace(b float64) float64 {
+	u := rand.Float64() - 0.5
+	return -b * math.Copysign(1, u) * math.Log(1-2*math.Abs(u))
+}
+
+// noised adds noise to n. Every count is of sessions, so one session
+// changes it by at most 1.
+func noised(n int64) int64 {
+	return max(0, int64(math.Round(float64(n)+laplace(1/cfg.PublicStatsEpsilon))))
+}
+
+// published returns the noisy counts of c, drawing them the first time.
+func (c *statsCell) published() statsCounts {
+	if c.noisy == nil {
+		c.noisy = &statsCounts{Sessions: noised(c.Sessions), Completed: noised(c.Completed)}
+	}
+	return *c.noisy
+}
+
+type publicDay struct {
+	Day       string                 `json:"day"`
+	Countries map[string]statsCounts `json:"countries"`
+}
+
+type publicStatsPage struct {
+	Epsilon   float64     `json:"epsilon"`
+	Threshold int64       `json:"threshold"`
+	Days      []publicDay `json:"days"`
+}
+
+func (s *usageStats) publish() publicStatsPage {
+	page := publicStatsPage{Epsilon: cfg.PublicStatsEpsilon, Threshold: cfg.PublicStatsThreshold, Days: []publicDay{}}
+	today := statsDay(time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune()
+	for day, cells := range s.days {
+		if day >= today {
+			continue
+		}
+		published := publicDay{Day: day, Countries: make(map[string]statsCounts)}
+		var other statsCounts
+		for country, c := range cells {
+			counts := c.published()
+			if country != unknownCountry && counts.Sessions >= cfg.PublicStatsThreshold {
+				published.Countries[country] = counts
+				continue
+			}
+			other.Sessions += counts.Sessions
+			other.Completed += counts.Completed
+		}
+		if other.Sessions >= cfg.PublicStatsThreshold {
+			published.Countries["other"] = other
+		}
+		page.Days = append(page.Days, published)
+	}
+	sort.Slice(page.Days, func(i, j int) bool { return page.Days[i].Day < page.Days[j].Day })
+	return page
+}
+
+func handlePublicStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, publicStats.publish())
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// POST /api/publish is the scriptable way to hand a file to people, e.g.
+// a build artifact from a CI job. It takes an API key, the file as the body
+// and options in the query:
+//
+//	filename, filetype  as for /api/upload (filetype defaults to Content-Type)
+//	labels              comma-separated tags shown in the admin API
+//	ttl                 how long the session lives, up to -publish-max-ttl
+//	max_downloads       how many receivers get the file before it closes
+//	webhook             URL told about every download and when it ends,
+//	                    signed with Sendmyzip-Webhook-Secret or a generated
+//	                    secret returned as webhook_secret
+//	room                room to announce it in (with Sendmyzip-Room-Key)
+//
+// The session needs no host socket; the file is served inline, so it has to
+// fit in -inline-max-bytes. `sendmyzip publish` wraps the endpoint.
+
+const defaultPublishTTL = 24 * time.Hour
+
+type publishedSession struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	ShareURL      string    `json:"share_url"`
+	ResumeURL     string    `json:"resume_url"` // attach as the host, e.g. to watch downloads
+	HostToken     string    `json:"host_token"`
+	ResumeToken   string    `json:"resume_token"`
+	Labels        []string  `json:"labels,omitempty"`
+	MaxDownloads  int       `json:"max_downloads,omitempty"`
+	WebhookSecret string    `json:"webhook_secret,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+
+	QuotaWarnings []quotaWarning `json:"quota_warnings,omitempty"`
+}
+
+func handlePublish(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeProblem(w, http.StatusServiceUnavailable, problemDraining, "")
+		return
+	}
+
+	query := r.URL.Query()
+	ttl := defaultPublishTTL
+	if s := query.Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid ttl, use a duration like 72h")
+			return
+		}
+		ttl = min(d, cfg.PublishMaxTTL)
+	}
+	var maxDownloads int
+	if s := query.Get("max_downloads"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid max_downloads parameter")
+			return
+		}
+		maxDownloads = n
+	}
+	webhook := query.Get("webhook")
+	if webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "webhook must be an http(s) URL")
+			return
+		}
+	}
+	room := query.Get("room")
+	if room != "" {
+		if !roomNamePattern.MatchString(room) {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Room names are 1-64 lowercase letters, digits, - and _")
+			return
+		}
+		ok, err := authorizeRoom(r.Context(), room, roomKey(r))
+		if err != nil {
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not look up room")
+			return
+		}
+		if !ok {
+			writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid or missing Sendmyzip-Room-Key")
+			return
+		}
+	}
+
+	meta, data, ok := readFileBody(w, r)
+	if !ok {
+		return
+	}
+	var quotaWarnings []quotaWarning
+	if key, ok := apiKeyFrom(r); ok {
+		limits := limitsFor(key)
+		var err error
+		if quotaWarnings, err = chargeQuota(key.ID, &limits, quotaBytesOf(meta)); err != nil {
+			writeQuotaProblem(w, err)
+			return
+		}
+	}
+
+	base := publicBaseURL(r)
+	upload := newHostlessUpload(meta, data, base, ttl)
+	upload.labels = parseCapabilities(query.Get("labels"))
+	upload.maxDownloads = maxDownloads
+	upload.webhookURL = webhook
+	if webhook != "" {
+		upload.webhookSecret = r.Header.Get("Sendmyzip-Webhook-Secret")
+		if upload.webhookSecret == "" {
+			upload.webhookSecret = newWebhookSecret()
+		}
+	}
+	upload.room = room
+	upload.country = clientCountry(r)
+	if tenant, ok := tenantFrom(r); ok {
+		upload.tenant = tenant
+	}
+	if passphrase := requestPassphrase(r); passphrase != "" {
+		upload.passphrase = hashPassphrase(passphrase)
+	}
+	id := registerUpload(upload)
+	announceUpload(upload)
+	log.Info("Published session", "id", id, "bytes", len(data), "labels", upload.labels, "ttl", ttl)
+
+	writeJSON(w, http.StatusCreated, publishedSession{
+		ID:            id,
+		URL:           base + "/?code=" + url.QueryEscape(id),
+		ShareURL:      base + "/d/" + url.PathEscape(id),
+		ResumeURL:     strings.Replace(base, "http", "ws", 1) + "/api/upload/" + url.PathEscape(id) + "/resume",
+		HostToken:     upload.hostToken,
+		ResumeToken:   upload.resumeToken,
+		Labels:        upload.labels,
+		MaxDownloads:  maxDownloads,
+		WebhookSecret: upload.webhookSecret,
+		ExpiresAt:     upload.expiresAt,
+		QuotaWarnings: quotaWarnings,
+	})
+}
+
+// downloadsExhausted reports whether the session has no downloads left.
+func (u *Upload) downloadsExhausted() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.maxDownloads > 0 && u.downloads >= u.maxDownloads
+}
+
+// countDownload records that receiver was handed the file.
+func countDownload(upload *Upload, receiver *Receiver) {
+	upload.mutex.Lock()
+	upload.downloads++
+	downloads := upload.downloads
+	upload.mutex.Unlock()
+
+	recordEvent(upload, "file_downloaded", map[string]any{"receiver_id": receiver.ID, "downloads": downloads})
+	notifySessionWebhook(upload, "downloaded", map[string]any{
+		"receiver_name": receiver.Name,
+		"downloads":     downloads,
+	})
+}
+
+// notifySessionWebhook posts event to the session's webhook, if it has one.
+func notifySessionWebhook(upload *Upload, event string, extra map[string]any) {
+	if upload.webhookURL == "" {
+		return
+	}
+	body := map[string]any{
+		"type":     event,
+		"id":       upload.ID,
+		"labels":   upload.labels,
+		"metadata": upload.Meta,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	sendWebhook(upload.webhookURL, upload.webhookSecret, event, body)
+}
+
+// runPublish implements `sendmyzip publish [flags] file`. It prints the
+// server's JSON response.
+func runPublish(args []string) {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:3000", "base URL of the sendmyzip server")
+	apiKey := fs.String("api-key", os.Getenv("SENDMYZIP_API_KEY"), "API key (defaults to $SENDMYZIP_API_KEY)")
+	labels := fs.String("labels", "", "comma-separated labels, e.g. the branch and commit")
+	ttl := fs.Duration("ttl", defaultPublishTTL, "how long the file stays available")
+	maxDownloads := fs.Int("max-downloads", 0, "close the session after this many downloads (0 is unlimited)")
+	webhook := fs.String("webhook", "", "URL to POST download and end events to")
+	webhookSecret := fs.String("webhook-secret", os.Getenv("SENDMYZIP_WEBHOOK_SECRET"), "secret the webhook deliveries are signed with (generated when empty; defaults to $SENDMYZIP_WEBHOOK_SECRET)")
+	room := fs.String("room", "", "room to announce the file in")
+	roomKey := fs.String("room-key", os.Getenv("SENDMYZIP_ROOM_KEY"), "key for -room (defaults to $SENDMYZIP_ROOM_KEY)")
+	passphrase := fs.String("passphrase", os.Getenv("SENDMYZIP_PASSPHRASE"), "passphrase receivers must enter (defaults to $SENDMYZIP_PASSPHRASE)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: sendmyzip publish [flags] file")
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal("Could not read file", "err", err)
+	}
+
+	filetype := mime.TypeByExtension(filepath.Ext(path))
+	if filetype == "" {
+		filetype = "application/octet-stream"
+	}
+	query := url.Values{
+		"filename": {filepath.Base(path)},
+		"filetype": {filetype},
+		"ttl":      {ttl.String()},
+	}
+	if *labels != "" {
+		query.Set("labels", *labels)
+	}
+	if *maxDownloads > 0 {
+		query.Set("max_downloads", strconv.Itoa(*maxDownloads))
+	}
+	if *webhook != "" {
+		query.Set("webhook", *webhook)
+	}
+	if *room != "" {
+		query.Set("room", *room)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(*server, "/")+"/api/publish?"+query.Encode(), bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+*apiKey)
+	req.Header.Set("Content-Type", filetype)
+	if *roomKey != "" {
+		req.Header.Set("Sendmyzip-Room-Key", *roomKey)
+	}
+	if *passphrase != "" {
+		req.Header.Set("Sendmyzip-Passphrase", *passphrase)
+	}
+	if *webhookSecret != "" {
+		req.Header.Set("Sendmyzip-Webhook-Secret", *webhookSecret)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal("Could not reach server", "err", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// A session with max_receivers doesn't turn joins away once it is full.
+// Receivers past the limit wait in line: they get queued with their place,
+// then queue_position whenever it changes, and are let in (or on to
+// approval) in order as soon as someone leaves. The host sees the line in
+// queue_update. Only when the line itself is full is a join rejected.
+
+// maxQueuedReceivers caps the line of one session.
+const maxQueuedReceivers = 100
+
+type queuedReceiver struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Position int       `json:"position"` // 1 is next in line
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// enterSession admits receiver, asks the host about it or puts it in line,
+// whichever its place allows. It reports false when even the line is full.
+func enterSession(upload *Upload, receiver *Receiver) bool {
+	receiver.queuedAt = time.Now()
+	upload.mutex.Lock()
+	full := upload.MaxReceivers > 0 && len(upload.Receivers)+len(upload.pending) >= upload.MaxReceivers
+	if full || len(upload.queue) > 0 {
+		if len(upload.queue) >= maxQueuedReceivers {
+			upload.mutex.Unlock()
+			return false
+		}
+		upload.queue = append(upload.queue, receiver)
+		upload.mutex.Unlock()
+		sendQueuePositions(upload)
+		return true
+	}
+	upload.mutex.Unlock()
+
+	letIn(upload, receiver)
+	return true
+}
+
+// hasQueueRoom reports whether another receiver can get in line.
+func (u *Upload) hasQueueRoom() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return len(u.queue) < maxQueuedReceivers
+}
+
+func letIn(upload *Upload, receiver *Receiver) {
+	if upload.RequireApproval {
+		requestApproval(upload, receiver)
+	} else {
+		admitReceiver(upload, receiver)
+	}
+}
+
+// promoteQueued lets in as many receivers from the line as there are free
+// places.
+func promoteQueued(upload *Upload) {
+	var promoted []*Receiver
+	upload.mutex.Lock()
+	for len(upload.queue) > 0 {
+		if upload.MaxReceivers > 0 && len(upload.Receivers)+len(upload.pending)+len(promoted) >= upload.MaxReceivers {
+			break
+		}
+		promoted = append(promoted, upload.queue[0])
+		upload.queue = upload.queue[1:]
+	}
+	upload.mutex.Unlock()
+	if len(promoted) == 0 {
+		return
+	}
+
+	for _, receiver := range promoted {
+		receiver.send(Message{Type: "queue_promoted", Payload: map[string]any{
+			"waited_ms": time.Since(receiver.queuedAt).Milliseconds(),
+		}})
+		letIn(upload, receiver)
+	}
+	sendQueuePositions(upload)
+}
+
+// takeQueued removes the receiver with id from the line.
+func takeQueued(upload *Upload, id string) *Receiver {
+	upload.mutex.Lock()
+	i := slices.IndexFunc(upload.queue, func(r *Receiver) bool { return r.ID == id })
+	if i < 0 {
+		upload.mutex.Unlock()
+		return nil
+	}
+	receiver := upload.queue[i]
+	upload.queue = slices.Delete(upload.queue, i, i+1)
+	upload.mutex.Unlock()
+
+	sendQueuePositions(upload)
+	return receiver
+}
+
+// sendQueuePositions tells everyone in line where they stand and the host
+// who is waiting.
+func sendQueuePositions(upload *Upload) {
+	upload.mutex.RLock()
+	queue := slices.Clone(upload.queue)
+	upload.mutex.RUnlock()
+
+	list := make([]queuedReceiver, len(queue))
+	for i, receiver := range queue {
+		list[i] = queuedReceiver{ID: receiver.ID, Name: receiver.Name, Position: i + 1, QueuedAt: receiver.queuedAt}
+		receiver.send(Message{Type: "queue_position", Payload: map[string]int{
+			"position":     i + 1,
+			"queue_length": len(queue),
+		}})
+	}
+	sendToHost(upload, Message{Type: "queue_update", Payload: map[string]any{"queued": list}})
+}
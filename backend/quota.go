@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Sessions created with an API key count against the key's daily quotas:
+// how many sessions it may create and how many bytes they may offer, per
+// UTC day. -tenant-sessions-per-day and -tenant-bytes-per-day set them for
+// every key; a key can carry its own, with a negative value, which only the
+// admin token can set, lifting that quota. The session that would go over
+// is refused with quota_exceeded.
+//
+// Before that, once -quota-warn-at of a quota is used, the creating host
+// finds quota_warnings in upload_created (or the publish response), and the
+// hosts of the key's other live sessions get a quota_warning message, once
+// on reaching the threshold and once more when the quota is used up. Usage
+// is kept in memory and starts over when the server does.
+
+const (
+	quotaSessions = "sessions"
+	quotaBytes    = "bytes"
+)
+
+type quotaLimits struct {
+	Sessions int64
+	Bytes    int64
+}
+
+// quotaWarning reports a quota at or past the warning threshold.
+type quotaWarning struct {
+	Quota    string    `json:"quota"`
+	Used     int64     `json:"used"`
+	Limit    int64     `json:"limit"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// quotaError is returned for a session that doesn't fit the quota.
+type quotaError struct {
+	quotaWarning
+}
+
+func (e quotaError) Error() string {
+	if e.Quota == quotaBytes {
+		return fmt.Sprintf("daily quota of %s would be exceeded (%s used)", formatFileSize(e.Limit), formatFileSize(e.Used))
+	}
+	return fmt.Sprintf("daily quota of %d sessions is used up", e.Limit)
+}
+
+type tenantUsage struct {
+	limits   quotaLimits
+	day      time.Time
+	sessions int64
+	bytes    int64
+	warned   map[string]int // level reached per quota today: 1 warned, 2 used up
+}
+
+var quotas = struct {
+	mutex   sync.Mutex
+	tenants map[string]*tenantUsage
+}{tenants: make(map[string]*tenantUsage)}
+
+// limitsFor returns the quotas that apply to key.
+func limitsFor(key APIKey) quotaLimits {
+	limits := quotaLimits{Sessions: cfg.TenantSessionsPerDay, Bytes: cfg.TenantBytesPerDay}
+	if key.SessionsPerDay != 0 {
+		limits.Sessions = key.SessionsPerDay
+	}
+	if key.BytesPerDay != 0 {
+		limits.Bytes = key.BytesPerDay
+	}
+	return limits
+}
+
+// quotaBytesOf is what a session offering meta counts against the byte
+// quota.
+func quotaBytesOf(meta Metadata) int64 {
+	return max(meta.FileSize, meta.TotalSize)
+}
+
+// chargeQuota counts a new session of size bytes against tenant. limits
+// replaces the tenant's known limits when set; sessions created over an
+// existing connection pass nil and keep them. It returns the warnings the
+// new session's host should see, or a quotaError when it doesn't fit.
+func chargeQuota(tenant string, limits *quotaLimits, size int64) ([]quotaWarning, error) {
+	if tenant == "" {
+		return nil, nil
+	}
+	now := time.Now().UTC()
+	day := now.Truncate(24 * time.Hour)
+
+	quotas.mutex.Lock()
+	u, ok := quotas.tenants[tenant]
+	if !ok {
+		u = &tenantUsage{}
+		quotas.tenants[tenant] = u
+	}
+	if limits != nil {
+		u.limits = *limits
+	}
+	if !u.day.Equal(day) {
+		u.day, u.sessions, u.bytes, u.warned = day, 0, 0, make(map[string]int)
+	}
+	resets := day.Add(24 * time.Hour)
+
+	if u.limits.Sessions > 0 && u.sessions >= u.limits.Sessions {
+		quotas.mutex.Unlock()
+		return nil, quotaError{quotaWarning{quotaSessions, u.sessions, u.limits.Sessions, resets}}
+	}
+	if u.limits.Bytes > 0 && u.bytes+size > u.limits.Bytes {
+		quotas.mutex.Unlock()
+		return nil, quotaError{quotaWarning{quotaBytes, u.bytes, u.limits.Bytes, resets}}
+	}
+	u.sessions++
+	u.bytes += size
+
+	var warnings, raised []quotaWarning
+	for _, q := range []quotaWarning{
+		{quotaSessions, u.sessions, u.limits.Sessions, resets},
+		{quotaBytes, u.bytes, u.limits.Bytes, resets},
+	} {
+		if q.Limit <= 0 || float64(q.Used) < cfg.QuotaWarnAt*float64(q.Limit) {
+			continue
+		}
+		warnings = append(warnings, q)
+		level := 1
+		if q.Used >= q.Limit {
+			level = 2
+		}
+		if level > u.warned[q.Quota] {
+			u.warned[q.Quota] = level
+			raised = append(raised, q)
+		}
+	}
+	quotas.mutex.Unlock()
+
+	if len(raised) > 0 {
+		log.Info("Tenant nearing its quota", "tenant", tenant, "warnings", raised)
+		warnTenant(tenant, raised)
+	}
+	return warnings, nil
+}
+
+// warnTenant tells the hosts of tenant's live sessions about warnings. The
+// session being created isn't registered yet and learns from its reply.
+func warnTenant(tenant string, warnings []quotaWarning) {
+	var live []*Upload
+	uploadsMutex.RLock()
+	for _, upload := range uploads {
+		if upload.tenant == tenant {
+			live = append(live, upload)
+		}
+	}
+	uploadsMutex.RUnlock()
+
+	msg := Message{Type: "quota_warning", Payload: map[string]any{"warnings": warnings}}
+	for _, upload := range live {
+		if !upload.isClosed() {
+			sendToHost(upload, msg)
+		}
+	}
+}
+
+// writeQuotaProblem answers a request refused by chargeQuota, telling the
+// client when the quota starts over.
+func writeQuotaProblem(w http.ResponseWriter, err error) {
+	if q, ok := err.(quotaError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(q.ResetsAt).Seconds()))))
+	}
+	writeProblem(w, http.StatusTooManyRequests, problemQuotaExceeded, err.Error())
+}
+
+// requestAPIKey returns the API key a request to an open endpoint such as
+// /api/upload carries, so its sessions count against the key's quotas. It
+// fails for a token that is neither a key nor the admin token.
+func requestAPIKey(r *http.Request) (key APIKey, ok bool, err error) {
+	token := bearerToken(r)
+	if token == "" || (cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1) {
+		return APIKey{}, false, nil
+	}
+	key, err = store.LookupAPIKey(r.Context(), hashAPIToken(token))
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	return key, true, nil
+}
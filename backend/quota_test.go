@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// quotaTenant names a tenant for t whose usage is gone when t is.
+func quotaTenant(t *testing.T) string {
+	t.Cleanup(func() {
+		quotas.mutex.Lock()
+		delete(quotas.tenants, t.Name())
+		quotas.mutex.Unlock()
+	})
+	return t.Name()
+}
+
+func TestChargeQuotaSessions(t *testing.T) {
+	tenant := quotaTenant(t)
+	limits := quotaLimits{Sessions: 2}
+	for i := range 2 {
+		if _, err := chargeQuota(tenant, &limits, 0); err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+	}
+	_, err := chargeQuota(tenant, &limits, 0)
+	var q quotaError
+	if !errors.As(err, &q) || q.Quota != quotaSessions || q.Used != 2 || q.Limit != 2 {
+		t.Fatalf("third session: got %v, want the sessions quota used up", err)
+	}
+}
+
+func TestChargeQuotaBytes(t *testing.T) {
+	tenant := quotaTenant(t)
+	limits := quotaLimits{Bytes: 1000}
+	if _, err := chargeQuota(tenant, &limits, 600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := chargeQuota(tenant, &limits, 500)
+	var q quotaError
+	if !errors.As(err, &q) || q.Quota != quotaBytes || q.Used != 600 {
+		t.Fatalf("going over: got %v, want the bytes quota exceeded", err)
+	}
+	// What was refused isn't counted
+	if _, err := chargeQuota(tenant, &limits, 400); err != nil {
+		t.Fatalf("filling up: %v", err)
+	}
+}
+
+func TestChargeQuotaWarnings(t *testing.T) {
+	tenant := quotaTenant(t)
+	limits := quotaLimits{Sessions: 10}
+	for i := 1; i <= 10; i++ {
+		warnings, err := chargeQuota(tenant, &limits, 0)
+		if err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+		warned := len(warnings) > 0
+		if want := float64(i) >= cfg.QuotaWarnAt*10; warned != want {
+			t.Errorf("session %d: warnings %v, want warned %v", i, warnings, want)
+		}
+	}
+}
+
+func TestChargeQuotaWithoutTenant(t *testing.T) {
+	limits := quotaLimits{Sessions: 1}
+	for range 3 {
+		if _, err := chargeQuota("", &limits, 1<<40); err != nil {
+			t.Fatalf("sessions from the web UI have no quota: %v", err)
+		}
+	}
+}
+
+func TestLimitsFor(t *testing.T) {
+	tenant := quotaTenant(t)
+	server := quotaLimits{cfg.TenantSessionsPerDay, cfg.TenantBytesPerDay}
+	if got := limitsFor(APIKey{}); got != server {
+		t.Errorf("key without limits: got %+v, want the server's %+v", got, server)
+	}
+	if got := limitsFor(APIKey{SessionsPerDay: 5}); got != (quotaLimits{5, server.Bytes}) {
+		t.Errorf("key with a session limit: got %+v", got)
+	}
+
+	// A negative limit lifts the quota
+	limits := limitsFor(APIKey{SessionsPerDay: -1, BytesPerDay: -1})
+	for range 200 {
+		if _, err := chargeQuota(tenant, &limits, 1<<30); err != nil {
+			t.Fatalf("lifted quota: %v", err)
+		}
+	}
+}
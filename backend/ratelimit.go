@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ipLimiter hands out a token bucket per client IP. Buckets that have been
+// idle long enough to be full again are dropped by the sweeper.
+type ipLimiter struct {
+	rate    rate.Limit
+	burst   int
+	mutex   sync.Mutex
+	buckets map[string]*ipBucket
+}
+
+type ipBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiter(perMinute float64, burst int) *ipLimiter {
+	return &ipLimiter{
+		rate:    rate.Limit(perMinute / 60),
+		burst:   burst,
+		buckets: make(map[string]*ipBucket),
+	}
+}
+
+func (l *ipLimiter) bucket(ip string) *rate.Limiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &ipBucket{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.buckets[ip] = b
+	}
+	b.lastSeen = time.Now()
+	return b.limiter
+}
+
+// rateStatus describes a client's bucket after a request.
+type rateStatus struct {
+	Limit      int           `json:"limit"`
+	Remaining  int           `json:"remaining"`
+	ResetSecs  int           `json:"reset"` // seconds until the bucket is full again
+	RetryAfter time.Duration `json:"-"`
+}
+
+// allow takes a token for ip. When the bucket is empty the status carries
+// how long until the next token is available.
+func (l *ipLimiter) allow(ip string) (bool, rateStatus) {
+	now := time.Now()
+	limiter := l.bucket(ip)
+	status := rateStatus{Limit: l.burst}
+
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		status.RetryAfter = time.Minute
+		return false, status
+	}
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+
+	tokens := limiter.TokensAt(now)
+	status.Remaining = max(int(math.Floor(tokens)), 0)
+	status.ResetSecs = int(math.Ceil((float64(l.burst) - tokens) / float64(l.rate)))
+	if delay > 0 {
+		status.RetryAfter = delay
+		return false, status
+	}
+	return true, status
+}
+
+func (s rateStatus) header() http.Header {
+	h := http.Header{}
+	h.Set("RateLimit-Limit", strconv.Itoa(s.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(s.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(s.ResetSecs))
+	return h
+}
+
+type rateStatusKey struct{}
+
+// rateStatusFrom returns the rate limit state recorded for r, if any.
+func rateStatusFrom(r *http.Request) (rateStatus, bool) {
+	s, ok := r.Context().Value(rateStatusKey{}).(rateStatus)
+	return s, ok
+}
+
+// responseHeader returns the RateLimit-* headers for r. WebSocket handlers
+// pass it to Upgrade, which ignores headers set on the ResponseWriter.
+func responseHeader(r *http.Request) http.Header {
+	if s, ok := rateStatusFrom(r); ok {
+		return s.header()
+	}
+	return nil
+}
+
+func (l *ipLimiter) sweep() {
+	// A bucket idle for this long has refilled completely
+	idle := time.Duration(float64(l.burst)/float64(l.rate)*float64(time.Second)) + time.Minute
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for ip, b := range l.buckets {
+		if time.Since(b.lastSeen) > idle {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+func (l *ipLimiter) runSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.sweep()
+	}
+}
+
+// rateLimited wraps next with the limiter. Every response carries the
+// RateLimit-* headers; once the client's bucket is empty it gets 429 with
+// Retry-After.
+func rateLimited(l *ipLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, status := l.allow(clientIP(r))
+		for name, values := range status.header() {
+			w.Header()[name] = values
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(status.RetryAfter.Seconds()))))
+			writeProblem(w, http.StatusTooManyRequests, problemRateLimited, "")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), rateStatusKey{}, status)))
+	}
+}
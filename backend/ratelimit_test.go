@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIPLimiterBurst(t *testing.T) {
+	l := newIPLimiter(1, 3)
+	for i := range 3 {
+		ok, status := l.allow("192.0.2.1")
+		if !ok {
+			t.Fatalf("request %d refused", i+1)
+		}
+		if status.Limit != 3 || status.Remaining != 2-i {
+			t.Errorf("request %d: got %+v, want %d remaining", i+1, status, 2-i)
+		}
+	}
+
+	ok, status := l.allow("192.0.2.1")
+	if ok {
+		t.Fatal("request past the burst allowed")
+	}
+	// One token a minute
+	if status.RetryAfter < 50*time.Second || status.RetryAfter > time.Minute {
+		t.Errorf("retry after %s, want about a minute", status.RetryAfter)
+	}
+	if status.Remaining != 0 {
+		t.Errorf("remaining %d, want 0", status.Remaining)
+	}
+
+	// A refused request doesn't use up the next token
+	if _, again := l.allow("192.0.2.1"); again.RetryAfter > status.RetryAfter {
+		t.Errorf("retry after grew from %s to %s", status.RetryAfter, again.RetryAfter)
+	}
+}
+
+func TestIPLimiterPerIP(t *testing.T) {
+	l := newIPLimiter(1, 1)
+	if ok, _ := l.allow("192.0.2.1"); !ok {
+		t.Fatal("first client refused")
+	}
+	if ok, _ := l.allow("192.0.2.2"); !ok {
+		t.Error("second client refused for the first one's request")
+	}
+	if ok, _ := l.allow("192.0.2.1"); ok {
+		t.Error("first client allowed past its burst")
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	var got rateStatus
+	handler := rateLimited(newIPLimiter(1, 2), func(w http.ResponseWriter, r *http.Request) {
+		got, _ = rateStatusFrom(r)
+	})
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/api/upload", nil))
+		return w
+	}
+
+	w := request()
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request: got %d", w.Code)
+	}
+	if w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("headers %v, want a limit of 2 with 1 remaining", w.Header())
+	}
+	if got.Remaining != 1 {
+		t.Errorf("handler saw %+v, want 1 remaining", got)
+	}
+
+	request()
+	w = request()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request: got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("RateLimit-Remaining %q, want 0", w.Header().Get("RateLimit-Remaining"))
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs < 1 || secs > 60 {
+		t.Errorf("Retry-After %q, want up to a minute", w.Header().Get("Retry-After"))
+	}
+}
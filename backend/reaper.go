@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// A session normally ends when its host socket errors, but a hung
+// connection may never error. Operators can have the reaper end sessions
+// that are older than -session-max-age or have seen no messages for
+// -session-idle-timeout; both are off unless set.
+
+// touch records activity on the session.
+func (u *Upload) touch() {
+	u.lastActivity.Store(time.Now().UnixNano())
+}
+
+// expiryReason returns why upload should be reaped, or "" if it shouldn't.
+func expiryReason(upload *Upload, now time.Time) string {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+
+	// Sessions created with their own lifetime end on that instead
+	if !upload.expiresAt.IsZero() {
+		return ""
+	}
+	if cfg.SessionMaxAge > 0 && now.Sub(upload.CreatedAt) > cfg.SessionMaxAge {
+		return "max_age"
+	}
+	// Detached hold-open sessions are idle by design and have their own TTL
+	idle := now.Sub(time.Unix(0, upload.lastActivity.Load()))
+	if cfg.SessionIdleTimeout > 0 && !upload.hostDetached && idle > cfg.SessionIdleTimeout {
+		return "idle"
+	}
+	return ""
+}
+
+// expireUpload tells everyone the session is over and removes it.
+func expireUpload(upload *Upload, reason string) {
+	log.Info("Reaping session", "id", upload.ID, "reason", reason)
+
+	upload.mutex.RLock()
+	receivers := make([]*Receiver, 0, len(upload.Receivers)+len(upload.pending)+len(upload.queue))
+	receivers = append(receivers, upload.Receivers...)
+	receivers = append(receivers, upload.pending...)
+	receivers = append(receivers, upload.queue...)
+	upload.mutex.RUnlock()
+
+	recordEvent(upload, "session_expired", map[string]any{"reason": reason})
+	sendToHost(upload, Message{Type: "session_expired", Payload: map[string]string{"reason": reason}})
+	for _, receiver := range receivers {
+		receiver.send(Message{Type: "host_disconnected", Payload: map[string]string{"reason": "session_expired"}})
+		receiver.close()
+	}
+	finalizeUpload(upload)
+}
+
+func reapSessions() {
+	now := time.Now()
+
+	uploadsMutex.RLock()
+	list := make([]*Upload, 0, len(uploads))
+	for _, upload := range uploads {
+		list = append(list, upload)
+	}
+	uploadsMutex.RUnlock()
+
+	for _, upload := range list {
+		if reason := expiryReason(upload, now); reason != "" {
+			expireUpload(upload, reason)
+		}
+	}
+}
+
+func runReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		reapSessions()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// A receiver whose socket drops is kept for -receiver-grace-period instead
+// of being removed at once. Messages for it are buffered, and when it joins
+// again with the resume_token it got in receiver_session it keeps its ID,
+// so the host doesn't have to start negotiating from scratch.
+
+// send writes msg to the receiver, or buffers it while the receiver is away.
+func (r *Receiver) send(msg Message) error {
+	r.connMutex.Lock()
+	defer r.connMutex.Unlock()
+	if r.away {
+		r.outbox = append(r.outbox, msg)
+		return nil
+	}
+	return r.Conn.WriteJSON(msg)
+}
+
+func (r *Receiver) currentConn() *wsConn {
+	r.connMutex.Lock()
+	defer r.connMutex.Unlock()
+	return r.Conn
+}
+
+// close disconnects the receiver for good; it can't resume afterwards.
+func (r *Receiver) close() {
+	r.connMutex.Lock()
+	r.closed = true
+	conn := r.Conn
+	r.connMutex.Unlock()
+	conn.Close()
+}
+
+// leave is called when the receiver's socket ends. It reports whether the
+// receiver is parked to wait for a resume rather than gone.
+func (r *Receiver) leave(upload *Upload, conn *wsConn) (parked bool) {
+	r.connMutex.Lock()
+	defer r.connMutex.Unlock()
+	if r.Conn != conn {
+		return true // already resumed on another socket
+	}
+	if r.closed || cfg.ReceiverGracePeriod <= 0 || upload.isClosed() {
+		return false
+	}
+	r.away = true
+	r.awayTimer = time.AfterFunc(graceAfter(conn, cfg.ReceiverGracePeriod), func() {
+		r.connMutex.Lock()
+		expired := r.away
+		r.connMutex.Unlock()
+		if expired {
+			removeReceiver(upload, r)
+		}
+	})
+	return true
+}
+
+// resumeReceiver finds the receiver that token belongs to and moves it to
+// conn, delivering what it missed.
+func resumeReceiver(upload *Upload, token string, conn *wsConn) *Receiver {
+	upload.mutex.RLock()
+	var receiver *Receiver
+	for _, r := range upload.Receivers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(r.resumeToken)) == 1 {
+			receiver = r
+			break
+		}
+	}
+	upload.mutex.RUnlock()
+	if receiver == nil {
+		return nil
+	}
+
+	receiver.connMutex.Lock()
+	if receiver.closed {
+		receiver.connMutex.Unlock()
+		return nil
+	}
+	old := receiver.Conn
+	receiver.Conn = conn
+	receiver.away = false
+	if receiver.awayTimer != nil {
+		receiver.awayTimer.Stop()
+		receiver.awayTimer = nil
+	}
+	outbox := receiver.outbox
+	receiver.outbox = nil
+
+	conn.WriteJSON(Message{Type: "receiver_resumed", Payload: map[string]any{"receiver_id": receiver.ID, "metadata": currentCaptions(upload.Meta)}})
+	for _, msg := range outbox {
+		conn.WriteJSON(msg)
+	}
+	receiver.connMutex.Unlock()
+
+	if old != conn {
+		old.Close()
+	}
+	log.Info("Receiver resumed", "id", upload.ID, "receiver", receiver.ID, "buffered", len(outbox))
+	sendToHost(upload, Message{Type: "receiver_back", Payload: receiverDecision{ReceiverID: receiver.ID}})
+	return receiver
+}
+
+// removeReceiver drops receiver from the session and tells the host.
+func removeReceiver(upload *Upload, receiver *Receiver) {
+	removed := false
+	upload.mutex.Lock()
+	for i, r := range upload.Receivers {
+		if r == receiver {
+			upload.Receivers = append(upload.Receivers[:i], upload.Receivers[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	upload.mutex.Unlock()
+	if removed {
+		stopWaitClock(upload, receiver)
+		endRelays(upload, receiver, "receiver_left")
+		endHTTPRelays(upload, receiver, "receiver_left")
+		endBandwidthProbes(upload, receiver, "receiver_left")
+		dropReverseOffers(upload, receiver.ID)
+		dropFileRequests(upload, receiver.ID)
+		recordEvent(upload, "receiver_left", map[string]any{"receiver_id": receiver.ID})
+	}
+
+	// Notify host about receiver leaving
+	sendReceiversUpdate(upload)
+	promoteQueued(upload)
+	finishIfDrained(upload)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/charmbracelet/log"
+)
+
+// With -relay a pair whose WebRTC connection can't be made, e.g. because a
+// corporate network blocks UDP and TURN alike, falls back to sending the
+// file through the server. Either side reports webrtc_failed, which rules
+// out p2p and turn for the pair; when relay is what the new transport_plan
+// picks, both sides get relay_start and the host streams chunks as binary
+// WebSocket frames that the server passes on to the receiver unchanged:
+//
+//	stream ID (4 bytes, big endian) | chunk
+//
+// Flow control is by credit. A stream starts with window bytes of credit,
+// each frame the host sends uses up its chunk's length, and the receiver
+// hands credit back with relay_ack as it writes chunks away, which reaches
+// the host as relay_credit. A host that overruns the window loses the
+// stream. The server itself buffers no more than the window: when the
+// receiver's socket can't keep up, forwarding blocks and with it the
+// reading of the host's socket, until the receiver drains or
+// wsWriteTimeout ends the stream.
+//
+// Either side ends a stream with relay_end; the server does when the
+// receiver leaves or the session ends. Every relayed byte is server
+// bandwidth, so the plan tries relay last and only with clients that list
+// it in their capabilities.
+
+const relayHeaderSize = 4
+
+var errReceiverAway = errors.New("receiver is away")
+
+type relayStream struct {
+	id       uint32
+	upload   *Upload
+	receiver *Receiver
+	window   int64
+	limit    int64  // bytes a bandwidth probe's stream may carry, 0 for transfers
+	ip       string // host address holding a relay slot, see ipquota.go
+
+	mutex    sync.Mutex
+	inflight int64 // forwarded but not acked yet
+	sent     int64
+	ended    bool
+}
+
+var relays = struct {
+	mutex   sync.Mutex
+	streams map[uint32]*relayStream
+}{streams: make(map[uint32]*relayStream)}
+
+var (
+	relayNextID  atomic.Uint32
+	relayStarted atomic.Int64
+	relayBytes   atomic.Int64
+)
+
+type relayStart struct {
+	StreamID   uint32 `json:"stream_id"`
+	ReceiverID string `json:"receiver_id"`
+	Window     int64  `json:"window"` // bytes of credit to start with
+	ChunkSize  int    `json:"chunk_size"`
+}
+
+type relayAck struct {
+	StreamID uint32 `json:"stream_id"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type relayCredit struct {
+	StreamID   uint32 `json:"stream_id"`
+	ReceiverID string `json:"receiver_id"`
+	Bytes      int64  `json:"bytes"`
+}
+
+type relayEnd struct {
+	StreamID   uint32 `json:"stream_id"`
+	ReceiverID string `json:"receiver_id,omitempty"` // set by the server
+	Reason     string `json:"reason,omitempty"`
+}
+
+// relayStats go into the admin stats; relayed bytes are what the fallback
+// costs in bandwidth.
+type relayStats struct {
+	Active  int   `json:"active"`
+	Started int64 `json:"started"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func relaySummary() relayStats {
+	relays.mutex.Lock()
+	active := len(relays.streams)
+	relays.mutex.Unlock()
+	return relayStats{Active: active, Started: relayStarted.Load(), Bytes: relayBytes.Load()}
+}
+
+// startRelay opens a stream for the pair unless one is already open.
+func startRelay(upload *Upload, receiver *Receiver, chunkSize int) {
+	ip := upload.hostConn().clientIP()
+	relays.mutex.Lock()
+	for _, s := range relays.streams {
+		if s.receiver == receiver && s.limit == 0 {
+			relays.mutex.Unlock()
+			return
+		}
+	}
+	if !acquireRelaySlot(ip) {
+		relays.mutex.Unlock()
+		sendToHost(upload, errorMessage(problemRelayLimit, "this address has as many relays going as it may", "relay_start"))
+		return
+	}
+	s := &relayStream{
+		id:       relayNextID.Add(1),
+		upload:   upload,
+		receiver: receiver,
+		window:   max(cfg.RelayWindow, int64(chunkSize)),
+		ip:       ip,
+	}
+	relays.streams[s.id] = s
+	relays.mutex.Unlock()
+	relayStarted.Add(1)
+
+	log.Info("Relaying transfer through the server", "id", upload.ID, "receiver", receiver.ID, "stream", s.id)
+	recordEvent(upload, "relay_started", map[string]any{"receiver_id": receiver.ID})
+	msg := Message{Type: "relay_start", Payload: relayStart{
+		StreamID:   s.id,
+		ReceiverID: receiver.ID,
+		Window:     s.window,
+		ChunkSize:  chunkSize,
+	}}
+	receiver.send(msg)
+	sendToHost(upload, msg)
+}
+
+// end closes the stream and tells both sides why.
+func (s *relayStream) end(reason string) {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.mutex.Unlock()
+
+	relays.mutex.Lock()
+	delete(relays.streams, s.id)
+	relays.mutex.Unlock()
+	if s.ip != "" {
+		releaseRelaySlot(s.ip)
+	}
+
+	msg := Message{Type: "relay_end", Payload: relayEnd{StreamID: s.id, ReceiverID: s.receiver.ID, Reason: reason}}
+	s.receiver.send(msg)
+	sendToHost(s.upload, msg)
+}
+
+// endRelays ends the streams of upload, or only receiver's when it is set.
+func endRelays(upload *Upload, receiver *Receiver, reason string) {
+	var ended []*relayStream
+	relays.mutex.Lock()
+	for _, s := range relays.streams {
+		if s.upload == upload && (receiver == nil || s.receiver == receiver) {
+			ended = append(ended, s)
+		}
+	}
+	relays.mutex.Unlock()
+	for _, s := range ended {
+		s.end(reason)
+	}
+}
+
+func lookupRelay(id uint32) *relayStream {
+	relays.mutex.Lock()
+	defer relays.mutex.Unlock()
+	return relays.streams[id]
+}
+
+// handleRelayFrame forwards a binary frame the host read on conn. It
+// blocks while the receiver's socket is backed up.
+func handleRelayFrame(conn *wsConn, frame []byte) {
+	var s *relayStream
+	if len(frame) > relayHeaderSize {
+		s = lookupRelay(binary.BigEndian.Uint32(frame))
+	}
+	if s == nil || s.upload.hostConn().root() != conn {
+		conn.WriteJSON(errorMessage(errCodeUnexpectedMessage, "binary frames are only for relay streams of this host", ""))
+		return
+	}
+
+	size := int64(len(frame) - relayHeaderSize)
+	s.mutex.Lock()
+	over := s.inflight+size > s.window
+	overLimit := s.limit > 0 && s.sent+size > s.limit
+	if !over && !overLimit {
+		s.inflight += size
+		s.sent += size
+	}
+	s.mutex.Unlock()
+	if over {
+		s.end("window_exceeded")
+		return
+	}
+	if overLimit {
+		s.end("limit_exceeded")
+		return
+	}
+	if !chargeIP(conn.clientIP(), size) {
+		s.end("ip_quota_exceeded")
+		return
+	}
+
+	if err := s.receiver.sendBinary(frame); err != nil {
+		reason := "receiver_stalled"
+		if errors.Is(err, errReceiverAway) {
+			reason = "receiver_away"
+		}
+		s.end(reason)
+		return
+	}
+	relayBytes.Add(size)
+	s.upload.touch()
+}
+
+// sendBinary writes a relay frame to the receiver. Frames aren't kept for
+// an away receiver the way messages are; the stream has to start over.
+func (r *Receiver) sendBinary(frame []byte) error {
+	r.connMutex.Lock()
+	conn := r.Conn
+	away := r.away
+	r.connMutex.Unlock()
+	if away {
+		return errReceiverAway
+	}
+	return conn.WriteBinary(frame, wsWriteTimeout)
+}
+
+// handleWebRTCFailed rules out WebRTC for the pair, which moves it on to
+// relay when both sides and the server can. Hosts name the receiver in to.
+func handleWebRTCFailed(upload *Upload, msg Message, from *Receiver) {
+	receiver := from
+	if receiver == nil {
+		receiver = upload.findReceiver(msg.To)
+	}
+	if receiver == nil || !isAdmitted(upload, receiver) {
+		reply(upload, from, invalidPayload(msg, errNoPeer))
+		return
+	}
+
+	upload.mutex.Lock()
+	for _, t := range []string{transportP2P, transportTURN} {
+		if !slices.Contains(receiver.failedTransports, t) {
+			receiver.failedTransports = append(receiver.failedTransports, t)
+		}
+	}
+	upload.mutex.Unlock()
+
+	log.Info("WebRTC failed", "id", upload.ID, "receiver", receiver.ID, "reported_by", msg.From)
+	sendTransportPlan(upload, receiver)
+}
+
+// handleRelayAck passes credit the receiver hands back on to the host.
+func handleRelayAck(upload *Upload, receiver *Receiver, msg Message) {
+	var ack relayAck
+	if err := decodePayload(msg, &ack); err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+	s := lookupRelay(ack.StreamID)
+	if s == nil || s.receiver != receiver || ack.Bytes <= 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	credit := min(ack.Bytes, s.inflight)
+	s.inflight -= credit
+	s.mutex.Unlock()
+	if credit > 0 {
+		sendToHost(upload, Message{Type: "relay_credit", Payload: relayCredit{StreamID: s.id, ReceiverID: receiver.ID, Bytes: credit}})
+	}
+}
+
+// handleRelayEnd ends a stream at the request of either side; from is nil
+// for the host.
+func handleRelayEnd(upload *Upload, msg Message, from *Receiver) {
+	var req relayEnd
+	if err := decodePayload(msg, &req); err != nil {
+		reply(upload, from, invalidPayload(msg, err))
+		return
+	}
+	s := lookupRelay(req.StreamID)
+	if s == nil || s.upload != upload || (from != nil && s.receiver != from) {
+		return
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "done"
+	}
+	s.end(reason)
+}
+
+// reply answers whoever sent a message: from, or the host when it is nil.
+func reply(upload *Upload, from *Receiver, msg Message) {
+	if from != nil {
+		from.send(msg)
+	} else {
+		sendToHost(upload, msg)
+	}
+}
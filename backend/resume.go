@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// When the host socket drops without the host closing the session (a
+// laptop going to sleep, a Wi-Fi blip), the session is kept for
+// -host-grace-period. Receivers stay connected, messages for the host are
+// queued, and the host can pick the session up again by connecting to
+// /api/upload/{id}/resume with the resume_token from upload_created.
+
+// hostAway parks a session whose host socket conn disappeared. It reports
+// false when the session should end instead.
+func hostAway(upload *Upload, conn *wsConn) bool {
+	if upload.holdsOpen() {
+		detachHost(upload, cfg.HoldOpenTTL)
+		return true
+	}
+	grace := graceAfter(conn, cfg.HostGracePeriod)
+	if grace <= 0 || upload.isClosed() {
+		return false
+	}
+
+	detachHost(upload, grace)
+	broadcastToReceivers(upload, Message{Type: "host_reconnecting", Payload: map[string]any{"grace_seconds": grace.Seconds()}})
+	return true
+}
+
+func broadcastToReceivers(upload *Upload, msg Message) {
+	upload.mutex.RLock()
+	receivers := make([]*Receiver, len(upload.Receivers))
+	copy(receivers, upload.Receivers)
+	upload.mutex.RUnlock()
+
+	for _, receiver := range receivers {
+		receiver.send(msg)
+	}
+}
+
+func resumeToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("resume_token")
+}
+
+// handleResumeHost is the WebSocket endpoint a host reconnects through.
+func handleResumeHost(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+
+	token := resumeToken(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(upload.resumeToken)) != 1 {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid resume token")
+		return
+	}
+
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	reattachHost(upload, conn, map[string]any{"id": upload.ID, "resumed": true})
+	broadcastToReceivers(upload, Message{Type: "host_reconnected", Payload: map[string]string{"id": upload.ID}})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// A receiver can send a file back to the host without a new session. It
+// describes the file in a reverse_offer; the host accepts or declines with
+// reverse_offer_response. Once accepted the receiver is the offerer: its
+// webrtc_offer goes to the host, the host's webrtc_answer comes back, and
+// ICE candidates flow both ways, all tagged with the offer_id so they
+// aren't mixed up with the host-to-receiver connection.
+
+var errNoReverseOffer = errors.New("offer_id must name an accepted reverse_offer")
+
+// maxReverseOffers caps the offers a receiver may have waiting.
+const maxReverseOffers = 5
+
+type reverseOfferRequest struct {
+	FileName string `json:"filename"`
+	FileType string `json:"filetype"`
+	FileSize int64  `json:"filesize"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+type reverseOffer struct {
+	ID         string    `json:"offer_id"`
+	ReceiverID string    `json:"receiver_id"`
+	Name       string    `json:"name"`
+	Meta       Metadata  `json:"metadata"`
+	Accepted   bool      `json:"accepted"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type reverseOfferResponse struct {
+	OfferID string `json:"offer_id"`
+	Accept  bool   `json:"accept"`
+}
+
+func (req reverseOfferRequest) validate() error {
+	switch {
+	case req.FileName == "" || req.FileType == "":
+		return errors.New("filename and filetype are required")
+	case req.FileSize <= 0:
+		return errors.New("filesize must be positive")
+	case req.SHA256 != "" && !sha256Pattern.MatchString(req.SHA256):
+		return errors.New("sha256 must be 64 lowercase hex characters")
+	}
+	return nil
+}
+
+func handleReverseOffer(upload *Upload, receiver *Receiver, msg Message) {
+	var req reverseOfferRequest
+	err := decodePayload(msg, &req)
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	offer := &reverseOffer{
+		ID:         generateReceiverID(),
+		ReceiverID: receiver.ID,
+		Name:       receiver.Name,
+		Meta:       Metadata{FileName: req.FileName, FileType: req.FileType, FileSize: req.FileSize, SHA256: req.SHA256},
+		CreatedAt:  time.Now(),
+	}
+
+	upload.mutex.Lock()
+	waiting := 0
+	for _, o := range upload.reverseOffers {
+		if o.ReceiverID == receiver.ID && !o.Accepted {
+			waiting++
+		}
+	}
+	if waiting >= maxReverseOffers {
+		upload.mutex.Unlock()
+		receiver.send(invalidPayload(msg, errors.New("too many offers are waiting for the host")))
+		return
+	}
+	upload.reverseOffers = append(upload.reverseOffers, offer)
+	upload.mutex.Unlock()
+
+	receiver.send(Message{Type: "reverse_offer_pending", Payload: map[string]string{"offer_id": offer.ID}})
+	sendToHost(upload, Message{Type: "reverse_offer", Payload: offer})
+}
+
+func handleReverseOfferResponse(upload *Upload, msg Message) {
+	var resp reverseOfferResponse
+	if err := decodePayload(msg, &resp); err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	upload.mutex.Lock()
+	i := slices.IndexFunc(upload.reverseOffers, func(o *reverseOffer) bool { return o.ID == resp.OfferID })
+	if i < 0 {
+		upload.mutex.Unlock()
+		sendToHost(upload, invalidPayload(msg, errors.New("no offer with that ID")))
+		return
+	}
+	offer := upload.reverseOffers[i]
+	if resp.Accept {
+		offer.Accepted = true
+	} else {
+		upload.reverseOffers = slices.Delete(upload.reverseOffers, i, i+1)
+	}
+	upload.mutex.Unlock()
+
+	if receiver := upload.findReceiver(offer.ReceiverID); receiver != nil {
+		receiver.send(Message{Type: "reverse_offer_answered", Payload: map[string]any{
+			"offer_id": offer.ID,
+			"accepted": resp.Accept,
+		}})
+	}
+}
+
+// acceptedReverseOffer returns the accepted offer id made by receiverID.
+func acceptedReverseOffer(upload *Upload, id, receiverID string) *reverseOffer {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	for _, o := range upload.reverseOffers {
+		if o.ID == id && o.ReceiverID == receiverID && o.Accepted {
+			return o
+		}
+	}
+	return nil
+}
+
+// dropReverseOffers forgets the offers of a receiver that left.
+func dropReverseOffers(upload *Upload, receiverID string) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	upload.reverseOffers = slices.DeleteFunc(upload.reverseOffers, func(o *reverseOffer) bool { return o.ReceiverID == receiverID })
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// A room is a named, long-lived channel that announces sessions. A host
+// publishes into a room by creating a session with room=<name> and the
+// room's key in the Sendmyzip-Room-Key header; the first publisher claims
+// the room and the key is remembered in the store. Anyone who knows the
+// name can subscribe at /api/rooms/{name} and is sent new_file_available
+// for every session published there, starting with the ones still open,
+// and file_unavailable when one ends. Together with the daemon this turns a
+// folder into a feed, e.g. for build artifacts.
+
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+type roomHub struct {
+	mutex       sync.Mutex
+	subscribers map[string][]*wsConn // room name:subscriber sockets
+}
+
+var rooms = roomHub{subscribers: make(map[string][]*wsConn)}
+
+func roomKey(r *http.Request) string {
+	return r.Header.Get("Sendmyzip-Room-Key")
+}
+
+// authorizeRoom checks key against the room, claiming the room with it if
+// nobody has yet.
+func authorizeRoom(ctx context.Context, name, key string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	hash := hashAPIToken(key)
+
+	room, err := store.GetRoom(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		log.Info("Room claimed", "room", name)
+		return true, store.PutRoom(ctx, Room{Name: name, KeyHash: hash, CreatedAt: time.Now()})
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(room.KeyHash)) == 1, nil
+}
+
+type fileAnnouncement struct {
+	ID       string `json:"id"`
+	Room     string `json:"room"`
+	FileName string `json:"filename"`
+	FileType string `json:"filetype"`
+	FileSize int64  `json:"filesize"`
+	URL      string `json:"url"`
+}
+
+func announcement(upload *Upload) Message {
+	return Message{Type: "new_file_available", Payload: fileAnnouncement{
+		ID:       upload.ID,
+		Room:     upload.room,
+		FileName: upload.Meta.FileName,
+		FileType: upload.Meta.FileType,
+		FileSize: upload.Meta.FileSize,
+		URL:      upload.baseURL + "/?code=" + url.QueryEscape(upload.ID),
+	}}
+}
+
+func (h *roomHub) broadcast(name string, msg Message) {
+	h.mutex.Lock()
+	subscribers := slices.Clone(h.subscribers[name])
+	h.mutex.Unlock()
+
+	for _, conn := range subscribers {
+		conn.WriteJSON(msg)
+	}
+}
+
+// announceUpload tells the room's subscribers about a new session.
+func announceUpload(upload *Upload) {
+	if upload.room != "" {
+		rooms.broadcast(upload.room, announcement(upload))
+	}
+}
+
+// announceUploadEnded tells the room's subscribers a session is gone.
+func announceUploadEnded(upload *Upload) {
+	if upload.room != "" {
+		rooms.broadcast(upload.room, Message{Type: "file_unavailable", Payload: map[string]string{"id": upload.ID, "room": upload.room}})
+	}
+}
+
+// roomUploads returns the open sessions published in the room, oldest first.
+func roomUploads(name string) []*Upload {
+	uploadsMutex.RLock()
+	var list []*Upload
+	for _, upload := range uploads {
+		if upload.room == name && !upload.isClosed() {
+			list = append(list, upload)
+		}
+	}
+	uploadsMutex.RUnlock()
+
+	slices.SortFunc(list, func(a, b *Upload) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return list
+}
+
+// handleRoomSubscribe is the WebSocket endpoint for room subscribers.
+func handleRoomSubscribe(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !roomNamePattern.MatchString(name) {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Room names are 1-64 lowercase letters, digits, - and _")
+		return
+	}
+
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	rooms.mutex.Lock()
+	rooms.subscribers[name] = append(rooms.subscribers[name], conn)
+	rooms.mutex.Unlock()
+
+	defer func() {
+		rooms.mutex.Lock()
+		rooms.subscribers[name] = slices.DeleteFunc(rooms.subscribers[name], func(c *wsConn) bool { return c == conn })
+		if len(rooms.subscribers[name]) == 0 {
+			delete(rooms.subscribers, name)
+		}
+		rooms.mutex.Unlock()
+		conn.Close()
+	}()
+
+	conn.WriteJSON(Message{Type: "room_joined", Payload: map[string]string{"room": name}})
+	for _, upload := range roomUploads(name) {
+		conn.WriteJSON(announcement(upload))
+	}
+
+	// Subscribers only listen; reading keeps the deadlines and close
+	// handshake going
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type == "hello" {
+			if !handleHello(conn, msg) {
+				return
+			}
+			continue
+		}
+		conn.WriteJSON(unknownType(msg))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Operators can pin which transports are allowed for clients from given
+// networks or countries, e.g. for data residency. Rules are loaded from the
+// JSON file given with -routing-policy, matched against the host when the
+// session is created and against each receiver when it joins, and applied
+// in planTransport. A pair whose rules leave no transport is refused.
+//
+//	[{"name": "eu-only", "countries": ["DE", "FR"], "allow": ["p2p", "relay"], "relay_region": "eu"},
+//	 {"name": "no-server-touch", "networks": ["10.0.0.0/8"], "allow": ["p2p"]}]
+
+type routingRule struct {
+	Name        string   `json:"name"`
+	Networks    []string `json:"networks"`
+	Countries   []string `json:"countries"` // ISO 3166 codes from -country-header
+	Allow       []string `json:"allow"`     // transports, empty allows all
+	RelayRegion string   `json:"relay_region,omitempty"`
+
+	prefixes []netip.Prefix
+}
+
+// routingConstraint is what the matched rules add up to for one client.
+type routingConstraint struct {
+	Rules       []string
+	Allow       []string // nil allows every transport
+	RelayRegion string
+}
+
+var routingRules []routingRule
+
+func loadRoutingPolicy(path string) ([]routingRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []routingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range rules {
+		for _, network := range rules[i].Networks {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %q: %w", path, rules[i].Name, err)
+			}
+			rules[i].prefixes = append(rules[i].prefixes, prefix)
+		}
+		for _, t := range rules[i].Allow {
+			if !slices.Contains(transportPreference, t) {
+				return nil, fmt.Errorf("%s: rule %q: unknown transport %q", path, rules[i].Name, t)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (rule routingRule) matches(ip netip.Addr, country string) bool {
+	for _, prefix := range rule.prefixes {
+		if ip.IsValid() && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return country != "" && slices.ContainsFunc(rule.Countries, func(c string) bool { return strings.EqualFold(c, country) })
+}
+
+// clientCountry returns the country a trusted proxy or CDN put in
+// -country-header.
+func clientCountry(r *http.Request) string {
+	if !cfg.TrustProxy || cfg.CountryHeader == "" {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(cfg.CountryHeader))
+}
+
+// routingFor evaluates the rules for the client behind r.
+func routingFor(r *http.Request) routingConstraint {
+	ip, _ := netip.ParseAddr(clientIP(r))
+	country := clientCountry(r)
+
+	var c routingConstraint
+	for _, rule := range routingRules {
+		if !rule.matches(ip.Unmap(), country) {
+			continue
+		}
+		c.Rules = append(c.Rules, rule.Name)
+		c.Allow = intersectTransports(c.Allow, rule.Allow)
+		if c.RelayRegion == "" {
+			c.RelayRegion = rule.RelayRegion
+		}
+	}
+	return c
+}
+
+// intersectTransports combines two allow lists where nil means anything.
+func intersectTransports(a, b []string) []string {
+	switch {
+	case b == nil:
+		return a
+	case a == nil:
+		return slices.Clone(b)
+	}
+	out := []string{}
+	for _, t := range a {
+		if slices.Contains(b, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// combine merges the constraints of both ends of a transfer.
+func (c routingConstraint) combine(other routingConstraint) routingConstraint {
+	out := routingConstraint{
+		Rules:       append(slices.Clone(c.Rules), other.Rules...),
+		Allow:       intersectTransports(c.Allow, other.Allow),
+		RelayRegion: c.RelayRegion,
+	}
+	if out.RelayRegion == "" {
+		out.RelayRegion = other.RelayRegion
+	}
+	return out
+}
+
+func (c routingConstraint) allows(transport string) bool {
+	return c.Allow == nil || slices.Contains(c.Allow, transport)
+}
+
+// blocksEverything reports whether no transport is left at all.
+func (c routingConstraint) blocksEverything() bool {
+	return c.Allow != nil && len(c.Allow) == 0
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+// A session created with sealed_signaling=true keeps offers, answers and
+// ICE candidates opaque to the server. Clients encrypt them with a key they
+// share outside the server (the link fragment, say) and send only
+// ciphertext and nonce as the payload, and handleWebRTCSignaling relays it
+// on the envelope like any other (see envelope.go). Since the server can't
+// see which held offer an answer is for or which reverse transfer an offer
+// belongs to, those checks fall back to what the envelope tells.
+
+// maxSealedSignal caps the ciphertext of one sealed message. SDP with many
+// candidates runs to a few KiB.
+const maxSealedSignal = 48 << 10 // bytes, base64
+
+type sealedSignal struct {
+	Ciphertext string `json:"ciphertext"`
+	Nonce      string `json:"nonce"`
+}
+
+func (s sealedSignal) validate() error {
+	switch {
+	case s.Ciphertext == "":
+		return errors.New("signaling in this session is sealed: send ciphertext and nonce")
+	case len(s.Ciphertext) > maxSealedSignal:
+		return errors.New("ciphertext is too long")
+	}
+	if _, err := decodeBase64(s.Ciphertext); err != nil {
+		return errors.New("ciphertext must be base64")
+	}
+	if _, err := decodeBase64(s.Nonce); err != nil || s.Nonce == "" {
+		return errors.New("nonce must be base64")
+	}
+	return nil
+}
+
+func isSignaling(msgType string) bool {
+	return msgType == "webrtc_offer" || msgType == "webrtc_answer" || msgType == "webrtc_ice_candidate"
+}
+
+func (u *Upload) sealsSignaling() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.sealedSignaling
+}
+
+// hasAcceptedReverseOffer reports whether receiverID may offer to the host.
+func hasAcceptedReverseOffer(upload *Upload, receiverID string) bool {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	return slices.ContainsFunc(upload.reverseOffers, func(o *reverseOffer) bool {
+		return o.ReceiverID == receiverID && o.Accepted
+	})
+}
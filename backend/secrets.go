@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/charmbracelet/log"
+)
+
+// Names of the server secrets. There is no receipt-signing secret: the
+// server doesn't sign receipts, so a key for them would only be loaded and
+// never used. Whatever comes to sign them should take its key from here
+// like the others do.
+const (
+	secretJoinTokens = "join-tokens"
+	secretTURN       = "turn"
+	secretSpool      = "spool"
+)
+
+// SecretVersion is one generation of a secret. Providers return versions
+// newest first: the first one signs, all of them verify. The ID names the
+// value, not its place in the rotation, since it is written next to what
+// the value signs or seals and has to find it again after a rotation.
+type SecretVersion struct {
+	ID    string
+	Value []byte
+}
+
+// fingerprintID derives a version ID from the value itself, for providers
+// that only know a version as current or previous.
+func fingerprintID(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:8])
+}
+
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) ([]SecretVersion, error)
+}
+
+// parseKeyLines reads "id:base64value" lines, skipping blanks and comments.
+func parseKeyLines(r io.Reader) ([]SecretVersion, error) {
+	var versions []SecretVersion
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.New("expected id:base64value")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("version %q: %w", id, err)
+		}
+		versions = append(versions, SecretVersion{ID: id, Value: value})
+	}
+	return versions, scanner.Err()
+}
+
+// envSecrets reads SENDMYZIP_SECRET_<NAME> and, during a rotation,
+// SENDMYZIP_SECRET_<NAME>_PREVIOUS. Values are base64.
+type envSecrets struct{}
+
+func envSecretName(name string) string {
+	return "SENDMYZIP_SECRET_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func (envSecrets) Secret(ctx context.Context, name string) ([]SecretVersion, error) {
+	var versions []SecretVersion
+	for _, suffix := range []string{"", "_PREVIOUS"} {
+		encoded := os.Getenv(envSecretName(name) + suffix)
+		if encoded == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s%s: %w", envSecretName(name), suffix, err)
+		}
+		versions = append(versions, SecretVersion{ID: fingerprintID(value), Value: value})
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return versions, nil
+}
+
+// fileSecrets reads <dir>/<name> in the id:base64value line format.
+type fileSecrets struct {
+	dir string
+}
+
+func (p fileSecrets) Secret(ctx context.Context, name string) ([]SecretVersion, error) {
+	f, err := os.Open(filepath.Join(p.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	versions, err := parseKeyLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return versions, nil
+}
+
+// vaultSecrets reads from a Vault KV v2 mount. Each secret is stored at
+// <path>/<name> with a base64 "value" field; the previous KV version is
+// returned as well so rotating in Vault doesn't break in-flight tokens.
+type vaultSecrets struct {
+	vault *vaultClient
+	mount string
+	path  string
+}
+
+func newVaultSecrets(path string) (*vaultSecrets, error) {
+	vault, err := newVaultClient()
+	if err != nil {
+		return nil, err
+	}
+	mount, rest, _ := strings.Cut(strings.Trim(path, "/"), "/")
+	return &vaultSecrets{vault: vault, mount: mount, path: rest}, nil
+}
+
+type vaultKVResponse struct {
+	Data struct {
+		Data     map[string]string `json:"data"`
+		Metadata struct {
+			Version int `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+}
+
+func (p *vaultSecrets) get(ctx context.Context, name string, version int) (*vaultKVResponse, error) {
+	path := fmt.Sprintf("%s/data/%s", p.mount, strings.TrimLeft(p.path+"/"+name, "/"))
+	if version > 0 {
+		path += "?version=" + url.QueryEscape(fmt.Sprint(version))
+	}
+	var out vaultKVResponse
+	if err := p.vault.do(ctx, "GET", path, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (p *vaultSecrets) Secret(ctx context.Context, name string) ([]SecretVersion, error) {
+	latest, err := p.get(ctx, name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []SecretVersion
+	add := func(resp *vaultKVResponse) error {
+		value, err := base64.StdEncoding.DecodeString(resp.Data.Data["value"])
+		if err != nil {
+			return fmt.Errorf("vault %s: %w", name, err)
+		}
+		versions = append(versions, SecretVersion{ID: fmt.Sprint(resp.Data.Metadata.Version), Value: value})
+		return nil
+	}
+	if err := add(latest); err != nil {
+		return nil, err
+	}
+
+	if v := latest.Data.Metadata.Version; v > 1 {
+		// The previous version may have been destroyed; that's not an error
+		if previous, err := p.get(ctx, name, v-1); err == nil && previous.Data.Data["value"] != "" {
+			add(previous)
+		}
+	}
+	return versions, nil
+}
+
+// kmsSecrets keeps secrets as KMS-encrypted blobs in a directory:
+// <name>.enc is current and <name>.previous.enc is the rotated-out version.
+// Plaintext only ever exists in memory.
+type kmsSecrets struct {
+	dir    string
+	client *kms.Client
+}
+
+func newKMSSecrets(ctx context.Context, dir string) (*kmsSecrets, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsSecrets{dir: dir, client: kms.NewFromConfig(awsCfg)}, nil
+}
+
+func (p *kmsSecrets) Secret(ctx context.Context, name string) ([]SecretVersion, error) {
+	var versions []SecretVersion
+	for _, file := range []string{name + ".enc", name + ".previous.enc"} {
+		blob, err := os.ReadFile(filepath.Join(p.dir, file))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := p.client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+		if err != nil {
+			return nil, fmt.Errorf("kms decrypt %s: %w", file, err)
+		}
+		versions = append(versions, SecretVersion{ID: fingerprintID(out.Plaintext), Value: out.Plaintext})
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return versions, nil
+}
+
+func openSecretProvider(ctx context.Context, spec string) (SecretProvider, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "env":
+		return envSecrets{}, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file secrets need a directory: file:/path")
+		}
+		return fileSecrets{dir: arg}, nil
+	case "vault":
+		if arg == "" {
+			arg = "secret/sendmyzip"
+		}
+		return newVaultSecrets(arg)
+	case "awskms":
+		if arg == "" {
+			return nil, errors.New("awskms secrets need a directory: awskms:/path")
+		}
+		return newKMSSecrets(ctx, arg)
+	default:
+		return nil, fmt.Errorf("unknown secret provider %q", kind)
+	}
+}
+
+// secretCache serves secrets from memory and refreshes them periodically,
+// so rotations at the provider are picked up without a restart.
+type secretCache struct {
+	provider SecretProvider
+	mutex    sync.RWMutex
+	values   map[string][]SecretVersion
+}
+
+var secrets *secretCache
+
+func newSecretCache(provider SecretProvider) *secretCache {
+	return &secretCache{provider: provider, values: make(map[string][]SecretVersion)}
+}
+
+// Versions returns every known version of name, newest first.
+func (c *secretCache) Versions(ctx context.Context, name string) ([]SecretVersion, error) {
+	c.mutex.RLock()
+	versions, ok := c.values[name]
+	c.mutex.RUnlock()
+	if ok {
+		return versions, nil
+	}
+	return c.load(ctx, name)
+}
+
+// Current returns the version used for signing.
+func (c *secretCache) Current(ctx context.Context, name string) (SecretVersion, error) {
+	versions, err := c.Versions(ctx, name)
+	if err != nil {
+		return SecretVersion{}, err
+	}
+	if len(versions) == 0 {
+		return SecretVersion{}, ErrNotFound
+	}
+	return versions[0], nil
+}
+
+func (c *secretCache) load(ctx context.Context, name string) ([]SecretVersion, error) {
+	versions, err := c.provider.Secret(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.values[name] = versions
+	c.mutex.Unlock()
+	return versions, nil
+}
+
+func (c *secretCache) refresh(ctx context.Context) {
+	c.mutex.RLock()
+	names := make([]string, 0, len(c.values))
+	for name := range c.values {
+		names = append(names, name)
+	}
+	c.mutex.RUnlock()
+
+	for _, name := range names {
+		if _, err := c.load(ctx, name); err != nil {
+			log.Warn("Could not refresh secret, keeping cached versions", "name", name, "err", err)
+		}
+	}
+}
+
+func (c *secretCache) runRefresher(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.refresh(context.Background())
+	}
+}
+
+// secretNames are the secrets the server reads.
+var secretNames = []string{secretJoinTokens, secretTURN, secretSpool}
+
+type secretStatus struct {
+	Name     string   `json:"name"`
+	Versions []string `json:"versions"`          // IDs, newest first
+	Rekeyed  int      `json:"rekeyed,omitempty"` // spool entries re-sealed under a new key
+	Error    string   `json:"error,omitempty"`
+}
+
+// handleAdminRefreshSecrets re-reads every secret from the provider now
+// rather than at the next -secret-refresh, so a rotation takes effect at
+// once. Only the version IDs are returned. The spool's keys are reloaded
+// too, from -spool-key-file when it is set, and a new current key has the
+// spool re-sealed under it.
+func handleAdminRefreshSecrets(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]secretStatus, len(secretNames))
+	for i, name := range secretNames {
+		statuses[i] = secretStatus{Name: name, Versions: []string{}}
+		versions, err := secrets.load(r.Context(), name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Warn("Could not refresh secret, keeping cached versions", "name", name, "err", err)
+			statuses[i].Error = err.Error()
+			continue
+		}
+		for _, v := range versions {
+			statuses[i].Versions = append(statuses[i].Versions, v.ID)
+		}
+		if name == secretSpool && spool != nil {
+			rekeyed, err := spool.reloadKeys(r.Context())
+			if err != nil {
+				log.Error("Could not rotate spool key", "rekeyed", rekeyed, "err", err)
+				statuses[i].Error = err.Error()
+			}
+			statuses[i].Rekeyed = rekeyed
+		}
+	}
+	log.Info("Secrets refreshed on request")
+	writeJSON(w, http.StatusOK, statuses)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func setEnvSecret(t *testing.T, name string, current, previous []byte) {
+	t.Helper()
+	t.Setenv(envSecretName(name), base64.StdEncoding.EncodeToString(current))
+	if previous == nil {
+		t.Setenv(envSecretName(name)+"_PREVIOUS", "")
+	} else {
+		t.Setenv(envSecretName(name)+"_PREVIOUS", base64.StdEncoding.EncodeToString(previous))
+	}
+}
+
+func TestEnvSecretsRotation(t *testing.T) {
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	setEnvSecret(t, secretSpool, first, nil)
+	before, err := envSecrets{}.Secret(context.Background(), secretSpool)
+	if err != nil || len(before) != 1 {
+		t.Fatalf("got %v, %v", before, err)
+	}
+
+	setEnvSecret(t, secretSpool, second, first)
+	after, err := envSecrets{}.Secret(context.Background(), secretSpool)
+	if err != nil || len(after) != 2 {
+		t.Fatalf("got %v, %v", after, err)
+	}
+	if after[1].ID != before[0].ID {
+		t.Errorf("rotated-out value changed ID from %q to %q", before[0].ID, after[1].ID)
+	}
+	if after[0].ID == before[0].ID {
+		t.Errorf("new value took over the old one's ID %q", after[0].ID)
+	}
+}
+
+// TestSpoolEnvRotation seals with an env key, rotates it and reads the data
+// back with the rotated-out key.
+func TestSpoolEnvRotation(t *testing.T) {
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	blobs, err := newFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() *Spool {
+		t.Helper()
+		versions, err := envSecrets{}.Secret(context.Background(), secretSpool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ring, err := keyringFromVersions(versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := newSpool(blobs, ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	read := func(s *Spool) ([]byte, error) {
+		rc, err := s.Open("file", blobKey{})
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	setEnvSecret(t, secretSpool, first, nil)
+	data := []byte("sealed before the rotation")
+	if err := open().Put("file", bytes.NewReader(data), time.Hour, blobKey{session: "session"}); err != nil {
+		t.Fatal(err)
+	}
+
+	setEnvSecret(t, secretSpool, second, first)
+	if got, err := read(open()); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("after the rotation: got %q, %v", got, err)
+	}
+
+	setEnvSecret(t, secretSpool, second, nil)
+	if _, err := read(open()); !errors.Is(err, ErrUnknownSpoolKey) {
+		t.Errorf("with the old key dropped: got %v, want ErrUnknownSpoolKey", err)
+	}
+}
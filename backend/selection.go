@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A receiver that only wants some of the files in a manifest says which
+// with request_files. Unlike file_request in pull mode the host doesn't
+// approve anything; it just learns what to send:
+//
+// Receiver: {"type": "request_files", "payload": {"paths": ["docs/a.txt", "b.png"]}}
+// Server:   {"type": "files_selected", "payload": {"paths": [...], "bytes": 1234}}
+// Host:     {"type": "files_requested", "payload": {"receiver_id": "...", "name": "...", "paths": [...], "bytes": 1234, "requested_at": "..."}}
+//
+// A new request replaces the previous one. The receiver reports each file
+// it has with transfer_complete and a path; once it has every file it
+// picked it counts as complete like a receiver that took the whole
+// session. receivers_update shows each receiver's selection and which of
+// its files are done.
+
+type fileSelection struct {
+	Paths       []string             `json:"paths"`
+	Bytes       int64                `json:"bytes"`
+	Completed   map[string]time.Time `json:"completed"` // path:when
+	RequestedAt time.Time            `json:"requested_at"`
+}
+
+type filesRequested struct {
+	ReceiverID  string    `json:"receiver_id"`
+	Name        string    `json:"name"`
+	Paths       []string  `json:"paths"`
+	Bytes       int64     `json:"bytes"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// selectFiles checks paths against the manifest and returns the bytes
+// they add up to.
+func selectFiles(meta Metadata, paths []string) (int64, error) {
+	if len(meta.Files) == 0 {
+		return 0, errors.New("the session has no manifest to pick from")
+	}
+	if len(paths) == 0 {
+		return 0, errors.New("paths must name at least one file")
+	}
+	sizes := make(map[string]int64, len(meta.Files))
+	for _, f := range meta.Files {
+		if f.Kind != entryDirectory {
+			sizes[manifestPath(f)] = f.Size
+		}
+	}
+	var total int64
+	for i, p := range paths {
+		size, ok := sizes[p]
+		if !ok {
+			return 0, fmt.Errorf("%s is not a file of the session", p)
+		}
+		if slices.Contains(paths[:i], p) {
+			return 0, fmt.Errorf("%s is listed twice", p)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func handleRequestFiles(upload *Upload, receiver *Receiver, msg Message) {
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := decodePayload(msg, &req); err != nil {
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+
+	upload.mutex.Lock()
+	size, err := selectFiles(upload.Meta, req.Paths)
+	if err != nil {
+		upload.mutex.Unlock()
+		receiver.send(invalidPayload(msg, err))
+		return
+	}
+	// Files already done stay done when they are picked again
+	selection := &fileSelection{
+		Paths:       req.Paths,
+		Bytes:       size,
+		Completed:   make(map[string]time.Time),
+		RequestedAt: time.Now(),
+	}
+	if previous := receiver.selection; previous != nil {
+		for _, p := range req.Paths {
+			if at, ok := previous.Completed[p]; ok {
+				selection.Completed[p] = at
+			}
+		}
+	}
+	receiver.selection = selection
+	upload.mutex.Unlock()
+
+	recordEvent(upload, "files_requested", map[string]any{"receiver_id": receiver.ID, "paths": req.Paths, "bytes": size})
+	receiver.send(Message{Type: "files_selected", Payload: map[string]any{"paths": req.Paths, "bytes": size}})
+	sendToHost(upload, Message{Type: "files_requested", Payload: filesRequested{
+		ReceiverID:  receiver.ID,
+		Name:        receiver.Name,
+		Paths:       req.Paths,
+		Bytes:       size,
+		RequestedAt: selection.RequestedAt,
+	}})
+	sendReceiversUpdate(upload)
+}
+
+// completeSelectedFile marks path done for the receiver and reports
+// whether that was the last file it picked.
+func completeSelectedFile(upload *Upload, receiver *Receiver, path string) (bool, error) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	selection := receiver.selection
+	if selection == nil {
+		return false, errors.New("path is only for receivers that sent request_files")
+	}
+	if !slices.Contains(selection.Paths, path) {
+		return false, fmt.Errorf("%s is not one of the files the receiver picked", path)
+	}
+	if _, ok := selection.Completed[path]; !ok {
+		selection.Completed[path] = time.Now()
+	}
+	return len(selection.Completed) == len(selection.Paths), nil
+}
+
+// selectionView is a receiver's selection for receivers_update, nil
+// without one. The caller holds upload.mutex.
+func selectionView(receiver *Receiver) *fileSelection {
+	if receiver.selection == nil {
+		return nil
+	}
+	view := *receiver.selection
+	view.Completed = make(map[string]time.Time, len(receiver.selection.Completed))
+	for p, at := range receiver.selection.Completed {
+		view.Completed[p] = at
+	}
+	return &view
+}
+
+// receiverTotal is how many bytes the receiver is to get. The caller holds
+// upload.mutex.
+func receiverTotal(upload *Upload, receiver *Receiver) int64 {
+	if receiver.selection != nil {
+		return receiver.selection.Bytes
+	}
+	return upload.Meta.FileSize
+}
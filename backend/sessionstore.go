@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// The live sessions themselves, with their sockets, stay on the node whose
+// host created them, but what other nodes need to know about them is kept
+// in a SessionStore chosen with -session-store:
+//
+//	memory               in this process, for a single node (the default)
+//	redis://host:6379/0  in Redis, shared by every node behind the load
+//	                     balancer
+//
+// Each node registers its sessions under its -node-id and keeps them fresh
+// while they live; a node that dies takes its sessions with it once
+// sessionRecordTTL passes. Registering claims the ID across all nodes, so
+// two nodes never hand out the same one. A node asked about a session it
+// doesn't have looks it up in the store: its info is answered from there,
+// and a join is answered 421 with session_elsewhere and the owning node's
+// -node-url in a Sendmyzip-Node header, for clients and load balancers to
+// retry there.
+
+const (
+	sessionRecordTTL       = 90 * time.Second
+	sessionHeartbeatPeriod = sessionRecordTTL / 3
+)
+
+// LiveSession is what the store knows about a session running on a node.
+type LiveSession struct {
+	ID                 string    `json:"id"`
+	Node               string    `json:"node"`
+	NodeURL            string    `json:"node_url,omitempty"`
+	Metadata           Metadata  `json:"metadata"`
+	ReceiverCount      int       `json:"receiver_count"`
+	PassphraseRequired bool      `json:"passphrase_required,omitempty"`
+	Closed             bool      `json:"closed,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+type SessionStore interface {
+	// Claim records s for s.Node unless its ID is already taken, on any
+	// node.
+	Claim(ctx context.Context, s LiveSession) (bool, error)
+	// Refresh replaces the record of one of the node's sessions and keeps
+	// it alive for another sessionRecordTTL.
+	Refresh(ctx context.Context, s LiveSession) error
+	// Lookup returns the session, or ErrNotFound.
+	Lookup(ctx context.Context, id string) (LiveSession, error)
+	// Release forgets a session of node; other nodes' sessions are left
+	// alone.
+	Release(ctx context.Context, id, node string) error
+	Close() error
+}
+
+var (
+	sessions SessionStore = newMemorySessionStore()
+	nodeID   string
+)
+
+func openSessionStore(c config) (SessionStore, error) {
+	switch {
+	case c.SessionStore == "" || c.SessionStore == "memory":
+		return newMemorySessionStore(), nil
+	case strings.HasPrefix(c.SessionStore, "redis://"), strings.HasPrefix(c.SessionStore, "rediss://"):
+		return openRedisSessionStore(c.SessionStore)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", c.SessionStore)
+	}
+}
+
+// defaultNodeID names the node after its host, with a random suffix so
+// two processes on one machine don't clash.
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "node"
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// liveSessionOf describes upload for the store.
+func liveSessionOf(upload *Upload) LiveSession {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	return LiveSession{
+		ID:                 upload.ID,
+		Node:               nodeID,
+		NodeURL:            cfg.NodeURL,
+		Metadata:           upload.Meta,
+		ReceiverCount:      len(upload.Receivers),
+		PassphraseRequired: upload.passphrase != nil,
+		Closed:             !upload.closedAt.IsZero(),
+		CreatedAt:          upload.CreatedAt,
+	}
+}
+
+// runSessionHeartbeat keeps the records of this node's sessions fresh.
+func runSessionHeartbeat() {
+	for range time.Tick(sessionHeartbeatPeriod) {
+		uploadsMutex.RLock()
+		live := make([]*Upload, 0, len(uploads))
+		for _, upload := range uploads {
+			live = append(live, upload)
+		}
+		uploadsMutex.RUnlock()
+
+		for _, upload := range live {
+			if err := sessions.Refresh(context.Background(), liveSessionOf(upload)); err != nil {
+				log.Error("Could not refresh session record", "id", upload.ID, "err", err)
+			}
+		}
+	}
+}
+
+// lookupElsewhere finds a session another node runs.
+func lookupElsewhere(ctx context.Context, id string) (LiveSession, bool) {
+	s, err := sessions.Lookup(ctx, id)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Error("Could not look up session", "id", id, "err", err)
+		}
+		return LiveSession{}, false
+	}
+	return s, s.Node != nodeID
+}
+
+// writeSessionMissing answers a request for a session this node doesn't
+// run: 421 pointing at the node that does, or 404.
+func writeSessionMissing(w http.ResponseWriter, r *http.Request, id string) {
+	s, ok := lookupElsewhere(r.Context(), id)
+	if !ok {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+	if s.NodeURL != "" {
+		w.Header().Set("Sendmyzip-Node", s.NodeURL)
+	}
+	writeProblem(w, http.StatusMisdirectedRequest, problemSessionElsewhere, "The session runs on node "+s.Node)
+}
+
+type memorySessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]LiveSession
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]LiveSession)}
+}
+
+func (m *memorySessionStore) Claim(_ context.Context, s LiveSession) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, taken := m.sessions[s.ID]; taken {
+		return false, nil
+	}
+	m.sessions[s.ID] = s
+	return true, nil
+}
+
+func (m *memorySessionStore) Refresh(_ context.Context, s LiveSession) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if current, ok := m.sessions[s.ID]; ok && current.Node != s.Node {
+		return fmt.Errorf("session %s belongs to node %s", s.ID, current.Node)
+	}
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *memorySessionStore) Lookup(_ context.Context, id string) (LiveSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return LiveSession{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *memorySessionStore) Release(_ context.Context, id, node string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if s, ok := m.sessions[id]; ok && s.Node == node {
+		delete(m.sessions, id)
+	}
+	return nil
+}
+
+func (m *memorySessionStore) Close() error { return nil }
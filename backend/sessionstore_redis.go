@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSessionStore keeps each session in a hash with its node and the
+// JSON record, expiring sessionRecordTTL after the last refresh. The
+// scripts make claiming, refreshing and releasing atomic, so a node can
+// never overwrite or drop another node's session.
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+const redisSessionPrefix = "sendmyzip:session:"
+
+var (
+	redisClaimSession = redis.NewScript(`
+if redis.call("exists", KEYS[1]) == 1 then return 0 end
+redis.call("hset", KEYS[1], "node", ARGV[1], "record", ARGV[2])
+redis.call("pexpire", KEYS[1], ARGV[3])
+return 1`)
+	redisRefreshSession = redis.NewScript(`
+local node = redis.call("hget", KEYS[1], "node")
+if node and node ~= ARGV[1] then return 0 end
+redis.call("hset", KEYS[1], "node", ARGV[1], "record", ARGV[2])
+redis.call("pexpire", KEYS[1], ARGV[3])
+return 1`)
+	redisReleaseSession = redis.NewScript(`
+if redis.call("hget", KEYS[1], "node") == ARGV[1] then return redis.call("del", KEYS[1]) end
+return 0`)
+)
+
+func openRedisSessionStore(url string) (*redisSessionStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisSessionStore{client: client}, nil
+}
+
+func (s *redisSessionStore) run(ctx context.Context, script *redis.Script, ls LiveSession) (int64, error) {
+	record, err := json.Marshal(ls)
+	if err != nil {
+		return 0, err
+	}
+	return script.Run(ctx, s.client, []string{redisSessionPrefix + ls.ID}, ls.Node, record, sessionRecordTTL.Milliseconds()).Int64()
+}
+
+func (s *redisSessionStore) Claim(ctx context.Context, ls LiveSession) (bool, error) {
+	n, err := s.run(ctx, redisClaimSession, ls)
+	return n == 1, err
+}
+
+func (s *redisSessionStore) Refresh(ctx context.Context, ls LiveSession) error {
+	n, err := s.run(ctx, redisRefreshSession, ls)
+	if err == nil && n == 0 {
+		err = fmt.Errorf("session %s belongs to another node", ls.ID)
+	}
+	return err
+}
+
+func (s *redisSessionStore) Lookup(ctx context.Context, id string) (LiveSession, error) {
+	var ls LiveSession
+	data, err := s.client.HGet(ctx, redisSessionPrefix+id, "record").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ls, ErrNotFound
+	}
+	if err != nil {
+		return ls, err
+	}
+	return ls, json.Unmarshal(data, &ls)
+}
+
+func (s *redisSessionStore) Release(ctx context.Context, id, node string) error {
+	return redisReleaseSession.Run(ctx, s.client, []string{redisSessionPrefix + id}, node).Err()
+}
+
+func (s *redisSessionStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Live sessions only exist in memory, so a deploy would end every one of
+// them. With -snapshot the server writes down what it takes to bring them
+// back every -snapshot-interval and once more when it shuts down:
+//
+//	/var/lib/sendmyzip/sessions.json  a file, written atomically
+//	redis://host:6379/0               a key per -node-id in Redis
+//
+// On shutdown the sessions are then not drained and ended but suspended:
+// hosts and receivers get server_restarting and their sockets just go away.
+// A restarted server loads the snapshot and puts each session back without
+// its sockets, as if everyone had dropped off at once. The host has
+// -snapshot-grace to reattach through /api/upload/{id}/resume with its
+// resume_token, and each receiver as long to join again with its own, after
+// which they are removed the usual way. Published sessions keep their own
+// expiry instead.
+//
+// A snapshot has the session's ID, metadata, tokens, settings and the
+// receivers it had, and never file contents, so sessions holding an inline
+// file aren't kept. Snapshots older than -snapshot-grace are ignored. With
+// a shared -session-store the restarted node needs the same -node-id to
+// claim its sessions again.
+
+type snapshot struct {
+	SavedAt  time.Time         `json:"saved_at"`
+	Sessions []sessionSnapshot `json:"sessions"`
+}
+
+type sessionSnapshot struct {
+	ID         string    `json:"id"`
+	Meta       Metadata  `json:"metadata"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`
+	Vocabulary string    `json:"vocabulary,omitempty"`
+
+	HostToken   string `json:"host_token"`
+	ResumeToken string `json:"resume_token"`
+
+	RequireApproval bool     `json:"require_approval,omitempty"`
+	RequireToken    bool     `json:"require_token,omitempty"`
+	MaxReceivers    int      `json:"max_receivers,omitempty"`
+	SealedSignaling bool     `json:"sealed_signaling,omitempty"`
+	PassphraseSalt  []byte   `json:"passphrase_salt,omitempty"`
+	PassphraseHash  []byte   `json:"passphrase_hash,omitempty"`
+	Recipient       string   `json:"recipient,omitempty"`
+	HostIdentity    string   `json:"host_identity,omitempty"`
+	BaseURL         string   `json:"base_url,omitempty"`
+	Room            string   `json:"room,omitempty"`
+	Labels          []string `json:"labels,omitempty"`
+	MaxDownloads    int      `json:"max_downloads,omitempty"`
+	Downloads       int      `json:"downloads,omitempty"`
+	WebhookURL      string   `json:"webhook_url,omitempty"`
+	WebhookSecret   string   `json:"webhook_secret,omitempty"`
+	Tenant          string   `json:"tenant,omitempty"`
+	Country         string   `json:"country,omitempty"`
+
+	Receivers []receiverSnapshot `json:"receivers,omitempty"`
+}
+
+type receiverSnapshot struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	PublicKey   string    `json:"public_key,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Locale      string    `json:"locale,omitempty"`
+	ResumeToken string    `json:"resume_token"`
+}
+
+type SnapshotStore interface {
+	Save(ctx context.Context, snap snapshot) error
+	// Load returns the last snapshot saved, or ErrNotFound.
+	Load(ctx context.Context) (snapshot, error)
+	Close() error
+}
+
+var snapshots SnapshotStore // nil without -snapshot
+
+func openSnapshotStore(spec string) (SnapshotStore, error) {
+	switch {
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return openRedisSnapshotStore(spec, nodeID)
+	case strings.Contains(spec, "://"):
+		return nil, fmt.Errorf("unknown snapshot store %q", spec)
+	default:
+		return fileSnapshotStore{path: spec}, nil
+	}
+}
+
+// snapshotOf describes upload for a snapshot, or reports false for a
+// session that can't be brought back.
+func snapshotOf(upload *Upload) (sessionSnapshot, bool) {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	if upload.inline != nil || !upload.closedAt.IsZero() {
+		return sessionSnapshot{}, false
+	}
+	s := sessionSnapshot{
+		ID:              upload.ID,
+		Meta:            upload.Meta,
+		CreatedAt:       upload.CreatedAt,
+		ExpiresAt:       upload.expiresAt,
+		HostToken:       upload.hostToken,
+		ResumeToken:     upload.resumeToken,
+		RequireApproval: upload.RequireApproval,
+		RequireToken:    upload.RequireToken,
+		MaxReceivers:    upload.MaxReceivers,
+		SealedSignaling: upload.sealedSignaling,
+		Recipient:       upload.recipient,
+		HostIdentity:    upload.hostIdentity,
+		BaseURL:         upload.baseURL,
+		Room:            upload.room,
+		Labels:          upload.labels,
+		MaxDownloads:    upload.maxDownloads,
+		Downloads:       upload.downloads,
+		WebhookURL:      upload.webhookURL,
+		WebhookSecret:   upload.webhookSecret,
+		Tenant:          upload.tenant,
+		Country:         upload.country,
+	}
+	if upload.vocabulary != nil {
+		s.Vocabulary = upload.vocabulary.Name
+	}
+	if upload.passphrase != nil {
+		s.PassphraseSalt, s.PassphraseHash = upload.passphrase.salt, upload.passphrase.hash
+	}
+	for _, r := range upload.Receivers {
+		s.Receivers = append(s.Receivers, receiverSnapshot{
+			ID:          r.ID,
+			Name:        r.Name,
+			PublicKey:   r.PublicKey,
+			ConnectedAt: r.ConnectedAt,
+			Locale:      r.locale,
+			ResumeToken: r.resumeToken,
+		})
+	}
+	return s, true
+}
+
+// saveSnapshot writes down the sessions running now.
+func saveSnapshot() error {
+	uploadsMutex.RLock()
+	live := make([]*Upload, 0, len(uploads))
+	for _, upload := range uploads {
+		live = append(live, upload)
+	}
+	uploadsMutex.RUnlock()
+
+	snap := snapshot{SavedAt: time.Now(), Sessions: make([]sessionSnapshot, 0, len(live))}
+	for _, upload := range live {
+		if s, ok := snapshotOf(upload); ok {
+			snap.Sessions = append(snap.Sessions, s)
+		}
+	}
+	return snapshots.Save(context.Background(), snap)
+}
+
+func runSnapshots() {
+	for range time.Tick(cfg.SnapshotInterval) {
+		if err := saveSnapshot(); err != nil {
+			log.Error("Could not save session snapshot", "err", err)
+		}
+	}
+}
+
+// suspendAllUploads tells everyone the server is going away and will be
+// back; the sessions are left in place for saveSnapshot.
+func suspendAllUploads() {
+	uploadsMutex.RLock()
+	live := make([]*Upload, 0, len(uploads))
+	for _, upload := range uploads {
+		live = append(live, upload)
+	}
+	uploadsMutex.RUnlock()
+
+	msg := Message{Type: "server_restarting", Payload: map[string]any{"grace_seconds": cfg.SnapshotGrace.Seconds()}}
+	for _, upload := range live {
+		sendToHost(upload, msg)
+		broadcastToReceivers(upload, msg)
+	}
+}
+
+// restoreSnapshot brings back the sessions of the last snapshot.
+func restoreSnapshot() {
+	snap, err := snapshots.Load(context.Background())
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Error("Could not load session snapshot", "err", err)
+		return
+	}
+	if time.Since(snap.SavedAt) > cfg.SnapshotGrace {
+		log.Warn("Ignoring stale session snapshot", "saved_at", snap.SavedAt, "sessions", len(snap.Sessions))
+		return
+	}
+
+	restored := 0
+	for _, s := range snap.Sessions {
+		if restoreSession(s) {
+			restored++
+		}
+	}
+	log.Info("Restored sessions from snapshot", "restored", restored, "saved", len(snap.Sessions), "saved_at", snap.SavedAt)
+}
+
+// restoreSession puts back one session from a snapshot, waiting for its
+// host and receivers to reattach.
+func restoreSession(s sessionSnapshot) bool {
+	grace := cfg.SnapshotGrace
+	if !s.ExpiresAt.IsZero() {
+		if grace = time.Until(s.ExpiresAt); grace <= 0 {
+			return false
+		}
+	}
+
+	upload := &Upload{
+		ID:              s.ID,
+		Meta:            s.Meta,
+		Receivers:       make([]*Receiver, 0, len(s.Receivers)),
+		CreatedAt:       s.CreatedAt,
+		RequireApproval: s.RequireApproval,
+		RequireToken:    s.RequireToken,
+		MaxReceivers:    s.MaxReceivers,
+		sealedSignaling: s.SealedSignaling,
+		recipient:       s.Recipient,
+		hostIdentity:    s.HostIdentity,
+		baseURL:         s.BaseURL,
+		room:            s.Room,
+		expiresAt:       s.ExpiresAt,
+		labels:          s.Labels,
+		maxDownloads:    s.MaxDownloads,
+		downloads:       s.Downloads,
+		webhookURL:      s.WebhookURL,
+		webhookSecret:   s.WebhookSecret,
+		tenant:          s.Tenant,
+		country:         s.Country,
+		hostToken:       s.HostToken,
+		resumeToken:     s.ResumeToken,
+		hostDetached:    true,
+		ctx:             context.Background(),
+	}
+	upload.vocabulary, _ = vocabularyFor(s.Vocabulary)
+	if s.PassphraseHash != nil {
+		upload.passphrase = &passphraseHash{salt: s.PassphraseSalt, hash: s.PassphraseHash}
+	}
+	for _, r := range s.Receivers {
+		receiver := &Receiver{
+			ID:             r.ID,
+			Name:           r.Name,
+			PublicKey:      r.PublicKey,
+			ConnectedAt:    r.ConnectedAt,
+			ctx:            context.Background(),
+			availableBytes: -1,
+			locale:         r.Locale,
+			resumeToken:    r.ResumeToken,
+			away:           true,
+		}
+		receiver.awayTimer = time.AfterFunc(min(grace, cfg.SnapshotGrace), func() {
+			receiver.connMutex.Lock()
+			expired := receiver.away
+			receiver.connMutex.Unlock()
+			if expired {
+				removeReceiver(upload, receiver)
+			}
+		})
+		upload.Receivers = append(upload.Receivers, receiver)
+	}
+	upload.touch()
+
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	if _, taken := uploads[s.ID]; taken {
+		return false
+	}
+	// The store may still have the record of the previous run
+	claimed, err := sessions.Claim(context.Background(), liveSessionOf(upload))
+	if err == nil && !claimed {
+		err = sessions.Refresh(context.Background(), liveSessionOf(upload))
+	}
+	if err != nil {
+		log.Warn("Could not reclaim restored session", "id", s.ID, "err", err)
+		return false
+	}
+	uploads[s.ID] = upload
+	upload.holdTimer = time.AfterFunc(grace, func() { finalizeUpload(upload) })
+	return true
+}
+
+// fileSnapshotStore keeps the snapshot in a file only the server can read,
+// since it holds the sessions' tokens.
+type fileSnapshotStore struct {
+	path string
+}
+
+func (f fileSnapshotStore) Save(_ context.Context, snap snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f fileSnapshotStore) Load(_ context.Context) (snapshot, error) {
+	var snap snapshot
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return snap, ErrNotFound
+	}
+	if err != nil {
+		return snap, err
+	}
+	return snap, json.Unmarshal(data, &snap)
+}
+
+func (f fileSnapshotStore) Close() error { return nil }
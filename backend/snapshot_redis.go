@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSnapshotStore keeps a node's snapshot in one key, dropped after a
+// day in case the node never comes back.
+type redisSnapshotStore struct {
+	client *redis.Client
+	key    string
+}
+
+const (
+	redisSnapshotPrefix = "sendmyzip:snapshot:"
+	redisSnapshotTTL    = 24 * time.Hour
+)
+
+func openRedisSnapshotStore(url, node string) (*redisSnapshotStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisSnapshotStore{client: client, key: redisSnapshotPrefix + node}, nil
+}
+
+func (s *redisSnapshotStore) Save(ctx context.Context, snap snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key, data, redisSnapshotTTL).Err()
+}
+
+func (s *redisSnapshotStore) Load(ctx context.Context) (snapshot, error) {
+	var snap snapshot
+	data, err := s.client.Get(ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return snap, ErrNotFound
+	}
+	if err != nil {
+		return snap, err
+	}
+	return snap, json.Unmarshal(data, &snap)
+}
+
+func (s *redisSnapshotStore) Close() error {
+	return s.client.Close()
+}
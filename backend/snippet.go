@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+)
+
+// A session can carry a short text or a URL instead of a file. The host
+// connects with kind=snippet (filetype text/plain, the default, or
+// text/uri-list) and no file parameters. Every receiver of such a session
+// has to bring an X25519 encryption_key in its join_request; the host
+// encrypts the snippet to that key and sends it in a snippet message, which
+// the server relays over the signaling socket. No data channel is opened,
+// so no transport plan is sent either.
+
+const (
+	kindSnippet = "snippet"
+
+	// maxSnippetCiphertext bounds the base64 ciphertext, which leaves
+	// room for about 16 KiB of text.
+	maxSnippetCiphertext = 24 << 10
+)
+
+var snippetTypes = []string{"text/plain", "text/uri-list"}
+
+// snippetMetadata fills in the metadata of a snippet session from query.
+// It reports false for a type that isn't a snippet type.
+func snippetMetadata(query url.Values) (Metadata, bool) {
+	meta := Metadata{
+		Kind:     kindSnippet,
+		FileName: query.Get("filename"),
+		FileType: query.Get("filetype"),
+	}
+	if meta.FileType == "" {
+		meta.FileType = snippetTypes[0]
+	}
+	if !slices.Contains(snippetTypes, meta.FileType) {
+		return meta, false
+	}
+	if meta.FileName == "" {
+		meta.FileName = "Tekst"
+		if meta.FileType == snippetTypes[1] {
+			meta.FileName = "Link"
+		}
+	}
+	return meta, true
+}
+
+// validEncryptionKey reports whether key is a base64 X25519 public key.
+func validEncryptionKey(key string) bool {
+	raw, err := decodeBase64(key)
+	return err == nil && len(raw) == 32
+}
+
+type snippetRequest struct {
+	ReceiverID   string `json:"receiver_id"`
+	Ciphertext   string `json:"ciphertext"`
+	Nonce        string `json:"nonce"`
+	EphemeralKey string `json:"ephemeral_key,omitempty"`
+}
+
+func handleSnippet(upload *Upload, msg Message) {
+	var req snippetRequest
+	err := decodePayload(msg, &req)
+	if err == nil && upload.Meta.Kind != kindSnippet {
+		err = errors.New("this is not a snippet session")
+	}
+	if err == nil && (req.Ciphertext == "" || len(req.Ciphertext) > maxSnippetCiphertext) {
+		err = errors.New("ciphertext must be set and at most 24 KiB")
+	}
+	if err == nil {
+		if _, err = decodeBase64(req.Ciphertext); err != nil {
+			err = errors.New("ciphertext must be base64")
+		}
+	}
+	if err == nil {
+		if _, err = decodeBase64(req.Nonce); err != nil || req.Nonce == "" {
+			err = errors.New("nonce must be base64")
+		}
+	}
+	var receiver *Receiver
+	if err == nil {
+		if receiver = upload.findReceiver(req.ReceiverID); receiver == nil {
+			err = errors.New("no receiver with that ID")
+		}
+	}
+	if err != nil {
+		sendToHost(upload, invalidPayload(msg, err))
+		return
+	}
+
+	receiver.send(Message{Type: "snippet", Payload: map[string]any{
+		"ciphertext":    req.Ciphertext,
+		"nonce":         req.Nonce,
+		"ephemeral_key": req.EphemeralKey,
+		"sender_key":    upload.hostIdentity,
+	}})
+	receiverServed(upload, receiver)
+	countDownload(upload, receiver)
+	sendToHost(upload, Message{Type: "snippet_delivered", Payload: receiverDecision{ReceiverID: receiver.ID}})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// A host closing its session only soft-deletes it: receivers are sent away
+// and new joins are refused, but for -restore-window the host can undo the
+// close and keep the same ID. After that, or as soon as the host socket goes
+// away, the session is removed.
+
+func (u *Upload) isClosed() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return !u.closedAt.IsZero()
+}
+
+// softDelete closes the session and sends the host the token that restores
+// it.
+func softDelete(upload *Upload) {
+	upload.mutex.Lock()
+	if !upload.closedAt.IsZero() {
+		token, until := upload.restoreToken, upload.closedAt.Add(cfg.RestoreWindow)
+		upload.mutex.Unlock()
+		sendSessionClosed(upload, token, until)
+		return
+	}
+	upload.closedAt = time.Now()
+	upload.restoreToken = generateReceiverID() + generateReceiverID()
+	until := upload.closedAt.Add(cfg.RestoreWindow)
+	upload.finalizeTimer = time.AfterFunc(cfg.RestoreWindow, func() { finalizeUpload(upload) })
+	receivers := make([]*Receiver, 0, len(upload.Receivers)+len(upload.pending)+len(upload.queue))
+	receivers = append(receivers, upload.Receivers...)
+	receivers = append(receivers, upload.pending...)
+	receivers = append(receivers, upload.queue...)
+	token := upload.restoreToken
+	upload.mutex.Unlock()
+
+	log.Info("Session closed by host", "id", upload.ID, "restorable_until", until)
+	sendSessionClosed(upload, token, until)
+
+	for _, receiver := range receivers {
+		receiver.send(Message{Type: "host_disconnected", Payload: map[string]string{"reason": "session_closed"}})
+		receiver.close()
+	}
+}
+
+// restoreUpload undoes a soft delete. It fails once the window has passed
+// or when token doesn't match.
+func restoreUpload(upload *Upload, token string, checkToken bool) bool {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	if upload.closedAt.IsZero() {
+		return true
+	}
+	if checkToken && subtle.ConstantTimeCompare([]byte(token), []byte(upload.restoreToken)) != 1 {
+		return false
+	}
+	if !upload.finalizeTimer.Stop() {
+		return false // already finalized
+	}
+	upload.closedAt = time.Time{}
+	upload.restoreToken = ""
+	upload.finalizeTimer = nil
+	log.Info("Session restored", "id", upload.ID)
+	return true
+}
+
+// finalizeUpload removes the session for good.
+func finalizeUpload(upload *Upload) {
+	uploadsMutex.Lock()
+	current, ok := uploads[upload.ID]
+	if ok && current == upload {
+		delete(uploads, upload.ID)
+	}
+	uploadsMutex.Unlock()
+	if !ok || current != upload {
+		return
+	}
+
+	if err := sessions.Release(context.Background(), upload.ID, nodeID); err != nil {
+		log.Error("Could not release session", "id", upload.ID, "err", err)
+	}
+	upload.hostConn().Close()
+	endRelays(upload, nil, "session_ended")
+	endHTTPRelays(upload, nil, "session_ended")
+	endBandwidthProbes(upload, nil, "session_ended")
+	closeLinkedHosts(upload)
+	unbindHostSession(upload)
+	announceUploadEnded(upload)
+	notifySessionWebhook(upload, "ended", nil)
+	upload.mutex.RLock()
+	receivers := len(upload.Receivers)
+	upload.mutex.RUnlock()
+	recordEvent(upload, "session_ended", map[string]any{"receiver_count": receivers})
+	recordSession(upload)
+}
+
+func sendSessionClosed(upload *Upload, token string, until time.Time) {
+	sendToHost(upload, Message{
+		Type: "session_closed",
+		Payload: map[string]any{
+			"restore_token":    token,
+			"restorable_until": until,
+		},
+	})
+}
+
+type restoreRequest struct {
+	RestoreToken string `json:"restore_token"`
+}
+
+// handleRestoreUpload is the undo endpoint for a soft-deleted session.
+func handleRestoreUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RestoreToken == "" {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Body must be JSON with a restore_token")
+		return
+	}
+
+	if !restoreUpload(upload, req.RestoreToken, true) {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid or expired restore token")
+		return
+	}
+
+	sendToHost(upload, Message{Type: "session_restored", Payload: map[string]string{"id": upload.ID}})
+	writeJSON(w, http.StatusOK, map[string]string{"id": upload.ID})
+}
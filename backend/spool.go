@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Everything the spool writes is sealed with a key of the session it
+// belongs to, client-encrypted or not, so a copy of the disk or the bucket
+// gives away neither files nor metadata. The key is the client's own when
+// it sent one, and otherwise derived from the current server key and the
+// session with HKDF; it is never stored or logged. Sealed files are a
+// sequence of AES-256-GCM segments; the nonce carries the segment counter
+// and a final flag so segments cannot be reordered or the file silently
+// truncated.
+//
+// Files written before session keys are either stored as-is (SMZ0) or
+// sealed with a server key directly (SMZ1). They can still be read, and
+// Rekey seals them anew.
+//
+// To rotate the server key, put the new one first in -spool-key-file or
+// the spool secret, keeping the old one after it, and run `sendmyzip admin
+// rotate-keys`. The server reloads the keys and re-seals the spool under
+// the new one; `sendmyzip admin rekey-spool` (POST /api/admin/spool/rekey)
+// does just the latter. Once every entry is re-sealed the old key can be
+// dropped.
+const (
+	spoolMagicPlain   = "SMZ0"
+	spoolMagicSealed  = "SMZ1"
+	spoolMagicSession = "SMZ2"
+
+	// clientKeyID marks session-sealed files whose key the client holds
+	clientKeyID = "client"
+
+	spoolSegmentSize = 64 * 1024
+	spoolNoncePrefix = 7
+)
+
+var (
+	ErrUnknownSpoolKey  = errors.New("spool: data sealed with unknown key")
+	ErrSpoolCorrupt     = errors.New("spool: corrupt or truncated data")
+	ErrClientKeyMissing = errors.New("spool: data sealed with a client key")
+)
+
+type spoolKey struct {
+	ID     string
+	aead   cipher.AEAD
+	secret []byte // for deriving session keys
+}
+
+func newSpoolAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// derive returns the key for session's data, which keeps k's ID so the
+// data can still be read after a rotation.
+func (k spoolKey) derive(session string) (spoolKey, error) {
+	secret, err := hkdf.Key(sha256.New, k.secret, nil, "sendmyzip spool session "+session, 32)
+	if err != nil {
+		return spoolKey{}, err
+	}
+	aead, err := newSpoolAEAD(secret)
+	if err != nil {
+		return spoolKey{}, err
+	}
+	return spoolKey{ID: k.ID, aead: aead}, nil
+}
+
+// blobKey says which key a spool entry is sealed with.
+type blobKey struct {
+	session string // what the server key is derived for
+	client  []byte // 32 bytes the client sent, used instead when set
+}
+
+// parseClientKey decodes a key a client sent as base64.
+func parseClientKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the key must be 32 bytes of base64")
+	}
+	return key, nil
+}
+
+// Keyring holds the server keys used to seal spooled data. The first key
+// encrypts new data; the rest are kept so data sealed before a rotation can
+// still be read.
+type Keyring struct {
+	mutex sync.RWMutex
+	keys  []spoolKey
+}
+
+func newKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// Add registers a 32-byte key. When current is true it becomes the key used
+// for new data.
+func (k *Keyring) Add(id string, key []byte, current bool) error {
+	if len(key) != 32 {
+		return fmt.Errorf("spool key %q must be 32 bytes, got %d", id, len(key))
+	}
+	aead, err := newSpoolAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for i, existing := range k.keys {
+		if existing.ID == id {
+			k.keys = append(k.keys[:i], k.keys[i+1:]...)
+			break
+		}
+	}
+	entry := spoolKey{ID: id, aead: aead, secret: bytes.Clone(key)}
+	if current {
+		k.keys = append([]spoolKey{entry}, k.keys...)
+	} else {
+		k.keys = append(k.keys, entry)
+	}
+	return nil
+}
+
+func (k *Keyring) current() (spoolKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if len(k.keys) == 0 {
+		return spoolKey{}, false
+	}
+	return k.keys[0], true
+}
+
+func (k *Keyring) lookup(id string) (spoolKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return spoolKey{}, false
+}
+
+// loadKeyringFile reads "id:base64key" lines. The first key is current.
+func loadKeyringFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	versions, err := parseKeyLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keyringFromVersions(versions)
+}
+
+// loadSpoolKeyring reads the spool keys from -spool-key-file or the spool
+// secret. It is empty when neither has any.
+func loadSpoolKeyring(ctx context.Context) (*Keyring, error) {
+	if cfg.SpoolKeyFile != "" {
+		return loadKeyringFile(cfg.SpoolKeyFile)
+	}
+	versions, err := secrets.Versions(ctx, secretSpool)
+	if err != nil {
+		return newKeyring(), nil
+	}
+	return keyringFromVersions(versions)
+}
+
+// replace swaps in the keys of other.
+func (k *Keyring) replace(other *Keyring) {
+	other.mutex.RLock()
+	keys := other.keys
+	other.mutex.RUnlock()
+	k.mutex.Lock()
+	k.keys = keys
+	k.mutex.Unlock()
+}
+
+// keyringFromVersions builds a keyring from secret versions, newest first.
+func keyringFromVersions(versions []SecretVersion) (*Keyring, error) {
+	ring := newKeyring()
+	for _, v := range versions {
+		// Appending in order keeps the newest version first, i.e. current
+		if err := ring.Add(v.ID, v.Value, false); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+func segmentNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[spoolNoncePrefix:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealStream encrypts src into dst with key, under the header magic.
+func sealStream(dst io.Writer, src io.Reader, magic string, key spoolKey) error {
+	header := []byte(magic)
+	header = append(header, byte(len(key.ID)))
+	header = append(header, key.ID...)
+	prefix := make([]byte, spoolNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	// Read one segment ahead so the last one can be flagged as final
+	buf := make([]byte, spoolSegmentSize)
+	next := make([]byte, spoolSegmentSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	var counter uint32
+	for {
+		m, nextErr := io.ReadFull(src, next)
+		if nextErr != nil && nextErr != io.ErrUnexpectedEOF && nextErr != io.EOF {
+			return nextErr
+		}
+		final := m == 0
+
+		sealed := key.aead.Seal(nil, segmentNonce(prefix, counter, final), buf[:n], nil)
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+		if _, err := dst.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+
+		counter++
+		buf, next = next, buf
+		n = m
+	}
+}
+
+type sealedReader struct {
+	src     *bufio.Reader
+	key     spoolKey
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (r *sealedReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		var length [4]byte
+		if _, err := io.ReadFull(r.src, length[:]); err != nil {
+			return 0, ErrSpoolCorrupt
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > spoolSegmentSize+uint32(r.key.aead.Overhead()) {
+			return 0, ErrSpoolCorrupt
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r.src, sealed); err != nil {
+			return 0, ErrSpoolCorrupt
+		}
+
+		// Try the segment as non-final first; the final flag is only valid
+		// for the last one and must be followed by EOF
+		plain, err := r.key.aead.Open(nil, segmentNonce(r.prefix, r.counter, false), sealed, nil)
+		if err != nil {
+			plain, err = r.key.aead.Open(nil, segmentNonce(r.prefix, r.counter, true), sealed, nil)
+			if err != nil {
+				return 0, ErrSpoolCorrupt
+			}
+			if _, err := r.src.Peek(1); err != io.EOF {
+				return 0, ErrSpoolCorrupt
+			}
+			r.done = true
+		}
+		r.counter++
+		r.buf = plain
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// openStream returns a reader yielding the plaintext of a spool file. A
+// wrong client key shows as ErrSpoolCorrupt on the first read.
+func openStream(src io.Reader, ring *Keyring, sk blobKey) (io.Reader, error) {
+	br := bufio.NewReader(src)
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, ErrSpoolCorrupt
+	}
+
+	switch string(magic) {
+	case spoolMagicPlain:
+		return br, nil
+	case spoolMagicSealed, spoolMagicSession:
+	default:
+		return nil, ErrSpoolCorrupt
+	}
+
+	idLen, err := br.ReadByte()
+	if err != nil {
+		return nil, ErrSpoolCorrupt
+	}
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(br, id); err != nil {
+		return nil, ErrSpoolCorrupt
+	}
+	prefix := make([]byte, spoolNoncePrefix)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, ErrSpoolCorrupt
+	}
+
+	key, err := resolveKey(ring, string(magic), string(id), sk)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReader{src: br, key: key, prefix: prefix}, nil
+}
+
+// resolveKey finds the key a file with the header magic and key id was
+// sealed with.
+func resolveKey(ring *Keyring, magic, id string, sk blobKey) (spoolKey, error) {
+	if magic == spoolMagicSession && id == clientKeyID {
+		if sk.client == nil {
+			return spoolKey{}, ErrClientKeyMissing
+		}
+		aead, err := newSpoolAEAD(sk.client)
+		return spoolKey{ID: clientKeyID, aead: aead}, err
+	}
+	if ring == nil {
+		return spoolKey{}, ErrUnknownSpoolKey
+	}
+	key, ok := ring.lookup(id)
+	if !ok {
+		return spoolKey{}, ErrUnknownSpoolKey
+	}
+	if magic == spoolMagicSession {
+		return key.derive(sk.session)
+	}
+	return key, nil
+}
+
+type spoolEntry struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	KeyID     string    `json:"key_id,omitempty"` // of the server key, empty for client keys
+	Session   string    `json:"session,omitempty"`
+	ClientKey bool      `json:"client_key,omitempty"`
+}
+
+// Spool keeps server-held blobs in a BlobStore with per-entry expiry, each
+// sealed with the key of its session. Each entry is two blobs, the data
+// under its name and its spoolEntry under name.meta.
+type Spool struct {
+	blobs BlobStore
+	ring  *Keyring
+}
+
+var spool *Spool // nil unless -spool-dir or -blob-store is set
+
+// newSpool keeps blobs in the store, sealed with keys from ring. Without a
+// server key it makes one up, and what it seals becomes unreadable when
+// the process exits.
+func newSpool(blobs BlobStore, ring *Keyring) (*Spool, error) {
+	if _, ok := ring.current(); !ok {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := ring.Add("ephemeral-"+hex.EncodeToString(key[:4]), key, true); err != nil {
+			return nil, err
+		}
+		log.Warn("No spool key configured, spooled data will not survive a restart")
+	}
+	return &Spool{blobs: blobs, ring: ring}, nil
+}
+
+// sealingKey returns the key new data for sk is sealed with.
+func (s *Spool) sealingKey(sk blobKey) (spoolKey, error) {
+	if sk.client != nil {
+		return resolveKey(s.ring, spoolMagicSession, clientKeyID, sk)
+	}
+	current, ok := s.ring.current()
+	if !ok {
+		return spoolKey{}, errors.New("spool: no current key")
+	}
+	return current.derive(sk.session)
+}
+
+// Put stores r under name until ttl elapses, sealed with the key sk names.
+func (s *Spool) Put(name string, r io.Reader, ttl time.Duration, sk blobKey) error {
+	key, err := s.sealingKey(sk)
+	if err != nil {
+		return err
+	}
+	entry := spoolEntry{ExpiresAt: time.Now().Add(ttl), Session: sk.session, ClientKey: sk.client != nil}
+	if !entry.ClientKey {
+		entry.KeyID = key.ID
+	}
+
+	// The entry goes first, so data never sits in the store without an
+	// expiry for the sweeper to find
+	if err := s.writeEntry(name, entry); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sealStream(pw, r, spoolMagicSession, key))
+	}()
+	err = s.blobs.Put(context.Background(), name, pr)
+	pr.CloseWithError(err) // unblocks the writer when the store gave up early
+	if err != nil {
+		s.blobs.Delete(context.Background(), name+".meta")
+	}
+	return err
+}
+
+func (s *Spool) writeEntry(name string, entry spoolEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.blobs.Put(context.Background(), name+".meta", bytes.NewReader(data))
+}
+
+func (s *Spool) readEntry(name string) (spoolEntry, error) {
+	var entry spoolEntry
+	rc, err := s.blobs.Open(context.Background(), name+".meta")
+	if err != nil {
+		return entry, err
+	}
+	defer rc.Close()
+	return entry, json.NewDecoder(rc).Decode(&entry)
+}
+
+type spoolFile struct {
+	io.Reader
+	io.Closer
+}
+
+// Open returns the plaintext of name, or os.ErrNotExist once it expired.
+// Data sealed with a client key needs it in sk.
+func (s *Spool) Open(name string, sk blobKey) (io.ReadCloser, error) {
+	entry, err := s.readEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		s.Delete(name)
+		return nil, os.ErrNotExist
+	}
+
+	rc, err := s.blobs.Open(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	if sk.session == "" {
+		sk.session = entry.Session
+	}
+	r, err := openStream(rc, s.ring, sk)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return spoolFile{Reader: r, Closer: rc}, nil
+}
+
+// Delete removes the entry. Sealed data additionally becomes unreadable
+// once its key is retired, wherever copies of it may linger.
+func (s *Spool) Delete(name string) error {
+	s.blobs.Delete(context.Background(), name+".meta")
+	return s.blobs.Delete(context.Background(), name)
+}
+
+// Rekey re-seals every entry that is not under a key derived from the
+// current one, so retired keys can be dropped from the keyring afterwards.
+// That includes entries from before session keys. Entries under a client
+// key are left alone; the server can't read them.
+func (s *Spool) Rekey() (int, error) {
+	current, ok := s.ring.current()
+	if !ok {
+		return 0, errors.New("spool: no current key")
+	}
+
+	names, err := s.names()
+	if err != nil {
+		return 0, err
+	}
+
+	rekeyed := 0
+	for _, name := range names {
+		entry, err := s.readEntry(name)
+		if err != nil || entry.ClientKey || (entry.KeyID == current.ID && entry.Session != "") {
+			continue
+		}
+		sk := blobKey{session: entry.Session}
+		if sk.session == "" {
+			sk.session = name
+		}
+
+		rc, err := s.Open(name, sk)
+		if err != nil {
+			return rekeyed, fmt.Errorf("rekey %s: %w", name, err)
+		}
+		// Read it all first; the store may not let a blob be replaced
+		// while it is being read
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err == nil {
+			err = s.Put(name, bytes.NewReader(data), time.Until(entry.ExpiresAt), sk)
+		}
+		if err != nil {
+			return rekeyed, fmt.Errorf("rekey %s: %w", name, err)
+		}
+		rekeyed++
+	}
+	return rekeyed, nil
+}
+
+// reloadKeys re-reads the spool keys and, when the current one changed,
+// re-seals the spool under it. Without any configured keys the spool keeps
+// the one it made up.
+func (s *Spool) reloadKeys(ctx context.Context) (int, error) {
+	ring, err := loadSpoolKeyring(ctx)
+	if err != nil {
+		return 0, err
+	}
+	next, ok := ring.current()
+	if !ok {
+		return 0, nil
+	}
+	previous, _ := s.ring.current()
+	s.ring.replace(ring)
+	// Compared by value, so a provider that kept the ID across a rotation
+	// still gets the spool re-sealed
+	if next.ID == previous.ID && bytes.Equal(next.secret, previous.secret) {
+		return 0, nil
+	}
+	log.Info("Spool key rotated", "previous", previous.ID, "current", next.ID)
+	return s.Rekey()
+}
+
+// handleAdminRekeySpool re-seals the spool under the current key.
+func handleAdminRekeySpool(w http.ResponseWriter, r *http.Request) {
+	if spool == nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "This server has no spool")
+		return
+	}
+	rekeyed, err := spool.Rekey()
+	if err != nil {
+		log.Error("Could not rekey spool", "rekeyed", rekeyed, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, err.Error())
+		return
+	}
+	log.Info("Spool rekeyed", "rekeyed", rekeyed)
+	writeJSON(w, http.StatusOK, map[string]int{"rekeyed": rekeyed})
+}
+
+func (s *Spool) names() ([]string, error) {
+	blobs, err := s.blobs.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, b := range blobs {
+		if name, ok := strings.CutSuffix(b.Name, ".meta"); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Usage returns the bytes the spool's blobs take up.
+func (s *Spool) Usage() (int64, error) {
+	blobs, err := s.blobs.List(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, b := range blobs {
+		total += b.Size
+	}
+	return total, nil
+}
+
+// Sweep deletes every expired entry.
+func (s *Spool) Sweep() {
+	names, err := s.names()
+	if err != nil {
+		log.Error("Could not list spool", "err", err)
+		return
+	}
+	now := time.Now()
+	for _, name := range names {
+		entry, err := s.readEntry(name)
+		if err != nil || now.After(entry.ExpiresAt) {
+			s.Delete(name)
+		}
+	}
+}
+
+func (s *Spool) runSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.Sweep()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestSpoolReloadKeys rotates the spool secret and checks the refresh
+// re-seals what the spool holds under the new key.
+func TestSpoolReloadKeys(t *testing.T) {
+	testServer(t) // for the secret cache
+	ctx := context.Background()
+	t.Cleanup(func() {
+		secrets.mutex.Lock()
+		delete(secrets.values, secretSpool)
+		secrets.mutex.Unlock()
+	})
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	setEnvSecret(t, secretSpool, first, nil)
+	secrets.load(ctx, secretSpool)
+	ring, err := loadSpoolKeyring(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := newFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSpool(blobs, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("sealed before the rotation")
+	if err := s.Put("file", bytes.NewReader(data), time.Hour, blobKey{session: "session"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rekeyed, err := s.reloadKeys(ctx); rekeyed != 0 || err != nil {
+		t.Errorf("reloading unchanged keys: rekeyed %d, %v", rekeyed, err)
+	}
+
+	setEnvSecret(t, secretSpool, second, first)
+	secrets.load(ctx, secretSpool)
+	if rekeyed, err := s.reloadKeys(ctx); rekeyed != 1 || err != nil {
+		t.Fatalf("reloading rotated keys: rekeyed %d, %v", rekeyed, err)
+	}
+	current, _ := s.ring.current()
+	if entry, err := s.readEntry("file"); err != nil || entry.KeyID != current.ID {
+		t.Errorf("entry %+v, %v, want it under %s", entry, err, current.ID)
+	}
+
+	// The old key can go now
+	setEnvSecret(t, secretSpool, second, nil)
+	secrets.load(ctx, secretSpool)
+	s.reloadKeys(ctx)
+	rc, err := s.Open("file", blobKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, err := io.ReadAll(rc); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %q, %v, want %q", got, err, data)
+	}
+}
+
+func readSpooled(s *Spool, name string) ([]byte, error) {
+	rc, err := s.Open(name, blobKey{})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// TestSpoolRoundTrip seals a few segments, rotates the key, re-seals and
+// then tampers with what is on disk.
+func TestSpoolRoundTrip(t *testing.T) {
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	ring := newKeyring()
+	ring.Add("first", first, true)
+	blobs, err := newFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSpool(blobs, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 2*spoolSegmentSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := s.Put("file", bytes.NewReader(data), time.Hour, blobKey{session: "session"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readSpooled(s, "file"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("before rotating: %d bytes, %v", len(got), err)
+	}
+	sealed, _ := os.ReadFile(blobs.path("file"))
+	if bytes.Contains(sealed, data[:64]) {
+		t.Fatal("data stored in the clear")
+	}
+
+	ring.Add("second", second, true)
+	if rekeyed, err := s.Rekey(); rekeyed != 1 || err != nil {
+		t.Fatalf("rekeyed %d, %v", rekeyed, err)
+	}
+	if rekeyed, _ := s.Rekey(); rekeyed != 0 {
+		t.Errorf("rekeyed %d again", rekeyed)
+	}
+	if entry, _ := s.readEntry("file"); entry.KeyID != "second" {
+		t.Errorf("entry under %q, want second", entry.KeyID)
+	}
+
+	// Only the new key is needed from here on
+	s.ring = newKeyring()
+	s.ring.Add("second", second, true)
+	if got, err := readSpooled(s, "file"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("after rotating: %d bytes, %v", len(got), err)
+	}
+
+	sealed, err = os.ReadFile(blobs.path("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)/2] ^= 1
+	for name, tampered := range map[string][]byte{
+		"flipped bit": flipped,
+		"truncated":   sealed[:len(sealed)-spoolSegmentSize/2],
+		// The 100 bytes of the final segment, its tag and its length
+		"last segment gone": sealed[:len(sealed)-(4+100+16)],
+	} {
+		if err := os.WriteFile(blobs.path("file"), tampered, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSpooled(s, "file"); !errors.Is(err, ErrSpoolCorrupt) {
+			t.Errorf("%s: got %v, want ErrSpoolCorrupt", name, err)
+		}
+	}
+}
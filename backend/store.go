@@ -0,0 +1,471 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// SessionRecord is what is remembered about an upload once it has ended.
+// It never contains file contents.
+type SessionRecord struct {
+	ID            string    `json:"id"`
+	Tenant        string    `json:"tenant,omitempty"` // API key ID, empty for sessions from the web UI
+	FileName      string    `json:"filename"`
+	FileType      string    `json:"filetype"`
+	FileSize      int64     `json:"filesize"`
+	ReceiverCount int       `json:"receiver_count"`
+	Notes         string    `json:"notes,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	EndedAt       time.Time `json:"ended_at"`
+
+	// How the transfers went, see history.go
+	CompletedCount    int    `json:"completed_count"`
+	AverageDurationMs int64  `json:"average_duration_ms,omitempty"`
+	Status            string `json:"status"`
+}
+
+// Ban blocks a subject (a client IP or a public key) from using the server.
+type Ban struct {
+	Subject   string    `json:"subject"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"` // zero means permanent
+}
+
+func (b Ban) Active(now time.Time) bool {
+	return b.ExpiresAt.IsZero() || now.Before(b.ExpiresAt)
+}
+
+// APIKey is a credential for the authenticated APIs. Only the SHA-256 of the
+// token is stored.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Daily quotas replacing the server's defaults when set, see quota.go
+	SessionsPerDay int64 `json:"sessions_per_day,omitempty"`
+	BytesPerDay    int64 `json:"bytes_per_day,omitempty"`
+}
+
+// Identity is a receiver that registered its public key so sessions can be
+// addressed to it. The channels are where it is told about new sessions.
+type Identity struct {
+	PublicKey     string    `json:"public_key"` // normalized base64
+	Name          string    `json:"name,omitempty"`
+	WebhookURL    string    `json:"webhook_url,omitempty"`
+	WebhookSecret string    `json:"webhook_secret,omitempty"` // signs webhook deliveries
+	Email         string    `json:"email,omitempty"`
+	Locale        string    `json:"locale,omitempty"` // BCP 47, see locale.go
+	CreatedAt     time.Time `json:"created_at"`
+
+	// Email is only mailed once its owner followed the confirmation link,
+	// whose token is kept as its SHA-256 until then.
+	EmailConfirmed bool   `json:"email_confirmed,omitempty"`
+	EmailToken     string `json:"email_token,omitempty"`
+}
+
+// Contact is an entry in an identity's contact book: someone it sends to,
+// or one of its own devices.
+type Contact struct {
+	Owner     string    `json:"owner"`
+	PublicKey string    `json:"public_key"`
+	Label     string    `json:"label,omitempty"`
+	Kind      string    `json:"kind"` // contact or device
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Room is a named channel sessions can be published into. Only the
+// SHA-256 of its key is stored.
+type Room struct {
+	Name      string    `json:"name"`
+	KeyHash   string    `json:"key_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type HistoryStore interface {
+	RecordSession(ctx context.Context, rec SessionRecord) error
+	// ListSessions returns the sessions of tenant, or of all for
+	// allTenants, that ended before the given time (any time when zero),
+	// newest first.
+	ListSessions(ctx context.Context, tenant string, before time.Time, limit int) ([]SessionRecord, error)
+}
+
+type BanStore interface {
+	AddBan(ctx context.Context, ban Ban) error
+	RemoveBan(ctx context.Context, subject string) error
+	GetBan(ctx context.Context, subject string) (Ban, error)
+	ListBans(ctx context.Context) ([]Ban, error)
+}
+
+type APIKeyStore interface {
+	PutAPIKey(ctx context.Context, key APIKey) error
+	DeleteAPIKey(ctx context.Context, id string) error
+	LookupAPIKey(ctx context.Context, hash string) (APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+}
+
+type IdentityStore interface {
+	PutIdentity(ctx context.Context, identity Identity) error
+	DeleteIdentity(ctx context.Context, publicKey string) error
+	GetIdentity(ctx context.Context, publicKey string) (Identity, error)
+}
+
+type ContactStore interface {
+	PutContact(ctx context.Context, contact Contact) error
+	DeleteContact(ctx context.Context, owner, publicKey string) error
+	GetContact(ctx context.Context, owner, publicKey string) (Contact, error)
+	ListContacts(ctx context.Context, owner string) ([]Contact, error)
+}
+
+type RoomStore interface {
+	PutRoom(ctx context.Context, room Room) error
+	GetRoom(ctx context.Context, name string) (Room, error)
+}
+
+// DeadLetterStore keeps webhook deliveries that ran out of attempts until
+// an admin redelivers or discards them.
+type DeadLetterStore interface {
+	PutDeadLetter(ctx context.Context, d WebhookDelivery) error
+	GetDeadLetter(ctx context.Context, id string) (WebhookDelivery, error)
+	ListDeadLetters(ctx context.Context) ([]WebhookDelivery, error) // oldest first
+	DeleteDeadLetter(ctx context.Context, id string) error
+}
+
+// EventStore is the append-only session event stream, see events.go.
+type EventStore interface {
+	AppendEvent(ctx context.Context, ev *Event) error // assigns ev.Seq
+	ListEvents(ctx context.Context, tenant string, after uint64, limit int) ([]Event, error)
+}
+
+type Store interface {
+	HistoryStore
+	BanStore
+	APIKeyStore
+	IdentityStore
+	ContactStore
+	RoomStore
+	DeadLetterStore
+	EventStore
+	Close() error
+}
+
+var store Store
+
+func openStore(c config) (Store, error) {
+	switch c.Store {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "bolt":
+		return openBoltStore(c.StorePath)
+	default:
+		return nil, fmt.Errorf("unknown store %q", c.Store)
+	}
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// isBanned reports whether subject has an active ban. Lookup failures are
+// logged and treated as not banned.
+func isBanned(ctx context.Context, subject string) bool {
+	ban, err := store.GetBan(ctx, subject)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Error("Could not look up ban", "subject", subject, "err", err)
+		}
+		return false
+	}
+	return ban.Active(time.Now())
+}
+
+type memoryStore struct {
+	mutex      sync.RWMutex
+	sessions   []SessionRecord
+	bans       map[string]Ban
+	keys       map[string]APIKey   // ID:APIKey
+	identities map[string]Identity // public key:Identity
+	contacts   map[string]Contact  // owner|public key:Contact
+	rooms      map[string]Room
+	dead       []WebhookDelivery
+	events     []Event
+	eventSeq   uint64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		bans:       make(map[string]Ban),
+		keys:       make(map[string]APIKey),
+		identities: make(map[string]Identity),
+		contacts:   make(map[string]Contact),
+		rooms:      make(map[string]Room),
+	}
+}
+
+// memoryHistoryLimit caps how many ended sessions the memory store keeps.
+const memoryHistoryLimit = 1000
+
+func (m *memoryStore) RecordSession(ctx context.Context, rec SessionRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sessions = append(m.sessions, rec)
+	if len(m.sessions) > memoryHistoryLimit {
+		m.sessions = m.sessions[len(m.sessions)-memoryHistoryLimit:]
+	}
+	return nil
+}
+
+func (m *memoryStore) ListSessions(ctx context.Context, tenant string, before time.Time, limit int) ([]SessionRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	out := make([]SessionRecord, 0, len(m.sessions))
+	for i := len(m.sessions) - 1; i >= 0; i-- {
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		rec := m.sessions[i]
+		if (tenant == allTenants || rec.Tenant == tenant) && (before.IsZero() || rec.EndedAt.Before(before)) {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStore) AddBan(ctx context.Context, ban Ban) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.bans[ban.Subject] = ban
+	return nil
+}
+
+func (m *memoryStore) RemoveBan(ctx context.Context, subject string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.bans, subject)
+	return nil
+}
+
+func (m *memoryStore) GetBan(ctx context.Context, subject string) (Ban, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ban, ok := m.bans[subject]
+	if !ok {
+		return Ban{}, ErrNotFound
+	}
+	return ban, nil
+}
+
+func (m *memoryStore) ListBans(ctx context.Context) ([]Ban, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	out := make([]Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		out = append(out, ban)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys[key.ID] = key
+	return nil
+}
+
+func (m *memoryStore) DeleteAPIKey(ctx context.Context, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.keys, id)
+	return nil
+}
+
+func (m *memoryStore) LookupAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, key := range m.keys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (m *memoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	out := make([]APIKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		out = append(out, key)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) PutIdentity(ctx context.Context, identity Identity) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.identities[identity.PublicKey] = identity
+	return nil
+}
+
+func (m *memoryStore) DeleteIdentity(ctx context.Context, publicKey string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.identities, publicKey)
+	return nil
+}
+
+func (m *memoryStore) GetIdentity(ctx context.Context, publicKey string) (Identity, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	identity, ok := m.identities[publicKey]
+	if !ok {
+		return Identity{}, ErrNotFound
+	}
+	return identity, nil
+}
+
+func contactKey(owner, publicKey string) string {
+	return owner + "|" + publicKey
+}
+
+func (m *memoryStore) PutContact(ctx context.Context, contact Contact) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.contacts[contactKey(contact.Owner, contact.PublicKey)] = contact
+	return nil
+}
+
+func (m *memoryStore) DeleteContact(ctx context.Context, owner, publicKey string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.contacts, contactKey(owner, publicKey))
+	return nil
+}
+
+func (m *memoryStore) GetContact(ctx context.Context, owner, publicKey string) (Contact, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	contact, ok := m.contacts[contactKey(owner, publicKey)]
+	if !ok {
+		return Contact{}, ErrNotFound
+	}
+	return contact, nil
+}
+
+func (m *memoryStore) ListContacts(ctx context.Context, owner string) ([]Contact, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var out []Contact
+	for _, contact := range m.contacts {
+		if contact.Owner == owner {
+			out = append(out, contact)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) PutRoom(ctx context.Context, room Room) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rooms[room.Name] = room
+	return nil
+}
+
+func (m *memoryStore) GetRoom(ctx context.Context, name string) (Room, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	room, ok := m.rooms[name]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	return room, nil
+}
+
+// memoryDeadLetterLimit caps how many dead letters the memory store keeps.
+const memoryDeadLetterLimit = 1000
+
+func (m *memoryStore) PutDeadLetter(ctx context.Context, d WebhookDelivery) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dead = append(m.dead, d)
+	if len(m.dead) > memoryDeadLetterLimit {
+		m.dead = m.dead[len(m.dead)-memoryDeadLetterLimit:]
+	}
+	return nil
+}
+
+func (m *memoryStore) GetDeadLetter(ctx context.Context, id string) (WebhookDelivery, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, d := range m.dead {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return WebhookDelivery{}, ErrNotFound
+}
+
+func (m *memoryStore) ListDeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return slices.Clone(m.dead), nil
+}
+
+func (m *memoryStore) DeleteDeadLetter(ctx context.Context, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dead = slices.DeleteFunc(m.dead, func(d WebhookDelivery) bool { return d.ID == id })
+	return nil
+}
+
+// memoryEventLimit caps how many events the memory store keeps. A
+// consumer further behind than that misses the oldest ones.
+const memoryEventLimit = 10000
+
+func (m *memoryStore) AppendEvent(ctx context.Context, ev *Event) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.eventSeq++
+	ev.Seq = m.eventSeq
+	m.events = append(m.events, *ev)
+	if len(m.events) > memoryEventLimit {
+		m.events = m.events[len(m.events)-memoryEventLimit:]
+	}
+	return nil
+}
+
+func (m *memoryStore) ListEvents(ctx context.Context, tenant string, after uint64, limit int) ([]Event, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	start, _ := slices.BinarySearchFunc(m.events, after+1, func(ev Event, seq uint64) int { return cmp.Compare(ev.Seq, seq) })
+	var out []Event
+	for _, ev := range m.events[start:] {
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		if tenant == allTenants || ev.Tenant == tenant {
+			out = append(out, ev)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStore) Close() error { return nil }
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketSessions   = []byte("sessions")
+	bucketBans       = []byte("bans")
+	bucketAPIKeys    = []byte("api_keys")
+	bucketAPIKeyHash = []byte("api_key_hashes") // hash:ID
+	bucketIdentities = []byte("identities")
+	bucketContacts   = []byte("contacts") // owner|public key:Contact
+	bucketRooms      = []byte("rooms")
+	bucketDead       = []byte("dead_letters") // failed at|ID:WebhookDelivery
+	bucketEvents     = []byte("events")       // seq:Event
+)
+
+// boltStore keeps history, events, bans, API keys, identities, contacts,
+// rooms and dead webhook deliveries in a single bbolt file, so a persistent deployment is still just one binary
+// and one data file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketSessions, bucketBans, bucketAPIKeys, bucketAPIKeyHash, bucketIdentities, bucketContacts, bucketRooms, bucketDead, bucketEvents} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// sessionKey orders records by end time so a reverse cursor walk yields the
+// newest sessions first.
+func sessionKey(rec SessionRecord) []byte {
+	key := make([]byte, 8, 8+len(rec.ID))
+	binary.BigEndian.PutUint64(key, uint64(rec.EndedAt.UnixNano()))
+	return append(key, rec.ID...)
+}
+
+func (s *boltStore) RecordSession(ctx context.Context, rec SessionRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Put(sessionKey(rec), data)
+	})
+}
+
+func (s *boltStore) ListSessions(ctx context.Context, tenant string, before time.Time, limit int) ([]SessionRecord, error) {
+	var out []SessionRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketSessions).Cursor()
+		k, v := c.Last()
+		if !before.IsZero() {
+			// Keys start with the end time, so seek just before it
+			var start [8]byte
+			binary.BigEndian.PutUint64(start[:], uint64(before.UnixNano()))
+			if k, v = c.Seek(start[:]); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil; k, v = c.Prev() {
+			if limit > 0 && len(out) == limit {
+				break
+			}
+			var rec SessionRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if tenant == allTenants || rec.Tenant == tenant {
+				out = append(out, rec)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) AddBan(ctx context.Context, ban Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Put([]byte(ban.Subject), data)
+	})
+}
+
+func (s *boltStore) RemoveBan(ctx context.Context, subject string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Delete([]byte(subject))
+	})
+}
+
+func (s *boltStore) GetBan(ctx context.Context, subject string) (Ban, error) {
+	var ban Ban
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketBans).Get([]byte(subject))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &ban)
+	})
+	return ban, err
+}
+
+func (s *boltStore) ListBans(ctx context.Context) ([]Ban, error) {
+	var out []Ban
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).ForEach(func(k, v []byte) error {
+			var ban Ban
+			if err := json.Unmarshal(v, &ban); err != nil {
+				return err
+			}
+			out = append(out, ban)
+			return nil
+		})
+	})
+	// ForEach walks them by ID, not in the order they were made
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, err
+}
+
+func (s *boltStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketAPIKeys).Put([]byte(key.ID), data); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketAPIKeyHash).Put([]byte(key.Hash), []byte(key.ID))
+	})
+}
+
+func (s *boltStore) DeleteAPIKey(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(bucketAPIKeys)
+		data := keys.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var key APIKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketAPIKeyHash).Delete([]byte(key.Hash)); err != nil {
+			return err
+		}
+		return keys.Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) LookupAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketAPIKeyHash).Get([]byte(hash))
+		if id == nil {
+			return ErrNotFound
+		}
+		data := tx.Bucket(bucketAPIKeys).Get(id)
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &key)
+	})
+	return key, err
+}
+
+func (s *boltStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var out []APIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAPIKeys).ForEach(func(k, v []byte) error {
+			var key APIKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			out = append(out, key)
+			return nil
+		})
+	})
+	// ForEach walks them by ID, not in the order they were made
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, err
+}
+
+func (s *boltStore) PutIdentity(ctx context.Context, identity Identity) error {
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketIdentities).Put([]byte(identity.PublicKey), data)
+	})
+}
+
+func (s *boltStore) DeleteIdentity(ctx context.Context, publicKey string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketIdentities).Delete([]byte(publicKey))
+	})
+}
+
+func (s *boltStore) GetIdentity(ctx context.Context, publicKey string) (Identity, error) {
+	var identity Identity
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketIdentities).Get([]byte(publicKey))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &identity)
+	})
+	return identity, err
+}
+
+func (s *boltStore) PutContact(ctx context.Context, contact Contact) error {
+	data, err := json.Marshal(contact)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketContacts).Put([]byte(contactKey(contact.Owner, contact.PublicKey)), data)
+	})
+}
+
+func (s *boltStore) DeleteContact(ctx context.Context, owner, publicKey string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketContacts).Delete([]byte(contactKey(owner, publicKey)))
+	})
+}
+
+func (s *boltStore) GetContact(ctx context.Context, owner, publicKey string) (Contact, error) {
+	var contact Contact
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketContacts).Get([]byte(contactKey(owner, publicKey)))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &contact)
+	})
+	return contact, err
+}
+
+func (s *boltStore) ListContacts(ctx context.Context, owner string) ([]Contact, error) {
+	var out []Contact
+	prefix := []byte(owner + "|")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketContacts).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var contact Contact
+			if err := json.Unmarshal(v, &contact); err != nil {
+				return err
+			}
+			out = append(out, contact)
+		}
+		return nil
+	})
+	// The cursor walks them by public key, not in the order they were made
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, err
+}
+
+func (s *boltStore) PutRoom(ctx context.Context, room Room) error {
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRooms).Put([]byte(room.Name), data)
+	})
+}
+
+func (s *boltStore) GetRoom(ctx context.Context, name string) (Room, error) {
+	var room Room
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketRooms).Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &room)
+	})
+	return room, err
+}
+
+// deadLetterKey orders dead letters by when they failed.
+func deadLetterKey(d WebhookDelivery) []byte {
+	key := make([]byte, 8, 8+len(d.ID))
+	binary.BigEndian.PutUint64(key, uint64(d.FailedAt.UnixNano()))
+	return append(key, d.ID...)
+}
+
+func (s *boltStore) PutDeadLetter(ctx context.Context, d WebhookDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDead).Put(deadLetterKey(d), data)
+	})
+}
+
+// findDeadLetter walks the bucket for id; dead letters are few enough
+// that a scan beats keeping a second index.
+func findDeadLetter(b *bolt.Bucket, id string) ([]byte, []byte) {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if string(k[8:]) == id {
+			return k, v
+		}
+	}
+	return nil, nil
+}
+
+func (s *boltStore) GetDeadLetter(ctx context.Context, id string) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, data := findDeadLetter(tx.Bucket(bucketDead), id)
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &d)
+	})
+	return d, err
+}
+
+func (s *boltStore) ListDeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	var out []WebhookDelivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDead).ForEach(func(k, v []byte) error {
+			var d WebhookDelivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			out = append(out, d)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (s *boltStore) DeleteDeadLetter(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDead)
+		key, _ := findDeadLetter(b, id)
+		if key == nil {
+			return nil
+		}
+		return b.Delete(key)
+	})
+}
+
+func (s *boltStore) AppendEvent(ctx context.Context, ev *Event) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketEvents)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		ev.Seq = seq
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		return b.Put(binary.BigEndian.AppendUint64(nil, seq), data)
+	})
+}
+
+func (s *boltStore) ListEvents(ctx context.Context, tenant string, after uint64, limit int) ([]Event, error) {
+	var out []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketEvents).Cursor()
+		for k, v := c.Seek(binary.BigEndian.AppendUint64(nil, after+1)); k != nil; k, v = c.Next() {
+			if limit > 0 && len(out) == limit {
+				break
+			}
+			var ev Event
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			if tenant == allTenants || ev.Tenant == tenant {
+				out = append(out, ev)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
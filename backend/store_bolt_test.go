@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBoltListOrder lists bans, API keys and contacts made in the reverse
+// order of their keys, which is how bbolt walks them.
+func TestBoltListOrder(t *testing.T) {
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	start := time.Now()
+	for i, id := range []string{"c", "b", "a"} {
+		at := start.Add(time.Duration(i) * time.Second)
+		if err := s.AddBan(ctx, Ban{Subject: id, CreatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutAPIKey(ctx, APIKey{ID: id, Hash: "hash-" + id, CreatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutContact(ctx, Contact{Owner: "owner", PublicKey: id, Kind: "contact", CreatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bans, err := s.ListBans(ctx)
+	if err != nil || len(bans) != 3 {
+		t.Fatalf("bans %+v, %v", bans, err)
+	}
+	keys, err := s.ListAPIKeys(ctx)
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("keys %+v, %v", keys, err)
+	}
+	contacts, err := s.ListContacts(ctx, "owner")
+	if err != nil || len(contacts) != 3 {
+		t.Fatalf("contacts %+v, %v", contacts, err)
+	}
+	for i, want := range []string{"c", "b", "a"} {
+		if bans[i].Subject != want || keys[i].ID != want || contacts[i].PublicKey != want {
+			t.Errorf("%d: ban %s, key %s, contact %s, want %s", i, bans[i].Subject, keys[i].ID, contacts[i].PublicKey, want)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// With a spool (-spool-dir or -blob-store) and -stored-max-bytes a host can
+// leave its file on the server for receivers who won't be online at the
+// same time. The host encrypts the file itself, as it would for any
+// transfer, and puts it with the host_token from upload_created:
+//
+//	PUT /api/upload/{id}/stored?ttl=72h   body is the encrypted file
+//
+// It gets back a stored ID, the download URL and a delete token. Until the
+// ttl runs out, whether or not the session is still around:
+//
+//	GET    /api/stored/{id}        the file, exactly as the host put it
+//	GET    /api/stored/{id}/info   the session's metadata and the expiry
+//	DELETE /api/stored/{id}        with the delete token as bearer
+//
+// Stored files live in the spool, whose sweeper removes them once they
+// expire. One can be up to -stored-max-bytes and all of them together up to
+// -stored-total-bytes. The server never sees the file's key, only the
+// ciphertext, and seals that again at rest like everything in the spool.
+// A host that sends a key of its own in a Sendmyzip-Storage-Key header (32
+// bytes, base64) has the data sealed with it rather than one the server
+// derives; the server keeps no copy, and downloads need the same header.
+// The info says so with key_required. Large files can be put with tus
+// instead, see tus.go.
+
+const defaultStoredTTL = 24 * time.Hour
+
+// storedInfo is what receivers can learn about a stored file.
+type storedInfo struct {
+	Metadata
+	ID          string    `json:"id"`
+	Size        int64     `json:"size"` // of the encrypted data
+	StoredAt    time.Time `json:"stored_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	KeyRequired bool      `json:"key_required,omitempty"`
+}
+
+// storedRecord is kept next to the data.
+type storedRecord struct {
+	storedInfo
+	DeleteTokenHash string  `json:"delete_token_hash"`
+	Parts           []int64 `json:"parts,omitempty"` // sizes, for files stored with tus
+}
+
+type storedFile struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	DeleteToken string    `json:"delete_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// storedReserved counts the bytes of puts still being written, which the
+// spool doesn't show yet.
+var storedReserved = struct {
+	mutex sync.Mutex
+	bytes int64
+}{}
+
+func storedName(id string) string {
+	return "stored-" + id
+}
+
+// storedPartName names part n of a file stored with tus.
+func storedPartName(id string, n int) string {
+	return storedName(id) + "." + strconv.Itoa(n)
+}
+
+// openStoredData returns the data of the stored file, key being the
+// client's storage key if it has one.
+func openStoredData(record storedRecord, key []byte) (io.ReadCloser, error) {
+	if len(record.Parts) == 0 {
+		return spool.Open(storedName(record.ID), blobKey{client: key})
+	}
+	first, err := spool.Open(storedPartName(record.ID, 0), blobKey{client: key})
+	if err != nil {
+		return nil, err
+	}
+	return &storedParts{id: record.ID, key: key, parts: len(record.Parts), next: 1, current: first}, nil
+}
+
+// deleteStoredData removes the data of a stored file with the given number
+// of parts, 0 for one that was put whole.
+func deleteStoredData(id string, parts int) {
+	if parts == 0 {
+		spool.Delete(storedName(id))
+	}
+	for n := range parts {
+		spool.Delete(storedPartName(id, n))
+	}
+}
+
+// storedParts reads the parts of a file stored with tus one after the
+// other.
+type storedParts struct {
+	id      string
+	key     []byte
+	parts   int
+	next    int
+	current io.ReadCloser
+	err     error
+}
+
+func (p *storedParts) Read(b []byte) (int, error) {
+	for p.err == nil {
+		n, err := p.current.Read(b)
+		if err != io.EOF || p.next == p.parts {
+			return n, err
+		}
+		p.current.Close()
+		p.current, p.err = spool.Open(storedPartName(p.id, p.next), blobKey{client: p.key})
+		p.next++
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, p.err
+}
+
+func (p *storedParts) Close() error {
+	if p.err != nil {
+		return nil // current failed to open
+	}
+	return p.current.Close()
+}
+
+// storageKey returns the key in r's Sendmyzip-Storage-Key header, nil
+// without one.
+func storageKey(r *http.Request) ([]byte, error) {
+	s := r.Header.Get("Sendmyzip-Storage-Key")
+	if s == "" {
+		return nil, nil
+	}
+	return parseClientKey(s)
+}
+
+// validStoredID reports whether id looks like one storeFile hands out.
+func validStoredID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// reserveStored makes room for size more bytes under -stored-total-bytes.
+func reserveStored(size int64) (bool, error) {
+	storedReserved.mutex.Lock()
+	defer storedReserved.mutex.Unlock()
+	if cfg.StoredTotalBytes > 0 {
+		used, err := spool.Usage()
+		if err != nil {
+			return false, err
+		}
+		if used+storedReserved.bytes+size > cfg.StoredTotalBytes {
+			return false, nil
+		}
+	}
+	storedReserved.bytes += size
+	return true, nil
+}
+
+func releaseStored(size int64) {
+	storedReserved.mutex.Lock()
+	storedReserved.bytes -= size
+	storedReserved.mutex.Unlock()
+}
+
+// storeRequest is a host's request to store a file of size bytes, whether
+// in one PUT or with tus (see tus.go).
+type storeRequest struct {
+	upload *Upload
+	size   int64
+	ttl    time.Duration
+	key    []byte // the client's storage key, nil without one
+}
+
+// parseStoreRequest checks the host's token, the ttl, the storage key and
+// the size, and reserves room for the file, which the caller releases. It
+// answers the request when something is wrong.
+func parseStoreRequest(w http.ResponseWriter, r *http.Request, size int64) (storeRequest, bool) {
+	upload, ok := lookupUpload(mux.Vars(r)["id"])
+	if !ok {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return storeRequest{}, false
+	}
+	if !upload.isHost(r) {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Only the host can store the file")
+		return storeRequest{}, false
+	}
+
+	req := storeRequest{upload: upload, size: size, ttl: min(defaultStoredTTL, cfg.StoredMaxTTL)}
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid ttl, use a duration like 72h")
+			return storeRequest{}, false
+		}
+		req.ttl = min(d, cfg.StoredMaxTTL)
+	}
+	key, err := storageKey(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid Sendmyzip-Storage-Key: "+err.Error())
+		return storeRequest{}, false
+	}
+	req.key = key
+
+	if size > cfg.StoredMaxBytes {
+		writeProblem(w, http.StatusRequestEntityTooLarge, problemFileTooLarge, "Stored files can be up to "+formatFileSize(cfg.StoredMaxBytes))
+		return storeRequest{}, false
+	}
+	ok, err = reserveStored(size)
+	if err != nil {
+		log.Error("Could not measure the spool", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+		return storeRequest{}, false
+	}
+	if !ok {
+		writeProblem(w, http.StatusInsufficientStorage, problemStorageFull, "")
+		return storeRequest{}, false
+	}
+	if !chargeIP(clientIP(r), size) {
+		releaseStored(size)
+		writeIPQuotaProblem(w)
+		return storeRequest{}, false
+	}
+	return req, true
+}
+
+// newStoredRecord describes the file of req as stored now, under id.
+func newStoredRecord(req storeRequest, id, deleteToken string) storedRecord {
+	now := time.Now()
+	req.upload.mutex.RLock()
+	defer req.upload.mutex.RUnlock()
+	return storedRecord{
+		storedInfo: storedInfo{
+			Metadata:  req.upload.Meta,
+			ID:        id,
+			Size:      req.size,
+			StoredAt:  now,
+			ExpiresAt: now.Add(req.ttl),
+
+			KeyRequired: req.key != nil,
+		},
+		DeleteTokenHash: hashAPIToken(deleteToken),
+	}
+}
+
+// saveStoredRecord puts the record next to the data, which makes the file
+// available.
+func saveStoredRecord(record storedRecord, session string) error {
+	data, _ := json.Marshal(record)
+	return spool.Put(storedName(record.ID)+".info", bytes.NewReader(data), time.Until(record.ExpiresAt), blobKey{session: session})
+}
+
+func storedFileFor(r *http.Request, id, deleteToken string, expiresAt time.Time) storedFile {
+	return storedFile{
+		ID:          id,
+		URL:         publicBaseURL(r) + "/api/stored/" + url.PathEscape(id),
+		DeleteToken: deleteToken,
+		ExpiresAt:   expiresAt,
+	}
+}
+
+// handleStoreFile is PUT /api/upload/{id}/stored.
+func handleStoreFile(w http.ResponseWriter, r *http.Request) {
+	size := r.ContentLength
+	switch {
+	case size < 0:
+		writeProblem(w, http.StatusLengthRequired, problemInvalidRequest, "Content-Length is required")
+		return
+	case size == 0:
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "The body is the encrypted file")
+		return
+	}
+	req, ok := parseStoreRequest(w, r, size)
+	if !ok {
+		return
+	}
+	defer releaseStored(size)
+	upload := req.upload
+	if !acquireRelaySlot(clientIP(r)) {
+		writeRelayLimitProblem(w)
+		return
+	}
+	defer releaseRelaySlot(clientIP(r))
+
+	id := generateReceiverID() + generateReceiverID()
+	deleteToken := generateReceiverID() + generateReceiverID()
+	record := newStoredRecord(req, id, deleteToken)
+
+	if err := spool.Put(storedName(id), r.Body, req.ttl, blobKey{session: upload.ID, client: req.key}); err != nil {
+		log.Error("Could not store file", "id", upload.ID, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store the file")
+		return
+	}
+	if err := saveStoredRecord(record, upload.ID); err != nil {
+		spool.Delete(storedName(id))
+		log.Error("Could not store file metadata", "id", upload.ID, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store the file")
+		return
+	}
+
+	log.Info("Stored file", "id", upload.ID, "stored_id", id, "bytes", size, "ttl", req.ttl)
+	recordEvent(upload, "file_stored", map[string]any{"stored_id": id, "bytes": size, "expires_at": record.ExpiresAt})
+	writeJSON(w, http.StatusCreated, storedFileFor(r, id, deleteToken, record.ExpiresAt))
+}
+
+// loadStored reads the record of the stored file r names, answering the
+// request when there is none.
+func loadStored(w http.ResponseWriter, r *http.Request) (storedRecord, bool) {
+	var record storedRecord
+	id := mux.Vars(r)["id"]
+	if !validStoredID(id) {
+		writeProblem(w, http.StatusNotFound, problemStoredNotFound, "")
+		return record, false
+	}
+	rc, err := spool.Open(storedName(id)+".info", blobKey{})
+	if err == nil {
+		err = json.NewDecoder(rc).Decode(&record)
+		rc.Close()
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeProblem(w, http.StatusNotFound, problemStoredNotFound, "")
+		return record, false
+	case errors.Is(err, ErrUnknownSpoolKey):
+		// Sealed with a key the server no longer has, such as one that
+		// didn't outlive a restart
+		log.Warn("Stored file sealed with an unknown key", "stored_id", id)
+		writeProblem(w, http.StatusNotFound, problemStoredNotFound, "")
+		return record, false
+	case err != nil:
+		log.Error("Could not read stored file metadata", "stored_id", id, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+		return record, false
+	}
+	return record, true
+}
+
+// handleGetStored is GET /api/stored/{id}.
+func handleGetStored(w http.ResponseWriter, r *http.Request) {
+	record, ok := loadStored(w, r)
+	if !ok {
+		return
+	}
+	key, err := storageKey(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid Sendmyzip-Storage-Key: "+err.Error())
+		return
+	}
+	if record.KeyRequired && key == nil {
+		writeProblem(w, http.StatusUnauthorized, problemStorageKeyRequired, "")
+		return
+	}
+	if !chargeIP(clientIP(r), record.Size) {
+		writeIPQuotaProblem(w)
+		return
+	}
+
+	rc, err := openStoredData(record, key)
+	if errors.Is(err, os.ErrNotExist) {
+		writeProblem(w, http.StatusNotFound, problemStoredNotFound, "")
+		return
+	}
+	if err != nil {
+		log.Error("Could not open stored file", "stored_id", record.ID, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+		return
+	}
+	defer rc.Close()
+
+	// The first segment shows whether the key is right, while there is
+	// still a status to say so with
+	data := bufio.NewReader(rc)
+	if _, err := data.Peek(1); err != nil && err != io.EOF {
+		if record.KeyRequired && errors.Is(err, ErrSpoolCorrupt) {
+			writeProblem(w, http.StatusForbidden, problemForbidden, "Wrong storage key")
+			return
+		}
+		log.Error("Could not read stored file", "stored_id", record.ID, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(record.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, data); err != nil {
+		log.Warn("Stored file download ended early", "stored_id", record.ID, "err", err)
+	}
+}
+
+// handleStoredInfo is GET /api/stored/{id}/info.
+func handleStoredInfo(w http.ResponseWriter, r *http.Request) {
+	record, ok := loadStored(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	info := record.storedInfo
+	info.Metadata = currentCaptions(info.Metadata)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleDeleteStored is DELETE /api/stored/{id}, for the holder of the
+// delete token.
+func handleDeleteStored(w http.ResponseWriter, r *http.Request) {
+	record, ok := loadStored(w, r)
+	if !ok {
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIToken(bearerToken(r))), []byte(record.DeleteTokenHash)) != 1 {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid delete token")
+		return
+	}
+	deleteStoredData(record.ID, len(record.Parts))
+	spool.Delete(storedName(record.ID) + ".info")
+	log.Info("Deleted stored file", "stored_id", record.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
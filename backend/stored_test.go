@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// storedServer serves the test server's sessions from a router with a
+// spool of its own, which stored files need.
+func storedServer(t *testing.T) string {
+	testServer(t)
+	blobs, err := newFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := newKeyring()
+	ring.Add("test", bytes.Repeat([]byte{7}, 32), true)
+	s, err := newSpool(blobs, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous, previousMax := spool, cfg.StoredMaxBytes
+	spool, cfg.StoredMaxBytes = s, 1<<20
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		server.Close()
+		spool, cfg.StoredMaxBytes = previous, previousMax
+	})
+	return server.URL
+}
+
+// openStoringHost creates a session and returns its ID and host token.
+func openStoringHost(t *testing.T) (string, string) {
+	host := dialTest(t, "/api/upload?filename=test.bin&filetype=application%2Foctet-stream&filesize=1024")
+	host.send(Message{Type: "hello", Payload: clientHello{Version: protocolMaxVersion}})
+	var created struct {
+		ID        string `json:"id"`
+		HostToken string `json:"host_token"`
+	}
+	host.await("upload_created", &created)
+	return created.ID, created.HostToken
+}
+
+// storedRequest sends a request with the token as bearer and header set.
+func storedRequest(t *testing.T, method, url, token string, body []byte, header map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func expectStatus(t *testing.T, what string, resp *http.Response, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s: got %s %s, want %d", what, resp.Status, body, status)
+	}
+}
+
+func expectStored(t *testing.T, base, id string, header map[string]string, data []byte) {
+	t.Helper()
+	resp := storedRequest(t, "GET", base+"/api/stored/"+id, "", nil, header)
+	expectStatus(t, "downloading", resp, http.StatusOK)
+	if got, err := io.ReadAll(resp.Body); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes, %v, want %d", len(got), err, len(data))
+	}
+}
+
+func TestStoredFile(t *testing.T) {
+	base := storedServer(t)
+	id, token := openStoringHost(t)
+	data := bytes.Repeat([]byte("ciphertext"), 10_000)
+
+	resp := storedRequest(t, "PUT", base+"/api/upload/"+id+"/stored", "", data, nil)
+	expectStatus(t, "storing without the host token", resp, http.StatusForbidden)
+	resp = storedRequest(t, "PUT", base+"/api/upload/"+id+"/stored", token, make([]byte, 1<<20+1), nil)
+	expectStatus(t, "storing too much", resp, http.StatusRequestEntityTooLarge)
+
+	resp = storedRequest(t, "PUT", base+"/api/upload/"+id+"/stored?ttl=1h", token, data, nil)
+	expectStatus(t, "storing", resp, http.StatusCreated)
+	var stored storedFile
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = storedRequest(t, "GET", base+"/api/stored/"+stored.ID+"/info", "", nil, nil)
+	expectStatus(t, "info", resp, http.StatusOK)
+	var info storedInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || info.Size != int64(len(data)) || info.FileName != "test.bin" {
+		t.Errorf("info %+v, %v", info, err)
+	}
+	expectStored(t, base, stored.ID, nil, data)
+
+	resp = storedRequest(t, "DELETE", base+"/api/stored/"+stored.ID, token, nil, nil)
+	expectStatus(t, "deleting with the host token", resp, http.StatusForbidden)
+	resp = storedRequest(t, "DELETE", base+"/api/stored/"+stored.ID, stored.DeleteToken, nil, nil)
+	expectStatus(t, "deleting", resp, http.StatusNoContent)
+	resp = storedRequest(t, "GET", base+"/api/stored/"+stored.ID, "", nil, nil)
+	expectStatus(t, "downloading after deleting", resp, http.StatusNotFound)
+}
+
+func TestStoredFileKey(t *testing.T) {
+	base := storedServer(t)
+	id, token := openStoringHost(t)
+	data := []byte("sealed with the host's key")
+	key := map[string]string{"Sendmyzip-Storage-Key": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))}
+	wrong := map[string]string{"Sendmyzip-Storage-Key": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))}
+
+	resp := storedRequest(t, "PUT", base+"/api/upload/"+id+"/stored", token, data, key)
+	expectStatus(t, "storing", resp, http.StatusCreated)
+	var stored storedFile
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = storedRequest(t, "GET", base+"/api/stored/"+stored.ID, "", nil, nil)
+	expectStatus(t, "downloading without the key", resp, http.StatusUnauthorized)
+	resp = storedRequest(t, "GET", base+"/api/stored/"+stored.ID, "", nil, wrong)
+	expectStatus(t, "downloading with another key", resp, http.StatusForbidden)
+	expectStored(t, base, stored.ID, key, data)
+}
+
+func TestTus(t *testing.T) {
+	base := storedServer(t)
+	id, token := openStoringHost(t)
+	data := bytes.Repeat([]byte("0123456789"), 20_000)
+	tus := map[string]string{"Tus-Resumable": tusVersion}
+
+	resp := storedRequest(t, "POST", base+"/api/upload/"+id+"/stored", token, nil, map[string]string{"Tus-Resumable": "0.2.2"})
+	expectStatus(t, "creating with another version", resp, http.StatusPreconditionFailed)
+	resp = storedRequest(t, "POST", base+"/api/upload/"+id+"/stored", token, nil, map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Upload-Length": strconv.Itoa(len(data)),
+	})
+	expectStatus(t, "creating", resp, http.StatusCreated)
+	var stored storedFile
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	location := resp.Header.Get("Location")
+
+	patch := func(offset int, body []byte) *http.Response {
+		return storedRequest(t, "PATCH", location, stored.DeleteToken, body, map[string]string{
+			"Tus-Resumable": tusVersion,
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		})
+	}
+	half := len(data) / 2
+	resp = patch(0, data[:half])
+	expectStatus(t, "first half", resp, http.StatusNoContent)
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.Itoa(half) {
+		t.Errorf("offset after the first half %s, want %d", got, half)
+	}
+
+	resp = storedRequest(t, "GET", base+"/api/stored/"+stored.ID, "", nil, nil)
+	expectStatus(t, "downloading half a file", resp, http.StatusNotFound)
+	resp = patch(0, data[half:])
+	expectStatus(t, "patching at the wrong offset", resp, http.StatusConflict)
+	resp = storedRequest(t, "HEAD", location, token, nil, tus)
+	expectStatus(t, "head with the host token", resp, http.StatusForbidden)
+	resp = storedRequest(t, "HEAD", location, stored.DeleteToken, nil, tus)
+	expectStatus(t, "head", resp, http.StatusOK)
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.Itoa(half) {
+		t.Errorf("head offset %s, want %d", got, half)
+	}
+
+	resp = patch(half, data[half:])
+	expectStatus(t, "second half", resp, http.StatusNoContent)
+	expectStored(t, base, stored.ID, nil, data)
+
+	// Done uploads are deleted as stored files
+	resp = storedRequest(t, "HEAD", location, stored.DeleteToken, nil, tus)
+	expectStatus(t, "head after completing", resp, http.StatusNotFound)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// certSource issues a fresh certificate and key.
+type certSource func(ctx context.Context) (*tls.Certificate, error)
+
+// reloadingCert holds a certificate that is swapped in place when renewed.
+// Listeners read it through GetCertificate, so renewals need no restart and
+// existing connections are unaffected.
+type reloadingCert struct {
+	name   string
+	source certSource
+	poll   time.Duration // upper bound between reloads, 0 for none
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+func newReloadingCert(ctx context.Context, name string, source certSource) (*reloadingCert, error) {
+	rc := &reloadingCert{name: name, source: source}
+	if err := rc.reload(ctx); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (rc *reloadingCert) reload(ctx context.Context) error {
+	cert, err := rc.source(ctx)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	rc.cert.Store(cert)
+	log.Info("Loaded certificate", "name", rc.name, "subject", cert.Leaf.Subject.CommonName, "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+func (rc *reloadingCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return rc.cert.Load(), nil
+}
+
+// renewAt is two thirds into the certificate's validity.
+func (rc *reloadingCert) renewAt() time.Time {
+	leaf := rc.cert.Load().Leaf
+	return leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+}
+
+func (rc *reloadingCert) runRenewer(ctx context.Context) {
+	for {
+		wait := time.Until(rc.renewAt())
+		if rc.poll > 0 && wait > rc.poll {
+			wait = rc.poll
+		}
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := rc.reload(ctx); err != nil {
+			log.Error("Could not renew certificate, retrying", "name", rc.name, "err", err)
+		}
+	}
+}
+
+// fileCertSource re-reads a PEM pair from disk, e.g. one kept fresh by an
+// external agent.
+func fileCertSource(certFile, keyFile string) certSource {
+	return func(context.Context) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		return &cert, err
+	}
+}
+
+type vaultPKIResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		CAChain     []string `json:"ca_chain"`
+		IssuingCA   string   `json:"issuing_ca"`
+	} `json:"data"`
+}
+
+// vaultCertSource issues certificates from a Vault PKI role, given as
+// "<mount>/issue/<role>".
+func vaultCertSource(vault *vaultClient, rolePath, commonName string, ttl time.Duration) certSource {
+	return func(ctx context.Context) (*tls.Certificate, error) {
+		var resp vaultPKIResponse
+		err := vault.do(ctx, "POST", rolePath, map[string]string{
+			"common_name": commonName,
+			"ttl":         ttl.String(),
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		chain := []string{resp.Data.Certificate}
+		if len(resp.Data.CAChain) > 0 {
+			chain = append(chain, resp.Data.CAChain...)
+		} else if resp.Data.IssuingCA != "" {
+			chain = append(chain, resp.Data.IssuingCA)
+		}
+
+		cert, err := tls.X509KeyPair([]byte(strings.Join(chain, "\n")), []byte(resp.Data.PrivateKey))
+		return &cert, err
+	}
+}
+
+var serverCert *reloadingCert // nil when serving plain HTTP
+
+// setupCertificates loads the TLS certificate from a file or Vault PKI
+// according to cfg, and starts its renewer.
+func setupCertificates(ctx context.Context, c config) error {
+	var vault *vaultClient
+	if c.VaultPKIRole != "" {
+		// Serving plain HTTP instead would go unnoticed
+		if c.TLSCommonName == "" {
+			return errors.New("-vault-pki-role needs -tls-cn for the certificate's common name")
+		}
+		var err error
+		vault, err = newVaultClient()
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch {
+	case c.VaultPKIRole != "":
+		serverCert, err = newReloadingCert(ctx, "tls", vaultCertSource(vault, c.VaultPKIRole, c.TLSCommonName, c.VaultPKITTL))
+	case c.TLSCert != "":
+		serverCert, err = newReloadingCert(ctx, "tls", fileCertSource(c.TLSCert, c.TLSKey))
+		if err == nil {
+			serverCert.poll = time.Hour
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if serverCert != nil {
+		go serverCert.runRenewer(ctx)
+	}
+	return nil
+}
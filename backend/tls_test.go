@@ -0,0 +1,13 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestVaultPKIRoleNeedsCommonName(t *testing.T) {
+	err := setupCertificates(context.Background(), config{VaultPKIRole: "pki/issue/sendmyzip"})
+	if err == nil || serverCert != nil {
+		t.Fatalf("got %v, certificate %v, want the server to refuse to start", err, serverCert)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The server picks the transport for each host/receiver pair and announces
+// it in a transport_plan message to both sides. The plan is redone whenever
+// a client reports that a transport failed, so a P2P attempt that can't get
+// through falls back instead of sitting there forever.
+//
+// Clients list what they support: hosts in the capabilities query parameter
+// on /api/upload, receivers in join_request. Clients that say nothing are
+// taken to only speak direct WebRTC.
+
+const (
+	transportInline = "inline"
+	transportP2P    = "p2p"
+	transportTURN   = "turn"
+	transportRelay  = "relay"
+	transportHTTP   = "http_relay"
+)
+
+// transportPreference is the order transports are tried in.
+var transportPreference = []string{transportInline, transportP2P, transportTURN, transportRelay, transportHTTP}
+
+type transportPlan struct {
+	ReceiverID string   `json:"receiver_id"`
+	Transport  string   `json:"transport"` // empty when nothing is left to try
+	Mandatory  bool     `json:"mandatory"`
+	Reason     string   `json:"reason"`
+	Fallbacks  []string `json:"fallbacks"`
+
+	// Set when a routing policy applies to the pair
+	Policies    []string `json:"policies,omitempty"`
+	RelayRegion string   `json:"relay_region,omitempty"`
+
+	ChunkSize int  `json:"chunk_size"` // advised data channel chunk size in bytes
+	LowPower  bool `json:"low_power,omitempty"`
+
+	// Set for transports that cost the server bandwidth, see estimate.go
+	Estimate        *transportEstimate `json:"estimate,omitempty"`
+	ConfirmRequired bool               `json:"confirm_required,omitempty"`
+}
+
+type iceOutcome struct {
+	ReceiverID string `json:"receiver_id"` // set by hosts, ignored from receivers
+	Transport  string `json:"transport"`
+	Success    bool   `json:"success"`
+}
+
+// p2pStats tracks how often direct connections work out across all
+// sessions. When most of them fail, e.g. because a lot of users sit behind
+// symmetric NATs, TURN is recommended up front.
+var p2pStats struct {
+	mutex       sync.Mutex
+	successRate float64 // smoothed, 1 when nothing has been observed
+	samples     int
+}
+
+func init() {
+	p2pStats.successRate = 1
+}
+
+func recordP2POutcome(success bool) {
+	sample := 0.0
+	if success {
+		sample = 1
+	}
+	p2pStats.mutex.Lock()
+	p2pStats.successRate = 0.05*sample + 0.95*p2pStats.successRate
+	p2pStats.samples++
+	p2pStats.mutex.Unlock()
+}
+
+func p2pLooksBroken() bool {
+	p2pStats.mutex.Lock()
+	defer p2pStats.mutex.Unlock()
+	return p2pStats.samples >= 20 && p2pStats.successRate < 0.5
+}
+
+// parseCapabilities turns "a,b" into a transport list.
+func parseCapabilities(s string) []string {
+	var caps []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+func supports(caps []string, transport string) bool {
+	if len(caps) == 0 {
+		return transport == transportP2P
+	}
+	return slices.Contains(caps, transport)
+}
+
+// serverSupports reports whether this server is configured for transport.
+func serverSupports(transport string) bool {
+	switch transport {
+	case transportInline:
+		return cfg.InlineMaxBytes > 0
+	case transportP2P:
+		return true
+	case transportRelay:
+		return cfg.Relay
+	case transportHTTP:
+		return cfg.HTTPRelay
+	default:
+		return false
+	}
+}
+
+// planTransport works out the transport for receiver. Caller holds
+// upload.mutex.
+func planTransport(upload *Upload, receiver *Receiver) transportPlan {
+	routing := upload.hostRouting.combine(receiver.routing)
+	mayRelay := ipMayRelay(upload.Host.clientIP())
+
+	var candidates []string
+	overQuota := false
+	for _, t := range transportPreference {
+		if !routing.allows(t) {
+			continue
+		}
+		if (t == transportRelay || t == transportHTTP) && !mayRelay {
+			overQuota = true
+			continue
+		}
+		if !serverSupports(t) || !supports(upload.hostCapabilities, t) || !supports(receiver.capabilities, t) {
+			continue
+		}
+		if slices.Contains(receiver.failedTransports, t) {
+			continue
+		}
+		if t == transportInline && upload.Meta.FileSize > cfg.InlineMaxBytes {
+			continue
+		}
+		candidates = append(candidates, t)
+	}
+
+	plan := transportPlan{
+		ReceiverID:  receiver.ID,
+		Mandatory:   cfg.TransportPolicy == "mandate" || len(routing.Rules) > 0,
+		Fallbacks:   []string{},
+		Policies:    routing.Rules,
+		RelayRegion: routing.RelayRegion,
+	}
+	if len(candidates) == 0 {
+		plan.Reason = "no_transport_left"
+		if overQuota {
+			plan.Reason = "ip_quota_exceeded"
+		}
+		return plan
+	}
+
+	plan.Transport, plan.Fallbacks = candidates[0], candidates[1:]
+	switch {
+	case plan.Transport == transportInline:
+		plan.Reason = "small_file"
+	case len(receiver.failedTransports) > 0:
+		plan.Reason = "fallback"
+	default:
+		plan.Reason = "preferred"
+	}
+
+	// Skip straight past P2P while it is failing for most users
+	if plan.Transport == transportP2P && len(plan.Fallbacks) > 0 && p2pLooksBroken() {
+		plan.Transport, plan.Fallbacks = plan.Fallbacks[0], append([]string{transportP2P}, plan.Fallbacks[1:]...)
+		plan.Reason = "p2p_unreliable"
+	}
+	if costsServer(plan.Transport) {
+		plan.Estimate = estimateTransport(upload, receiver, plan.Transport)
+		plan.ConfirmRequired = upload.Host != nil && upload.Host.understands(featureRelayConfirm)
+	}
+	return plan
+}
+
+// sendTransportPlan tells both ends of the pair which transport to use and
+// opens the relay when it goes through the server, unless the host is to
+// confirm it first.
+func sendTransportPlan(upload *Upload, receiver *Receiver) {
+	size := chunkSize(upload.hostConn(), receiver.currentConn())
+	upload.mutex.Lock()
+	plan := planTransport(upload, receiver)
+	receiver.unconfirmed = ""
+	if plan.ConfirmRequired {
+		receiver.unconfirmed = plan.Transport
+	}
+	upload.mutex.Unlock()
+	plan.ChunkSize, plan.LowPower = size, size == lowPowerChunkSize
+
+	msg := Message{Type: "transport_plan", Payload: plan}
+	receiver.send(msg)
+	sendToHost(upload, msg)
+	if !plan.ConfirmRequired {
+		startTransport(upload, receiver, plan.Transport, plan.ChunkSize)
+	}
+}
+
+// startTransport opens the relay for transports that go through the
+// server.
+func startTransport(upload *Upload, receiver *Receiver, transport string, chunkSize int) {
+	switch transport {
+	case transportRelay:
+		startRelay(upload, receiver, chunkSize)
+	case transportHTTP:
+		startHTTPRelay(upload, receiver, chunkSize)
+	}
+}
+
+// handleICEOutcome records a connection attempt. A failure rules the
+// transport out for the pair and produces a new plan.
+func handleICEOutcome(upload *Upload, msg Message, from *Receiver) {
+	var outcome iceOutcome
+	if err := decodePayload(msg, &outcome); err != nil {
+		if from != nil {
+			from.send(invalidPayload(msg, err))
+		} else {
+			sendToHost(upload, invalidPayload(msg, err))
+		}
+		return
+	}
+
+	receiver := from
+	if receiver == nil {
+		receiver = upload.findReceiver(outcome.ReceiverID)
+	}
+	if receiver == nil || !slices.Contains(transportPreference, outcome.Transport) {
+		return
+	}
+
+	if outcome.Transport == transportP2P {
+		recordP2POutcome(outcome.Success)
+	}
+	if outcome.Success {
+		return
+	}
+
+	upload.mutex.Lock()
+	if slices.Contains(receiver.failedTransports, outcome.Transport) {
+		// The other side already reported it
+		upload.mutex.Unlock()
+		return
+	}
+	receiver.failedTransports = append(receiver.failedTransports, outcome.Transport)
+	upload.mutex.Unlock()
+
+	sendTransportPlan(upload, receiver)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// With -turn-urls the server mints short-lived credentials for a coturn
+// server run with use-auth-secret, as in the TURN REST API draft: the
+// username is the expiry as a Unix time and an opaque user, the password
+// the base64 HMAC-SHA1 of the username keyed with the shared secret. The
+// secret is the turn secret (see secrets.go), decoded, and never leaves the
+// server; list every live version as static-auth-secret in coturn while
+// rotating.
+//
+// Each client finds a TURN server with its own credentials among the
+// ice_servers of upload_created and file_metadata. A transfer that outlasts
+// them can get fresh ones from /api/turn-credentials?session=<id>.
+
+var turnURLs []string
+
+type turnCredentials struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int64    `json:"ttl"` // seconds
+	URIs     []string `json:"uris"`
+}
+
+// parseTURNURLs reads the comma-separated URLs of -turn-urls.
+func parseTURNURLs(list string) ([]string, error) {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+			return nil, fmt.Errorf("%s: not a turn or turns URL", u)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// mintTURNCredentials returns credentials for user valid for -turn-ttl.
+func mintTURNCredentials(ctx context.Context, user string) (turnCredentials, error) {
+	secret, err := secrets.Current(ctx, secretTURN)
+	if err != nil {
+		return turnCredentials{}, err
+	}
+	username := fmt.Sprintf("%d:%s", time.Now().Add(cfg.TURNTTL).Unix(), user)
+	mac := hmac.New(sha1.New, secret.Value)
+	mac.Write([]byte(username))
+	return turnCredentials{
+		Username: username,
+		Password: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		TTL:      int64(cfg.TURNTTL.Seconds()),
+		URIs:     turnURLs,
+	}, nil
+}
+
+// iceServersFor returns the ICE servers for peer of upload, with a TURN
+// server minted for it when one is configured.
+func iceServersFor(ctx context.Context, upload *Upload, peer string) []iceServer {
+	if len(turnURLs) == 0 {
+		return iceServers
+	}
+	creds, err := mintTURNCredentials(ctx, upload.ID+"-"+peer)
+	if err != nil {
+		log.Error("Could not mint TURN credentials", "id", upload.ID, "err", err)
+		return iceServers
+	}
+	servers := append([]iceServer{}, iceServers...)
+	return append(servers, iceServer{URLs: creds.URIs, Username: creds.Username, Credential: creds.Password})
+}
+
+func handleTURNCredentials(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+	upload, ok := lookupUpload(id)
+	if !ok || upload.isClosed() {
+		writeProblem(w, http.StatusNotFound, problemUploadNotFound, "")
+		return
+	}
+
+	creds, err := mintTURNCredentials(r.Context(), id+"-"+generateReceiverID())
+	if err != nil {
+		log.Error("Could not mint TURN credentials", "id", id, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, creds)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// A stored file can also be put with the tus protocol (tus.io, version
+// 1.0.0 with the creation, expiration and termination extensions), so a
+// multi-gigabyte upload that loses its connection picks up at the last byte
+// the server has instead of starting over. The host creates the upload with
+// the same ttl and Sendmyzip-Storage-Key as for a PUT:
+//
+//	POST  /api/upload/{id}/stored?ttl=72h  Upload-Length: the file's size
+//	HEAD  /api/tus/{id}                    Upload-Offset says how far it got
+//	PATCH /api/tus/{id}                    appends the body at Upload-Offset
+//	DELETE /api/tus/{id}                   gives up on the upload
+//
+// The creation answers with the Location of the upload and, in the body,
+// the same stored ID, URL and delete token a PUT gets. The delete token is
+// the bearer for everything under /api/tus, so an upload can carry on after
+// the session has ended. Every PATCH is kept as a part of its own in the
+// spool, sealed like the rest, and what arrived of an interrupted PATCH is
+// kept too. Once the last byte is in, the file can be downloaded like one
+// that was put whole; until then it can't. An upload that never completes
+// is swept with its ttl.
+
+const tusVersion = "1.0.0"
+
+// tusState is kept next to the parts of an upload that has not completed.
+type tusState struct {
+	storedRecord
+	Session string `json:"session"`
+	KeyHash string `json:"key_hash,omitempty"` // of the storage key, every PATCH must send the same
+}
+
+func (s tusState) offset() int64 {
+	var offset int64
+	for _, size := range s.Parts {
+		offset += size
+	}
+	return offset
+}
+
+func tusStateName(id string) string {
+	return storedName(id) + ".tus"
+}
+
+func saveTusState(state tusState) error {
+	data, _ := json.Marshal(state)
+	return spool.Put(tusStateName(state.ID), bytes.NewReader(data), time.Until(state.ExpiresAt), blobKey{session: state.Session})
+}
+
+// tusAppending holds the uploads a PATCH is appending to.
+var tusAppending = struct {
+	mutex sync.Mutex
+	ids   map[string]bool
+}{ids: make(map[string]bool)}
+
+func lockTus(id string) bool {
+	tusAppending.mutex.Lock()
+	defer tusAppending.mutex.Unlock()
+	if tusAppending.ids[id] {
+		return false
+	}
+	tusAppending.ids[id] = true
+	return true
+}
+
+func unlockTus(id string) {
+	tusAppending.mutex.Lock()
+	delete(tusAppending.ids, id)
+	tusAppending.mutex.Unlock()
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusResumable answers requests for a version of tus other than ours.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	setTusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeProblem(w, http.StatusPreconditionFailed, problemInvalidRequest, "Only tus "+tusVersion+" is supported")
+		return false
+	}
+	return true
+}
+
+// handleTusOptions is OPTIONS on the creation and upload URLs, which tells
+// tus clients what the server supports.
+func handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.StoredMaxBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTusCreate is POST /api/upload/{id}/stored.
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Upload-Length must be the size of the encrypted file")
+		return
+	}
+	req, ok := parseStoreRequest(w, r, size)
+	if !ok {
+		return
+	}
+	// Only a check for now; each PATCH reserves what is left
+	releaseStored(size)
+
+	id := generateReceiverID() + generateReceiverID()
+	deleteToken := generateReceiverID() + generateReceiverID()
+	state := tusState{
+		storedRecord: newStoredRecord(req, id, deleteToken),
+		Session:      req.upload.ID,
+	}
+	if req.key != nil {
+		state.KeyHash = hashAPIToken(string(req.key))
+	}
+	if err := saveTusState(state); err != nil {
+		log.Error("Could not create tus upload", "id", req.upload.ID, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not create the upload")
+		return
+	}
+
+	log.Info("Created tus upload", "id", req.upload.ID, "stored_id", id, "bytes", size, "ttl", req.ttl)
+	w.Header().Set("Location", publicBaseURL(r)+"/api/tus/"+url.PathEscape(id))
+	w.Header().Set("Upload-Expires", state.ExpiresAt.UTC().Format(http.TimeFormat))
+	writeJSON(w, http.StatusCreated, storedFileFor(r, id, deleteToken, state.ExpiresAt))
+}
+
+// loadTus reads the state of the upload r names and checks the delete
+// token, answering the request when either is wrong.
+func loadTus(w http.ResponseWriter, r *http.Request) (tusState, bool) {
+	var state tusState
+	id := mux.Vars(r)["id"]
+	if !validStoredID(id) {
+		writeProblem(w, http.StatusNotFound, problemStoredNotFound, "")
+		return state, false
+	}
+	rc, err := spool.Open(tusStateName(id), blobKey{})
+	if err == nil {
+		err = json.NewDecoder(rc).Decode(&state)
+		rc.Close()
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrUnknownSpoolKey):
+		writeProblem(w, http.StatusNotFound, problemStoredNotFound, "")
+		return state, false
+	case err != nil:
+		log.Error("Could not read tus upload", "stored_id", id, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+		return state, false
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIToken(bearerToken(r))), []byte(state.DeleteTokenHash)) != 1 {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "Invalid delete token")
+		return state, false
+	}
+	w.Header().Set("Upload-Expires", state.ExpiresAt.UTC().Format(http.TimeFormat))
+	return state, true
+}
+
+// handleTusHead is HEAD /api/tus/{id}.
+func handleTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	state, ok := loadTus(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(state.offset(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(state.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusBody counts what a PATCH body gave before it ended, and turns a
+// broken connection into the end of the part so what arrived is kept.
+type tusBody struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (b *tusBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// handleTusPatch is PATCH /api/tus/{id}.
+func handleTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeProblem(w, http.StatusUnsupportedMediaType, problemInvalidRequest, "The body must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Upload-Offset is required")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if !lockTus(id) {
+		writeProblem(w, http.StatusLocked, problemUploadLocked, "")
+		return
+	}
+	defer unlockTus(id)
+
+	state, ok := loadTus(w, r)
+	if !ok {
+		return
+	}
+	if offset != state.offset() {
+		writeProblem(w, http.StatusConflict, problemOffsetMismatch, "The upload is at "+strconv.FormatInt(state.offset(), 10))
+		return
+	}
+	key, err := storageKey(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Invalid Sendmyzip-Storage-Key: "+err.Error())
+		return
+	}
+	if (key == nil) != (state.KeyHash == "") || (key != nil && hashAPIToken(string(key)) != state.KeyHash) {
+		writeProblem(w, http.StatusForbidden, problemForbidden, "The upload was created with another storage key")
+		return
+	}
+
+	remaining := state.Size - offset
+	ok, err = reserveStored(remaining)
+	if err != nil {
+		log.Error("Could not measure the spool", "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "")
+		return
+	}
+	if !ok {
+		writeProblem(w, http.StatusInsufficientStorage, problemStorageFull, "")
+		return
+	}
+	defer releaseStored(remaining)
+	if !acquireRelaySlot(clientIP(r)) {
+		writeRelayLimitProblem(w)
+		return
+	}
+	defer releaseRelaySlot(clientIP(r))
+
+	part := storedPartName(state.ID, len(state.Parts))
+	body := &tusBody{r: http.MaxBytesReader(w, r.Body, remaining)}
+	if err := spool.Put(part, body, time.Until(state.ExpiresAt), blobKey{session: state.Session, client: key}); err != nil {
+		spool.Delete(part)
+		log.Error("Could not store tus part", "stored_id", state.ID, "err", err)
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store the data")
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(body.err, &tooLarge) {
+		spool.Delete(part)
+		writeProblem(w, http.StatusRequestEntityTooLarge, problemFileTooLarge, "The body goes past Upload-Length")
+		return
+	}
+	if body.n == 0 {
+		spool.Delete(part)
+	} else {
+		state.Parts = append(state.Parts, body.n)
+		if err := saveTusState(state); err != nil {
+			spool.Delete(part)
+			log.Error("Could not save tus upload", "stored_id", state.ID, "err", err)
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store the data")
+			return
+		}
+	}
+	if body.err != nil {
+		log.Info("Tus upload interrupted", "stored_id", state.ID, "offset", state.offset(), "err", body.err)
+		return
+	}
+
+	if state.offset() == state.Size {
+		if err := completeTus(state); err != nil {
+			log.Error("Could not store file metadata", "stored_id", state.ID, "err", err)
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not store the file")
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(state.offset(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeTus makes the file of a finished upload available.
+func completeTus(state tusState) error {
+	if err := saveStoredRecord(state.storedRecord, state.Session); err != nil {
+		return err
+	}
+	spool.Delete(tusStateName(state.ID))
+
+	log.Info("Stored file", "id", state.Session, "stored_id", state.ID, "bytes", state.Size, "parts", len(state.Parts))
+	if upload, ok := lookupUpload(state.Session); ok {
+		recordEvent(upload, "file_stored", map[string]any{"stored_id": state.ID, "bytes": state.Size, "expires_at": state.ExpiresAt})
+	}
+	return nil
+}
+
+// handleTusDelete is DELETE /api/tus/{id}.
+func handleTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if !lockTus(id) {
+		writeProblem(w, http.StatusLocked, problemUploadLocked, "")
+		return
+	}
+	defer unlockTus(id)
+
+	state, ok := loadTus(w, r)
+	if !ok {
+		return
+	}
+	deleteStoredData(state.ID, len(state.Parts))
+	spool.Delete(tusStateName(state.ID))
+	log.Info("Deleted tus upload", "stored_id", state.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
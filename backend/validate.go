@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Messages from clients are decoded strictly: a payload with fields the
+// server doesn't know, or of the wrong shape, is answered with an error
+// message instead of being half-applied. The socket stays open, so a client
+// bug shows up in its console rather than as a transfer that never starts.
+
+// decodePayload decodes msg's payload into v, rejecting unknown fields.
+func decodePayload(msg Message, v any) error {
+	data, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", msg.Type, err)
+	}
+	return nil
+}
+
+func invalidPayload(msg Message, err error) Message {
+	return errorMessage(errCodeInvalidPayload, err.Error(), msg.Type)
+}
+
+func unknownType(msg Message) Message {
+	return errorMessage(errCodeUnknownType, fmt.Sprintf("unknown message type %q", msg.Type), msg.Type)
+}
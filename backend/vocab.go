@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Upload IDs double as join codes people read out and type, so the words
+// they are made of come from a vocabulary pack:
+//
+//	hex      0-9a-f, the default
+//	digits   0-9, for dictating over the phone
+//	en, da   short English or Danish words, joined with dashes
+//	animals  a themed English list
+//
+// -id-vocabulary picks the pack for the deployment and a host can ask for
+// another with ?vocabulary= when it creates its session. Each <name>.txt in
+// -id-vocabulary-dir adds a pack, or replaces a built-in one, with one word
+// per line; # starts a comment.
+//
+// How many words a code has is worked out for every session from the size
+// of the pack and the number of active sessions: enough for the -id-bytes
+// floor against guessing, and enough that a fresh code lands on a taken one
+// with odds no worse than one in 2^idCollisionMarginBits, so registerUpload
+// hardly ever has to draw again however busy the instance is.
+
+const idCollisionMarginBits = 20
+
+type idVocabulary struct {
+	Name      string
+	Separator string
+	words     []string
+}
+
+var (
+	vocabNamePattern = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+	vocabWordPattern = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+)
+
+var defaultVocabularies = map[string]string{
+	"hex":    "0 1 2 3 4 5 6 7 8 9 a b c d e f",
+	"digits": "0 1 2 3 4 5 6 7 8 9",
+	"en": `able acid aged also area army away baby back ball band bank base bath bear beat
+bell belt best bird blow blue boat body bone book boot born boss both bowl
+bulk burn bush busy cake calm came camp card care cart case cash cast cell
+chef chip city clay club coal coat code cold cook cool copy corn cost crew
+crop dark data dawn deal dear deep desk dial diet dirt dish dock door dose
+down draw drop drum duck dust duty earn ease east easy edge else even ever
+exit face fact fair fall farm fast fate fear feel file film find fine fire
+firm fish five flag flat flow folk food foot fork form fort four free frog
+fuel full fund gain game gate gear gift girl glad goal gold golf good grab
+gray grow gulf hair half hall hand hang hard harm hawk head heat help herb
+hero hill hint hold hole home hook hope horn host hour huge hunt idea inch
+iron item jazz join joke jump jury keen keep kind king kite knee knot lake
+lamp land lane last late lawn lead leaf lean left lens life lift lime line
+link lion list load loan lock long loop lord loud love luck mail main mall
+malt many map mark mask mass meal meat mild milk mill mind mint mode moon`,
+	"da": `aben alle arm bad bag bil bjerg blad blomst bog bold bord bro brod by
+dag dal dame dans dor due dyr eg elv eng fad fag fisk fjer flag fly fod
+fugl gade gang gave glas gran gren gul hal hane hat have hest hjem hop hule
+hus hval ild is jord kage kam kat kirke klit ko kop kort krone kugle kyst
+lam land lys mad mark mel mose mus nat net ni nord ost pil pind pude rad
+regn ring ris ro rose sal salt sand sej sko skov sky slot smor sne sol sten
+stol strand sti sukker syd tag tal tog tromme trae tun ur uge ugle vand vej
+vest vind vin`,
+	"animals": `ant ape bat bear bee bison boar cat clam cod colt cow crab crane crow
+deer dog dove duck eagle eel elk emu ferret finch fox frog gecko gnu goat
+goose hare hawk heron horse ibis jay koala lamb lark lemur lion llama lynx
+mole moose moth mouse mule newt otter owl ox panda pig puma quail rabbit
+rat raven seal shark sheep skunk sloth snail swan tiger toad trout wasp
+whale wolf wren yak zebra`,
+}
+
+// vocabularies are the packs by name; cfg.IDVocabulary is one of them.
+var vocabularies map[string]*idVocabulary
+
+// loadVocabularies builds the packs from the built-in lists and dir.
+func loadVocabularies(dir string) (map[string]*idVocabulary, error) {
+	packs := make(map[string]*idVocabulary)
+	for name, words := range defaultVocabularies {
+		v, err := newVocabulary(name, strings.Fields(words))
+		if err != nil {
+			return nil, err
+		}
+		packs[name] = v
+	}
+	if dir == "" {
+		return packs, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var words []string
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			if line = strings.ToLower(strings.TrimSpace(line)); line != "" {
+				words = append(words, line)
+			}
+		}
+		v, err := newVocabulary(strings.TrimSuffix(filepath.Base(file), ".txt"), words)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		packs[v.Name] = v
+	}
+	return packs, nil
+}
+
+// newVocabulary checks words and drops duplicates. Packs of single
+// characters are joined without a separator.
+func newVocabulary(name string, words []string) (*idVocabulary, error) {
+	if !vocabNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid vocabulary name %q", name)
+	}
+	sort.Strings(words)
+	words = slices.Compact(words)
+	if len(words) < 2 {
+		return nil, fmt.Errorf("vocabulary %s needs at least two distinct words", name)
+	}
+	separator := ""
+	for _, word := range words {
+		if !vocabWordPattern.MatchString(word) {
+			return nil, fmt.Errorf("vocabulary %s: %q is not 1-16 lowercase letters or digits", name, word)
+		}
+		if len(word) > 1 {
+			separator = "-"
+		}
+	}
+	return &idVocabulary{Name: name, Separator: separator, words: words}, nil
+}
+
+// vocabularyFor returns the pack named name, or the deployment's for "".
+func vocabularyFor(name string) (*idVocabulary, bool) {
+	if name == "" {
+		name = cfg.IDVocabulary
+	}
+	v, ok := vocabularies[name]
+	return v, ok
+}
+
+// codeLength returns how many words a code drawn from v needs with active
+// sessions running.
+func (v *idVocabulary) codeLength(active int) int {
+	bits := math.Max(float64(cfg.IDBytes*8), math.Log2(float64(active+1))+idCollisionMarginBits)
+	return int(math.Ceil(bits / math.Log2(float64(len(v.words)))))
+}
+
+// draw returns a random code of n words.
+func (v *idVocabulary) draw(n int) (string, error) {
+	size := big.NewInt(int64(len(v.words)))
+	code := make([]string, n)
+	for i := range code {
+		k, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		code[i] = v.words[k.Int64()]
+	}
+	return strings.Join(code, v.Separator), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// A receiver is waiting from the moment it is admitted until it has
+// something to start the transfer with: a webrtc_offer or the inline file.
+// When that takes longer than -receiver-wait-alert the host is probably
+// asleep or its client stuck, so the host gets a receiver_waiting alert, the
+// session webhook is told, and the wait is counted in the admin stats.
+
+// waitSampleLimit is how many recent waits the percentiles are taken over.
+const waitSampleLimit = 1024
+
+type waitStats struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	next    int
+	served  int64
+	alerts  int64
+}
+
+var receiverWaits waitStats
+
+func (s *waitStats) observe(wait time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.served++
+	if len(s.samples) < waitSampleLimit {
+		s.samples = append(s.samples, wait)
+		return
+	}
+	s.samples[s.next] = wait
+	s.next = (s.next + 1) % waitSampleLimit
+}
+
+func (s *waitStats) alert() {
+	s.mutex.Lock()
+	s.alerts++
+	s.mutex.Unlock()
+}
+
+type waitSummary struct {
+	Served      int64 `json:"served"`
+	Alerts      int64 `json:"alerts"`
+	ThresholdMs int64 `json:"threshold_ms"`
+	P50Ms       int64 `json:"p50_ms"`
+	P95Ms       int64 `json:"p95_ms"`
+	MaxMs       int64 `json:"max_ms"`
+}
+
+func (s *waitStats) summary() waitSummary {
+	s.mutex.Lock()
+	sorted := slices.Clone(s.samples)
+	summary := waitSummary{Served: s.served, Alerts: s.alerts, ThresholdMs: cfg.ReceiverWaitAlert.Milliseconds()}
+	s.mutex.Unlock()
+
+	if len(sorted) == 0 {
+		return summary
+	}
+	slices.Sort(sorted)
+	at := func(q float64) int64 {
+		return sorted[int(math.Ceil(q*float64(len(sorted))))-1].Milliseconds()
+	}
+	summary.P50Ms = at(0.5)
+	summary.P95Ms = at(0.95)
+	summary.MaxMs = sorted[len(sorted)-1].Milliseconds()
+	return summary
+}
+
+// startWaitClock starts timing receiver, which was just admitted.
+func startWaitClock(upload *Upload, receiver *Receiver) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	receiver.admittedAt = time.Now()
+	if cfg.ReceiverWaitAlert > 0 {
+		receiver.waitTimer = time.AfterFunc(cfg.ReceiverWaitAlert, func() { alertReceiverWaiting(upload, receiver) })
+	}
+}
+
+// stopWaitClock stops the alert for a receiver that left.
+func stopWaitClock(upload *Upload, receiver *Receiver) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	if receiver.waitTimer != nil {
+		receiver.waitTimer.Stop()
+	}
+}
+
+// receiverServed records that receiver was handed an offer or the file.
+func receiverServed(upload *Upload, receiver *Receiver) {
+	upload.mutex.Lock()
+	if receiver.served || receiver.admittedAt.IsZero() {
+		upload.mutex.Unlock()
+		return
+	}
+	receiver.served = true
+	if receiver.waitTimer != nil {
+		receiver.waitTimer.Stop()
+	}
+	wait := time.Since(receiver.admittedAt)
+	upload.mutex.Unlock()
+
+	receiverWaits.observe(wait)
+}
+
+func alertReceiverWaiting(upload *Upload, receiver *Receiver) {
+	upload.mutex.RLock()
+	waiting := !receiver.served && slices.Contains(upload.Receivers, receiver)
+	wait := time.Since(receiver.admittedAt)
+	upload.mutex.RUnlock()
+	if !waiting {
+		return
+	}
+
+	receiverWaits.alert()
+	log.Warn("Receiver is still waiting for an offer", "id", upload.ID, "receiver", receiver.ID, "wait", wait)
+
+	alert := map[string]any{
+		"receiver_id": receiver.ID,
+		"name":        receiver.Name,
+		"waiting_ms":  wait.Milliseconds(),
+	}
+	sendToHost(upload, Message{Type: "receiver_waiting", Payload: alert})
+	recordEvent(upload, "receiver_waiting", alert)
+	notifySessionWebhook(upload, "receiver_waiting", alert)
+}
+
+type adminStats struct {
+	ReceiverWait waitSummary     `json:"receiver_wait"`
+	Feedback     feedbackSummary `json:"feedback"`
+	UploadIDs    idSummary       `json:"upload_ids"`
+	Relay        relayStats      `json:"relay"`
+	HTTPRelay    relayStats      `json:"http_relay"`
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, adminStats{
+		ReceiverWait: receiverWaits.summary(),
+		Feedback:     receiverFeedback.summary(),
+		UploadIDs:    uploadIDStats.summary(),
+		Relay:        relaySummary(),
+		HTTPRelay:    httpRelaySummary(),
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// Webhook deliveries are signed with the target's own secret and retried
+// with exponential backoff and jitter. Every request carries
+//
+//	Sendmyzip-Event:     the event type
+//	Sendmyzip-Delivery:  an ID that stays the same across retries
+//	Sendmyzip-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// so receivers can check authenticity, reject replays and drop duplicates.
+// A delivery that keeps failing, or is refused with a 4xx other than 408
+// and 429, ends up in the dead-letter list on the admin API, from where it
+// can be sent again.
+//
+// Besides the webhooks of published sessions and identities, an operator
+// can have session lifecycle events pushed to their own systems with
+// -webhook-url, signed with -webhook-secret. Each delivery is the event as
+// GET /api/events has it, for the types in -webhook-events.
+//
+// Published sessions and identities name their own webhook URLs, so those
+// deliveries only ever connect to public addresses: the check is made on
+// the address being dialed, redirects and DNS answers that change after
+// registration included. Only the operator's own targets, -webhook-url
+// and the chat webhooks, may be internal.
+
+const webhookBaseBackoff = 2 * time.Second
+
+// defaultWebhookEvents are the event types -webhook-url gets unless
+// -webhook-events says otherwise.
+const defaultWebhookEvents = "session_created,receiver_joined,transfer_completed,session_expired"
+
+// WebhookDelivery is one event on its way to one target.
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Secret    string          `json:"secret"`
+	Event     string          `json:"event"`
+	Body      json.RawMessage `json:"body"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	FailedAt  time.Time       `json:"failed_at,omitzero"`
+}
+
+// deadLetterView is a dead letter as the admin API shows it, without the
+// secret.
+type deadLetterView struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Event     string          `json:"event"`
+	Body      json.RawMessage `json:"body"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	FailedAt  time.Time       `json:"failed_at"`
+}
+
+// errPermanent marks a response retrying won't fix.
+var errPermanent = errors.New("rejected by target")
+
+// errPrivateTarget refuses a connection to an address that isn't public.
+var errPrivateTarget = errors.New("target address is not public")
+
+// webhookClient delivers to the URLs that come from clients. It doesn't
+// use a proxy, so the address it checks is the target's.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: publicOnly}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// publicOnly is a dialer Control refusing loopback, private, link-local,
+// multicast and unspecified addresses.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("%w: %s", errPrivateTarget, ip)
+	}
+	return nil
+}
+
+// operatorWebhook reports whether url is one of the operator's own
+// targets, which may be on the internal network.
+func operatorWebhook(url string) bool {
+	return url == cfg.SlackWebhook || url == cfg.DiscordWebhook ||
+		slices.Contains(parseCapabilities(cfg.WebhookURLs), url)
+}
+
+func newWebhookSecret() string {
+	return "whsec_" + generateReceiverID() + generateReceiverID()
+}
+
+// sendWebhook queues payload for url, signed with secret.
+func sendWebhook(url, secret, event string, payload any) {
+	if cfg.Local {
+		log.Debug("Not sending webhook in local mode", "event", event)
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Error("Could not encode webhook", "event", event, "err", err)
+		return
+	}
+	d := &WebhookDelivery{
+		ID:        generateReceiverID() + generateReceiverID(),
+		URL:       url,
+		Secret:    secret,
+		Event:     event,
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+	go attemptDelivery(d)
+}
+
+// notifyEventWebhooks sends ev to the -webhook-url targets if they
+// subscribed to its type.
+func notifyEventWebhooks(ev Event) {
+	if cfg.WebhookURLs == "" || !slices.Contains(parseCapabilities(cfg.WebhookEvents), ev.Type) {
+		return
+	}
+	for _, url := range parseCapabilities(cfg.WebhookURLs) {
+		sendWebhook(url, cfg.WebhookSecret, ev.Type, ev)
+	}
+}
+
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func postWebhook(d *WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Sendmyzip-Event", d.Event)
+	req.Header.Set("Sendmyzip-Delivery", d.ID)
+	req.Header.Set("Sendmyzip-Attempt", strconv.Itoa(d.Attempts))
+	req.Header.Set("Sendmyzip-Signature", signWebhook(d.Secret, time.Now().Unix(), d.Body))
+
+	client := webhookClient
+	if operatorWebhook(d.URL) {
+		client = notifyClient
+	}
+	resp, err := client.Do(req)
+	if errors.Is(err, errPrivateTarget) {
+		return fmt.Errorf("%w: %w", errPermanent, err)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("target answered %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: %s", errPermanent, resp.Status)
+	}
+}
+
+// webhookBackoff is the wait before the next attempt: exponential in the
+// attempts so far, capped, with half of it random.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookBaseBackoff << min(attempts-1, 20)
+	d = min(d, cfg.WebhookMaxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+func attemptDelivery(d *WebhookDelivery) {
+	d.Attempts++
+	err := postWebhook(d)
+	if err == nil {
+		return
+	}
+	d.LastError = err.Error()
+
+	if errors.Is(err, errPermanent) || d.Attempts >= cfg.WebhookMaxAttempts {
+		d.FailedAt = time.Now()
+		log.Warn("Webhook delivery failed for good", "id", d.ID, "url", d.URL, "event", d.Event, "attempts", d.Attempts, "err", err)
+		if err := store.PutDeadLetter(context.Background(), *d); err != nil {
+			log.Error("Could not store dead letter", "id", d.ID, "err", err)
+		}
+		return
+	}
+
+	wait := webhookBackoff(d.Attempts)
+	log.Info("Webhook delivery failed, retrying", "id", d.ID, "url", d.URL, "attempt", d.Attempts, "in", wait, "err", err)
+	time.AfterFunc(wait, func() { attemptDelivery(d) })
+}
+
+func handleAdminListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := store.ListDeadLetters(r.Context())
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not list dead letters")
+		return
+	}
+	views := make([]deadLetterView, len(letters))
+	for i, d := range letters {
+		views[i] = deadLetterView{
+			ID:        d.ID,
+			URL:       d.URL,
+			Event:     d.Event,
+			Body:      d.Body,
+			Attempts:  d.Attempts,
+			LastError: d.LastError,
+			CreatedAt: d.CreatedAt,
+			FailedAt:  d.FailedAt,
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleAdminRedeliver takes a dead letter off the list and starts its
+// delivery over, with a fresh set of attempts.
+func handleAdminRedeliver(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	d, err := store.GetDeadLetter(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, http.StatusNotFound, problemDeadLetterNotFound, "")
+		return
+	}
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not load dead letter")
+		return
+	}
+	if err := store.DeleteDeadLetter(r.Context(), id); err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not remove dead letter")
+		return
+	}
+
+	log.Info("Redelivering webhook", "id", id, "url", d.URL)
+	d.Attempts = 0
+	d.LastError = ""
+	d.FailedAt = time.Time{}
+	go attemptDelivery(&d)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleAdminDeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if err := store.DeleteDeadLetter(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeProblem(w, http.StatusInternalServerError, problemInternal, "Could not delete dead letter")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// checkSignature verifies a Sendmyzip-Signature header the way a receiver
+// of the webhook would.
+func checkSignature(header, secret string, body []byte) error {
+	ts, mac, ok := strings.Cut(strings.TrimPrefix(header, "t="), ",v1=")
+	if !ok {
+		return fmt.Errorf("malformed signature %q", header)
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts + "."))
+	h.Write(body)
+	if want := hex.EncodeToString(h.Sum(nil)); !hmac.Equal([]byte(mac), []byte(want)) {
+		return fmt.Errorf("signature %s, want %s", mac, want)
+	}
+	return nil
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"type":"session_offer"}`)
+	sig := signWebhook("whsec_test", 1700000000, body)
+	if !strings.HasPrefix(sig, "t=1700000000,v1=") {
+		t.Fatalf("signature %q", sig)
+	}
+	if err := checkSignature(sig, "whsec_test", body); err != nil {
+		t.Fatal(err)
+	}
+	for name, other := range map[string]string{
+		"other secret": signWebhook("whsec_other", 1700000000, body),
+		"other time":   signWebhook("whsec_test", 1700000001, body),
+		"other body":   signWebhook("whsec_test", 1700000000, []byte(`{}`)),
+	} {
+		if other[strings.Index(other, "v1="):] == sig[strings.Index(sig, "v1="):] {
+			t.Errorf("%s: same MAC", name)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts := 1; attempts <= 40; attempts++ {
+		ceiling := min(webhookBaseBackoff<<min(attempts-1, 20), cfg.WebhookMaxBackoff)
+		for range 50 {
+			if d := webhookBackoff(attempts); d < ceiling/2 || d > ceiling {
+				t.Fatalf("attempt %d: waited %v, want between %v and %v", attempts, d, ceiling/2, ceiling)
+			}
+		}
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	testServer(t)
+	var delivered *http.Request
+	var deliveredBody []byte
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Sendmyzip-Delivery") != "delivery" {
+			return // an event from another test
+		}
+		delivered = r
+		deliveredBody, _ = io.ReadAll(r.Body)
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+	}))
+	defer target.Close()
+
+	// Loopback is only reachable for the operator's own targets
+	previous := cfg.WebhookURLs
+	var urls []string
+	for _, status := range []int{200, 408, 429, 500, 404, 410} {
+		urls = append(urls, target.URL+"/"+strconv.Itoa(status))
+	}
+	cfg.WebhookURLs = strings.Join(urls, ",")
+	t.Cleanup(func() { cfg.WebhookURLs = previous })
+
+	for _, tt := range []struct {
+		status    int
+		err       bool
+		permanent bool
+	}{
+		{200, false, false},
+		{408, true, false},
+		{429, true, false},
+		{500, true, false},
+		{404, true, true},
+		{410, true, true},
+	} {
+		d := &WebhookDelivery{
+			ID:       "delivery",
+			URL:      target.URL + "/" + strconv.Itoa(tt.status),
+			Secret:   "whsec_test",
+			Event:    "session_offer",
+			Body:     []byte(`{"type":"session_offer"}`),
+			Attempts: 2,
+		}
+		delivered = nil
+		err := postWebhook(d)
+		if (err != nil) != tt.err || errors.Is(err, errPermanent) != tt.permanent {
+			t.Errorf("%d: got %v, want error %v, permanent %v", tt.status, err, tt.err, tt.permanent)
+		}
+		if delivered == nil {
+			t.Fatalf("%d: nothing delivered", tt.status)
+		}
+		if got := delivered.Header.Get("Sendmyzip-Event"); got != "session_offer" {
+			t.Errorf("%d: event %q", tt.status, got)
+		}
+		if got := delivered.Header.Get("Sendmyzip-Attempt"); got != "2" {
+			t.Errorf("%d: attempt %q", tt.status, got)
+		}
+		if err := checkSignature(delivered.Header.Get("Sendmyzip-Signature"), d.Secret, deliveredBody); err != nil {
+			t.Errorf("%d: %v", tt.status, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// Errors on a WebSocket are reported with an error message:
+//
+//	{"type": "error", "payload": {"code": "session_full", "message": "...", "retryable": true}}
+//
+// Codes are stable and shared with the REST problem codes where the two
+// overlap, so clients can branch on them and show their own text. Retryable
+// tells the client whether trying again (later, or with a passphrase) can
+// succeed.
+//
+// Before protocol version 2 join failures were announced with join_rejected
+// or kicked instead, and clients that haven't negotiated version 2 still get
+// those, see compat.go.
+
+// Codes sent in error messages that have no REST counterpart.
+const (
+	errCodeInvalidJSON        = "invalid_json"
+	errCodeInvalidPayload     = "invalid_payload"
+	errCodeUnknownType        = "unknown_type"
+	errCodeUnexpectedMessage  = "unexpected_message"
+	errCodeUnsupportedVersion = "unsupported_version"
+	errCodeIdentityRequired   = "identity_required"
+
+	errCodeEncryptionKeyRequired = "encryption_key_required"
+)
+
+var retryableErrors = map[string]bool{
+	problemSessionFull:      true,
+	problemPasswordRequired: true,
+	problemRateLimited:      true,
+	problemDraining:         true,
+}
+
+// wsError is the payload of an error message.
+type wsError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	Type      string `json:"type,omitempty"` // type of the message it is about
+}
+
+func errorMessage(code, message, msgType string) Message {
+	return Message{Type: "error", Payload: wsError{
+		Code:      code,
+		Message:   message,
+		Retryable: retryableErrors[code],
+		Type:      msgType,
+	}}
+}
+
+// rejectJoin tells a receiver why it was turned away.
+func rejectJoin(conn *wsConn, code, message string) {
+	conn.WriteJSON(errorMessage(code, message, "join_request"))
+}
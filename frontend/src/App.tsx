@@ -7,6 +7,7 @@ import {
   applyRemoteAnswer,
   addIceCandidate,
   closeConnections,
+  setIceServers,
 } from './webrtc'
 import * as QRCode from 'qrcode'
 
@@ -14,10 +15,11 @@ interface FileMetadata {
   filename: string
   filetype: string
   filesize: number
+  ice_servers?: RTCIceServer[]
 }
 
 type ServerMessage =
-  | { type: 'upload_created'; payload: { id: string } }
+  | { type: 'upload_created'; payload: { id: string; ice_servers?: RTCIceServer[] } }
   | { type: 'receivers_update'; payload: Array<{ id: string; name?: string; connected_at?: string }> }
   | { type: 'webrtc_answer'; payload: { answer: RTCSessionDescriptionInit } }
   | { type: 'webrtc_ice_candidate'; payload: { candidate: RTCIceCandidateInit } }
@@ -147,6 +149,7 @@ function App() {
       switch (message.type) {
         case 'upload_created': {
           const url = `${window.location.origin}/?code=${message.payload.id}`
+          setIceServers(message.payload.ice_servers)
           setUploadId(message.payload.id)
           setShareLink(url)
           try {
@@ -242,10 +245,8 @@ function App() {
         wsRef.current.send(
           JSON.stringify({
             type: 'webrtc_ice_candidate',
-            payload: {
-              candidate,
-              peer_id: receiverIdRef.current ?? 'receiver_id',
-            },
+            to: receiverIdRef.current,
+            payload: { candidate },
           }),
         )
       },
@@ -282,10 +283,8 @@ function App() {
       wsRef.current.send(
         JSON.stringify({
           type: 'webrtc_offer',
-          payload: {
-            receiver_id: receiverIdRef.current,
-            offer,
-          },
+          to: receiverIdRef.current,
+          payload: { offer },
         }),
       )
     }
@@ -306,10 +305,8 @@ function App() {
         wsRef.current.send(
           JSON.stringify({
             type: 'webrtc_ice_candidate',
-            payload: {
-              candidate,
-              peer_id: 'host',
-            },
+            to: 'host',
+            payload: { candidate },
           }),
         )
       },
@@ -418,6 +415,7 @@ function App() {
 
         switch (message.type) {
           case 'file_metadata':
+            setIceServers(message.payload.ice_servers)
             setMetadata(message.payload)
             downloadNameRef.current = message.payload.filename
             ensureReceiverPeerConnection()
@@ -1,4 +1,11 @@
-const ICE_SERVERS: RTCIceServer[] = [{ urls: 'stun:stun.l.google.com:19302' }]
+let iceServers: RTCIceServer[] = [{ urls: 'stun:stun.l.google.com:19302' }]
+
+// The server sends the ICE servers of the deployment with upload_created and file_metadata
+export function setIceServers(servers: RTCIceServer[] | undefined) {
+  if (servers) {
+    iceServers = servers
+  }
+}
 
 type RegisterOptions = {
   onDataChannelMessage?: (event: MessageEvent<Blob | ArrayBuffer | string>) => void
@@ -59,7 +66,7 @@ export function createPeerConnection(options: PeerConnectionOptions = {}) {
     onDataChannelCreated,
   } = options
 
-  const peerConnection = new RTCPeerConnection({ iceServers: ICE_SERVERS })
+  const peerConnection = new RTCPeerConnection({ iceServers })
 
   if (onIceCandidate) {
     peerConnection.onicecandidate = (event) => {